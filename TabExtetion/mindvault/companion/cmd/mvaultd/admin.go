@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mindvault/companion/internal/config"
+	"github.com/mindvault/companion/internal/db"
+	"github.com/mindvault/companion/internal/instance"
+)
+
+// ── Admin commands ────────────────────────────────────────────────────────────
+// Maintenance commands work on the same database whether or not the daemon
+// runs. If a daemon answers, they go through its API (see dialDaemon) so it
+// stays the only writer; otherwise they open the database file directly —
+// which is also how to recover when the HTTP server will not start.
+
+// adminTarget is where an admin command runs: exactly one of api and db is set.
+type adminTarget struct {
+	api *daemonClient
+	db  *db.DB
+}
+
+// adminCmd describes one admin command: args is the usage text after its
+// name and nargs the number of positional arguments (-1 = at least one). In
+// direct mode, migrate applies pending migrations first and backups loads the
+// backup file settings (encryption). flags declares the command's own flags
+// and returns the function that runs it; print renders its result as text.
+type adminCmd struct {
+	args    string
+	nargs   int
+	migrate bool
+	backups bool
+	flags   func(fs *flag.FlagSet) func(t *adminTarget, args []string) (any, error)
+	print   func(v any)
+}
+
+// adminCommands maps "name" or "name sub" to its command.
+var adminCommands = map[string]adminCmd{
+	"backup": {migrate: true, backups: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, _ []string) (any, error) {
+				if t.api != nil {
+					return callAPI[db.BackupInfo](t.api, http.MethodPost, "/backup", nil)
+				}
+				return t.db.Backup()
+			}
+		},
+		print: func(v any) {
+			b := v.(db.BackupInfo)
+			fmt.Printf("Backup written: %s (%s, verified %v)\n", b.Filename, fmtBytes(b.SizeBytes), b.Verified)
+		},
+	},
+	"restore": {args: "FILENAME", nargs: 1, backups: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, args []string) (any, error) {
+				if t.api != nil {
+					var res struct {
+						PreRestore db.BackupInfo `json:"preRestore"`
+					}
+					err := t.api.call(http.MethodPost, "/restore/"+url.PathEscape(args[0]), nil, &res)
+					return res.PreRestore, err
+				}
+				return t.db.Restore(args[0])
+			}
+		},
+		print: func(v any) {
+			fmt.Printf("Restored. The previous state was saved as %s.\n", v.(db.BackupInfo).Filename)
+		},
+	},
+	"backups list": {migrate: true, backups: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, _ []string) (any, error) {
+				if t.api != nil {
+					return callAPI[[]db.BackupInfo](t.api, http.MethodGet, "/backups", nil)
+				}
+				return t.db.ListBackups()
+			}
+		},
+		print: func(v any) {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "FILENAME\tCREATED\tSIZE\tVERIFIED")
+			for _, b := range v.([]db.BackupInfo) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%v\n", b.Filename, fmtMillis(b.CreatedAt), fmtBytes(b.SizeBytes), b.Verified)
+			}
+			tw.Flush()
+		},
+	},
+	"export": {args: "[-library ID]... [-o FILE]", migrate: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			var libs libraryList
+			fs.Var(&libs, "library", "export only this library ID (repeatable; default all)")
+			out := fs.String("o", "-", "output file (- = stdout)")
+			return func(t *adminTarget, _ []string) (any, error) {
+				var e *db.Export
+				var err error
+				if t.api != nil {
+					q := url.Values{"libId": libs}
+					err = t.api.call(http.MethodGet, "/export?"+q.Encode(), nil, &e)
+				} else {
+					e, err = t.db.Export(libs)
+				}
+				if err != nil {
+					return nil, err
+				}
+				w := io.Writer(os.Stdout)
+				if *out != "-" {
+					f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+					if err != nil {
+						return nil, err
+					}
+					defer f.Close()
+					w = f
+				}
+				enc := json.NewEncoder(w)
+				enc.SetIndent("", "  ")
+				return nil, enc.Encode(e)
+			}
+		},
+	},
+	"import": {args: "FILE|-", nargs: 1, migrate: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, args []string) (any, error) {
+				r := io.Reader(os.Stdin)
+				if args[0] != "-" {
+					f, err := os.Open(args[0])
+					if err != nil {
+						return nil, err
+					}
+					defer f.Close()
+					r = f
+				}
+				if t.api != nil {
+					return callAPI[db.ImportResult](t.api, http.MethodPost, "/import", r)
+				}
+				e, err := db.ReadExport(r)
+				if err != nil {
+					return nil, err
+				}
+				res, err := t.db.Import(e)
+				if err != nil {
+					return nil, err
+				}
+				return *res, nil
+			}
+		},
+		print: func(v any) {
+			res := v.(db.ImportResult)
+			fmt.Printf("Imported %d librar%s: %s\n", len(res.Libraries), plural(len(res.Libraries), "y", "ies"), strings.Join(res.Libraries, ", "))
+			for table, n := range res.Rows {
+				if n > 0 {
+					fmt.Printf("  %-16s %d rows\n", table, n)
+				}
+			}
+			if res.PreImport.Filename != "" {
+				fmt.Printf("The previous state was saved as %s.\n", res.PreImport.Filename)
+			}
+		},
+	},
+	"search": {args: "[-library ID] QUERY", nargs: -1, migrate: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			lib := fs.String("library", "", "search only this library ID")
+			return func(t *adminTarget, args []string) (any, error) {
+				q := strings.Join(args, " ")
+				if t.api != nil {
+					return callAPI[[]db.SearchResult](t.api, http.MethodGet, "/search?"+url.Values{"q": {q}, "libId": {*lib}}.Encode(), nil)
+				}
+				return t.db.Search(*lib, q)
+			}
+		},
+		print: func(v any) {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "TYPE\tID\tTITLE\tURL")
+			for _, r := range v.([]db.SearchResult) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.EntityType, r.EntityID, r.Title, r.URL)
+			}
+			tw.Flush()
+		},
+	},
+	"libraries list": {migrate: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, _ []string) (any, error) {
+				if t.api != nil {
+					return callAPI[[]db.Library](t.api, http.MethodGet, "/libraries", nil)
+				}
+				return t.db.ListLibraries()
+			}
+		},
+		print: func(v any) {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tNAME\tENCRYPTED\tCREATED")
+			for _, l := range v.([]db.Library) {
+				fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", l.ID, l.Name, l.IsEncrypted, fmtMillis(l.CreatedAt))
+			}
+			tw.Flush()
+		},
+	},
+	"libraries rename": {args: "ID NAME", nargs: 2, migrate: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, args []string) (any, error) {
+				var err error
+				if t.api != nil {
+					err = t.api.call(http.MethodPatch, "/libraries/"+url.PathEscape(args[0]), map[string]string{"name": args[1]}, nil)
+				} else {
+					err = t.db.RenameLibrary(args[0], args[1])
+				}
+				return fmt.Sprintf("Renamed library %s to %q.", args[0], args[1]), err
+			}
+		},
+		print: printLine,
+	},
+	"libraries delete": {args: "ID", nargs: 1, migrate: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, args []string) (any, error) {
+				var err error
+				if t.api != nil {
+					err = t.api.call(http.MethodDelete, "/libraries/"+url.PathEscape(args[0]), nil, nil)
+				} else {
+					err = t.db.DeleteLibrary(args[0])
+				}
+				return fmt.Sprintf("Deleted library %s.", args[0]), err
+			}
+		},
+		print: printLine,
+	},
+	"sessions list": {args: "[-library ID] [-archived]", migrate: true,
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			lib := fs.String("library", "", "list only this library's sessions")
+			archived := fs.Bool("archived", false, "include archived sessions")
+			return func(t *adminTarget, _ []string) (any, error) {
+				if t.api != nil {
+					path := "/sessions"
+					if *lib != "" {
+						path = "/libraries/" + url.PathEscape(*lib) + "/sessions"
+					}
+					return callAPI[[]db.Session](t.api, http.MethodGet, fmt.Sprintf("%s?archived=%v", path, *archived), nil)
+				}
+				if *lib != "" {
+					return t.db.ListSessions(*lib, *archived)
+				}
+				return t.db.ListAllSessions(*archived)
+			}
+		},
+		print: func(v any) {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tLIBRARY\tNAME\tTABS\tUPDATED\tARCHIVED")
+			for _, s := range v.([]db.Session) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%v\n", s.ID, s.LibraryID, s.Name, s.TabCount, fmtMillis(s.UpdatedAt), s.Archived)
+			}
+			tw.Flush()
+		},
+	},
+	"doctor": {args: "[-fix]",
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			fix := fs.Bool("fix", false, "repair what can be repaired safely")
+			return func(t *adminTarget, _ []string) (any, error) {
+				var res *db.DoctorReport
+				var err error
+				if t.api != nil {
+					method := http.MethodGet
+					if *fix {
+						method = http.MethodPost
+					}
+					res, err = callAPI[*db.DoctorReport](t.api, method, "/admin/doctor", nil)
+				} else {
+					res, err = t.db.Doctor(*fix)
+				}
+				if err != nil {
+					return nil, err
+				}
+				if !res.Healthy {
+					return res, errProblems
+				}
+				return res, nil
+			}
+		},
+		print: func(v any) {
+			res := v.(*db.DoctorReport)
+			for _, f := range res.Findings {
+				status := "not fixable"
+				switch {
+				case f.Fixed:
+					status = "fixed"
+				case f.Fixable:
+					status = "fixable with -fix"
+				}
+				fmt.Printf("%-7s %s: %s", f.Severity, f.Check, f.Message)
+				if f.Count > 0 {
+					fmt.Printf(" (%d)", f.Count)
+				}
+				fmt.Printf(" — %s\n", status)
+				if len(f.Sample) > 0 {
+					fmt.Printf("        e.g. %s\n", strings.Join(f.Sample, ", "))
+				}
+			}
+			verdict := "healthy"
+			if !res.Healthy {
+				verdict = "unhealthy"
+			}
+			fmt.Printf("%d checks, %d %s: %s\n", len(res.Checks), len(res.Findings), plural(len(res.Findings), "finding", "findings"), verdict)
+		},
+	},
+	"vacuum": {
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, _ []string) (any, error) {
+				if t.api != nil {
+					return callAPI[db.VacuumResult](t.api, http.MethodPost, "/admin/vacuum", nil)
+				}
+				return t.db.Vacuum()
+			}
+		},
+		print: func(v any) {
+			res := v.(db.VacuumResult)
+			fmt.Printf("Vacuumed: %s → %s\n", fmtBytes(res.BeforeBytes), fmtBytes(res.AfterBytes))
+		},
+	},
+	"migrate status": {
+		flags: func(fs *flag.FlagSet) func(*adminTarget, []string) (any, error) {
+			return func(t *adminTarget, _ []string) (any, error) {
+				if t.api != nil {
+					return callAPI[[]db.MigrationState](t.api, http.MethodGet, "/admin/migrations", nil)
+				}
+				return t.db.MigrationStatus()
+			}
+		},
+		print: func(v any) {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "VERSION\tSTATUS")
+			for _, m := range v.([]db.MigrationState) {
+				status := "pending"
+				if m.Applied {
+					status = "applied " + fmtMillis(m.AppliedAt*1000)
+				}
+				fmt.Fprintf(tw, "%d\t%s\n", m.Version, status)
+			}
+			tw.Flush()
+		},
+	},
+}
+
+// errProblems makes a command exit 1 after printing its (unhealthy) result.
+var errProblems = errors.New("problems found")
+
+// isAdminCommand reports whether name starts an admin command ("backups" for
+// "backups list", …).
+func isAdminCommand(name string) bool {
+	for key := range adminCommands {
+		if key == name || strings.HasPrefix(key, name+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// runAdmin runs the admin command starting with args[0]. Every command takes
+// -config, -db (database for direct access), -port (of the running daemon)
+// and -json (print the result as JSON).
+func runAdmin(args []string) int {
+	name := args[0]
+	args = args[1:]
+	if _, ok := adminCommands[name]; !ok && len(args) > 0 {
+		name += " " + args[0]
+		args = args[1:]
+	}
+	cmd, ok := adminCommands[name]
+	if !ok {
+		group := strings.Fields(name)[0]
+		fmt.Fprintf(os.Stderr, "usage: mvaultd %s %s\n", group, adminSubcommands(group))
+		return 2
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	cfgPath := fs.String("config", config.Path(), "config file")
+	dbPath := fs.String("db", "", "database file for direct access (default from the config)")
+	port := fs.Int("port", 0, "REST API port of the running daemon (default from the config)")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	run := cmd.flags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: mvaultd %s [-config PATH] [-db PATH] [-port N] [-json] %s\n", name, cmd.args)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if n := fs.NArg(); (cmd.nargs >= 0 && n != cmd.nargs) || (cmd.nargs < 0 && n == 0) {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, _, err := config.LoadLayered(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 1
+	}
+	if *dbPath != "" {
+		cfg.DB.Path = *dbPath
+	}
+	t, closeTarget, err := openAdminTarget(cfg, *port, cmd, *dbPath != "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer closeTarget()
+
+	v, err := run(t, fs.Args())
+	if err != nil && !errors.Is(err, errProblems) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch {
+	case v == nil || cmd.print == nil: // export writes its own output
+	case *asJSON:
+		out, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Println(string(out))
+	default:
+		cmd.print(v)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// openAdminTarget connects to the running daemon or, if none answers, opens
+// the database file. An explicit -db always means direct access: it is for
+// a database no daemon is using (a copy, or one of another profile).
+func openAdminTarget(cfg config.Config, port int, cmd adminCmd, direct bool) (*adminTarget, func(), error) {
+	if !direct {
+		c, err := dialDaemon(cfg, port)
+		if err == nil {
+			return &adminTarget{api: c}, c.Close, nil
+		}
+		if !errors.Is(err, errDaemonDown) {
+			return nil, nil, err
+		}
+	}
+	path := dbPath(cfg)
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, fmt.Errorf("database: %w", err)
+	}
+	// Direct access takes the daemon's lock too: a daemon that holds it but
+	// did not answer (still starting, or hung) must not see the file change.
+	lock, err := instance.Acquire(path)
+	if errors.Is(err, instance.ErrLocked) && direct {
+		return nil, nil, fmt.Errorf("%w; run the command without -db to go through the daemon", err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := db.Open(path)
+	if err != nil {
+		lock.Release()
+		return nil, nil, fmt.Errorf("open database: %w", err)
+	}
+	closeAll := func() {
+		d.Close()
+		lock.Release()
+	}
+	if cmd.migrate {
+		if err := d.Migrate(); err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("migrate: %w", err)
+		}
+	}
+	if cmd.backups {
+		if err := applyBackupOptions(d, cfg.Backup); err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		// Prune as the daemon would after a manual backup.
+		d.SetRetentionPolicy(retentionPolicy(cfg.Backup.Retention))
+	}
+	return &adminTarget{db: d}, closeAll, nil
+}
+
+// adminSubcommands lists the subcommands of group, e.g. "list|rename|delete".
+func adminSubcommands(group string) string {
+	var subs []string
+	for key := range adminCommands {
+		if sub, ok := strings.CutPrefix(key, group+" "); ok {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Strings(subs)
+	return strings.Join(subs, "|")
+}
+
+func printLine(v any) { fmt.Println(v) }
+
+// fmtBytes formats a size for humans.
+func fmtBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/mindvault/companion/internal/autostart"
+)
+
+// runAutostart implements `mvaultd autostart status|enable|disable`: starting
+// the daemon at login, the same as the dashboard's switch (GET/POST/DELETE
+// /autostart) but without a running daemon.
+func runAutostart(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, `usage:
+  mvaultd autostart [-backend NAME] status
+  mvaultd autostart [-backend NAME] [-config PATH] enable
+  mvaultd autostart [-backend NAME] disable`)
+		return 2
+	}
+	fs := flag.NewFlagSet("autostart", flag.ContinueOnError)
+	name := fs.String("backend", "auto", "systemd, xdg, launchd or schtasks (auto = first available)")
+	cfgPath := fs.String("config", "", "config file the started daemon uses (default: its default)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		return usage()
+	}
+	env, err := autostart.UserEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "autostart:", err)
+		return 1
+	}
+
+	if fs.Arg(0) == "status" {
+		for _, b := range autostart.Backends(runtime.GOOS, env) {
+			on, _ := b.Enabled()
+			fmt.Printf("%-9s available=%v enabled=%v\n", b.Name(), b.Available(), on)
+		}
+		return 0
+	}
+	b, err := autostart.Select(runtime.GOOS, *name, env)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "autostart:", err)
+		return 1
+	}
+	switch fs.Arg(0) {
+	case "enable":
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "autostart:", err)
+			return 1
+		}
+		exe, _ = filepath.Abs(exe)
+		cmd := []string{exe, "serve"}
+		if *cfgPath != "" {
+			abs, _ := filepath.Abs(*cfgPath)
+			cmd = append(cmd, "-config", abs)
+		}
+		err = b.Enable(cmd)
+	case "disable":
+		err = b.Disable()
+	default:
+		return usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "autostart (%s): %v\n", b.Name(), err)
+		return 1
+	}
+	fmt.Printf("autostart %sd (%s)\n", fs.Arg(0), b.Name())
+	return 0
+}
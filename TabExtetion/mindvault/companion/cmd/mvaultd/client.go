@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/mindvault/companion/internal/api"
+	"github.com/mindvault/companion/internal/auth"
+	"github.com/mindvault/companion/internal/config"
+	"github.com/mindvault/companion/internal/db"
+	"github.com/mindvault/companion/internal/instance"
+)
+
+// errDaemonDown is returned by dialDaemon when no daemon answers.
+var errDaemonDown = errors.New("daemon not running")
+
+// cliTokenTTL bounds how long a command's temporary admin token stays valid
+// if the command dies before deleting it. It outlasts the HTTP client timeout
+// (api.LongRequestTimeout).
+const cliTokenTTL = 15 * time.Minute
+
+// daemonClient calls a running daemon's API with a temporary admin token it
+// creates in the token store; Close deletes it again.
+type daemonClient struct {
+	http    *http.Client
+	base    string
+	secret  string
+	release func()
+}
+
+// daemonEndpoint returns the base URLs to try, in order, and the HTTP client
+// for the daemon that cfg describes. Over TCP (HTTPS with the local CA when
+// TLS is on) these are the address in the database's discovery file, the
+// configured address (port overrides its port when non-zero) and, unless
+// the port or address is fixed, the fallback ports after the default one.
+// When TCP is off it is the Unix socket.
+func daemonEndpoint(cfg config.Config, port int) ([]string, *http.Client, error) {
+	client := &http.Client{Timeout: api.LongRequestTimeout} // vacuum, import and restore can take a while
+	if !cfg.Listen.TCP {
+		sock := cfg.Listen.SocketFile()
+		client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		}}
+		return []string{"http://mvaultd"}, client, nil
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", defaultPort)
+	if cfg.Listen.Address != "" {
+		addr = cfg.Listen.Address
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen address: %w", err)
+	}
+	scheme := "http"
+	if cfg.TLS.Enabled {
+		pem, err := os.ReadFile(filepath.Join(cfg.TLS.Dir(), "ca.pem"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("local CA: %w", err)
+		}
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(pem)
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+		scheme = "https"
+	}
+
+	var bases []string
+	add := func(host, port string) {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		base := scheme + "://" + net.JoinHostPort(host, port)
+		if !slices.Contains(bases, base) {
+			bases = append(bases, base)
+		}
+	}
+	if port != 0 {
+		add(host, fmt.Sprint(port))
+		return bases, client, nil
+	}
+	if info, err := instance.ReadInfo(dbPath(cfg)); err == nil && info.Address != "" {
+		if h, p, err := net.SplitHostPort(info.Address); err == nil {
+			add(h, p)
+		}
+	}
+	add(host, portStr)
+	if cfg.Listen.Address == "" {
+		for p := defaultPort + 1; p <= defaultPort+portFallbacks; p++ {
+			add(host, fmt.Sprint(p))
+		}
+	}
+	return bases, client, nil
+}
+
+// dbPath is the database cfg names, or the default one.
+func dbPath(cfg config.Config) string {
+	if cfg.DB.Path != "" {
+		return cfg.DB.Path
+	}
+	return db.DefaultDBPath()
+}
+
+// dialDaemon connects to the running daemon, or returns errDaemonDown.
+func dialDaemon(cfg config.Config, port int) (*daemonClient, error) {
+	bases, client, err := daemonEndpoint(cfg, port)
+	if err != nil {
+		return nil, err
+	}
+	base := ""
+	for _, b := range bases {
+		if isDaemon(client, b) {
+			base = b
+			break
+		}
+	}
+	if base == "" {
+		return nil, errDaemonDown
+	}
+
+	bootstrap, err := auth.LoadOrCreateToken()
+	if err != nil {
+		return nil, fmt.Errorf("auth token: %w", err)
+	}
+	store, err := auth.OpenStore(auth.StorePath(), bootstrap)
+	if err != nil {
+		return nil, fmt.Errorf("token store: %w", err)
+	}
+	tok, secret, err := store.CreateTemporary(fmt.Sprintf("mvaultd command (pid %d)", os.Getpid()), auth.ScopeAdmin, cliTokenTTL)
+	if err != nil {
+		return nil, fmt.Errorf("token store: %w", err)
+	}
+	return &daemonClient{http: client, base: base, secret: secret, release: func() { _ = store.Delete(tok.ID) }}, nil
+}
+
+// isDaemon reports whether an mvaultd answers GET /health at base.
+func isDaemon(client *http.Client, base string) bool {
+	probe := *client
+	probe.Timeout = 2 * time.Second
+	resp, err := probe.Get(base + "/health")
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	var health struct {
+		Service string `json:"service"`
+	}
+	return json.NewDecoder(resp.Body).Decode(&health) == nil && health.Service == "mvaultd"
+}
+
+// Close deletes the client's token.
+func (c *daemonClient) Close() { c.release() }
+
+// call sends body (an io.Reader as is, anything else as JSON) and decodes a
+// 2xx JSON response into out (nil = ignore it). Error responses become errors.
+func (c *daemonClient) call(method, path string, body, out any) error {
+	var rd io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		rd = b
+	default:
+		data, _ := json.Marshal(b)
+		rd = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-MindVault-Token", c.secret)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// The daemon answered /health, so the request may have run anyway.
+		return fmt.Errorf("no answer from the daemon (the command may still have completed; see its log): %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// callAPI is call decoding into a new T.
+func callAPI[T any](c *daemonClient, method, path string, body any) (T, error) {
+	var out T
+	err := c.call(method, path, body, &out)
+	return out, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mindvault/companion/internal/config"
+)
+
+// runConfig implements `mvaultd config show|validate`: the configuration the
+// daemon would run with — defaults, overlaid by the config file, overlaid by
+// MINDVAULT_* environment variables. Daemon flags (-db, -listen, -tls) still
+// take precedence over what is shown here.
+func runConfig(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, `usage:
+  mvaultd config [-config PATH] show
+  mvaultd config [-config PATH] validate`)
+		return 2
+	}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	path := fs.String("config", config.Path(), "config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		return usage()
+	}
+
+	cfg, applied, err := config.LoadLayered(*path)
+	switch fs.Arg(0) {
+	case "validate":
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config invalid: %v\n", err)
+			return 1
+		}
+		fmt.Printf("%s: ok\n", *path)
+	case "show":
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config invalid: %v\n", err)
+			return 1
+		}
+		source := *path
+		if _, err := os.Stat(*path); errors.Is(err, os.ErrNotExist) {
+			source += " (not found; defaults)"
+		}
+		fmt.Printf("# file: %s\n", source)
+		if len(applied) > 0 {
+			fmt.Printf("# environment: %s\n", strings.Join(applied, ", "))
+		}
+		out, _ := json.MarshalIndent(cfg, "", "  ")
+		fmt.Println(string(out))
+	default:
+		return usage()
+	}
+	return 0
+}
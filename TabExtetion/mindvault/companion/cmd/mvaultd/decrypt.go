@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mindvault/companion/internal/backupfile"
+	"github.com/mindvault/companion/internal/config"
+	"golang.org/x/term"
+)
+
+// runDecryptBackup implements `mvaultd decrypt-backup`: it turns a .sqlite.enc
+// or .sqlite.gz backup back into a plain SQLite file without a running daemon.
+// The passphrase comes from MINDVAULT_BACKUP_PASSPHRASE or is read from stdin,
+// without echo when stdin is a terminal.
+func runDecryptBackup(args []string) int {
+	fs := flag.NewFlagSet("decrypt-backup", flag.ContinueOnError)
+	in := fs.String("in", "", "backup file (.sqlite.enc or .sqlite.gz)")
+	out := fs.String("out", "", "plain SQLite file to write (default: input name without extension + .sqlite)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *in == "" {
+		fmt.Fprintln(os.Stderr, "usage: mvaultd decrypt-backup -in FILE [-out FILE]")
+		return 2
+	}
+	if *out == "" {
+		*out = backupfile.TrimExt(*in) + ".decrypted" + backupfile.ExtPlain
+	}
+
+	passphrase := os.Getenv(config.PassphraseEnv)
+	if passphrase == "" && backupfile.IsEncrypted(*in) {
+		var err error
+		if passphrase, err = readPassphrase(); err != nil {
+			fmt.Fprintf(os.Stderr, "read passphrase: %v\n", err)
+			return 1
+		}
+	}
+
+	src, err := os.Open(*in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := backupfile.Decode(dst, src, *in, passphrase); err != nil {
+		dst.Close()
+		os.Remove(*out)
+		fmt.Fprintf(os.Stderr, "decrypt %s: %v\n", *in, err)
+		return 1
+	}
+	if err := dst.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("wrote %s\n", *out)
+	return 0
+}
+
+// readPassphrase prompts for the passphrase on stderr and reads it from stdin:
+// without echo from a terminal, otherwise as the first line of the input.
+func readPassphrase() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Backup passphrase: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"slices"
+)
+
+// isLoopback reports whether host (from a listen address) only accepts
+// connections from this machine.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// certHosts returns the extra names the TLS certificate must cover for a
+// listener on host: the configured names, plus host itself — or, for a
+// wildcard address, this machine's LAN addresses.
+func certHosts(host string, configured []string) []string {
+	hosts := append([]string{}, configured...)
+	if host != "" && host != "0.0.0.0" && host != "::" {
+		return append(hosts, host)
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.IsGlobalUnicast() {
+			hosts = append(hosts, ipn.IP.String())
+		}
+	}
+	return hosts
+}
+
+// selfOrigins returns the origins the dashboard is loaded from: scheme://h:port
+// for 127.0.0.1, localhost and every extra host.
+func selfOrigins(scheme, port string, hosts []string) []string {
+	var out []string
+	for _, h := range append([]string{"127.0.0.1", "localhost"}, hosts...) {
+		o := scheme + "://" + net.JoinHostPort(h, port)
+		if !slices.Contains(out, o) {
+			out = append(out, o)
+		}
+	}
+	return out
+}
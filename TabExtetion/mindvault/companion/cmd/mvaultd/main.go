@@ -4,119 +4,458 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/mindvault/companion/internal/api"
 	"github.com/mindvault/companion/internal/auth"
+	"github.com/mindvault/companion/internal/backuptarget"
+	"github.com/mindvault/companion/internal/config"
 	"github.com/mindvault/companion/internal/db"
+	"github.com/mindvault/companion/internal/instance"
+	"github.com/mindvault/companion/internal/logging"
+	"github.com/mindvault/companion/internal/tlscert"
 )
 
 const (
 	defaultPort   = 47821
-	defaultDBPath = ""  // resolved at runtime to %APPDATA%\MindVault\db.sqlite
+	portFallbacks = 9  // a taken default port falls back up to defaultPort+9
+	defaultDBPath = "" // resolved at runtime to %APPDATA%\MindVault\db.sqlite
 	version       = "0.1.0"
 )
 
 func main() {
 	var (
-		port          = flag.Int("port", defaultPort, "REST API listen port")
-		dbPath        = flag.String("db", defaultDBPath, "SQLite database path")
-		nativeMsg     = flag.Bool("native", false, "Run in native messaging mode (stdin/stdout)")
-		showVersion   = flag.Bool("version", false, "Print version and exit")
+		port        = flag.Int("port", defaultPort, "REST API listen port")
+		dbPath      = flag.String("db", defaultDBPath, "SQLite database path")
+		nativeMsg   = flag.Bool("native", false, "Run in native messaging mode (stdin/stdout)")
+		showVersion = flag.Bool("version", false, "Print version and exit")
+		useTLS      = flag.Bool("tls", false, "Serve HTTPS with a certificate from the local CA")
+		listenAddr  = flag.String("listen", "", "TCP listen address (default 127.0.0.1:<port>); non-loopback requires -tls")
+		configPath  = flag.String("config", "", "config file (default $"+config.PathEnv+" or the platform path)")
 	)
-	flag.Parse()
+	// mvaultd [serve] [flags] runs the daemon; any other first argument is a
+	// subcommand (see commandUsage).
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
+	} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		os.Exit(runCommand(args))
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: mvaultd [serve] [flags]\n       mvaultd COMMAND ...\n\n%s\nserve flags:\n", commandUsage)
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
 
 	if *showVersion {
 		fmt.Printf("mvaultd v%s\n", version)
 		os.Exit(0)
 	}
 
+	// Settings are layered: flags > MINDVAULT_* env > config file > defaults.
+	// Flags given on the command line are re-applied on every reload; -port
+	// replaces the port of whatever address the layers below chose.
+	if *configPath == "" {
+		*configPath = config.Path()
+	}
+	loadConfig := func() (config.Config, error) {
+		cfg, _, err := config.LoadLayered(*configPath)
+		if err != nil {
+			return cfg, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "db":
+				cfg.DB.Path = *dbPath
+			case "listen":
+				cfg.Listen.Address = *listenAddr
+			case "port": // visited after "listen"
+				cfg.Listen.Address = cfg.Listen.WithPort(*port)
+			case "tls":
+				cfg.TLS.Enabled = *useTLS
+			}
+		})
+		return cfg, cfg.Validate()
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		logging.Fatal("config error", "err", err)
+	}
+	if err := logging.Configure(logOptions(cfg.Log), os.Stderr); err != nil {
+		logging.Fatal("logging", "err", err)
+	}
+	defer logging.Close()
+
 	// Resolve default DB path
-	if *dbPath == "" {
-		*dbPath = db.DefaultDBPath()
+	if cfg.DB.Path == "" {
+		cfg.DB.Path = db.DefaultDBPath()
 	}
 
-	log.Printf("mvaultd v%s starting", version)
-	log.Printf("  DB path : %s", *dbPath)
+	slog.Info("mvaultd starting", "version", version, "config", *configPath, "db", cfg.DB.Path)
+	if cfg.Log.File {
+		slog.Info("logging to file", "path", cfg.Log.LogFile())
+	}
+
+	// One daemon per database: take its lock before touching the file, so a
+	// second mvaultd exits before migrating or backing anything up.
+	lock, err := instance.Acquire(cfg.DB.Path)
+	if err != nil {
+		logging.Fatal("another mvaultd uses this database; stop it first, or use a different -db", "err", err)
+	}
+	defer lock.Release()
+	startedAt := time.Now()
+
+	// Bind the TCP port before opening the database as well. Without -port or
+	// listen.address, a taken default port falls back to the next free one in
+	// defaultPort…defaultPort+portFallbacks, where clients look for it.
+	addr := fmt.Sprintf("127.0.0.1:%d", *port)
+	if cfg.Listen.Address != "" {
+		addr = cfg.Listen.Address
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		logging.Fatal("listen address", "err", err)
+	}
+	tlsOn := cfg.TLS.Enabled
+	if cfg.Listen.TCP && !tlsOn && !isLoopback(host) {
+		logging.Fatal("listen address is reachable from other machines; enable TLS (-tls) to use it", "addr", addr)
+	}
+	var tcpLn net.Listener
+	if cfg.Listen.TCP {
+		portSet := cfg.Listen.Address != "" // also set by -port
+		if tcpLn, err = listenTCP(addr, !portSet); err != nil {
+			logging.Fatal("listen", "err", err)
+		}
+		addr = tcpLn.Addr().String()
+	}
+	_, portStr, _ := net.SplitHostPort(addr)
 
 	// Initialise database
-	database, err := db.Open(*dbPath)
+	database, err := db.Open(cfg.DB.Path)
 	if err != nil {
-		log.Fatalf("failed to open database: %v", err)
+		logging.Fatal("failed to open database", "err", err)
 	}
 	defer database.Close()
 
 	if err := database.Migrate(); err != nil {
-		log.Fatalf("migration failed: %v", err)
+		logging.Fatal("migration failed", "err", err)
 	}
 
 	// One-time retroactive rename: "Default Library" → "Default (Chrome/Firefox/…)"
 	// Safe to call every start — idempotent; only renames libraries still named exactly
 	// "Default Library" by looking at dominant source_browser of their sessions.
 	if err := database.MigrateDefaultLibraryNames(); err != nil {
-		log.Printf("default-library rename migration warning: %v", err)
+		slog.Warn("default-library rename migration", "err", err)
+	}
+
+	// Keys of unlocked encrypted libraries are dropped after this much idle time.
+	database.SetUnlockIdleTimeout(time.Duration(cfg.Encryption.UnlockIdleMinutes) * time.Minute)
+
+	// Backup file encoding: optional gzip, optional passphrase encryption.
+	// The passphrase never lives in config.json itself (see config.Backup).
+	bc := cfg.Backup
+	if err := applyBackupOptions(database, bc); err != nil {
+		logging.Fatal("backup settings", "err", err)
 	}
 
-	// Daily auto-backup — one snapshot per calendar day, 30-day default retention.
-	// Non-fatal: a backup failure never prevents the daemon from starting.
-	if err := database.AutoBackup(30); err != nil {
-		log.Printf("auto-backup warning (non-fatal): %v", err)
+	// Scheduled backups every backup.intervalMinutes with GFS retention.
+	// With the scheduler disabled (interval 0), fall back to the old daily
+	// startup snapshot. Non-fatal: a backup failure never stops the daemon.
+	schedCtx, stopSched := context.WithCancel(context.Background())
+	defer func() { stopSched() }()
+	database.SetBackupTargets(backupTargets(bc))
+	database.StartBackupScheduler(schedCtx, time.Duration(bc.IntervalMinutes)*time.Minute, retentionPolicy(bc.Retention))
+	if bc.IntervalMinutes == 0 {
+		if err := database.AutoBackup(); err != nil {
+			slog.Warn("auto-backup failed (non-fatal)", "err", err)
+		}
 	}
 
+	// History older than history.retentionDays is pruned in the background.
+	pruneCtx, stopPrune := context.WithCancel(context.Background())
+	defer stopPrune()
+	database.SetHistoryRetention(cfg.History.RetentionDays)
+	database.StartHistoryPruner(pruneCtx)
+
 	// Load or generate auth token
 	token, err := auth.LoadOrCreateToken()
 	if err != nil {
-		log.Fatalf("auth token error: %v", err)
+		logging.Fatal("auth token", "err", err)
 	}
-	log.Printf("  Auth    : token loaded (%d chars)", len(token))
+	tokens, err := auth.OpenStore(auth.StorePath(), token)
+	if err != nil {
+		logging.Fatal("token store", "err", err)
+	}
+	slog.Info("auth", "tokenStore", auth.StorePath())
 
 	// Native messaging mode: read JSON from stdin, write JSON to stdout
 	if *nativeMsg {
-		log.Printf("  Mode    : native messaging")
+		slog.Info("mode: native messaging")
 		// TODO(step-12): implement native messaging host protocol
-		log.Fatal("native messaging not yet implemented — coming in Step 12")
+		logging.Fatal("native messaging not yet implemented — coming in Step 12")
 	}
 
-	// HTTP REST API mode
-	addr := fmt.Sprintf("127.0.0.1:%d", *port)
-	log.Printf("  Mode    : REST API at http://%s", addr)
+	// HTTP REST API mode. -listen / listen.address may expose the API beyond
+	// loopback (e.g. to a phone on the LAN), but only over TLS.
+	scheme, extraHosts := "http", []string(nil)
+	var certs *tlscert.Manager
+	if cfg.Listen.TCP && tlsOn {
+		extraHosts = certHosts(host, cfg.TLS.Hosts)
+		if certs, err = tlscert.Load(cfg.TLS.Dir(), extraHosts); err != nil {
+			logging.Fatal("tls", "err", err)
+		}
+		scheme = "https"
+		slog.Info("tls: certificate", "hosts", certs.Hosts())
+		slog.Info("tls: trust the local CA on clients (also at /tls/ca.pem)", "ca", certs.CAPath())
+	}
 
-	router := api.NewRouter(database, token)
+	// New clients pair instead of reading a shared token: print each request's
+	// code so the user can compare it with the one the client shows.
+	pairer := auth.NewPairer(tokens)
+	pairer.OnRequest = func(r auth.PairRequest) {
+		slog.Info("pairing request: approve in the dashboard or run: mvaultd pair approve <code> [scope]",
+			"client", r.Client, "scope", r.Scope, "origin", r.Origin, "code", r.Code)
+	}
 
-	srv := &http.Server{
-		Addr:         addr,
-		Handler:      router,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	// CORS: exact origins only — config.json's cors section, the dashboard's
+	// own origin and the origins of paired clients.
+	self := selfOrigins(scheme, portStr, extraHosts)
+	origins := api.NewOrigins(append(cfg.CORS.AllowedOrigins(), self...), tokens)
+	features := api.NewFeatures(cfg.Features.Dashboard, cfg.Features.Pairing)
+
+	router := api.NewRouter(database, tokens, pairer, origins, features)
+	if certs != nil {
+		router = api.ServeCACert(router, certs.CAPEM())
 	}
 
-	// Graceful shutdown on SIGINT / SIGTERM
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	// The same router is served on TCP and / or a Unix socket (config listen).
+	// Socket requests must also come from the daemon's own user.
+	var servers []*http.Server
+	serve := func(ln net.Listener, srv *http.Server, url string) {
+		servers = append(servers, srv)
+		go func() {
+			slog.Info("listening", "url", url)
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				logging.Fatal("server error", "err", err)
+			}
+		}()
+	}
+	newServer := func(h http.Handler) *http.Server {
+		return &http.Server{
+			Handler:      h,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		}
+	}
+	if cfg.Listen.TCP {
+		slog.Info("mode: REST API", "url", scheme+"://"+addr)
+		ln := tcpLn
+		if certs != nil {
+			ln = tls.NewListener(ln, certs.TLSConfig())
+		}
+		serve(ln, newServer(router), scheme+"://"+addr)
+	}
+	if cfg.Listen.Socket {
+		sock := cfg.Listen.SocketFile()
+		slog.Info("mode: REST API on unix socket", "socket", sock)
+		if !api.PeerCredSupported() {
+			slog.Warn("peer credentials unavailable on this platform; relying on socket file mode 0600")
+		}
+		ln, err := api.ListenSocket(sock)
+		if err != nil {
+			logging.Fatal("unix socket", "err", err)
+		}
+		defer os.Remove(sock)
+		srv := newServer(api.PeerCredMiddleware(router))
+		srv.ConnContext = api.SocketConnContext
+		serve(ln, srv, "unix://"+sock)
+	}
 
-	go func() {
-		log.Printf("listening on http://%s", addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
+	// Clients that do not know the port (CLI, scripts) read it from here.
+	info := instance.Info{PID: os.Getpid(), Version: version, StartedAt: startedAt.UnixMilli(), DBPath: cfg.DB.Path}
+	if cfg.Listen.TCP {
+		info.Scheme, info.Address = scheme, addr
+		info.Port, _ = strconv.Atoi(portStr)
+	}
+	if cfg.Listen.Socket {
+		info.Socket = cfg.Listen.SocketFile()
+	}
+	if err := instance.WriteInfo(cfg.DB.Path, info); err != nil {
+		slog.Warn("discovery file", "err", err)
+	}
+	defer instance.RemoveInfo(cfg.DB.Path)
+
+	// SIGHUP re-reads the configuration and applies what can change while
+	// running; listen, TLS and database settings need a restart.
+	reload := func() {
+		next, err := loadConfig()
+		if err != nil {
+			slog.Error("reload: keeping the current configuration", "err", err)
+			return
+		}
+		if next.DB.Path == "" {
+			next.DB.Path = db.DefaultDBPath()
 		}
-	}()
+		if changed := restartRequired(cfg, next); len(changed) > 0 {
+			slog.Warn("reload: restart mvaultd to apply", "changed", changed)
+		}
+		if err := logging.Configure(logOptions(next.Log), os.Stderr); err != nil {
+			slog.Error("reload: keeping the current log settings", "err", err)
+			next.Log = cfg.Log
+		}
+		origins.Set(append(next.CORS.AllowedOrigins(), self...))
+		features.Set(next.Features.Dashboard, next.Features.Pairing)
+		database.SetUnlockIdleTimeout(time.Duration(next.Encryption.UnlockIdleMinutes) * time.Minute)
+		database.SetHistoryRetention(next.History.RetentionDays)
+		if !reflect.DeepEqual(cfg.Backup, next.Backup) {
+			if err := applyBackupOptions(database, next.Backup); err != nil {
+				slog.Error("reload: keeping the current backup settings", "err", err)
+				next.Backup = cfg.Backup
+			} else {
+				stopSched()
+				schedCtx, stopSched = context.WithCancel(context.Background())
+				database.SetBackupTargets(backupTargets(next.Backup))
+				database.StartBackupScheduler(schedCtx, time.Duration(next.Backup.IntervalMinutes)*time.Minute, retentionPolicy(next.Backup.Retention))
+			}
+		}
+		cfg.Log, cfg.CORS, cfg.Features, cfg.Encryption, cfg.History, cfg.Backup =
+			next.Log, next.CORS, next.Features, next.Encryption, next.History, next.Backup
+		slog.Info("reload: configuration applied", "config", *configPath)
+	}
 
-	<-stop
-	log.Println("shutting down...")
+	// Graceful shutdown on SIGINT / SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := <-stop; sig == syscall.SIGHUP; sig = <-stop {
+		reload()
+	}
+	slog.Info("shutting down")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("shutdown error: %v", err)
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("shutdown", "err", err)
+		}
+	}
+	slog.Info("bye")
+}
+
+// commandUsage lists the subcommands.
+const commandUsage = `commands:
+  serve                       run the daemon (the default)
+  backup                      take a verified backup now
+  restore FILENAME            replace the database with a backup
+  backups list                list backups
+  export [-o FILE]            write libraries as a JSON export file
+  import FILE                 replace libraries with those in an export file
+  search QUERY                full-text search
+  libraries list|rename|delete
+  sessions list               list sessions
+  doctor [-fix]               check (and repair) the database
+  vacuum                      compact the database file
+  migrate status              show applied and pending schema migrations
+  token create|list|revoke    manage API tokens
+  pair list|approve|deny      answer pairing requests
+  config show|validate        show or check the effective configuration
+  autostart status|enable|disable
+                              start the daemon at login
+  decrypt-backup              decrypt an encrypted backup file
+
+Maintenance commands use the running daemon's API, or the database file
+directly when no daemon is running. Run mvaultd COMMAND -h for its flags.
+`
+
+// runCommand runs the subcommand args[0].
+func runCommand(args []string) int {
+	switch args[0] {
+	case "decrypt-backup": // offline: mvaultd decrypt-backup -in FILE -out FILE
+		return runDecryptBackup(args[1:])
+	case "token":
+		return runToken(args[1:])
+	case "pair":
+		return runPair(args[1:])
+	case "config":
+		return runConfig(args[1:])
+	case "autostart":
+		return runAutostart(args[1:])
+	case "help":
+		fmt.Print(commandUsage)
+		return 0
+	}
+	if isAdminCommand(args[0]) {
+		return runAdmin(args)
+	}
+	fmt.Fprintf(os.Stderr, "mvaultd: unknown command %q\n\n%s", args[0], commandUsage)
+	return 2
+}
+
+// retentionPolicy converts a config retention section to the db policy.
+func retentionPolicy(r config.Retention) db.RetentionPolicy {
+	return db.RetentionPolicy{
+		KeepHourly:    r.KeepHourly,
+		KeepDaily:     r.KeepDaily,
+		KeepWeekly:    r.KeepWeekly,
+		KeepMonthly:   r.KeepMonthly,
+		MaxTotalBytes: r.MaxTotalMB << 20,
+	}
+}
+
+// backupTargets builds the replica targets configured in backup.targets.
+func backupTargets(bc config.Backup) []db.ReplicaTarget {
+	var targets []db.ReplicaTarget
+	for _, t := range bc.Targets {
+		var target backuptarget.Target
+		switch t.Type {
+		case config.TargetDir:
+			target = backuptarget.NewDir(t.Name, t.Path)
+		case config.TargetS3:
+			access, secret := t.Credentials()
+			if access == "" || secret == "" {
+				slog.Warn("backup target: S3 credentials not set in the environment", "target", t.Name)
+			}
+			target = backuptarget.NewS3(backuptarget.S3Config{
+				Name: t.Name, Endpoint: t.Endpoint, Region: t.Region,
+				Bucket: t.Bucket, Prefix: t.Prefix,
+				AccessKey: access, SecretKey: secret,
+			})
+		}
+		slog.Info("backup: replicating", "target", t.Name, "type", t.Type)
+		targets = append(targets, db.ReplicaTarget{Target: target, Policy: retentionPolicy(bc.TargetRetention(t))})
+	}
+	return targets
+}
+
+// listenTCP listens on addr. With fallback, a port in use moves on to the
+// next one, up to portFallbacks times.
+func listenTCP(addr string, fallback bool) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil || !fallback {
+		return ln, err
+	}
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	for i := 1; i <= portFallbacks; i++ {
+		next := net.JoinHostPort(host, strconv.Itoa(port+i))
+		if ln, err2 := net.Listen("tcp", next); err2 == nil {
+			slog.Warn("port in use; listening on the next one", "addr", addr, "instead", next)
+			return ln, nil
+		}
 	}
-	log.Println("bye")
+	return nil, fmt.Errorf("%w (and ports %d–%d)", err, port+1, port+portFallbacks)
 }
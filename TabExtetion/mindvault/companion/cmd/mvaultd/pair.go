@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mindvault/companion/internal/auth"
+	"github.com/mindvault/companion/internal/config"
+)
+
+// runPair implements `mvaultd pair list|approve CODE [SCOPE]|deny CODE`:
+// approving pairing requests from the terminal of a running daemon. SCOPE
+// defaults to the requested one, except that granting admin must be explicit. Pending requests
+// live in the daemon's memory, so the command talks to it over HTTP (see
+// dialDaemon) — over TCP, or over the Unix socket when the config turns TCP off.
+func runPair(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, `usage:
+  mvaultd pair [-port N] list
+  mvaultd pair [-port N] approve CODE [read|write|admin]
+  mvaultd pair [-port N] deny CODE`)
+		return 2
+	}
+	fs := flag.NewFlagSet("pair", flag.ContinueOnError)
+	port := fs.Int("port", 0, "REST API port of the running daemon (default from the config)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 0 || (args[0] == "list") != (len(args) == 1) || len(args) > 3 ||
+		(len(args) == 3 && args[0] != "approve") {
+		return usage()
+	}
+
+	cfg, _, err := config.LoadLayered(config.Path())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 1
+	}
+	c, err := dialDaemon(cfg, *port)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer c.Close()
+	call := c.call
+
+	switch args[0] {
+	case "list":
+		var reqs []auth.PairRequest
+		if err := call(http.MethodGet, "/pairings", nil, &reqs); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(reqs) == 0 {
+			fmt.Println("No pending pairing requests.")
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CODE\tCLIENT\tSCOPE\tLIBRARIES\tORIGIN\tREQUESTED")
+		for _, r := range reqs {
+			libs := "all"
+			if len(r.Libraries) > 0 {
+				libs = strings.Join(r.Libraries, ",")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Code, r.Client, r.Scope, libs, r.Origin, fmtMillis(r.RequestedAt))
+		}
+		tw.Flush()
+	case "approve":
+		scope := ""
+		if len(args) == 3 {
+			scope = args[2]
+		} else {
+			var reqs []auth.PairRequest
+			if err := call(http.MethodGet, "/pairings", nil, &reqs); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			for _, r := range reqs {
+				if strings.ReplaceAll(r.Code, "-", "") == strings.ReplaceAll(args[1], "-", "") {
+					scope = string(r.Scope)
+				}
+			}
+			if scope == string(auth.ScopeAdmin) {
+				fmt.Fprintf(os.Stderr, "%s requests admin; grant it explicitly: mvaultd pair approve %s admin (or write)\n", args[1], args[1])
+				return 1
+			}
+		}
+		var r auth.PairRequest
+		if err := call(http.MethodPost, "/pairings/approve", map[string]string{"code": args[1], "scope": scope}, &r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Approved pairing %s for %q (requested %s, granted %s).\n", r.Code, r.Client, r.Scope, r.Granted)
+	case "deny":
+		var r auth.PairRequest
+		if err := call(http.MethodPost, "/pairings/deny", map[string]string{"code": args[1]}, &r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Denied pairing %s for %q (requested %s).\n", r.Code, r.Client, r.Scope)
+	default:
+		return usage()
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/mindvault/companion/internal/backupfile"
+	"github.com/mindvault/companion/internal/config"
+	"github.com/mindvault/companion/internal/db"
+	"github.com/mindvault/companion/internal/logging"
+)
+
+// restartRequired names the settings that differ between old and next but
+// only take effect at startup: the listeners, TLS and the database file.
+func restartRequired(old, next config.Config) []string {
+	var changed []string
+	if !reflect.DeepEqual(old.Listen, next.Listen) {
+		changed = append(changed, "listen")
+	}
+	if !reflect.DeepEqual(old.TLS, next.TLS) {
+		changed = append(changed, "tls")
+	}
+	if old.DB.Path != next.DB.Path {
+		changed = append(changed, "db.path")
+	}
+	return changed
+}
+
+// applyBackupOptions sets the backup file encoding of bc on database,
+// resolving the passphrase when backups are encrypted.
+func applyBackupOptions(database *db.DB, bc config.Backup) error {
+	opts := backupfile.Options{Compression: bc.Compression}
+	if bc.Encrypt {
+		passphrase, err := bc.Passphrase()
+		if err != nil {
+			return fmt.Errorf("backup passphrase: %w", err)
+		}
+		if passphrase == "" {
+			return fmt.Errorf("backup.encrypt is set but no passphrase: set %s or backup.passphraseFile", config.PassphraseEnv)
+		}
+		opts.Passphrase = passphrase
+	}
+	if err := database.SetBackupOptions(opts); err != nil {
+		return fmt.Errorf("backup options: %w", err)
+	}
+	return nil
+}
+
+// logOptions converts the config's log section to logging options.
+func logOptions(l config.Log) logging.Options {
+	o := logging.Options{Level: l.Level, Requests: l.Requests, Format: l.Format, MaxSizeMB: l.MaxSizeMB, MaxFiles: l.MaxFiles}
+	if l.File {
+		o.File = l.LogFile()
+	}
+	return o
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mindvault/companion/internal/auth"
+)
+
+// libraryList collects repeated -library flags.
+type libraryList []string
+
+func (l *libraryList) String() string     { return strings.Join(*l, ",") }
+func (l *libraryList) Set(v string) error { *l = append(*l, v); return nil }
+
+// runToken implements `mvaultd token create|list|revoke`, managing the API
+// token store (see auth.Store). It works while the daemon runs: the daemon
+// picks up changes on its next request.
+func runToken(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, `usage:
+  mvaultd token create -name NAME [-scope read|write|admin] [-library ID]...
+  mvaultd token list
+  mvaultd token revoke ID|NAME`)
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	bootstrap, err := auth.LoadOrCreateToken()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "auth token: %v\n", err)
+		return 1
+	}
+	store, err := auth.OpenStore(auth.StorePath(), bootstrap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "token store: %v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("token create", flag.ContinueOnError)
+		name := fs.String("name", "", "token name, e.g. the client using it")
+		scope := fs.String("scope", string(auth.ScopeRead), "read, write or admin")
+		var libs libraryList
+		fs.Var(&libs, "library", "restrict to this library ID (repeatable)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		tok, secret, err := store.Create(*name, auth.Scope(*scope), libs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Created token %s (%s, scope %s).\n", tok.ID, tok.Name, tok.Scope)
+		fmt.Println("Secret (shown only once; send it as X-MindVault-Token):")
+		fmt.Println(secret)
+	case "list":
+		tokens, err := store.List()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPE\tLIBRARIES\tCREATED\tLAST USED\tSTATUS")
+		for _, t := range tokens {
+			libs, status := "all", "active"
+			if len(t.Libraries) > 0 {
+				libs = strings.Join(t.Libraries, ",")
+			}
+			switch {
+			case t.RevokedAt != 0:
+				status = "revoked " + fmtMillis(t.RevokedAt)
+			case !t.Active():
+				status = "expired " + fmtMillis(t.ExpiresAt)
+			case t.ExpiresAt != 0:
+				status = "active until " + fmtMillis(t.ExpiresAt)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				t.ID, t.Name, t.Scope, libs, fmtMillis(t.CreatedAt), fmtMillis(t.LastUsedAt), status)
+		}
+		tw.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return usage()
+		}
+		tok, err := store.Revoke(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Revoked token %s (%s).\n", tok.ID, tok.Name)
+	default:
+		return usage()
+	}
+	return 0
+}
+
+// fmtMillis formats a Unix ms timestamp for the token list ("-" for 0).
+func fmtMillis(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.UnixMilli(ms).Local().Format("2006-01-02 15:04")
+}
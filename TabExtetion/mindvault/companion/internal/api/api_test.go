@@ -2,23 +2,47 @@ package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/mindvault/companion/internal/api"
+	"github.com/mindvault/companion/internal/auth"
 	"github.com/mindvault/companion/internal/db"
+	"github.com/mindvault/companion/internal/logging"
 )
 
 const testToken = "test-secret-token-for-e2e"
 
+// testOrigin is the one configured CORS origin of test servers.
+const testOrigin = "chrome-extension://abcdefghijklmnop"
+
 // newTestServer creates a httptest.Server backed by an in-memory DB.
 // It seeds one library, one session, and two tabs, then returns the server
-// and the seeded library/session IDs.
+// and the seeded library/session IDs. testToken is the admin token.
 func newTestServer(t *testing.T) (*httptest.Server, *db.DB, string, string) {
 	t.Helper()
+	tokens, err := auth.OpenStore("", testToken)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	return newTestServerWith(t, tokens)
+}
+
+// newTestServerWith is newTestServer with a caller-supplied token store.
+func newTestServerWith(t *testing.T, tokens *auth.Store) (*httptest.Server, *db.DB, string, string) {
+	t.Helper()
 
 	database, err := db.OpenInMemory()
 	if err != nil {
@@ -61,7 +85,7 @@ func newTestServer(t *testing.T) (*httptest.Server, *db.DB, string, string) {
 		}
 	}
 
-	router := api.NewRouter(database, testToken)
+	router := api.NewRouter(database, tokens, auth.NewPairer(tokens), api.NewOrigins([]string{testOrigin}, tokens), nil)
 	srv := httptest.NewServer(router)
 	t.Cleanup(func() {
 		srv.Close()
@@ -438,3 +462,926 @@ func TestCreateTabLibraryNotFound(t *testing.T) {
 	}
 	resp.Body.Close()
 }
+
+func TestCreateTabUnknownSession(t *testing.T) {
+	srv, _, libID, _ := newTestServer(t)
+
+	// The foreign key rejects it; that is the caller's mistake, not a 500.
+	resp := post(t, srv, "/libraries/"+libID+"/tabs", testToken, map[string]any{
+		"sessionId": "no-such-session",
+		"url":       "https://example.com",
+		"title":     "Lost",
+	})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want 400, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+// ---- POST /sessions:merge + /sessions/{id}/split -----------------------------
+
+func TestMergeAndSplitSessions(t *testing.T) {
+	srv, database, libID, sessID := newTestServer(t)
+
+	now := time.Now().UnixMilli()
+	if err := database.CreateSession(db.Session{
+		ID: "sess-e2e-002", LibraryID: libID, Name: "Second",
+		CreatedAt: now, UpdatedAt: now, SourceBrowser: "Chrome",
+	}); err != nil {
+		t.Fatalf("seed session: %v", err)
+	}
+
+	resp := post(t, srv, "/sessions:merge", testToken, map[string]any{
+		"sessionIds": []string{sessID, "sess-e2e-002"},
+		"name":       "Merged",
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("merge: want 200, got %d", resp.StatusCode)
+	}
+	var merged struct {
+		Session        map[string]any `json:"session"`
+		SourceBrowsers []string       `json:"sourceBrowsers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&merged); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if merged.Session["name"] != "Merged" || len(merged.SourceBrowsers) != 1 {
+		t.Errorf("unexpected merge result %+v", merged)
+	}
+	mergedID, _ := merged.Session["id"].(string)
+
+	resp = post(t, srv, "/sessions/"+mergedID+"/split", testToken, map[string]any{
+		"tabIds": []string{"tab-e2e-001"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("split: want 200, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	resp = post(t, srv, "/sessions/"+mergedID+"/split", testToken, map[string]any{
+		"tabIds": []string{"no-such-tab"},
+	})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("split unknown tab: want 400, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	resp = post(t, srv, "/sessions:merge", testToken, map[string]any{
+		"sessionIds": []string{mergedID, "nope"},
+	})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("merge missing: want 404, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+// ---- GET /sessions/{id} + window / group structure ---------------------------
+
+func TestSessionDetailWithWindows(t *testing.T) {
+	srv, _, libID, sessID := newTestServer(t)
+
+	resp := post(t, srv, "/sessions/"+sessID+"/windows", testToken, map[string]any{"id": "win-e2e", "focused": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create window: want 200, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = post(t, srv, "/sessions/"+sessID+"/groups", testToken, map[string]any{"id": "grp-e2e", "windowId": "win-e2e", "name": "Go", "colour": "cyan"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create group: want 200, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = post(t, srv, "/sessions/"+sessID+"/groups", testToken, map[string]any{"colour": "plaid"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad colour: want 400, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = post(t, srv, "/libraries/"+libID+"/tabs", testToken, map[string]any{
+		"sessionId": sessID, "url": "https://go.dev/blog", "title": "Blog",
+		"windowId": "win-e2e", "groupId": "grp-e2e", "index": 0, "isPinned": true,
+	})
+	resp.Body.Close()
+
+	resp = get(t, srv, "/sessions/"+sessID, testToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("detail: want 200, got %d", resp.StatusCode)
+	}
+	var detail struct {
+		WindowCount int `json:"windowCount"`
+		Windows     []struct {
+			Groups []map[string]any `json:"groups"`
+			Tabs   []map[string]any `json:"tabs"`
+		} `json:"windows"`
+		LooseTabs []map[string]any `json:"looseTabs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&detail); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if detail.WindowCount != 1 || len(detail.Windows[0].Tabs) != 1 || detail.Windows[0].Tabs[0]["isPinned"] != true {
+		t.Errorf("unexpected detail %+v", detail)
+	}
+	if len(detail.LooseTabs) != 2 {
+		t.Errorf("want 2 loose tabs, got %d", len(detail.LooseTabs))
+	}
+
+	resp = get(t, srv, "/sessions/no-such-session", testToken)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing session: want 404, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+func TestLibrarySessionAndTabsPaging(t *testing.T) {
+	srv, _, libID, sessID := newTestServer(t)
+
+	resp := get(t, srv, "/libraries/"+libID+"/sessions/"+sessID+"?limit=1", testToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want 200, got %d", resp.StatusCode)
+	}
+	var body struct {
+		Session map[string]any `json:"session"`
+		Tabs    struct {
+			Tabs  []map[string]any `json:"tabs"`
+			Total int              `json:"total"`
+		} `json:"tabs"`
+		Stats struct {
+			TabCount int `json:"tabCount"`
+			Domains  []struct {
+				Domain string `json:"domain"`
+			} `json:"domains"`
+		} `json:"stats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if len(body.Tabs.Tabs) != 1 || body.Tabs.Total != 2 || body.Stats.TabCount != 2 || len(body.Stats.Domains) != 2 {
+		t.Errorf("unexpected body %+v", body)
+	}
+
+	resp = get(t, srv, "/sessions/"+sessID+"/tabs?offset=1", testToken)
+	var page struct {
+		Tabs []map[string]any `json:"tabs"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if len(page.Tabs) != 1 {
+		t.Errorf("offset=1: want 1 tab, got %d", len(page.Tabs))
+	}
+
+	resp = get(t, srv, "/libraries/other-lib/sessions/"+sessID, testToken)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong library: want 404, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/libraries/"+libID+"/sessions/"+sessID, nil)
+	req.Header.Set("X-MindVault-Token", testToken)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	resp = get(t, srv, "/libraries/"+libID+"/sessions?unsorted=true", testToken)
+	var sessions []map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&sessions)
+	resp.Body.Close()
+	if len(sessions) != 1 || sessions[0]["id"] != "unsorted" || sessions[0]["virtual"] != true {
+		t.Errorf("want only the virtual Unsorted session, got %+v", sessions)
+	}
+}
+
+func TestEncryptedLibraryLockedAndUnlock(t *testing.T) {
+	srv, database, _, _ := newTestServer(t)
+	now := time.Now().UnixMilli()
+	if err := database.CreateLibrary(db.Library{ID: "lib-enc", Name: "Private", CreatedAt: now, UpdatedAt: now, IsEncrypted: true}); err != nil {
+		t.Fatalf("CreateLibrary: %v", err)
+	}
+
+	resp := get(t, srv, "/libraries/lib-enc/tabs", testToken)
+	if resp.StatusCode != http.StatusLocked {
+		t.Errorf("locked list: want 423, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = get(t, srv, "/search?q=x&libId=lib-enc", testToken)
+	if resp.StatusCode != http.StatusLocked {
+		t.Errorf("locked search: want 423, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	resp = post(t, srv, "/libraries/lib-enc/unlock", testToken, map[string]string{"password": "pw"})
+	var st struct {
+		Unlocked  bool  `json:"unlocked"`
+		ExpiresAt int64 `json:"expiresAt"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !st.Unlocked || st.ExpiresAt == 0 {
+		t.Fatalf("unlock: status %d, %+v", resp.StatusCode, st)
+	}
+	resp = get(t, srv, "/libraries/lib-enc/tabs", testToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unlocked list: want 200, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	resp = post(t, srv, "/libraries/lib-enc/lock", testToken, nil)
+	resp.Body.Close()
+	resp = get(t, srv, "/libraries/lib-enc/tabs", testToken)
+	if resp.StatusCode != http.StatusLocked {
+		t.Errorf("after lock: want 423, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+func TestZeroKnowledgeBlobRoundTrip(t *testing.T) {
+	srv, _, _, _ := newTestServer(t)
+	resp := post(t, srv, "/libraries", testToken, map[string]any{"id": "lib-zk", "name": "E2E", "zeroKnowledge": true})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create library: %d", resp.StatusCode)
+	}
+
+	// The extension's EncryptedField JSON, pushed as opaque bytes.
+	ct := []byte(`{"ct":"q83vEjRWeJA=","iv":"AAECAwQFBgcICQoL"}` + "\n")
+	resp = post(t, srv, "/libraries/lib-zk/blobs", testToken, map[string]any{
+		"blobs": []map[string]any{{"id": "tab-1", "data": ct, "createdAt": 1, "updatedAt": 2}},
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("push: %d", resp.StatusCode)
+	}
+
+	resp = get(t, srv, "/libraries/lib-zk/blobs", testToken)
+	var page struct {
+		Blobs []struct {
+			ID   string `json:"id"`
+			Data []byte `json:"data"`
+		} `json:"blobs"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if len(page.Blobs) != 1 || page.Blobs[0].ID != "tab-1" || !bytes.Equal(page.Blobs[0].Data, ct) {
+		t.Fatalf("pull: %+v", page)
+	}
+
+	resp = get(t, srv, "/search?q=ct&libId=lib-zk", testToken)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("search of a zero-knowledge library: want 400, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = get(t, srv, "/libraries/lib-e2e-001/blobs", testToken)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("blobs of a normal library: want 400, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+func TestKeyHashOnlyVerified(t *testing.T) {
+	srv, _, _, _ := newTestServer(t)
+	const hash = "c2VjcmV0LWNoZWNrLXZhbHVl"
+	resp := post(t, srv, "/libraries", testToken, map[string]any{
+		"id": "lib-zk", "name": "E2E", "zeroKnowledge": true, "passwordSalt": "c2FsdA==", "encryptionKeyHash": hash,
+	})
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || bytes.Contains(body, []byte(hash)) {
+		t.Fatalf("create library: %d %s", resp.StatusCode, body)
+	}
+	for _, path := range []string{"/libraries", "/libraries/lib-zk"} {
+		resp = get(t, srv, path, testToken)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if bytes.Contains(body, []byte(hash)) || bytes.Contains(body, []byte("encryptionKeyHash")) {
+			t.Errorf("GET %s leaks the key hash: %s", path, body)
+		}
+	}
+
+	for hashIn, want := range map[string]bool{hash: true, "d3Jvbmc=": false} {
+		resp = post(t, srv, "/libraries/lib-zk/verify-key", testToken, map[string]any{"encryptionKeyHash": hashIn})
+		var res struct {
+			Valid bool `json:"valid"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || res.Valid != want {
+			t.Errorf("verify-key %s: %d valid=%v, want %v", hashIn, resp.StatusCode, res.Valid, want)
+		}
+	}
+	resp = post(t, srv, "/libraries/lib-e2e-001/verify-key", testToken, map[string]any{"encryptionKeyHash": hash})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("verify-key of a normal library: want 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestScopedTokens(t *testing.T) {
+	tokens, err := auth.OpenStore("", testToken)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	srv, _, libID, _ := newTestServerWith(t, tokens)
+	_, reader, err := tokens.Create("script", auth.ScopeRead, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	_, scoped, _ := tokens.Create("one-lib", auth.ScopeWrite, []string{libID})
+	revokedTok, revoked, _ := tokens.Create("old", auth.ScopeAdmin, nil)
+	if _, err := tokens.Revoke(revokedTok.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+
+	cases := []struct {
+		name, method, path, token string
+		want                      int
+	}{
+		{"read token lists tabs", "GET", "/libraries/" + libID + "/tabs", reader, http.StatusOK},
+		{"read token cannot write", "POST", "/libraries/" + libID + "/tabs", reader, http.StatusForbidden},
+		{"read token cannot list backups", "GET", "/backups", reader, http.StatusForbidden},
+		{"read token cannot restore", "POST", "/restore/x.sqlite", reader, http.StatusForbidden},
+		{"scoped token reads its library", "GET", "/libraries/" + libID + "/sessions", scoped, http.StatusOK},
+		{"scoped token, other library", "GET", "/libraries/other/sessions", scoped, http.StatusForbidden},
+		{"scoped token, cross-library route", "GET", "/tabs", scoped, http.StatusForbidden},
+		{"scoped token, scoped search", "GET", "/search?q=go&libId=" + libID, scoped, http.StatusOK},
+		{"scoped token, global search", "GET", "/search?q=go", scoped, http.StatusForbidden},
+		{"revoked token", "GET", "/libraries", revoked, http.StatusUnauthorized},
+		{"admin token", "GET", "/backups/status", testToken, http.StatusOK},
+	}
+	for _, c := range cases {
+		var resp *http.Response
+		if c.method == "GET" {
+			resp = get(t, srv, c.path, c.token)
+		} else {
+			resp = post(t, srv, c.path, c.token, map[string]string{"url": "https://x.example"})
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s: want %d, got %d", c.name, c.want, resp.StatusCode)
+		}
+	}
+
+	list, _ := tokens.List()
+	for _, tk := range list {
+		if tk.Name == "script" && tk.LastUsedAt == 0 {
+			t.Error("last-used time not recorded")
+		}
+	}
+}
+
+func TestJobsOfRestrictedToken(t *testing.T) {
+	tokens, err := auth.OpenStore("", testToken)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	srv, database, _, _ := newTestServerWith(t, tokens)
+	now := time.Now().UnixMilli()
+	jobs := map[string]string{} // library → job
+	for _, id := range []string{"lib-mine", "lib-theirs"} {
+		if err := database.CreateLibrary(db.Library{ID: id, Name: id, CreatedAt: now, UpdatedAt: now, IsEncrypted: true}); err != nil {
+			t.Fatalf("CreateLibrary: %v", err)
+		}
+		if _, err := database.UnlockLibrary(id, "old"); err != nil {
+			t.Fatalf("UnlockLibrary: %v", err)
+		}
+		job, err := database.RekeyLibrary(id, "old", "new")
+		if err != nil {
+			t.Fatalf("RekeyLibrary: %v", err)
+		}
+		jobs[id] = job.ID
+	}
+	_, scoped, _ := tokens.Create("one-lib", auth.ScopeRead, []string{"lib-mine"})
+
+	resp := get(t, srv, "/jobs", scoped)
+	var list []db.Job
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /jobs: %d %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+	if len(list) != 1 || list[0].LibraryID != "lib-mine" {
+		t.Errorf("restricted token sees jobs %+v, want only lib-mine's", list)
+	}
+	for lib, want := range map[string]int{"lib-mine": http.StatusOK, "lib-theirs": http.StatusNotFound} {
+		resp := get(t, srv, "/jobs/"+jobs[lib], scoped)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET job of %s: want %d, got %d", lib, want, resp.StatusCode)
+		}
+	}
+	resp = get(t, srv, "/jobs", testToken)
+	list = nil
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 2 {
+		t.Errorf("unrestricted token sees %d jobs, want 2", len(list))
+	}
+}
+
+func TestScopedTokenStaysInItsLibrary(t *testing.T) {
+	tokens, err := auth.OpenStore("", testToken)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	srv, database, libID, _ := newTestServerWith(t, tokens)
+	_, scoped, _ := tokens.Create("one-lib", auth.ScopeWrite, []string{libID})
+
+	// Rows of another library, addressed by ID through the token's own prefix.
+	const other = "lib-other"
+	now := time.Now().UnixMilli()
+	url := "https://other.example"
+	steps := []error{
+		database.CreateLibrary(db.Library{ID: other, Name: "Other", CreatedAt: now, UpdatedAt: now}),
+		database.CreateSession(db.Session{ID: "o-sess", LibraryID: other, Name: "Theirs", CreatedAt: now, UpdatedAt: now}),
+		database.CreateTab(db.Tab{ID: "o-tab", LibraryID: other, URL: url, SavedAt: now}),
+		database.CreateBookmark(db.Bookmark{ID: "o-bm", LibraryID: other, Title: "b", URL: &url, CreatedAt: now}),
+		database.UpsertHistoryEntry(db.HistoryEntry{ID: "o-hist", LibraryID: other, URL: url, VisitTime: now}),
+		database.CreateDownload(db.Download{ID: "o-dl", LibraryID: other, Filename: "f", URL: url, DownloadedAt: now, State: "complete"}),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatalf("seed other library: %v", err)
+		}
+	}
+	do := func(method, path, token string, body string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("X-MindVault-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := do(http.MethodPatch, "/libraries/"+libID+"/sessions/o-sess", scoped, `{"name":"Mine"}`); got != http.StatusNotFound {
+		t.Errorf("PATCH other library's session: want 404, got %d", got)
+	}
+	targets := []string{"sessions/o-sess", "sessions/o-sess?deleteTabs=true", "tabs/o-tab", "bookmarks/o-bm", "history/o-hist", "downloads/o-dl"}
+	for _, p := range targets {
+		if got := do(http.MethodDelete, "/libraries/"+libID+"/"+p, scoped, ""); got != http.StatusNotFound {
+			t.Errorf("DELETE %s through own prefix: want 404, got %d", p, got)
+		}
+	}
+	// Every row is still there for a caller that may reach the other library.
+	if s, err := database.GetSession("o-sess"); err != nil || s.Name != "Theirs" {
+		t.Errorf("session after PATCH: %+v, %v", s, err)
+	}
+	for _, p := range targets[1:] {
+		if got := do(http.MethodDelete, "/libraries/"+other+"/"+p, testToken, ""); got != http.StatusNoContent {
+			t.Errorf("DELETE %s in its library: want 204, got %d", p, got)
+		}
+	}
+}
+
+func TestPairingFlow(t *testing.T) {
+	srv, _, _, _ := newTestServer(t)
+
+	if resp := get(t, srv, "/token", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /token still served: %d", resp.StatusCode)
+	}
+
+	resp := post(t, srv, "/pair", "", map[string]any{"client": "Firefox extension", "scope": "admin"})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /pair: want 202, got %d", resp.StatusCode)
+	}
+	var pr struct{ ID, Code, Secret string }
+	_ = json.NewDecoder(resp.Body).Decode(&pr)
+	resp.Body.Close()
+	if pr.ID == "" || len(pr.Code) != 7 || pr.Secret == "" {
+		t.Fatalf("pair response: %+v", pr)
+	}
+
+	poll := func(secret string) (int, map[string]any) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/pair/"+pr.ID, nil)
+		req.Header.Set("X-MindVault-Pair-Secret", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+		defer resp.Body.Close()
+		var body map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	if code, _ := poll("wrong"); code != http.StatusNotFound {
+		t.Errorf("poll with wrong secret: want 404, got %d", code)
+	}
+	if code, body := poll(pr.Secret); code != http.StatusOK || body["state"] != "pending" || body["token"] != nil {
+		t.Fatalf("poll before approval: %d %v", code, body)
+	}
+
+	// Only an admin can see and approve requests.
+	if resp := post(t, srv, "/pairings/approve", "", map[string]string{"code": pr.Code}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("approve without token: want 401, got %d", resp.StatusCode)
+	}
+	if resp := post(t, srv, "/pairings/approve", testToken, map[string]string{"code": "not-a-code", "scope": "write"}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("approve unknown code: want 404, got %d", resp.StatusCode)
+	}
+	var pending []map[string]any
+	resp = get(t, srv, "/pairings", testToken)
+	_ = json.NewDecoder(resp.Body).Decode(&pending)
+	resp.Body.Close()
+	if len(pending) != 1 || pending[0]["code"] != pr.Code || pending[0]["scope"] != "admin" {
+		t.Fatalf("pending pairings: %v", pending)
+	}
+	// The granted scope is stated, never taken from the request.
+	if resp := post(t, srv, "/pairings/approve", testToken, map[string]string{"code": pr.Code}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("approve without scope: want 400, got %d", resp.StatusCode)
+	}
+	if resp := post(t, srv, "/pairings/approve", testToken, map[string]string{"code": strings.ReplaceAll(pr.Code, "-", ""), "scope": "write"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("approve: want 200, got %d", resp.StatusCode)
+	}
+
+	code, body := poll(pr.Secret)
+	token, _ := body["token"].(string)
+	if code != http.StatusOK || body["state"] != "approved" || token == "" {
+		t.Fatalf("poll after approval: %d %v", code, body)
+	}
+	if code, _ := poll(pr.Secret); code != http.StatusNotFound {
+		t.Errorf("token handed out twice: %d", code)
+	}
+	if resp := post(t, srv, "/libraries", token, map[string]string{"name": "Paired"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("paired token cannot write: %d", resp.StatusCode)
+	}
+	if resp := get(t, srv, "/backups", token); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("paired write token reached an admin route: %d", resp.StatusCode)
+	}
+}
+
+func TestCORSAllowlist(t *testing.T) {
+	tokens, err := auth.OpenStore("", testToken)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	srv, _, _, _ := newTestServerWith(t, tokens)
+
+	preflight := func(path, origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, srv.URL+path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("preflight: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	cases := []struct {
+		name, origin string
+		allowed      bool
+	}{
+		{"configured extension", testOrigin, true},
+		{"other extension ID", "chrome-extension://abcdefghijklmnopX", false},
+		{"extension ID prefix", "chrome-extension://abcdefghijklmno", false},
+		{"same ID, other browser", "moz-extension://abcdefghijklmnop", false},
+		{"localhost subdomain confusion", "http://localhost.evil.com", false},
+		{"loopback IP prefix confusion", "http://127.0.0.1.evil.com", false},
+		{"localhost dev server", "http://localhost:3000", false},
+		{"userinfo confusion", "http://127.0.0.1@evil.com", false},
+		{"null origin", "null", false},
+	}
+	for _, c := range cases {
+		resp := preflight("/libraries", c.origin)
+		got := resp.Header.Get("Access-Control-Allow-Origin")
+		if c.allowed && (resp.StatusCode != http.StatusNoContent || got != c.origin) {
+			t.Errorf("%s: want 204 allowing %s, got %d %q", c.name, c.origin, resp.StatusCode, got)
+		}
+		if !c.allowed && (resp.StatusCode != http.StatusForbidden || got != "") {
+			t.Errorf("%s: want 403 without CORS headers, got %d %q", c.name, resp.StatusCode, got)
+		}
+		if !strings.Contains(strings.Join(resp.Header.Values("Vary"), ","), "Origin") {
+			t.Errorf("%s: missing Vary: Origin", c.name)
+		}
+	}
+
+	// Actual (non-preflight) requests from unknown origins are refused too.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/libraries", nil)
+	req.Header.Set("X-MindVault-Token", testToken)
+	req.Header.Set("Origin", "http://localhost.evil.com")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET from unknown origin: %v %v", resp.StatusCode, err)
+	}
+
+	// Any origin may pair; once approved, its origin joins the allowlist.
+	const pwa = "http://localhost:5173"
+	if resp := preflight("/pair", pwa); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != pwa {
+		t.Fatalf("pairing preflight from %s: %d", pwa, resp.StatusCode)
+	}
+	if resp := preflight("/pair", "null"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("pairing preflight from null origin: %d", resp.StatusCode)
+	}
+	b, _ := json.Marshal(map[string]string{"client": "PWA"})
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/pair", bytes.NewReader(b))
+	req.Header.Set("Origin", pwa)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /pair: %v %v", resp.StatusCode, err)
+	}
+	var pr struct{ ID, Code, Secret string }
+	_ = json.NewDecoder(resp.Body).Decode(&pr)
+	resp.Body.Close()
+	post(t, srv, "/pairings/approve", testToken, map[string]string{"code": pr.Code, "scope": "write"}).Body.Close()
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/pair/"+pr.ID, nil)
+	req.Header.Set("X-MindVault-Pair-Secret", pr.Secret)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("collect token: %v %v", resp.StatusCode, err)
+	}
+	if resp := preflight("/libraries", pwa); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("paired origin not allowed: %d", resp.StatusCode)
+	}
+	if _, err := tokens.Revoke("PWA (" + pr.ID[:6] + ")"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if resp := preflight("/libraries", pwa); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("origin of a revoked token still allowed: %d", resp.StatusCode)
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket file modes are not enforced on Windows")
+	}
+	srv, _, _, _ := newTestServer(t)
+	dir, err := os.MkdirTemp("", "mv") // short: socket paths are limited to ~100 bytes
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "run", "mindvault.sock")
+
+	ln, err := api.ListenSocket(sock)
+	if err != nil {
+		t.Fatalf("ListenSocket: %v", err)
+	}
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode: %v %v", fi.Mode(), err)
+	}
+	if _, err := api.ListenSocket(sock); err == nil {
+		t.Error("second listener took over a live socket")
+	}
+	sockSrv := &http.Server{Handler: api.PeerCredMiddleware(srv.Config.Handler), ConnContext: api.SocketConnContext}
+	go sockSrv.Serve(ln)
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+	}}}
+	req, _ := http.NewRequest(http.MethodGet, "http://mvaultd/libraries", nil)
+	req.Header.Set("X-MindVault-Token", testToken)
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET over socket: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	req.Header.Del("X-MindVault-Token")
+	if resp, _ := client.Do(req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("socket request without token: want 401, got %d", resp.StatusCode)
+	}
+
+	// Without peer credentials (not a socket connection) requests are refused.
+	if api.PeerCredSupported() {
+		tcp := httptest.NewServer(api.PeerCredMiddleware(srv.Config.Handler))
+		defer tcp.Close()
+		if resp := get(t, tcp, "/libraries", testToken); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("unverified peer: want 403, got %d", resp.StatusCode)
+		}
+	}
+
+	// A socket file left behind by a dead daemon is replaced.
+	sockSrv.Close()
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err = api.ListenSocket(sock)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	ln.Close()
+}
+
+func TestFeatureToggles(t *testing.T) {
+	_, database, _, _ := newTestServer(t)
+	tokens, err := auth.OpenStore("", testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	features := api.NewFeatures(false, false)
+	srv := httptest.NewServer(api.NewRouter(database, tokens, auth.NewPairer(tokens), api.NewOrigins(nil, tokens), features))
+	defer srv.Close()
+
+	pair := map[string]string{"client": "Test", "scope": "read"}
+	if resp := get(t, srv, "/ui/", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("dashboard off: want 404, got %d", resp.StatusCode)
+	}
+	if resp := post(t, srv, "/pair", "", pair); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("pairing off: want 404, got %d", resp.StatusCode)
+	}
+
+	features.Set(true, true) // as on SIGHUP
+	if resp := get(t, srv, "/ui/", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("dashboard on: want 200, got %d", resp.StatusCode)
+	}
+	if resp := post(t, srv, "/pair", "", pair); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("pairing on: want 202, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminMaintenanceEndpoints(t *testing.T) {
+	srv, database, libID, _ := newTestServer(t)
+
+	resp := get(t, srv, "/export?libId="+libID, testToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /export: %d", resp.StatusCode)
+	}
+	var export bytes.Buffer
+	export.ReadFrom(resp.Body)
+	resp.Body.Close()
+
+	if err := database.RenameLibrary(libID, "Changed"); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/import", &export)
+	req.Header.Set("X-MindVault-Token", testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /import: %v %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+	if l, _ := database.GetLibrary(libID); l.Name != "E2E Library" {
+		t.Errorf("library after import: %q", l.Name)
+	}
+
+	for _, path := range []string{"/admin/migrations", "/admin/doctor"} {
+		if resp := get(t, srv, path, testToken); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %d", path, resp.StatusCode)
+		}
+	}
+	if resp := post(t, srv, "/admin/vacuum", testToken, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /admin/vacuum: %d", resp.StatusCode)
+	}
+	resp = post(t, srv, "/admin/doctor", testToken, nil)
+	var report db.DoctorReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /admin/doctor: %d %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+	if !report.Fix || !report.Healthy {
+		t.Errorf("doctor report: %+v", report)
+	}
+}
+
+func TestAutostartXDG(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("XDG autostart is a Linux backend")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "cfg"))
+	srv, _, _, _ := newTestServer(t)
+
+	state := func() (enabled bool, backend string) {
+		t.Helper()
+		resp := get(t, srv, "/autostart?backend=xdg", testToken)
+		defer resp.Body.Close()
+		var body struct {
+			Enabled bool   `json:"enabled"`
+			Backend string `json:"backend"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /autostart: %d %v", resp.StatusCode, err)
+		}
+		return body.Enabled, body.Backend
+	}
+	if on, backend := state(); on || backend != "xdg" {
+		t.Fatalf("before enable: %v %q", on, backend)
+	}
+	if resp := post(t, srv, "/autostart?backend=xdg", testToken, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("POST /autostart: %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(home, "cfg", "autostart", "mvaultd.desktop")); err != nil {
+		t.Fatalf("desktop entry: %v", err)
+	}
+	if on, _ := state(); !on {
+		t.Error("not enabled after POST")
+	}
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/autostart?backend=xdg", nil)
+	req.Header.Set("X-MindVault-Token", testToken)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /autostart: %v %v", resp, err)
+	}
+	if on, _ := state(); on {
+		t.Error("still enabled after DELETE")
+	}
+	if resp := post(t, srv, "/autostart?backend=launchd", testToken, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /autostart?backend=launchd on linux: %d", resp.StatusCode)
+	}
+}
+
+func TestSlowAdminRoutesOutlastWriteTimeout(t *testing.T) {
+	database, err := db.OpenInMemory()
+	if err != nil {
+		t.Fatalf("OpenInMemory: %v", err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	tokens, _ := auth.OpenStore("", testToken)
+	router := api.NewRouter(database, tokens, auth.NewPairer(tokens), api.NewOrigins(nil, tokens), nil)
+	srv := httptest.NewUnstartedServer(router)
+	srv.Config.WriteTimeout = time.Nanosecond // past before any answer is written
+	srv.Start()
+	defer srv.Close()
+
+	if resp, err := http.DefaultClient.Do(mustRequest(t, http.MethodGet, srv.URL+"/admin/doctor")); err != nil {
+		t.Errorf("GET /admin/doctor: %v", err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /admin/doctor: %d", resp.StatusCode)
+	}
+	// An ordinary route keeps the server's timeout.
+	if resp, err := http.DefaultClient.Do(mustRequest(t, http.MethodGet, srv.URL+"/libraries")); err == nil {
+		resp.Body.Close()
+		t.Errorf("GET /libraries answered %d past the write timeout", resp.StatusCode)
+	}
+}
+
+// mustRequest is an authenticated request without a body.
+func mustRequest(t *testing.T, method, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-MindVault-Token", testToken)
+	return req
+}
+
+func TestAdminLogs(t *testing.T) {
+	if err := logging.Configure(logging.Options{Level: "debug"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Configure(logging.Options{Level: "info"}, os.Stderr)
+	srv, _, libID, _ := newTestServer(t)
+	since := time.Now().Add(-time.Millisecond).UnixMilli()
+
+	get(t, srv, "/libraries/"+libID, testToken).Body.Close()
+	get(t, srv, "/libraries?access_token=leaked-secret", "wrong-token").Body.Close()
+	get(t, srv, "/search?q=private+diagnosis&limit=5", testToken).Body.Close()
+
+	resp := get(t, srv, "/admin/logs?since="+strconv.FormatInt(since, 10), testToken)
+	var entries []logging.Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /admin/logs: %d %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+	var ok, denied, search *logging.Entry
+	for i, e := range entries {
+		if e.Msg != "request" {
+			continue
+		}
+		switch e.Attrs["path"] {
+		case "/libraries/" + libID:
+			ok = &entries[i]
+		case "/libraries?access_token=REDACTED":
+			denied = &entries[i]
+		case "/search?limit=5&q=REDACTED":
+			search = &entries[i]
+		}
+	}
+	if ok == nil || ok.Level != "INFO" || ok.Attrs["route"] != "GET /libraries/{id}" ||
+		ok.Attrs["status"] != float64(200) || ok.Attrs["client"] == nil {
+		t.Errorf("request line for a good request: %+v", ok)
+	}
+	if denied == nil || denied.Level != "WARN" || denied.Attrs["status"] != float64(401) {
+		t.Errorf("request line for a denied request: %+v", denied)
+	}
+	if search == nil {
+		t.Error("no request line for a search with its terms redacted")
+	}
+	data, _ := json.Marshal(entries)
+	for _, secret := range []string{testToken, "wrong-token", "leaked-secret", "diagnosis"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("logs contain %q", secret)
+		}
+	}
+
+	if resp := get(t, srv, "/admin/logs?level=loud", testToken); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad level: %d", resp.StatusCode)
+	}
+
+	// log.requests moves successful requests to another level.
+	if err := logging.Configure(logging.Options{Level: "debug", Requests: "debug"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	since = time.Now().Add(-time.Millisecond).UnixMilli()
+	get(t, srv, "/libraries/"+libID, testToken).Body.Close()
+	found := false
+	for _, e := range logging.Recent(time.UnixMilli(since), slog.LevelDebug, 0) {
+		if e.Msg == "request" && e.Attrs["path"] == "/libraries/"+libID {
+			found = e.Level == "DEBUG"
+		}
+	}
+	if !found {
+		t.Error("with requests: debug, a good request did not log at debug")
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mindvault/companion/internal/auth"
+)
+
+// Origins is the CORS allowlist. An origin is allowed only if it equals an
+// entry exactly: the configured origins (config.CORS plus the dashboard's own
+// origin) or the origin of an active paired token. There is no prefix or
+// wildcard matching, and the opaque origin "null" is never allowed.
+type Origins struct {
+	tokens *auth.Store // nil = configured origins only
+
+	mu         sync.RWMutex
+	configured []string
+}
+
+// NewOrigins returns an allowlist of configured plus the origins of paired
+// clients in tokens.
+func NewOrigins(configured []string, tokens *auth.Store) *Origins {
+	o := &Origins{tokens: tokens}
+	o.Set(configured)
+	return o
+}
+
+// Set replaces the configured origins.
+func (o *Origins) Set(configured []string) {
+	o.mu.Lock()
+	o.configured = append([]string{}, configured...)
+	o.mu.Unlock()
+}
+
+// Allowed reports whether origin may call the API from a browser.
+func (o *Origins) Allowed(origin string) bool {
+	if origin == "" || origin == "null" {
+		return false
+	}
+	o.mu.RLock()
+	ok := slices.Contains(o.configured, origin)
+	o.mu.RUnlock()
+	if !ok && o.tokens != nil {
+		ok = slices.Contains(o.tokens.Origins(), origin)
+	}
+	return ok
+}
+
+// isPairingPath reports whether path is one of the unauthenticated pairing
+// endpoints, which any origin may call: a client's origin only joins the
+// allowlist once its pairing has been approved.
+func isPairingPath(path string) bool {
+	return path == "/pair" || strings.HasPrefix(path, "/pair/")
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Features switches optional routes on and off at runtime (config features,
+// reloaded on SIGHUP). A switched-off route answers 404 as if absent.
+type Features struct {
+	dashboard atomic.Bool
+	pairing   atomic.Bool
+}
+
+// NewFeatures returns toggles with the given initial state.
+func NewFeatures(dashboard, pairing bool) *Features {
+	f := &Features{}
+	f.Set(dashboard, pairing)
+	return f
+}
+
+// Set updates the toggles.
+func (f *Features) Set(dashboard, pairing bool) {
+	f.dashboard.Store(dashboard)
+	f.pairing.Store(pairing)
+}
+
+// gate serves next only while on reports true.
+func gate(on func() bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !on() {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,128 @@
+// Package handlers — admin.go
+// Maintenance endpoints behind the mvaultd admin CLI (all need the admin scope).
+//
+// Endpoints:
+//   GET  /export[?libId=…&libId=…]  → Export (JSON dump of the libraries; none = all)
+//   POST /import                   → ImportResult (body: an export file)
+//   POST /admin/vacuum             → VacuumResult
+//   GET  /admin/migrations         → []MigrationState
+//   GET  /admin/doctor             → DoctorReport (checks only)
+//   POST /admin/doctor             → DoctorReport (checks and repairs what it safely can)
+//   GET  /admin/logs?since=&level=&limit= → recent log records, oldest first
+
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mindvault/companion/internal/db"
+	"github.com/mindvault/companion/internal/logging"
+)
+
+// Export godoc — GET /export?libId=
+// Streams the named libraries (repeat libId; none = all) as an export file.
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	e, err := h.db.Export(r.URL.Query()["libId"])
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="mindvault-export-%s.json"`, time.Now().UTC().Format("2006-01-02")))
+	jsonOK(w, e)
+}
+
+// Import godoc — POST /import
+// Replaces the libraries in the uploaded export file with their exported
+// state, after a pre-import backup. Other libraries are untouched.
+func (h *Handler) Import(w http.ResponseWriter, r *http.Request) {
+	e, err := db.ReadExport(r.Body)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	res, err := h.db.Import(e)
+	if err != nil {
+		jsonErr(w, "import failed: "+err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, res)
+}
+
+// Vacuum godoc — POST /admin/vacuum
+// Rebuilds the database file and reports its size before and after.
+func (h *Handler) Vacuum(w http.ResponseWriter, r *http.Request) {
+	res, err := h.db.Vacuum()
+	if err != nil {
+		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonOK(w, res)
+}
+
+// Migrations godoc — GET /admin/migrations
+// Lists the schema migrations this build knows and which are applied.
+func (h *Handler) Migrations(w http.ResponseWriter, r *http.Request) {
+	list, err := h.db.MigrationStatus()
+	if err != nil {
+		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonOK(w, list)
+}
+
+// Doctor godoc — GET /admin/doctor, POST /admin/doctor
+// Runs the database checks (see db.Doctor). POST also repairs what it safely
+// can; the report marks those findings fixed.
+func (h *Handler) Doctor(w http.ResponseWriter, r *http.Request) {
+	report, err := h.db.Doctor(r.Method == http.MethodPost)
+	if err != nil {
+		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonOK(w, report)
+}
+
+// Logs godoc — GET /admin/logs?since=&level=&limit=
+// Returns the daemon's recent log records (kept in memory, including request
+// lines) newer than since — Unix ms or RFC 3339; pass the last record's time
+// to poll for more. level is the minimum level (default debug: all kept);
+// limit caps the answer to the newest records (default 500).
+func (h *Handler) Logs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			since = time.UnixMilli(ms)
+		} else if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			since = t
+		} else {
+			jsonErr(w, "since: want Unix ms or RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	min := slog.LevelDebug
+	if v := q.Get("level"); v != "" {
+		if err := min.UnmarshalText([]byte(v)); err != nil {
+			jsonErr(w, "level: want debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 500
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			jsonErr(w, "limit: want a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	entries := logging.Recent(since, min, limit)
+	if entries == nil {
+		entries = []logging.Entry{}
+	}
+	jsonOK(w, entries)
+}
@@ -1,93 +1,109 @@
 // Package handlers — autostart.go
-// Windows Task Scheduler integration for companion daemon auto-start at logon.
+// Starting the companion daemon at login, through the platform's backends (see
+// package autostart): systemd --user or XDG autostart on Linux, a LaunchAgent
+// on macOS, Task Scheduler on Windows.
 //
 // Endpoints:
-//   GET    /autostart  → { "enabled": bool, "platform": string }
-//   POST   /autostart  → 204 — register logon task
-//   DELETE /autostart  → 204 — remove logon task
+//   GET    /autostart[?backend=]  → { "enabled", "platform", "backend", "backends": [...] }
+//   POST   /autostart[?backend=]  → 204 — register the daemon
+//   DELETE /autostart[?backend=]  → 204 — remove the registration
 //
-// Uses schtasks.exe (built into Windows); no admin required (/RL LIMITED).
+// backend names one of the platform's backends; without it (or "auto") the
+// first available one is used. Registering never starts a second daemon now.
 
 package handlers
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
-)
 
-const taskName = "MindVault Companion Daemon"
+	"github.com/mindvault/companion/internal/autostart"
+)
 
-// isTaskRegistered reports whether the Task Scheduler logon job exists.
-func isTaskRegistered() bool {
-	if runtime.GOOS != "windows" {
-		return false
+// autostartBackend returns the backend the request names.
+func autostartBackend(r *http.Request) (autostart.Backend, int, error) {
+	env, err := autostart.UserEnv()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
 	}
-	return exec.Command("schtasks", "/Query", "/TN", taskName).Run() == nil
+	b, err := autostart.Select(runtime.GOOS, r.URL.Query().Get("backend"), env)
+	switch {
+	case errors.Is(err, autostart.ErrUnknown):
+		return nil, http.StatusBadRequest, err
+	case errors.Is(err, autostart.ErrUnsupported):
+		return nil, http.StatusNotImplemented, err
+	}
+	return b, http.StatusOK, err
+}
+
+// autostartState is one backend in GET /autostart.
+type autostartState struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Enabled   bool   `json:"enabled"`
 }
 
-// GetAutostart returns the current auto-start registration state.
-// GET /autostart → { "enabled": bool, "platform": "windows"|"other" }
+// GetAutostart godoc — GET /autostart
+// Reports whether the daemon starts at login: "enabled" for the selected
+// backend, and the state of every backend of the platform.
 func (h *Handler) GetAutostart(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]interface{}{
-		"enabled":  isTaskRegistered(),
-		"platform": runtime.GOOS,
-	})
+	env, err := autostart.UserEnv()
+	if err != nil {
+		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"enabled": false, "platform": runtime.GOOS, "backend": ""}
+	if b, code, err := autostartBackend(r); err == nil {
+		resp["backend"] = b.Name()
+		resp["enabled"], _ = b.Enabled()
+	} else if code == http.StatusBadRequest {
+		jsonErr(w, err.Error(), code)
+		return
+	}
+	var states []autostartState
+	for _, b := range autostart.Backends(runtime.GOOS, env) {
+		on, _ := b.Enabled()
+		states = append(states, autostartState{Name: b.Name(), Available: b.Available(), Enabled: on})
+	}
+	resp["backends"] = states
+	jsonOK(w, resp)
 }
 
-// EnableAutostart creates a Task Scheduler job to start the daemon at logon.
-// POST /autostart → 204 No Content
+// EnableAutostart godoc — POST /autostart
+// Registers this executable (mvaultd serve) with the selected backend.
 func (h *Handler) EnableAutostart(w http.ResponseWriter, r *http.Request) {
-	if runtime.GOOS != "windows" {
-		jsonErr(w, "auto-start is only supported on Windows", http.StatusNotImplemented)
+	b, code, err := autostartBackend(r)
+	if err != nil {
+		jsonErr(w, err.Error(), code)
 		return
 	}
-
 	exe, err := os.Executable()
 	if err != nil {
 		jsonErr(w, "cannot resolve executable path: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	exe, _ = filepath.Abs(exe)
-
-	// /F   — overwrite if task already exists
-	// /RL LIMITED — run without elevation (no UAC prompt)
-	out, err := exec.Command("schtasks", "/Create",
-		"/F", "/TN", taskName,
-		"/TR", `"`+exe+`"`,
-		"/SC", "ONLOGON",
-		"/RL", "LIMITED",
-	).CombinedOutput()
-	if err != nil {
-		jsonErr(w, "schtasks: "+string(out), http.StatusInternalServerError)
+	if err := b.Enable([]string{exe, "serve"}); err != nil {
+		jsonErr(w, b.Name()+": "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// DisableAutostart removes the Task Scheduler logon job (idempotent).
-// DELETE /autostart → 204 No Content
+// DisableAutostart godoc — DELETE /autostart
+// Removes the registration (idempotent).
 func (h *Handler) DisableAutostart(w http.ResponseWriter, r *http.Request) {
-	if runtime.GOOS != "windows" {
-		jsonErr(w, "auto-start is only supported on Windows", http.StatusNotImplemented)
-		return
-	}
-
-	if !isTaskRegistered() {
-		w.WriteHeader(http.StatusNoContent) // Already removed — idempotent
+	b, code, err := autostartBackend(r)
+	if err != nil {
+		jsonErr(w, err.Error(), code)
 		return
 	}
-
-	out, err := exec.Command("schtasks", "/Delete", "/TN", taskName, "/F").CombinedOutput()
-	if err != nil {
-		jsonErr(w, "schtasks: "+string(out), http.StatusInternalServerError)
+	if err := b.Disable(); err != nil {
+		jsonErr(w, b.Name()+": "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-
 	w.WriteHeader(http.StatusNoContent)
 }
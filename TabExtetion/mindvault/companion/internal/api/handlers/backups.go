@@ -0,0 +1,68 @@
+// Package handlers — backups.go
+// Backup inspection and selective restore.
+//
+// Endpoints:
+//   GET  /backups/status                        → BackupStatus (scheduler, policy, next run, last result)
+//   GET  /backups/{filename}/summary             → BackupSummary (per-library counts)
+//   GET  /backups/{filename}/diff[?libId=&limit=] → BackupDiff vs the live DB
+//   POST /backups/{filename}/restore             → SelectiveRestoreResult
+//
+// The full-replace restore stays at POST /restore/{filename}.
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/mindvault/companion/internal/db"
+)
+
+// BackupStatus godoc — GET /backups/status
+// Reports the backup scheduler's interval, retention policy, next run and last result.
+func (h *Handler) BackupStatus(w http.ResponseWriter, r *http.Request) {
+	jsonOK(w, h.db.BackupStatus())
+}
+
+// BackupSummary godoc — GET /backups/{filename}/summary
+// Shows what a backup contains before restoring it.
+func (h *Handler) BackupSummary(w http.ResponseWriter, r *http.Request) {
+	sum, err := h.db.BackupSummary(r.PathValue("filename"))
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, sum)
+}
+
+// BackupDiff godoc — GET /backups/{filename}/diff?libId=&limit=
+// Lists entities only in the backup (deleted since), only in the live DB
+// (created since) or changed. limit caps the entries list (default 500);
+// counts are always complete.
+func (h *Handler) BackupDiff(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	diff, err := h.db.DiffBackup(r.PathValue("filename"), r.URL.Query().Get("libId"), limit)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, diff)
+}
+
+// RestoreSelected godoc — POST /backups/{filename}/restore
+// Body: { "libraryIds": ["…"], "sessionIds": ["…"] }. Replaces only the chosen
+// libraries / sessions with their backup state; a pre-restore backup is taken first.
+func (h *Handler) RestoreSelected(w http.ResponseWriter, r *http.Request) {
+	var req db.RestoreSelection
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := h.db.RestoreSelected(r.PathValue("filename"), req)
+	if err != nil {
+		jsonErr(w, "restore failed: "+err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, res)
+}
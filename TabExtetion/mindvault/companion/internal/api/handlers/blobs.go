@@ -0,0 +1,75 @@
+// Package handlers — blobs.go
+// Sync of zero-knowledge libraries (see db/library_blobs.go): the extension
+// pushes and pulls client-encrypted blobs the companion cannot read.
+//
+// Endpoints:
+//   POST /libraries/{id}/blobs        { "blobs": [Blob…] }          → BlobPushResult
+//   GET  /libraries/{id}/blobs?cursor=&limit=                       → BlobPage
+//   GET  /libraries/{id}/blobs/{blobId}                             → Blob
+//
+// Blob.data is base64 in JSON and comes back byte-for-byte as pushed. A
+// library that is not zero-knowledge answers 400.
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/mindvault/companion/internal/db"
+)
+
+// pushBlobsReq is the JSON body for POST /libraries/{id}/blobs.
+type pushBlobsReq struct {
+	Blobs []db.Blob `json:"blobs"`
+}
+
+// PushBlobs godoc — POST /libraries/{id}/blobs
+// Upserts blobs last-writer-wins on updatedAt; deleted=true stores a tombstone.
+// IDs whose stored copy is newer are returned under "stale".
+func (h *Handler) PushBlobs(w http.ResponseWriter, r *http.Request) {
+	var req pushBlobsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := h.db.PushBlobs(r.PathValue("id"), req.Blobs)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, res)
+}
+
+// ListBlobs godoc — GET /libraries/{id}/blobs
+// Query params: ?cursor=n — the previous page's cursor (omit for a full
+// pull); ?limit=n (default 500).
+func (h *Handler) ListBlobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var cursor int64
+	if s := q.Get("cursor"); s != "" {
+		var err error
+		if cursor, err = strconv.ParseInt(s, 10, 64); err != nil {
+			jsonErr(w, "cursor must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	page, err := h.db.ListBlobs(r.PathValue("id"), cursor, limit)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, page)
+}
+
+// GetBlob godoc — GET /libraries/{id}/blobs/{blobId}
+func (h *Handler) GetBlob(w http.ResponseWriter, r *http.Request) {
+	b, err := h.db.GetBlob(r.PathValue("id"), r.PathValue("blobId"))
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, b)
+}
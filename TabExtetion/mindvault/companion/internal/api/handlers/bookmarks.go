@@ -0,0 +1,160 @@
+// Package handlers — bookmarks.go
+// Bookmark folder-tree endpoints: nested listing, reorder, subtree move/copy/export.
+//
+// Endpoints:
+//   GET  /libraries/{libId}/bookmarks/tree[?parent=id] → []BookmarkNode
+//   POST /libraries/{libId}/bookmarks/reorder          → 204
+//   POST /libraries/{libId}/bookmarks/{id}/move        → Bookmark
+//   POST /libraries/{libId}/bookmarks/{id}/copy        → BookmarkNode (new IDs)
+//   GET  /libraries/{libId}/bookmarks/{id}/export      → JSON tree or Netscape HTML
+//
+// Moves and copies into the node itself or any descendant are rejected (400).
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/mindvault/companion/internal/db"
+)
+
+// BookmarkTree godoc — GET /libraries/{libId}/bookmarks/tree
+// Query params: ?parent=id — return only the subtree rooted at that folder.
+func (h *Handler) BookmarkTree(w http.ResponseWriter, r *http.Request) {
+	libID := r.PathValue("libId")
+	tree, err := h.db.BookmarkTree(libID, r.URL.Query().Get("parent"))
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, tree)
+}
+
+// reorderBookmarksReq is the JSON body for POST …/bookmarks/reorder.
+// { "parentId": "folder-id" | null, "order": ["id3","id1","id2"] }
+type reorderBookmarksReq struct {
+	ParentID *string  `json:"parentId"`
+	Order    []string `json:"order"`
+}
+
+// ReorderBookmarks godoc — POST /libraries/{libId}/bookmarks/reorder
+// Sets sort_order for every child of parentId (null = root). Returns 204.
+func (h *Handler) ReorderBookmarks(w http.ResponseWriter, r *http.Request) {
+	libID := r.PathValue("libId")
+	var req reorderBookmarksReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db.ReorderBookmarks(libID, req.ParentID, req.Order); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// placeBookmarkReq is the JSON body for …/move and …/copy.
+// { "parentId": "folder-id" | null, "index": 0 } — index omitted = append.
+type placeBookmarkReq struct {
+	ParentID *string `json:"parentId"`
+	Index    *int    `json:"index"`
+}
+
+// index returns the requested position, or -1 (append) when omitted.
+func (p placeBookmarkReq) index() int {
+	if p.Index == nil {
+		return -1
+	}
+	return *p.Index
+}
+
+// MoveBookmark godoc — POST /libraries/{libId}/bookmarks/{id}/move
+// Re-parents a bookmark or folder (with its subtree). Returns the moved bookmark.
+func (h *Handler) MoveBookmark(w http.ResponseWriter, r *http.Request) {
+	libID, id := r.PathValue("libId"), r.PathValue("id")
+	var req placeBookmarkReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := h.db.MoveBookmark(libID, id, req.ParentID, req.index())
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, b)
+}
+
+// CopyBookmark godoc — POST /libraries/{libId}/bookmarks/{id}/copy
+// Deep-copies a bookmark or folder subtree with fresh IDs. Returns the new subtree.
+func (h *Handler) CopyBookmark(w http.ResponseWriter, r *http.Request) {
+	libID, id := r.PathValue("libId"), r.PathValue("id")
+	var req placeBookmarkReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	node, err := h.db.CopyBookmark(libID, id, req.ParentID, req.index(), generateID)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, node)
+}
+
+// ExportBookmarks godoc — GET /libraries/{libId}/bookmarks/{id}/export?format=json|html
+// json (default): the nested subtree. html: Netscape bookmark file that every
+// browser's "Import bookmarks" dialog accepts.
+func (h *Handler) ExportBookmarks(w http.ResponseWriter, r *http.Request) {
+	libID, id := r.PathValue("libId"), r.PathValue("id")
+	tree, err := h.db.BookmarkTree(libID, id)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		jsonOK(w, tree[0])
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="bookmarks.html"`)
+		_, _ = w.Write([]byte(netscapeBookmarks(tree)))
+	default:
+		jsonErr(w, "format must be json or html", http.StatusBadRequest)
+	}
+}
+
+// netscapeBookmarks renders nodes in the NETSCAPE-Bookmark-file-1 format.
+// ADD_DATE is Unix seconds as browsers expect.
+func netscapeBookmarks(nodes []*db.BookmarkNode) string {
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE NETSCAPE-Bookmark-file-1>\n")
+	sb.WriteString(`<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">` + "\n")
+	sb.WriteString("<TITLE>Bookmarks</TITLE>\n<H1>Bookmarks</H1>\n<DL><p>\n")
+	var walk func(ns []*db.BookmarkNode, depth int)
+	walk = func(ns []*db.BookmarkNode, depth int) {
+		pad := strings.Repeat("    ", depth)
+		for _, n := range ns {
+			if n.IsFolder {
+				fmt.Fprintf(&sb, "%s<DT><H3 ADD_DATE=\"%d\">%s</H3>\n%s<DL><p>\n",
+					pad, n.CreatedAt/1000, html.EscapeString(n.Title), pad)
+				walk(n.Children, depth+1)
+				fmt.Fprintf(&sb, "%s</DL><p>\n", pad)
+				continue
+			}
+			url := ""
+			if n.URL != nil {
+				url = *n.URL
+			}
+			fmt.Fprintf(&sb, "%s<DT><A HREF=\"%s\" ADD_DATE=\"%d\">%s</A>\n",
+				pad, html.EscapeString(url), n.CreatedAt/1000, html.EscapeString(n.Title))
+		}
+	}
+	walk(nodes, 1)
+	sb.WriteString("</DL><p>\n")
+	return sb.String()
+}
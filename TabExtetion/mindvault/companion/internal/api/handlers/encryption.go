@@ -0,0 +1,173 @@
+// Package handlers — encryption.go
+// Unlocking encrypted libraries (see db/library_crypto.go).
+//
+// Endpoints:
+//   POST /libraries/{id}/unlock  { "password": "…" }                       → UnlockStatus
+//   POST /libraries/{id}/lock                                              → UnlockStatus (key dropped)
+//   GET  /libraries/{id}/lock                                              → UnlockStatus
+//   POST /libraries/{id}/rekey   { "oldPassword": "…", "newPassword": "…" } → 202 Job
+//   POST /libraries/{id}/verify-key { "encryptionKeyHash": "…" }           → { "valid": bool }
+//   GET  /libraries/{id}/audit?limit=                                      → []AuditEntry
+//   GET  /jobs, GET /jobs/{id}                                             → Job progress
+//
+// While an encrypted library is locked its list, search and write endpoints
+// answer 423 Locked. A key is dropped after the idle timeout without use.
+// Unlocks (also failed ones), locks and rekeys are written to the audit log.
+
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/mindvault/companion/internal/db"
+)
+
+// unlockLibraryReq is the JSON body for POST /libraries/{id}/unlock.
+type unlockLibraryReq struct {
+	Password string `json:"password"`
+}
+
+// UnlockLibrary godoc — POST /libraries/{id}/unlock
+// Derives the library key from the password, verifies it against the stored
+// key hash and keeps it in memory.
+// 400 on a wrong password or a library that is not encrypted.
+func (h *Handler) UnlockLibrary(w http.ResponseWriter, r *http.Request) {
+	var req unlockLibraryReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	st, err := h.db.UnlockLibrary(r.PathValue("id"), req.Password)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, st)
+}
+
+// verifyKeyReq is the JSON body for POST /libraries/{id}/verify-key.
+type verifyKeyReq struct {
+	EncryptionKeyHash string `json:"encryptionKeyHash"`
+}
+
+// VerifyKey godoc — POST /libraries/{id}/verify-key
+// Checks the extension's key hash of a zero-knowledge library against the
+// stored one; the stored value itself is never returned. 400 for a library
+// that is not zero-knowledge or has no key hash.
+func (h *Handler) VerifyKey(w http.ResponseWriter, r *http.Request) {
+	var req verifyKeyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ok, err := h.db.VerifyKeyHash(r.PathValue("id"), req.EncryptionKeyHash)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, map[string]bool{"valid": ok})
+}
+
+// LockLibrary godoc — POST /libraries/{id}/lock
+// Forgets the library key immediately.
+func (h *Handler) LockLibrary(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.LockLibrary(r.PathValue("id")); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	h.LibraryLockStatus(w, r)
+}
+
+// LibraryLockStatus godoc — GET /libraries/{id}/lock
+// Reports whether the library is encrypted and currently unlocked.
+func (h *Handler) LibraryLockStatus(w http.ResponseWriter, r *http.Request) {
+	st, err := h.db.LibraryLockStatus(r.PathValue("id"))
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, st)
+}
+
+// rekeyLibraryReq is the JSON body for POST /libraries/{id}/rekey.
+type rekeyLibraryReq struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// RekeyLibrary godoc — POST /libraries/{id}/rekey
+// Verifies the old password, then re-encrypts the library under the new one
+// in a background job. Responds 202 with the job; poll GET /jobs/{id}.
+// Other requests wait while the job's transaction runs.
+func (h *Handler) RekeyLibrary(w http.ResponseWriter, r *http.Request) {
+	var req rekeyLibraryReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	job, err := h.db.RekeyLibrary(r.PathValue("id"), req.OldPassword, req.NewPassword)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// LibraryAudit godoc — GET /libraries/{id}/audit
+// Query params: ?limit=n — newest n entries (default 100).
+func (h *Handler) LibraryAudit(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	entries, err := h.db.ListAuditLog(r.PathValue("id"), limit)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, entries)
+}
+
+// restrictedKey carries the libraries of a library-restricted token.
+type restrictedKey struct{}
+
+// WithLibraries marks a request as made by a token restricted to libs; the
+// job routes then show only those libraries' jobs.
+func WithLibraries(ctx context.Context, libs []string) context.Context {
+	return context.WithValue(ctx, restrictedKey{}, libs)
+}
+
+// jobVisible reports whether the request's token may see j.
+func jobVisible(r *http.Request, j db.Job) bool {
+	libs, ok := r.Context().Value(restrictedKey{}).([]string)
+	return !ok || (j.LibraryID != "" && slices.Contains(libs, j.LibraryID))
+}
+
+// ListJobs godoc — GET /jobs
+// Running and recently finished background jobs, newest first; for a
+// library-restricted token only those of its libraries.
+func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := slices.DeleteFunc(h.db.ListJobs(), func(j db.Job) bool { return !jobVisible(r, j) })
+	jsonOK(w, jobs)
+}
+
+// GetJob godoc — GET /jobs/{id}
+// Progress of one background job; 404 once it has been forgotten, or when
+// it belongs to a library the token may not access.
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, err := h.db.Job(r.PathValue("id"))
+	if err == nil && !jobVisible(r, *job) {
+		err = fmt.Errorf("job %s: %w", r.PathValue("id"), sql.ErrNoRows)
+	}
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, job)
+}
@@ -3,14 +3,16 @@ package handlers
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
-	"strconv"
 	"sync"
 	"time"
 
+	"github.com/mindvault/companion/internal/auth"
 	"github.com/mindvault/companion/internal/db"
 )
 
@@ -36,20 +38,14 @@ const daemonVersion = "0.1.0"
 
 // Handler holds shared dependencies for all HTTP handlers.
 type Handler struct {
-	db    *db.DB
-	token string
+	db   *db.DB
+	pair *auth.Pairer
 }
 
-// New creates a Handler with the given database and auth token.
-func New(database *db.DB, token string) *Handler {
-	return &Handler{db: database, token: token}
-}
-
-// GetToken godoc — GET /token (no auth — localhost only, used by extension to bootstrap)
-// Returns the current auth token so the extension can authenticate subsequent requests.
-// Security: companion only binds to 127.0.0.1 so only local processes can reach this.
-func (h *Handler) GetToken(w http.ResponseWriter, r *http.Request) {
-	jsonOK(w, map[string]string{"token": h.token})
+// New creates a Handler with the given database and the pairer that issues
+// tokens to new clients (see pairing.go).
+func New(database *db.DB, pairer *auth.Pairer) *Handler {
+	return &Handler{db: database, pair: pairer}
 }
 
 // jsonOK writes a JSON 200 response. Logs encoding errors (client may have disconnected).
@@ -57,7 +53,7 @@ func jsonOK(w http.ResponseWriter, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(v); err != nil {
-		log.Printf("[warn] jsonOK encode: %v", err)
+		slog.Warn("jsonOK encode", "err", err)
 	}
 }
 
@@ -66,7 +62,7 @@ func jsonErr(w http.ResponseWriter, msg string, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(map[string]string{"error": msg}); err != nil {
-		log.Printf("[warn] jsonErr encode: %v", err)
+		slog.Warn("jsonErr encode", "err", err)
 	}
 }
 
@@ -74,6 +70,7 @@ func jsonErr(w http.ResponseWriter, msg string, code int) {
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 	jsonOK(w, map[string]string{
 		"status":  "ok",
+		"service": "mvaultd", // lets clients probing a port range recognise the daemon
 		"version": daemonVersion,
 	})
 }
@@ -95,11 +92,17 @@ func (h *Handler) ListLibraries(w http.ResponseWriter, r *http.Request) {
 
 // createLibraryReq is the JSON body for POST /libraries.
 type createLibraryReq struct {
-	ID           string  `json:"id,omitempty"`           // optional — use IDB ID for sync
+	ID           string  `json:"id,omitempty"` // optional — use IDB ID for sync
 	Name         string  `json:"name"`
 	Description  *string `json:"description,omitempty"`
 	IsEncrypted  bool    `json:"isEncrypted"`
 	PasswordSalt *string `json:"passwordSalt,omitempty"`
+	// ZeroKnowledge: the extension encrypts everything and syncs opaque blobs
+	// via /libraries/{id}/blobs. Implies isEncrypted.
+	ZeroKnowledge bool `json:"zeroKnowledge,omitempty"`
+	// EncryptionKeyHash: the extension's key check value; stored for
+	// zero-knowledge libraries only (the companion computes its own).
+	EncryptionKeyHash *string `json:"encryptionKeyHash,omitempty"`
 }
 
 // idOrNew returns req.ID if non-empty, otherwise generates a new random ID.
@@ -123,13 +126,15 @@ func (h *Handler) CreateLibrary(w http.ResponseWriter, r *http.Request) {
 	}
 	now := time.Now().UnixMilli()
 	lib := db.Library{
-		ID:           idOrNew(req.ID),
-		Name:         req.Name,
-		Description:  req.Description,
-		CreatedAt:    now,
-		UpdatedAt:    now,
-		IsEncrypted:  req.IsEncrypted,
-		PasswordSalt: req.PasswordSalt,
+		ID:            idOrNew(req.ID),
+		Name:          req.Name,
+		Description:   req.Description,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		IsEncrypted:   req.IsEncrypted || req.ZeroKnowledge,
+		PasswordSalt:  req.PasswordSalt,
+		ZeroKnowledge: req.ZeroKnowledge,
+		KeyHash:       req.EncryptionKeyHash,
 	}
 	if err := h.db.CreateLibrary(lib); err != nil {
 		jsonErr(w, err.Error(), http.StatusInternalServerError)
@@ -184,14 +189,33 @@ func (h *Handler) DeleteLibrary(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// MergeLibrary godoc — POST /libraries/{id}/merge-into/{targetId}
+// Moves every session, tab, bookmark tree, history entry, download and tag from
+// library {id} into {targetId}, resolving tag-name and history-URL collisions,
+// then deletes {id}. Returns per-entity move counts.
+func (h *Handler) MergeLibrary(w http.ResponseWriter, r *http.Request) {
+	res, err := h.db.MergeLibraries(r.PathValue("id"), r.PathValue("targetId"))
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, res)
+}
+
 // ListSessions godoc — GET /libraries/{libId}/sessions
-// Query params: ?archived=true — include archived sessions (default: omit archived).
+// Query params: ?archived=true — include archived sessions (default: omit archived);
+// ?unsorted=true — append the virtual "Unsorted" session when orphaned tabs exist.
 func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
 	libID := r.PathValue("libId")
 	includeArchived := r.URL.Query().Get("archived") == "true"
 	sessions, err := h.db.ListSessions(libID, includeArchived)
 	if err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	sessions, err = h.withUnsorted(r, libID, sessions)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, sessions)
@@ -199,23 +223,42 @@ func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
 
 // ListAllSessions godoc — GET /sessions
 // Returns sessions across ALL libraries merged (master view). Newest first.
-// Query params: ?archived=true to include archived sessions.
+// Query params: ?archived=true to include archived sessions; ?unsorted=true as above.
 func (h *Handler) ListAllSessions(w http.ResponseWriter, r *http.Request) {
 	includeArchived := r.URL.Query().Get("archived") == "true"
 	sessions, err := h.db.ListAllSessions(includeArchived)
 	if err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	sessions, err = h.withUnsorted(r, "", sessions)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, sessions)
 }
 
+// withUnsorted appends the virtual "Unsorted" session (libID "" = all
+// libraries) when ?unsorted=true and at least one orphaned tab exists.
+// Opt-in so extension sync never mistakes it for a real session.
+func (h *Handler) withUnsorted(r *http.Request, libID string, sessions []db.Session) ([]db.Session, error) {
+	if r.URL.Query().Get("unsorted") != "true" {
+		return sessions, nil
+	}
+	u, err := h.db.UnsortedSession(libID)
+	if err != nil || u.TabCount == 0 {
+		return sessions, err
+	}
+	return append(sessions, *u), nil
+}
+
 // ListAllTabs godoc — GET /tabs
 // Returns saved_tabs across ALL libraries merged (master "All Tabs" view). Newest first.
 func (h *Handler) ListAllTabs(w http.ResponseWriter, r *http.Request) {
 	tabs, err := h.db.ListAllTabs()
 	if err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, tabs)
@@ -223,7 +266,7 @@ func (h *Handler) ListAllTabs(w http.ResponseWriter, r *http.Request) {
 
 // createSessionReq is the JSON body for POST /libraries/{libId}/sessions.
 // sourceBrowser: the browser that saved this session ("Chrome", "Firefox", etc.).
-//   Used to auto-rename "Default Library" → "Default (Chrome)" on first push.
+// Used to auto-rename "Default Library" → "Default (Chrome)" on first push.
 type createSessionReq struct {
 	ID            string `json:"id,omitempty"` // optional — use IDB ID for sync
 	Name          string `json:"name"`
@@ -262,7 +305,7 @@ func (h *Handler) CreateSession(w http.ResponseWriter, r *http.Request) {
 		SourceBrowser: req.SourceBrowser,
 	}
 	if err := h.db.CreateSession(session); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	// Auto-rename on push from a known browser.
@@ -300,8 +343,8 @@ func (h *Handler) PatchSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	patch := db.SessionPatch{Name: req.Name, Archived: req.Archived}
-	if err := h.db.UpdateSession(id, patch); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+	if err := h.db.UpdateSession(r.PathValue("libId"), id, patch); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -310,29 +353,114 @@ func (h *Handler) PatchSession(w http.ResponseWriter, r *http.Request) {
 // DeleteSession godoc — DELETE /libraries/{libId}/sessions/{id}
 // Default: session row deleted; its saved_tabs remain with session_id=NULL.
 // ?deleteTabs=true: hard-deletes session AND all its saved_tabs in one transaction.
-//   Use ?deleteTabs=true for the "Delete all data" context menu action in the UI.
+// Use ?deleteTabs=true for the "Delete all data" context menu action in the UI.
 func (h *Handler) DeleteSession(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
+	libID, id := r.PathValue("libId"), r.PathValue("id")
 	if r.URL.Query().Get("deleteTabs") == "true" {
-		if err := h.db.DeleteSessionWithTabs(id); err != nil {
-			jsonErr(w, err.Error(), http.StatusInternalServerError)
+		if err := h.db.DeleteSessionWithTabs(libID, id); err != nil {
+			jsonErr(w, err.Error(), dbErrStatus(err))
 			return
 		}
 	} else {
-		if err := h.db.DeleteSession(id); err != nil {
-			jsonErr(w, err.Error(), http.StatusInternalServerError)
+		if err := h.db.DeleteSession(libID, id); err != nil {
+			jsonErr(w, err.Error(), dbErrStatus(err))
 			return
 		}
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// dbErrStatus maps a db-layer error to an HTTP status:
+// sql.ErrNoRows → 404, db.ErrInvalid → 400, db.ErrConflict → 409, db.ErrLocked → 423,
+// anything else → 500. Bare constraint violations count as the error db.ConstraintKind names.
+func dbErrStatus(err error) int {
+	if kind := db.ConstraintKind(err); kind != nil {
+		err = kind
+	}
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrLocked):
+		return http.StatusLocked
+	}
+	return http.StatusInternalServerError
+}
+
+// mergeSessionsReq is the JSON body for POST /sessions:merge.
+// { "sessionIds": ["a","b","c"], "name": "Work (restored)", "libraryId": "" }
+type mergeSessionsReq struct {
+	ID         string   `json:"id,omitempty"` // optional — ID for the merged session
+	SessionIDs []string `json:"sessionIds"`
+	Name       string   `json:"name"`      // "" = first session's name
+	LibraryID  string   `json:"libraryId"` // "" = first session's library
+}
+
+// MergeSessions godoc — POST /sessions:merge
+// Combines N sessions (any library, any source browser) into one new session.
+// Tabs are deduplicated by URL, notes are concatenated, sources are removed.
+// Returns the merged session plus the recorded browser set.
+func (h *Handler) MergeSessions(w http.ResponseWriter, r *http.Request) {
+	var req mergeSessionsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.SessionIDs) < 2 {
+		jsonErr(w, "sessionIds must list at least two sessions", http.StatusBadRequest)
+		return
+	}
+	res, err := h.db.MergeSessions(db.MergeSessionsOpts{
+		SessionIDs: req.SessionIDs,
+		NewID:      idOrNew(req.ID),
+		Name:       req.Name,
+		LibraryID:  req.LibraryID,
+	})
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, res)
+}
+
+// splitSessionReq is the JSON body for POST /sessions/{id}/split.
+// { "tabIds": ["t1","t2"], "name": "Research" }
+type splitSessionReq struct {
+	ID     string   `json:"id,omitempty"` // optional — ID for the new session
+	TabIDs []string `json:"tabIds"`
+	Name   string   `json:"name"` // "" = "<source name> (split)"
+}
+
+// SplitSession godoc — POST /sessions/{id}/split
+// Moves the chosen tabs into a new session in the same library. Tab IDs are kept.
+func (h *Handler) SplitSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req splitSessionReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.TabIDs) == 0 {
+		jsonErr(w, "tabIds is required", http.StatusBadRequest)
+		return
+	}
+	res, err := h.db.SplitSession(id, idOrNew(req.ID), req.Name, req.TabIDs, generateID)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, res)
+}
+
 // ListTabs godoc — GET /libraries/{libId}/tabs
 func (h *Handler) ListTabs(w http.ResponseWriter, r *http.Request) {
 	libID := r.PathValue("libId")
 	tabs, err := h.db.ListTabs(libID)
 	if err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, tabs)
@@ -347,6 +475,10 @@ type createTabReq struct {
 	FavIconURL *string `json:"favIconUrl,omitempty"`
 	Notes      string  `json:"notes"`
 	Colour     *string `json:"colour,omitempty"`
+	WindowID   *string `json:"windowId,omitempty"` // window / group placement (migration 004)
+	GroupID    *string `json:"groupId,omitempty"`
+	Index      int     `json:"index"`
+	IsPinned   bool    `json:"isPinned"`
 }
 
 // CreateTab godoc — POST /libraries/{libId}/tabs
@@ -376,9 +508,13 @@ func (h *Handler) CreateTab(w http.ResponseWriter, r *http.Request) {
 		SavedAt:    time.Now().UnixMilli(),
 		Notes:      req.Notes,
 		Colour:     req.Colour,
+		WindowID:   req.WindowID,
+		GroupID:    req.GroupID,
+		TabIndex:   req.Index,
+		IsPinned:   req.IsPinned,
 	}
 	if err := h.db.CreateTab(tab); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, tab)
@@ -386,9 +522,9 @@ func (h *Handler) CreateTab(w http.ResponseWriter, r *http.Request) {
 
 // DeleteTab godoc — DELETE /libraries/{libId}/tabs/{id}
 func (h *Handler) DeleteTab(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
-	if err := h.db.DeleteTab(id); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+	libID, id := r.PathValue("libId"), r.PathValue("id")
+	if err := h.db.DeleteTab(libID, id); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -397,12 +533,16 @@ func (h *Handler) DeleteTab(w http.ResponseWriter, r *http.Request) {
 // patchTabReq is the JSON body for PATCH /tabs/{id}.
 // All fields optional; nil = no change.
 type patchTabReq struct {
-	Notes *string `json:"notes"` // updated notes text
+	Notes    *string `json:"notes"`    // updated notes text
+	IsPinned *bool   `json:"isPinned"` // pin / unpin
+	WindowID *string `json:"windowId"` // "" = detach from window
+	GroupID  *string `json:"groupId"`  // "" = ungroup
+	Index    *int    `json:"index"`    // position inside the window
 }
 
 // PatchTab godoc — PATCH /tabs/{id}
-// Updates notes on a saved tab (no library context required).
-// Body: { "notes": "..." }. Returns 204 No Content on success.
+// Updates notes and/or window placement on a saved tab (no library context required).
+// Body: { "notes"?, "isPinned"?, "windowId"?, "groupId"?, "index"? }. Returns 204 No Content on success.
 func (h *Handler) PatchTab(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	var req patchTabReq
@@ -410,8 +550,15 @@ func (h *Handler) PatchTab(w http.ResponseWriter, r *http.Request) {
 		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := h.db.UpdateTab(id, db.TabPatch{Notes: req.Notes}); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+	patch := db.TabPatch{
+		Notes:    req.Notes,
+		IsPinned: req.IsPinned,
+		WindowID: req.WindowID,
+		GroupID:  req.GroupID,
+		Index:    req.Index,
+	}
+	if err := h.db.UpdateTab(id, patch); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -422,8 +569,8 @@ func (h *Handler) PatchTab(w http.ResponseWriter, r *http.Request) {
 // Used by the companion All Tabs master view action button. Returns 204 No Content.
 func (h *Handler) DeleteTabByID(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	if err := h.db.DeleteTab(id); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+	if err := h.db.DeleteTab("", id); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -439,7 +586,7 @@ func (h *Handler) Search(w http.ResponseWriter, r *http.Request) {
 	libID := r.URL.Query().Get("libId") // empty = search all libraries
 	results, err := h.db.Search(libID, q)
 	if err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, results)
@@ -482,22 +629,19 @@ func (h *Handler) SyncDone(w http.ResponseWriter, r *http.Request) {
 	syncDoneAt = time.Now()
 	syncMu.Unlock()
 	jsonOK(w, map[string]any{
-		"ok":    true,
+		"ok":     true,
 		"doneAt": syncDoneAt.UTC().Format(time.RFC3339),
 	})
 }
 
 // ── Database Backup & Restore ─────────────────────────────────────────────────
 
-// CreateBackup godoc — POST /backup?retain=30
-// Creates a timestamped backup of the SQLite database in the backups directory.
-// The optional `retain` query param (days, default 30) triggers cleanup of older backups.
+// CreateBackup godoc — POST /backup
+// Creates a timestamped hot backup (VACUUM INTO) in the backups directory; the
+// response carries verified=true and the file's sha256 once integrity_check passed.
+// Older backups are then pruned with the configured retention policy.
 func (h *Handler) CreateBackup(w http.ResponseWriter, r *http.Request) {
-	retain, _ := strconv.Atoi(r.URL.Query().Get("retain"))
-	if retain <= 0 {
-		retain = 30
-	}
-	info, err := h.db.Backup(retain)
+	info, err := h.db.Backup()
 	if err != nil {
 		jsonErr(w, "backup failed: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -505,27 +649,36 @@ func (h *Handler) CreateBackup(w http.ResponseWriter, r *http.Request) {
 	jsonOK(w, info)
 }
 
-// ListBackups godoc — GET /backups
-// Returns all backup files sorted newest-first.
+// ListBackups godoc — GET /backups?target=
+// Returns all backup files sorted newest-first: the local backups directory by
+// default, or the copies on the named replica target (400 if unknown).
 func (h *Handler) ListBackups(w http.ResponseWriter, r *http.Request) {
-	list, err := h.db.ListBackups()
+	list, err := h.db.ListTargetBackups(r.Context(), r.URL.Query().Get("target"))
 	if err != nil {
-		jsonErr(w, "list backups failed: "+err.Error(), http.StatusInternalServerError)
+		jsonErr(w, "list backups failed: "+err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, list)
 }
 
 // RestoreBackup godoc — POST /restore/{filename}
-// Replaces the live database with the named backup file and reopens the connection.
-// The HTTP server keeps running; callers should reload the UI after restore.
+// Validates the named backup, snapshots the current database as a
+// "pre-restore" backup, drains in-flight requests, swaps the file in and
+// migrates it. A corrupt or too-new backup is rejected with 400; on any later
+// failure the pre-restore file is put back. The HTTP server keeps running;
+// callers should reload the UI after restore.
 func (h *Handler) RestoreBackup(w http.ResponseWriter, r *http.Request) {
 	filename := r.PathValue("filename")
-	if err := h.db.Restore(filename); err != nil {
-		jsonErr(w, "restore failed: "+err.Error(), http.StatusInternalServerError)
+	pre, err := h.db.Restore(filename)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrInvalid) {
+			status = http.StatusBadRequest
+		}
+		jsonErr(w, "restore failed: "+err.Error(), status)
 		return
 	}
-	jsonOK(w, map[string]any{"ok": true, "message": "Restore complete — refresh the page."})
+	jsonOK(w, map[string]any{"ok": true, "message": "Restore complete — refresh the page.", "preRestore": pre})
 }
 
 // DeleteBackup godoc — DELETE /backups/{filename}
@@ -546,20 +699,21 @@ func (h *Handler) ListBookmarks(w http.ResponseWriter, r *http.Request) {
 	libID := r.PathValue("libId")
 	items, err := h.db.ListBookmarks(libID)
 	if err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, items)
 }
 
 type createBookmarkReq struct {
-	ID       string  `json:"id,omitempty"`
-	ParentID *string `json:"parentId,omitempty"`
-	Title    string  `json:"title"`
-	URL      *string `json:"url,omitempty"`
-	Notes    string  `json:"notes"`
-	Colour   *string `json:"colour,omitempty"`
-	IsFolder bool    `json:"isFolder"`
+	ID        string  `json:"id,omitempty"`
+	ParentID  *string `json:"parentId,omitempty"`
+	Title     string  `json:"title"`
+	URL       *string `json:"url,omitempty"`
+	Notes     string  `json:"notes"`
+	Colour    *string `json:"colour,omitempty"`
+	IsFolder  bool    `json:"isFolder"`
+	SortOrder *int    `json:"sortOrder,omitempty"` // omitted = append after last sibling
 }
 
 // CreateBookmark godoc — POST /libraries/{libId}/bookmarks
@@ -589,8 +743,13 @@ func (h *Handler) CreateBookmark(w http.ResponseWriter, r *http.Request) {
 		CreatedAt: time.Now().UnixMilli(),
 		IsFolder:  req.IsFolder,
 	}
+	if req.SortOrder != nil {
+		b.SortOrder = *req.SortOrder
+	} else if next, err := h.db.NextBookmarkSortOrder(libID, req.ParentID); err == nil {
+		b.SortOrder = next
+	}
 	if err := h.db.CreateBookmark(b); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, b)
@@ -603,7 +762,7 @@ func (h *Handler) ListHistory(w http.ResponseWriter, r *http.Request) {
 	libID := r.PathValue("libId")
 	items, err := h.db.ListHistory(libID)
 	if err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, items)
@@ -652,7 +811,7 @@ func (h *Handler) CreateHistoryEntry(w http.ResponseWriter, r *http.Request) {
 		IsImportant: req.IsImportant,
 	}
 	if err := h.db.UpsertHistoryEntry(entry); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, entry)
@@ -665,7 +824,7 @@ func (h *Handler) ListDownloads(w http.ResponseWriter, r *http.Request) {
 	libID := r.PathValue("libId")
 	items, err := h.db.ListDownloads(libID)
 	if err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, items)
@@ -718,7 +877,7 @@ func (h *Handler) CreateDownload(w http.ResponseWriter, r *http.Request) {
 		Notes:        req.Notes,
 	}
 	if err := h.db.CreateDownload(dl); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	jsonOK(w, dl)
@@ -729,9 +888,9 @@ func (h *Handler) CreateDownload(w http.ResponseWriter, r *http.Request) {
 // DeleteBookmark godoc — DELETE /libraries/{libId}/bookmarks/{id}
 // Also removes child bookmarks via ON DELETE CASCADE in the schema.
 func (h *Handler) DeleteBookmark(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
-	if err := h.db.DeleteBookmark(id); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+	libID, id := r.PathValue("libId"), r.PathValue("id")
+	if err := h.db.DeleteBookmark(libID, id); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -739,9 +898,9 @@ func (h *Handler) DeleteBookmark(w http.ResponseWriter, r *http.Request) {
 
 // DeleteHistoryEntry godoc — DELETE /libraries/{libId}/history/{id}
 func (h *Handler) DeleteHistoryEntry(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
-	if err := h.db.DeleteHistoryEntry(id); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+	libID, id := r.PathValue("libId"), r.PathValue("id")
+	if err := h.db.DeleteHistoryEntry(libID, id); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -749,9 +908,9 @@ func (h *Handler) DeleteHistoryEntry(w http.ResponseWriter, r *http.Request) {
 
 // DeleteDownload godoc — DELETE /libraries/{libId}/downloads/{id}
 func (h *Handler) DeleteDownload(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
-	if err := h.db.DeleteDownload(id); err != nil {
-		jsonErr(w, err.Error(), http.StatusInternalServerError)
+	libID, id := r.PathValue("libId"), r.PathValue("id")
+	if err := h.db.DeleteDownload(libID, id); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
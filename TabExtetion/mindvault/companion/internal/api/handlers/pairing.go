@@ -0,0 +1,142 @@
+// Package handlers — pairing.go
+// Pairing handshake that issues per-client tokens (see auth/pairing.go).
+//
+// Endpoints:
+//   POST /pair  { "client": "…", "scope": "write", "libraries": [] }  → 202 { id, code, secret, expiresAt } (no auth)
+//   GET  /pair/{id}   X-MindVault-Pair-Secret: …                     → { state, code, expiresAt, token? } (no auth)
+//   GET  /pairings                                                    → []PairRequest (admin)
+//   POST /pairings/approve  { "code": "482-913", "scope": "write" }   → PairRequest (admin)
+//   POST /pairings/deny     { "code": "482-913" }                     → PairRequest (admin)
+//
+// The requesting client shows its code; the user approves the request whose
+// code matches in the dashboard or with `mvaultd pair approve CODE [SCOPE]`,
+// stating the scope granted. The token is returned once, on the first poll
+// after approval.
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/mindvault/companion/internal/auth"
+)
+
+// pairRequestReq is the JSON body for POST /pair.
+type pairRequestReq struct {
+	Client    string     `json:"client"`
+	Scope     auth.Scope `json:"scope"`
+	Libraries []string   `json:"libraries"`
+}
+
+// RequestPairing godoc — POST /pair (no auth)
+// Starts a pairing request. Responds 202 with the code to show the user and
+// the secret to poll GET /pair/{id} with. 429 when the peer address asked
+// too often.
+func (h *Handler) RequestPairing(w http.ResponseWriter, r *http.Request) {
+	var req pairRequestReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	pr, secret, err := h.pair.Request(req.Client, r.Header.Get("Origin"), peer, req.Scope, req.Libraries)
+	if errors.Is(err, auth.ErrPairRateLimited) {
+		w.Header().Set("Retry-After", strconv.Itoa(60))
+		jsonErr(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, auth.ErrPairQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(60))
+		jsonErr(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		jsonErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/pair/"+pr.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"id": pr.ID, "code": pr.Code, "secret": secret, "expiresAt": pr.ExpiresAt,
+	})
+}
+
+// PairingStatus godoc — GET /pair/{id} (no auth; X-MindVault-Pair-Secret)
+// Reports pending / approved / denied / expired. The approved response carries
+// the new token; afterwards the request is gone (404).
+func (h *Handler) PairingStatus(w http.ResponseWriter, r *http.Request) {
+	pr, token, err := h.pair.Poll(r.PathValue("id"), r.Header.Get("X-MindVault-Pair-Secret"))
+	if errors.Is(err, auth.ErrPairNotFound) {
+		jsonErr(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"state": pr.State, "code": pr.Code, "expiresAt": pr.ExpiresAt}
+	if token != "" {
+		resp["token"] = token
+	}
+	jsonOK(w, resp)
+}
+
+// ListPairings godoc — GET /pairings
+// Pairing requests waiting for approval, oldest first.
+func (h *Handler) ListPairings(w http.ResponseWriter, r *http.Request) {
+	jsonOK(w, h.pair.Pending())
+}
+
+// pairDecisionReq is the JSON body for POST /pairings/approve and /deny.
+type pairDecisionReq struct {
+	Code  string     `json:"code"`
+	Scope auth.Scope `json:"scope"` // approve only: the scope granted
+}
+
+// ApprovePairing godoc — POST /pairings/approve
+// Approves the pending request showing the code the user entered with the
+// stated scope: the requested one or narrower (400 otherwise, or if missing).
+// 404 if no pending request has that code.
+func (h *Handler) ApprovePairing(w http.ResponseWriter, r *http.Request) {
+	h.decidePairing(w, r, func(req pairDecisionReq) (auth.PairRequest, error) {
+		return h.pair.Approve(req.Code, req.Scope)
+	})
+}
+
+// DenyPairing godoc — POST /pairings/deny
+// Rejects the pending request showing the code.
+func (h *Handler) DenyPairing(w http.ResponseWriter, r *http.Request) {
+	h.decidePairing(w, r, func(req pairDecisionReq) (auth.PairRequest, error) {
+		return h.pair.Deny(req.Code)
+	})
+}
+
+func (h *Handler) decidePairing(w http.ResponseWriter, r *http.Request, decide func(pairDecisionReq) (auth.PairRequest, error)) {
+	var req pairDecisionReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pr, err := decide(req)
+	if errors.Is(err, auth.ErrPairNotFound) {
+		jsonErr(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, auth.ErrPairScope) {
+		jsonErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonOK(w, pr)
+}
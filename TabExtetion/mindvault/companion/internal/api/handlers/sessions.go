@@ -0,0 +1,221 @@
+// Package handlers — sessions.go
+// Session detail and window / tab-group structure endpoints.
+//
+// Endpoints:
+//   GET    /libraries/{libId}/sessions/{id}  → session + paginated tabs + stats
+//   GET    /sessions/{id}/tabs               → paginated tabs (?libId= optional)
+//   GET    /sessions/{id}                    → SessionDetail (windows → groups + tabs, looseTabs)
+//   POST   /sessions/{id}/windows            → SessionWindow
+//   DELETE /sessions/{id}/windows/{windowId} → 204 — tabs become loose
+//   POST   /sessions/{id}/groups             → TabGroup
+//   PATCH  /sessions/{id}/groups/{groupId}   → 204 — name / colour / collapsed
+//   DELETE /sessions/{id}/groups/{groupId}   → 204 — tabs become ungrouped
+//
+// Tabs are placed into windows/groups via windowId, groupId, index and
+// isPinned on POST /libraries/{libId}/tabs and PATCH /tabs/{id}.
+//
+// The reserved session ID "unsorted" addresses the virtual session holding
+// orphaned tabs (their session was deleted; DeleteSession keeps tabs).
+
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mindvault/companion/internal/db"
+)
+
+// pageParams reads ?limit=&offset= (defaults 100 / 0; limit capped at 500 by the db layer).
+func pageParams(r *http.Request) (limit, offset int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	return limit, offset
+}
+
+// sessionErrMsg is the error text for a failed session lookup.
+func sessionErrMsg(err error) string {
+	if errors.Is(err, sql.ErrNoRows) {
+		return "session not found"
+	}
+	return err.Error()
+}
+
+// librarySessionResp is the GET /libraries/{libId}/sessions/{id} response.
+type librarySessionResp struct {
+	Session *db.Session      `json:"session"`
+	Tabs    *db.TabPage      `json:"tabs"`
+	Stats   *db.SessionStats `json:"stats"`
+}
+
+// GetLibrarySession godoc — GET /libraries/{libId}/sessions/{id}?limit=&offset=
+// Returns the session, one page of its tabs (newest first) and statistics
+// computed over all of its tabs: domain breakdown, count by colour, pinned.
+func (h *Handler) GetLibrarySession(w http.ResponseWriter, r *http.Request) {
+	libID, id := r.PathValue("libId"), r.PathValue("id")
+	s, err := h.db.GetLibrarySession(libID, id)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	limit, offset := pageParams(r)
+	page, err := h.db.ListSessionTabsPage(libID, id, limit, offset)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	stats, err := h.db.SessionStats(libID, id)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, librarySessionResp{Session: s, Tabs: page, Stats: stats})
+}
+
+// ListSessionTabs godoc — GET /sessions/{id}/tabs?limit=&offset=&libId=
+// Paginated tabs of one session; replaces downloading ListAllTabs and
+// filtering by sessionId client-side.
+func (h *Handler) ListSessionTabs(w http.ResponseWriter, r *http.Request) {
+	libID, id := r.URL.Query().Get("libId"), r.PathValue("id")
+	if _, err := h.db.GetLibrarySession(libID, id); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	limit, offset := pageParams(r)
+	page, err := h.db.ListSessionTabsPage(libID, id, limit, offset)
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, page)
+}
+
+// GetSessionDetail godoc — GET /sessions/{id}
+// Returns the session with its windows nested (groups + ordered tabs per window).
+func (h *Handler) GetSessionDetail(w http.ResponseWriter, r *http.Request) {
+	detail, err := h.db.GetSessionDetail(r.PathValue("id"))
+	if err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, detail)
+}
+
+// createWindowReq is the JSON body for POST /sessions/{id}/windows.
+type createWindowReq struct {
+	ID        string `json:"id,omitempty"`        // optional — use extension ID for sync
+	SortOrder *int   `json:"sortOrder,omitempty"` // omitted = after the last window
+	Focused   bool   `json:"focused"`
+}
+
+// CreateWindow godoc — POST /sessions/{id}/windows
+func (h *Handler) CreateWindow(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	if _, err := h.db.GetSession(sessionID); err != nil {
+		jsonErr(w, sessionErrMsg(err), dbErrStatus(err))
+		return
+	}
+	var req createWindowReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	win := db.SessionWindow{
+		ID:        idOrNew(req.ID),
+		SessionID: sessionID,
+		Focused:   req.Focused,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if req.SortOrder != nil {
+		win.SortOrder = *req.SortOrder
+	} else if next, err := h.db.NextWindowSortOrder(sessionID); err == nil {
+		win.SortOrder = next
+	}
+	if err := h.db.CreateWindow(win); err != nil {
+		jsonErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonOK(w, win)
+}
+
+// DeleteWindow godoc — DELETE /sessions/{id}/windows/{windowId}
+func (h *Handler) DeleteWindow(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.DeleteWindow(r.PathValue("id"), r.PathValue("windowId")); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createTabGroupReq is the JSON body for POST /sessions/{id}/groups.
+// colour: grey|blue|red|yellow|green|pink|purple|cyan|orange (default grey).
+type createTabGroupReq struct {
+	ID        string  `json:"id,omitempty"`
+	WindowID  *string `json:"windowId,omitempty"`
+	Name      string  `json:"name"`
+	Colour    string  `json:"colour"`
+	Collapsed bool    `json:"collapsed"`
+}
+
+// CreateTabGroup godoc — POST /sessions/{id}/groups
+func (h *Handler) CreateTabGroup(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	if _, err := h.db.GetSession(sessionID); err != nil {
+		jsonErr(w, sessionErrMsg(err), dbErrStatus(err))
+		return
+	}
+	var req createTabGroupReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	colour := req.Colour
+	if colour == "" {
+		colour = "grey"
+	}
+	g := db.TabGroup{
+		ID:        idOrNew(req.ID),
+		SessionID: sessionID,
+		WindowID:  req.WindowID,
+		Name:      req.Name,
+		Colour:    colour,
+		Collapsed: req.Collapsed,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := h.db.CreateTabGroup(g); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	jsonOK(w, g)
+}
+
+// PatchTabGroup godoc — PATCH /sessions/{id}/groups/{groupId}
+// Body: { "name"?, "colour"?, "collapsed"? }. Returns 204 No Content.
+func (h *Handler) PatchTabGroup(w http.ResponseWriter, r *http.Request) {
+	var req db.TabGroupPatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErr(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db.UpdateTabGroup(r.PathValue("id"), r.PathValue("groupId"), req); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteTabGroup godoc — DELETE /sessions/{id}/groups/{groupId}
+func (h *Handler) DeleteTabGroup(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.DeleteTabGroup(r.PathValue("id"), r.PathValue("groupId")); err != nil {
+		jsonErr(w, err.Error(), dbErrStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
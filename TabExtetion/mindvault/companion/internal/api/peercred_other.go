@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+
+package api
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredSupported = false
+
+// peerUID is not available on this platform.
+func peerUID(*net.UnixConn) (int, error) {
+	return -1, errors.New("socket peer credentials are not supported on this platform")
+}
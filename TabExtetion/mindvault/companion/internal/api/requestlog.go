@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mindvault/companion/internal/logging"
+)
+
+// requestInfo collects what inner middleware learns about a request for the
+// request log; authMiddleware sets client.
+type requestInfo struct {
+	client string
+}
+
+type requestInfoKey struct{}
+
+// setRequestClient records the ID of the token that authenticated r.
+func setRequestClient(r *http.Request, id string) {
+	if ri, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		ri.client = id
+	}
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// requestLog logs one line per request: method, route pattern (so IDs in
+// paths do not make every line unique), path, status, latency and the ID of
+// the client's token. Tokens, search terms and other data are never logged:
+// headers are left out and query values redacted unless loggedParams lists
+// them. Successful requests log at logging.RequestLevel, 4xx at warn and 5xx
+// at error.
+func requestLog(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ri := &requestInfo{}
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, ri))
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := logging.RequestLevel()
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		ctx := r.Context()
+		if !slog.Default().Enabled(ctx, level) {
+			return
+		}
+		_, pattern := mux.Handler(r)
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", pattern),
+			slog.String("path", redactedPath(r.URL)),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if ri.client != "" {
+			attrs = append(attrs, slog.String("client", ri.client))
+		}
+		if o := r.Header.Get("Origin"); o != "" {
+			attrs = append(attrs, slog.String("origin", o))
+		}
+		slog.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
+
+// loggedParams are the query parameters whose values are logged as sent:
+// paging, filters and options that carry no library content or secrets.
+var loggedParams = map[string]bool{
+	"archived": true, "backend": true, "cursor": true, "deleteTabs": true,
+	"format": true, "level": true, "libId": true, "limit": true,
+	"offset": true, "parent": true, "since": true, "target": true,
+	"unsorted": true,
+}
+
+// redactedPath is u's path and query with every value loggedParams does not
+// list replaced, so search terms, URLs and credentials stay out of the log.
+func redactedPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	q := u.Query()
+	for k := range q {
+		if !loggedParams[k] {
+			q[k] = []string{"REDACTED"}
+		}
+	}
+	return u.Path + "?" + q.Encode()
+}
@@ -3,11 +3,14 @@ package api
 
 import (
 	"embed"
+	"encoding/json"
 	"io/fs"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/mindvault/companion/internal/api/handlers"
+	"github.com/mindvault/companion/internal/auth"
 	"github.com/mindvault/companion/internal/db"
 )
 
@@ -15,37 +18,90 @@ import (
 var uiFiles embed.FS
 
 // NewRouter creates and returns the main HTTP mux with all routes registered.
-func NewRouter(database *db.DB, token string) http.Handler {
+// tokens authenticates requests; pairer hands new clients their tokens;
+// origins is the CORS allowlist; features switches the dashboard and new
+// pairing requests on and off (nil = both on).
+func NewRouter(database *db.DB, tokens *auth.Store, pairer *auth.Pairer, origins *Origins, features *Features) http.Handler {
 	mux := http.NewServeMux()
+	if features == nil {
+		features = NewFeatures(true, true)
+	}
 
-	h := handlers.New(database, token)
+	h := handlers.New(database, pairer)
 
-	// Auth middleware wraps every route
-	protected := authMiddleware(token)
+	// Auth middleware wraps every route; drainMiddleware lets a restore wait
+	// for in-flight requests and hold off new ones while the DB is swapped.
+	// protected routes need the read scope for GET and write otherwise;
+	// admin routes (backup, restore, autostart, maintenance) need the admin scope.
+	authed := authMiddleware(tokens, "")
+	adminOnly := authMiddleware(tokens, auth.ScopeAdmin)
+	protected := func(next http.Handler) http.Handler {
+		return authed(drainMiddleware(database)(next))
+	}
+	admin := func(next http.Handler) http.Handler {
+		return adminOnly(drainMiddleware(database)(next))
+	}
+	// slow admin routes (backup, restore, export, import, vacuum, doctor) may
+	// outlast the server's read and write timeouts, waiting for the drain gate
+	// included.
+	slow := func(next http.Handler) http.Handler {
+		return adminOnly(longRunning(drainMiddleware(database)(next)))
+	}
 
-	// Health + token bootstrap (no auth required)
+	// Health (no auth required)
 	mux.HandleFunc("GET /health", h.Health)
 	mux.HandleFunc("GET /version", h.Version)
-	mux.HandleFunc("GET /token", h.GetToken) // extension fetches this on startup to bootstrap auth
+
+	// Pairing — a new client asks for a token (no auth), the user approves it
+	// by its code (admin); the client collects the token by polling.
+	mux.Handle("POST /pair", gate(features.pairing.Load, http.HandlerFunc(h.RequestPairing)))
+	mux.HandleFunc("GET /pair/{id}", h.PairingStatus)
+	mux.Handle("GET /pairings", adminOnly(http.HandlerFunc(h.ListPairings)))
+	mux.Handle("POST /pairings/approve", adminOnly(http.HandlerFunc(h.ApprovePairing)))
+	mux.Handle("POST /pairings/deny", adminOnly(http.HandlerFunc(h.DenyPairing)))
 
 	// Libraries
 	mux.Handle("GET /libraries", protected(http.HandlerFunc(h.ListLibraries)))
 	mux.Handle("POST /libraries", protected(http.HandlerFunc(h.CreateLibrary)))
-	mux.Handle("GET /libraries/{id}",    protected(http.HandlerFunc(h.GetLibrary)))
-	mux.Handle("PATCH /libraries/{id}",  protected(http.HandlerFunc(h.PatchLibrary)))
+	mux.Handle("GET /libraries/{id}", protected(http.HandlerFunc(h.GetLibrary)))
+	mux.Handle("PATCH /libraries/{id}", protected(http.HandlerFunc(h.PatchLibrary)))
 	mux.Handle("DELETE /libraries/{id}", protected(http.HandlerFunc(h.DeleteLibrary)))
+	mux.Handle("POST /libraries/{id}/merge-into/{targetId}", protected(http.HandlerFunc(h.MergeLibrary)))
+	// Encrypted libraries: keep / drop the key in memory
+	mux.Handle("POST /libraries/{id}/unlock", protected(http.HandlerFunc(h.UnlockLibrary)))
+	mux.Handle("POST /libraries/{id}/lock", protected(http.HandlerFunc(h.LockLibrary)))
+	mux.Handle("GET /libraries/{id}/lock", protected(http.HandlerFunc(h.LibraryLockStatus)))
+	mux.Handle("POST /libraries/{id}/rekey", protected(http.HandlerFunc(h.RekeyLibrary)))
+	mux.Handle("POST /libraries/{id}/verify-key", protected(http.HandlerFunc(h.VerifyKey)))
+	mux.Handle("GET /libraries/{id}/audit", protected(http.HandlerFunc(h.LibraryAudit)))
+	// Zero-knowledge libraries: opaque client-encrypted blobs
+	mux.Handle("POST /libraries/{id}/blobs", protected(http.HandlerFunc(h.PushBlobs)))
+	mux.Handle("GET /libraries/{id}/blobs", protected(http.HandlerFunc(h.ListBlobs)))
+	mux.Handle("GET /libraries/{id}/blobs/{blobId}", protected(http.HandlerFunc(h.GetBlob)))
 
 	// Sessions (per-library)
-	mux.Handle("GET /libraries/{libId}/sessions",          protected(http.HandlerFunc(h.ListSessions)))
-	mux.Handle("POST /libraries/{libId}/sessions",         protected(http.HandlerFunc(h.CreateSession)))
-	mux.Handle("PATCH /libraries/{libId}/sessions/{id}",  protected(http.HandlerFunc(h.PatchSession)))
+	mux.Handle("GET /libraries/{libId}/sessions", protected(http.HandlerFunc(h.ListSessions)))
+	mux.Handle("POST /libraries/{libId}/sessions", protected(http.HandlerFunc(h.CreateSession)))
+	mux.Handle("GET /libraries/{libId}/sessions/{id}", protected(http.HandlerFunc(h.GetLibrarySession)))
+	mux.Handle("PATCH /libraries/{libId}/sessions/{id}", protected(http.HandlerFunc(h.PatchSession)))
 	mux.Handle("DELETE /libraries/{libId}/sessions/{id}", protected(http.HandlerFunc(h.DeleteSession)))
 
 	// Master views (cross-library — companion UI "All Sessions" / "All Tabs" panels)
-	mux.Handle("GET /sessions",    protected(http.HandlerFunc(h.ListAllSessions)))
-	mux.Handle("GET /tabs",        protected(http.HandlerFunc(h.ListAllTabs)))
+	mux.Handle("GET /sessions", protected(http.HandlerFunc(h.ListAllSessions)))
+	mux.Handle("GET /tabs", protected(http.HandlerFunc(h.ListAllTabs)))
+	// Session merge / split — cross-library, IDs are global
+	mux.Handle("POST /sessions:merge", protected(http.HandlerFunc(h.MergeSessions)))
+	mux.Handle("POST /sessions/{id}/split", protected(http.HandlerFunc(h.SplitSession)))
+	// Session detail + window / tab-group structure
+	mux.Handle("GET /sessions/{id}", protected(http.HandlerFunc(h.GetSessionDetail)))
+	mux.Handle("GET /sessions/{id}/tabs", protected(http.HandlerFunc(h.ListSessionTabs)))
+	mux.Handle("POST /sessions/{id}/windows", protected(http.HandlerFunc(h.CreateWindow)))
+	mux.Handle("DELETE /sessions/{id}/windows/{windowId}", protected(http.HandlerFunc(h.DeleteWindow)))
+	mux.Handle("POST /sessions/{id}/groups", protected(http.HandlerFunc(h.CreateTabGroup)))
+	mux.Handle("PATCH /sessions/{id}/groups/{groupId}", protected(http.HandlerFunc(h.PatchTabGroup)))
+	mux.Handle("DELETE /sessions/{id}/groups/{groupId}", protected(http.HandlerFunc(h.DeleteTabGroup)))
 	// Global tab operations — no library context (used by All Tabs master view)
-	mux.Handle("PATCH /tabs/{id}",  protected(http.HandlerFunc(h.PatchTab)))
+	mux.Handle("PATCH /tabs/{id}", protected(http.HandlerFunc(h.PatchTab)))
 	mux.Handle("DELETE /tabs/{id}", protected(http.HandlerFunc(h.DeleteTabByID)))
 
 	// Tabs (per-library)
@@ -57,6 +113,11 @@ func NewRouter(database *db.DB, token string) http.Handler {
 	mux.Handle("GET /libraries/{libId}/bookmarks", protected(http.HandlerFunc(h.ListBookmarks)))
 	mux.Handle("POST /libraries/{libId}/bookmarks", protected(http.HandlerFunc(h.CreateBookmark)))
 	mux.Handle("DELETE /libraries/{libId}/bookmarks/{id}", protected(http.HandlerFunc(h.DeleteBookmark)))
+	mux.Handle("GET /libraries/{libId}/bookmarks/tree", protected(http.HandlerFunc(h.BookmarkTree)))
+	mux.Handle("POST /libraries/{libId}/bookmarks/reorder", protected(http.HandlerFunc(h.ReorderBookmarks)))
+	mux.Handle("POST /libraries/{libId}/bookmarks/{id}/move", protected(http.HandlerFunc(h.MoveBookmark)))
+	mux.Handle("POST /libraries/{libId}/bookmarks/{id}/copy", protected(http.HandlerFunc(h.CopyBookmark)))
+	mux.Handle("GET /libraries/{libId}/bookmarks/{id}/export", protected(http.HandlerFunc(h.ExportBookmarks)))
 
 	// History
 	mux.Handle("GET /libraries/{libId}/history", protected(http.HandlerFunc(h.ListHistory)))
@@ -69,30 +130,48 @@ func NewRouter(database *db.DB, token string) http.Handler {
 	mux.Handle("DELETE /libraries/{libId}/downloads/{id}", protected(http.HandlerFunc(h.DeleteDownload)))
 
 	// Auto-start (Task Scheduler integration — Windows only)
-	mux.Handle("GET /autostart",    protected(http.HandlerFunc(h.GetAutostart)))
-	mux.Handle("POST /autostart",   protected(http.HandlerFunc(h.EnableAutostart)))
-	mux.Handle("DELETE /autostart", protected(http.HandlerFunc(h.DisableAutostart)))
+	mux.Handle("GET /autostart", admin(http.HandlerFunc(h.GetAutostart)))
+	mux.Handle("POST /autostart", admin(http.HandlerFunc(h.EnableAutostart)))
+	mux.Handle("DELETE /autostart", admin(http.HandlerFunc(h.DisableAutostart)))
+
+	// Background jobs — in memory, so served without the drain gate: progress
+	// stays visible while a job (rekey) holds the database exclusively.
+	mux.Handle("GET /jobs", authed(http.HandlerFunc(h.ListJobs)))
+	mux.Handle("GET /jobs/{id}", authed(http.HandlerFunc(h.GetJob)))
 
 	// Search (libId optional — empty = all libraries)
 	mux.Handle("GET /search", protected(http.HandlerFunc(h.Search)))
 
 	// Machine Sync — in-memory pending state (no DB required)
-	mux.Handle("POST /sync",        protected(http.HandlerFunc(h.Sync)))
+	mux.Handle("POST /sync", protected(http.HandlerFunc(h.Sync)))
 	mux.Handle("GET /sync/pending", protected(http.HandlerFunc(h.GetSyncPending)))
-	mux.Handle("POST /sync/done",   protected(http.HandlerFunc(h.SyncDone)))
+	mux.Handle("POST /sync/done", protected(http.HandlerFunc(h.SyncDone)))
 
 	// Database Backup & Restore
-	mux.Handle("POST /backup",               protected(http.HandlerFunc(h.CreateBackup)))
-	mux.Handle("GET /backups",               protected(http.HandlerFunc(h.ListBackups)))
-	mux.Handle("POST /restore/{filename}",   protected(http.HandlerFunc(h.RestoreBackup)))
-	mux.Handle("DELETE /backups/{filename}", protected(http.HandlerFunc(h.DeleteBackup)))
+	mux.Handle("POST /backup", slow(http.HandlerFunc(h.CreateBackup)))
+	mux.Handle("GET /backups", admin(http.HandlerFunc(h.ListBackups)))
+	mux.Handle("POST /restore/{filename}", adminOnly(longRunning(http.HandlerFunc(h.RestoreBackup)))) // takes the drain gate itself
+	mux.Handle("DELETE /backups/{filename}", admin(http.HandlerFunc(h.DeleteBackup)))
+	mux.Handle("GET /backups/status", admin(http.HandlerFunc(h.BackupStatus)))
+	mux.Handle("GET /backups/{filename}/summary", slow(http.HandlerFunc(h.BackupSummary)))
+	mux.Handle("GET /backups/{filename}/diff", slow(http.HandlerFunc(h.BackupDiff)))
+	mux.Handle("POST /backups/{filename}/restore", slow(http.HandlerFunc(h.RestoreSelected)))
+
+	// Maintenance — export / import and the mvaultd admin CLI
+	mux.Handle("GET /export", slow(http.HandlerFunc(h.Export)))
+	mux.Handle("POST /import", slow(http.HandlerFunc(h.Import)))
+	mux.Handle("POST /admin/vacuum", slow(http.HandlerFunc(h.Vacuum)))
+	mux.Handle("GET /admin/migrations", admin(http.HandlerFunc(h.Migrations)))
+	mux.Handle("GET /admin/doctor", slow(http.HandlerFunc(h.Doctor)))
+	mux.Handle("POST /admin/doctor", slow(http.HandlerFunc(h.Doctor)))
+	mux.Handle("GET /admin/logs", adminOnly(http.HandlerFunc(h.Logs)))
 
 	// Companion web dashboard UI (embedded static files)
 	// noCacheUI ensures browsers always revalidate UI assets after a binary update.
 	// Without this, browsers serve stale app.js / style.css from their local cache
 	// even after the daemon binary (and its embedded files) has been replaced.
 	uiFS, _ := fs.Sub(uiFiles, "ui")
-	mux.Handle("/ui/", noCacheUI(http.StripPrefix("/ui/", http.FileServer(http.FS(uiFS)))))
+	mux.Handle("/ui/", gate(features.dashboard.Load, noCacheUI(http.StripPrefix("/ui/", http.FileServer(http.FS(uiFS))))))
 	// Redirect bare /ui → /ui/  and  / → /ui/
 	mux.HandleFunc("/ui", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/ui/", http.StatusMovedPermanently)
@@ -105,7 +184,22 @@ func NewRouter(database *db.DB, token string) http.Handler {
 		}
 	})
 
-	return corsMiddleware(mux)
+	return requestLog(mux, corsMiddleware(origins)(mux))
+}
+
+// ServeCACert wraps router to serve the local CA certificate (see tlscert) at
+// GET /tls/ca.pem without auth, so a phone or another browser can download it
+// and trust the daemon's HTTPS certificate. The certificate is public.
+func ServeCACert(router http.Handler, caPEM []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tls/ca.pem" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			router.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", `attachment; filename="mindvault-ca.pem"`)
+		_, _ = w.Write(caPEM)
+	})
 }
 
 // noCacheUI wraps a static-file handler to set Cache-Control: no-cache on every
@@ -125,42 +219,141 @@ func noCacheUI(next http.Handler) http.Handler {
 	})
 }
 
-// authMiddleware validates the X-MindVault-Token header.
-func authMiddleware(token string) func(http.Handler) http.Handler {
+// authMiddleware validates the X-MindVault-Token header against the token
+// store (401 if unknown or revoked) and checks its scope (403): need, or for
+// need "" read on GET/HEAD and write otherwise. A library-restricted token is
+// only let through to routes naming allowed libraries (see requestLibraries)
+// or filtering by them (see filtersLibraries).
+func authMiddleware(tokens *auth.Store, need auth.Scope) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Header.Get("X-MindVault-Token") != token {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				_, _ = w.Write([]byte(`{"error":"unauthorized"}`))
+			tok, ok := tokens.Authenticate(r.Header.Get("X-MindVault-Token"))
+			if !ok {
+				writeAuthErr(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			setRequestClient(r, tok.ID)
+			scope := need
+			if scope == "" {
+				scope = auth.ScopeWrite
+				if r.Method == http.MethodGet || r.Method == http.MethodHead {
+					scope = auth.ScopeRead
+				}
+			}
+			if !tok.Scope.Includes(scope) {
+				writeAuthErr(w, http.StatusForbidden, "token "+tok.Name+" lacks the "+string(scope)+" scope")
 				return
 			}
+			if len(tok.Libraries) > 0 && filtersLibraries(r) {
+				r = r.WithContext(handlers.WithLibraries(r.Context(), tok.Libraries))
+			} else if len(tok.Libraries) > 0 {
+				libs := requestLibraries(r)
+				if len(libs) == 0 {
+					writeAuthErr(w, http.StatusForbidden, "token "+tok.Name+" is restricted to libraries; this route is not")
+					return
+				}
+				for _, id := range libs {
+					if !tok.AllowsLibrary(id) {
+						writeAuthErr(w, http.StatusForbidden, "token "+tok.Name+" may not access library "+id)
+						return
+					}
+				}
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// corsMiddleware adds CORS headers to allow requests from browser extensions and
-// the local web UI / PWA. Only localhost-bound, so no external CORS risk.
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		// Allow Chrome, Firefox, Safari, Edge extension origins + local web origins
-		if strings.HasPrefix(origin, "chrome-extension://") ||
-			strings.HasPrefix(origin, "moz-extension://") ||
-			strings.HasPrefix(origin, "safari-extension://") ||
-			strings.HasPrefix(origin, "http://127.0.0.1") ||
-			strings.HasPrefix(origin, "http://localhost") ||
-			origin == "null" { // PWA installed from local
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-MindVault-Token")
-		w.Header().Set("Access-Control-Allow-Credentials", "false")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
+// requestLibraries returns the libraries a request touches, as far as the
+// URL shows: the {id}/{libId} segment of /libraries/… routes (plus the merge
+// target) and ?libId= of /search. Other routes return none.
+func requestLibraries(r *http.Request) []string {
+	if r.URL.Path == "/search" {
+		if id := r.URL.Query().Get("libId"); id != "" {
+			return []string{id}
 		}
+		return nil
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/libraries/")
+	if !ok || rest == "" {
+		return nil
+	}
+	parts := strings.Split(rest, "/")
+	libs := []string{parts[0]}
+	if len(parts) >= 3 && parts[1] == "merge-into" {
+		libs = append(libs, parts[2])
+	}
+	return libs
+}
+
+// filtersLibraries reports whether r's route narrows its answer to the
+// libraries of a restricted token itself (the job routes) instead of naming
+// one in the URL.
+func filtersLibraries(r *http.Request) bool {
+	return r.URL.Path == "/jobs" || strings.HasPrefix(r.URL.Path, "/jobs/")
+}
+
+// LongRequestTimeout is how long the slow admin routes may take to read
+// their request and write their answer; the server's own timeouts are far
+// shorter. The mvaultd CLI waits as long.
+const LongRequestTimeout = 10 * time.Minute
+
+// longRunning extends the connection's read and write deadlines to
+// LongRequestTimeout for the request it wraps.
+func longRunning(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(LongRequestTimeout)
+		_ = rc.SetReadDeadline(deadline)
+		_ = rc.SetWriteDeadline(deadline)
 		next.ServeHTTP(w, r)
 	})
 }
+
+// writeAuthErr writes a JSON error for a rejected token.
+func writeAuthErr(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// drainMiddleware holds the database's request gate (shared) for the lifetime
+// of each request, so db.Restore can drain in-flight requests before it swaps
+// the underlying file and block new ones until the swap is done.
+func drainMiddleware(database *db.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			release := database.Acquire()
+			defer release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// corsMiddleware enforces the CORS allowlist. A request with an Origin header
+// (i.e. from a browser) is answered only if the origin is allowed — exactly,
+// see Origins — or it targets the pairing endpoints; anything else, preflights
+// included, gets 403 without CORS headers. Requests without an Origin (CLI,
+// scripts, same-origin GETs from the dashboard) pass through unchanged.
+func corsMiddleware(origins *Origins) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin != "" {
+				if !origins.Allowed(origin) && !(isPairingPath(r.URL.Path) && origin != "null") {
+					writeAuthErr(w, http.StatusForbidden, "origin "+origin+" is not allowed")
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-MindVault-Token, X-MindVault-Pair-Secret")
+			}
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ── Unix domain socket ────────────────────────────────────────────────────────
+// The router can also be served on a Unix socket, which — unlike the TCP port —
+// other local user accounts cannot reach: the socket file is 0600. As a second
+// factor next to the token, each connection's peer credentials are read from
+// the kernel (SO_PEERCRED / LOCAL_PEERCRED) and requests from any user other
+// than the daemon's own are refused.
+
+// ListenSocket listens on the Unix socket at path with mode 0600, creating
+// the parent directory (0700) if needed. A stale socket file left by a
+// crashed daemon is replaced; one a running daemon still answers on is not.
+func ListenSocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("create socket dir: %w", err)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another daemon", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	return ln, nil
+}
+
+// peerKey is the context key under which SocketConnContext stores a
+// connection's peer user ID.
+type peerKey struct{}
+
+// SocketConnContext is an http.Server ConnContext for the socket server: it
+// records the connecting process's user ID (or the error reading it).
+func SocketConnContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return context.WithValue(ctx, peerKey{}, peerResult{err: errors.New("not a unix socket connection")})
+	}
+	uid, err := peerUID(uc)
+	return context.WithValue(ctx, peerKey{}, peerResult{uid: uid, err: err})
+}
+
+type peerResult struct {
+	uid int
+	err error
+}
+
+// PeerCredSupported reports whether this platform can read socket peer
+// credentials. Where it cannot, PeerCredMiddleware relies on the socket's
+// file mode alone.
+func PeerCredSupported() bool { return peerCredSupported }
+
+// PeerCredMiddleware refuses (403) socket requests from a user other than the
+// daemon's own. Use it with SocketConnContext.
+func PeerCredMiddleware(next http.Handler) http.Handler {
+	self := os.Getuid()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peerCredSupported {
+			p, ok := r.Context().Value(peerKey{}).(peerResult)
+			if !ok || p.err != nil {
+				writeAuthErr(w, http.StatusForbidden, "cannot verify the connecting user")
+				return
+			}
+			if p.uid != self {
+				writeAuthErr(w, http.StatusForbidden, fmt.Sprintf("user %d may not use this socket", p.uid))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
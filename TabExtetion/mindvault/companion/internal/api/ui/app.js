@@ -1,5 +1,5 @@
 // MindVault Companion Web Dashboard — Vanilla JS SPA
-// Talks to the companion REST API (same origin: http://127.0.0.1:47821)
+// Talks to the companion REST API (same origin, usually http://127.0.0.1:47821)
 'use strict';
 
 // ── Toast notification (replaces alert()) ─────────────────────────────────────
@@ -108,6 +108,7 @@ const colVisMenu          = document.getElementById('colVisMenu');
 const issue011Notice      = document.getElementById('issue011Notice');
 const mtbMachineSyncBtn   = document.getElementById('mtbMachineSyncBtn');
 const machineSyncNotice   = document.getElementById('machineSyncNotice');
+const pairingNotice       = document.getElementById('pairingNotice');
 
 // ── API helpers ───────────────────────────────────────────────────────────────
 async function apiGet(path) {
@@ -148,20 +149,91 @@ async function boot() {
   if (savedTheme) document.documentElement.dataset.theme = savedTheme;
   else delete document.documentElement.dataset.theme;
   try {
-    const td = await (await fetch('/token')).json();
-    token = td.token;
+    token = await ensureToken();
     statusDot.className   = 'status-dot status-ok';
     statusDot.textContent = '● Connected';
-  } catch {
+  } catch (e) {
     statusDot.className   = 'status-dot status-err';
     statusDot.textContent = '● Offline';
-    libList.innerHTML = '<div class="loading-msg">Companion not running.<br/>Start it and refresh.</div>';
+    libList.innerHTML = e instanceof PairingError
+      ? `<div class="loading-msg">${esc(e.message)}<br/>Refresh to pair again.</div>`
+      : '<div class="loading-msg">Companion not running.<br/>Start it and refresh.</div>';
     return;
   }
   applyColWidthsToCSS();
   wireTabsToolbar();
   wireLibContextMenu();
   await loadLibraries();
+  pollPairings();
+}
+
+// ── Pairing ───────────────────────────────────────────────────────────────────
+// The dashboard gets its (admin) token through the same pairing handshake as
+// every other client: it shows a code, the user approves that code in the
+// daemon's terminal (`mvaultd pair approve CODE admin`) or in an already
+// paired dashboard, and the token is kept in localStorage afterwards. The
+// approver always states the scope granted; any page may ask for admin.
+class PairingError extends Error {}
+
+async function ensureToken() {
+  const saved = localStorage.getItem('mv-token') || '';
+  if (saved) {
+    const r = await fetch('/libraries', { headers: { 'X-MindVault-Token': saved } });
+    if (r.status !== 401) return saved;
+    localStorage.removeItem('mv-token'); // revoked — pair again
+  }
+  const r = await fetch('/pair', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ client: 'Dashboard', scope: 'admin' }),
+  });
+  const p = await r.json();
+  if (!r.ok) throw new PairingError(p.error || `${r.status} ${r.statusText}`);
+  statusDot.className   = 'status-dot status-warn';
+  statusDot.textContent = '● Pairing';
+  libList.innerHTML = `<div class="loading-msg">Pairing code<br/>
+    <span class="pairing-code">${esc(p.code)}</span><br/>
+    Approve it in the companion terminal:<br/><code>mvaultd pair approve ${esc(p.code)} admin</code></div>`;
+  for (;;) {
+    await new Promise(res => setTimeout(res, 2000));
+    const s = await (await fetch('/pair/' + p.id, { headers: { 'X-MindVault-Pair-Secret': p.secret } })).json();
+    if (s.token) {
+      localStorage.setItem('mv-token', s.token);
+      return s.token;
+    }
+    if (s.state !== 'pending') throw new PairingError(`Pairing ${s.state || 'failed'}.`);
+  }
+}
+
+// pollPairings — show other clients' pending requests with Approve / Deny.
+// Admin requests can also be approved as write; each button names its scope.
+async function pollPairings() {
+  try {
+    renderPairings(await apiGet('/pairings'));
+  } catch { /* non-admin or offline — leave the notice as is */ }
+  setTimeout(pollPairings, 5000);
+}
+
+function renderPairings(reqs) {
+  pairingNotice.classList.toggle('hidden', !reqs.length);
+  pairingNotice.innerHTML = reqs.length
+    ? '<div>Approve only if the code matches the one the client shows:</div>' : '';
+  reqs.forEach(p => {
+    const row = document.createElement('div');
+    row.className = 'pairing-row';
+    row.innerHTML = `<span class="pairing-code">${esc(p.code)}</span> ${esc(p.client)}
+      <div class="muted">requests ${esc(p.scope)}${p.origin ? ' · ' + esc(p.origin) : ''}</div>
+      ${(p.scope === 'admin' ? ['admin', 'write'] : [p.scope]).map(s =>
+        `<button class="btn-secondary" data-act="approve" data-scope="${esc(s)}">Approve as ${esc(s)}</button>`).join('')}<button class="btn-secondary" data-act="deny">Deny</button>`;
+    row.querySelectorAll('button').forEach(b => b.addEventListener('click', async () => {
+      try {
+        await apiPost('/pairings/' + b.dataset.act, { code: p.code, scope: b.dataset.scope });
+        showToast(b.dataset.act === 'approve' ? `Approved ${p.client} as ${b.dataset.scope}` : `Denied ${p.client}`);
+      } catch (e) { showToast('Pairing: ' + e.message, true); }
+      renderPairings(await apiGet('/pairings').catch(() => []));
+    }));
+    pairingNotice.appendChild(row);
+  });
 }
 
 // ── Libraries ─────────────────────────────────────────────────────────────────
@@ -1396,9 +1468,17 @@ function wireImportCard() {
 }
 
 // ── Settings ──────────────────────────────────────────────────────────────────
+// Display names of the autostart backends GET /autostart reports.
+const AUTOSTART_BACKENDS = {
+  systemd:  'systemd user service',
+  xdg:      'Desktop autostart entry',
+  launchd:  'LaunchAgent',
+  schtasks: 'Task Scheduler',
+};
+
 async function renderSettings() {
   settingsContent.innerHTML = '<div class="loading-msg">Loading…</div>';
-  let version = '?', libCount = 0, autoStartEnabled = false, onWindows = false;
+  let version = '?', libCount = 0, autoStartEnabled = false, autoStartBackend = '';
   try {
     const h   = await (await fetch('/health')).json();
     version   = h.version || '?';
@@ -1408,7 +1488,7 @@ async function renderSettings() {
     cachedLibsMap = Object.fromEntries(cachedLibs.map(l => [l.id, l]));
     const as  = await apiGet('/autostart');
     autoStartEnabled = as.enabled;
-    onWindows = as.platform === 'windows';
+    autoStartBackend = as.backend || '';
   } catch { /* offline */ }
 
   settingsContent.innerHTML = `
@@ -1416,12 +1496,12 @@ async function renderSettings() {
       <h3>Companion Status</h3>
       <div class="settings-row"><span>Status</span><span class="val ok">● Running</span></div>
       <div class="settings-row"><span>Version</span><span class="val">${esc(version)}</span></div>
-      <div class="settings-row"><span>Port</span><span class="val">47821</span></div>
+      <div class="settings-row"><span>Port</span><span class="val">${esc(location.port || (location.protocol === 'https:' ? '443' : '80'))}</span></div>
       <div class="settings-row"><span>Libraries</span><span class="val">${libCount}</span></div>
       <div class="settings-row"><span>Dashboard</span><span class="val">
-        <a href="/ui/" style="color:var(--accent)">http://127.0.0.1:47821/ui/</a></span></div>
+        <a href="/ui/" style="color:var(--accent)">${esc(location.origin)}/ui/</a></span></div>
     </div>
-    ${onWindows ? `
+    ${autoStartBackend ? `
     <div class="settings-card">
       <h3>Auto-Start</h3>
       <div class="settings-row">
@@ -1432,7 +1512,7 @@ async function renderSettings() {
         </button>
       </div>
       <div class="settings-row" style="font-size:12px">
-        <span class="muted">Task Scheduler: <strong style="color:${autoStartEnabled ? 'var(--green)' : 'var(--muted)'}">
+        <span class="muted">${esc(AUTOSTART_BACKENDS[autoStartBackend] || autoStartBackend)}: <strong style="color:${autoStartEnabled ? 'var(--green)' : 'var(--muted)'}">
           ${autoStartEnabled ? '● Active' : '○ Inactive'}
         </strong></span>
       </div>
@@ -1458,15 +1538,6 @@ async function renderSettings() {
     </div>
     <div class="settings-card" id="backupCard">
       <h3>🗄️ Database Backup &amp; Restore</h3>
-      <div class="settings-row">
-        <span>Keep backups for</span>
-        <select id="backupRetain" style="font-size:12px;padding:2px 6px">
-          <option value="7">7 days</option>
-          <option value="15">15 days</option>
-          <option value="30">30 days</option>
-          <option value="90">90 days</option>
-        </select>
-      </div>
       <div class="settings-row">
         <span>Manual backup</span>
         <button id="backupNowBtn" class="btn-primary" style="padding:4px 14px;font-size:12px">🗄 Backup Now</button>
@@ -1474,9 +1545,24 @@ async function renderSettings() {
       <div id="backupStatus" class="backup-status"></div>
       <div id="backupList" class="backup-list"><div class="loading-msg">Loading backups…</div></div>
     </div>
+    <div class="settings-card" id="logsCard">
+      <h3>Daemon Logs</h3>
+      <div class="settings-row">
+        <span>Show</span>
+        <select id="logsLevel" style="font-size:12px;padding:2px 6px">
+          <option value="debug">Everything</option>
+          <option value="info">Info and above</option>
+          <option value="warn" selected>Warnings and errors</option>
+          <option value="error">Errors only</option>
+        </select>
+        <button id="logsRefreshBtn" class="btn-secondary" style="padding:4px 14px;font-size:12px">↻ Refresh</button>
+      </div>
+      <div id="logsList" class="log-list"><div class="loading-msg">Loading logs…</div></div>
+    </div>
   `;
   wireImportCard();
   void wireBackupCard();
+  void wireLogsCard();
   // Wire theme switcher buttons
   const themeSwitcher = document.getElementById('themeSwitcher');
   if (themeSwitcher) {
@@ -1509,6 +1595,48 @@ async function renderSettings() {
   }
 }
 
+// ── Daemon logs ───────────────────────────────────────────────────────────────
+
+/** Load the daemon's recent log records (GET /admin/logs) into #logsList, newest first. */
+async function loadLogs() {
+  const list = document.getElementById('logsList');
+  if (!list) return;
+  const level = document.getElementById('logsLevel')?.value || 'warn';
+  let entries;
+  try {
+    entries = await apiGet(`/admin/logs?level=${level}&limit=200`);
+  } catch (e) {
+    list.innerHTML = `<div class="backup-empty">Could not load logs: ${esc(e.message)}</div>`;
+    return;
+  }
+  if (!entries || entries.length === 0) {
+    list.innerHTML = '<div class="backup-empty">Nothing logged at this level.</div>';
+    return;
+  }
+  list.innerHTML = entries.slice().reverse().map(e => {
+    const attrs = Object.entries(e.attrs || {}).map(([k, v]) => `${k}=${typeof v === 'string' ? v : JSON.stringify(v)}`).join(' ');
+    return `<div class="log-row log-${esc(e.level.toLowerCase())}">
+      <span class="log-time">${esc(new Date(e.time).toLocaleTimeString())}</span>
+      <span class="log-level">${esc(e.level)}</span>
+      <span class="log-msg">${esc(e.msg)} <span class="muted">${esc(attrs)}</span></span>
+    </div>`;
+  }).join('');
+}
+
+/** Wire up the Daemon Logs settings card after it is injected into DOM. */
+async function wireLogsCard() {
+  const levelSel = document.getElementById('logsLevel');
+  if (levelSel) {
+    levelSel.value = localStorage.getItem('mv-logs-level') || 'warn';
+    levelSel.addEventListener('change', () => {
+      localStorage.setItem('mv-logs-level', levelSel.value);
+      void loadLogs();
+    });
+  }
+  document.getElementById('logsRefreshBtn')?.addEventListener('click', loadLogs);
+  await loadLogs();
+}
+
 // ── Backup & Restore helpers ──────────────────────────────────────────────────
 
 /** Render a list of BackupInfo objects into #backupList. */
@@ -1533,14 +1661,6 @@ function renderBackupRows(backups) {
 
 /** Wire up the Backup & Restore settings card after it is injected into DOM. */
 async function wireBackupCard() {
-  // Set saved retention
-  const retainSel = document.getElementById('backupRetain');
-  if (retainSel) {
-    const saved = localStorage.getItem('mv-backup-retain') || '30';
-    retainSel.value = saved;
-    retainSel.addEventListener('change', () =>
-      localStorage.setItem('mv-backup-retain', retainSel.value));
-  }
   // Fetch and render backup list
   try {
     const backups = await apiGet('/backups');
@@ -1568,8 +1688,7 @@ async function doBackupNow() {
   btn.disabled = true; btn.textContent = '⏳ Backing up…';
   if (status) status.textContent = '';
   try {
-    const retain = localStorage.getItem('mv-backup-retain') || '30';
-    const info   = await apiPost(`/backup?retain=${retain}`, {});
+    const info = await apiPost('/backup', {});
     if (status) status.textContent = `✅ Saved: ${info.filename || 'done'}`;
     const backups = await apiGet('/backups');
     renderBackupRows(backups || []);
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package auth
+
+import "os"
+
+// No file locking here; concurrent writers may lose an update.
+func lockFile(*os.File) error { return nil }
+
+func unlockFile(*os.File) {}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Pairing ───────────────────────────────────────────────────────────────────
+// A new client gets its token through a handshake instead of an open GET
+// /token:
+//
+//  1. The client asks to pair (POST /pair) and receives a request ID, a poll
+//     secret and a short code, which it shows to the user.
+//  2. The daemon shows the same code (terminal log, dashboard). The user checks
+//     that both match and approves it by entering the code and the scope to
+//     grant — in the dashboard (POST /pairings/approve, admin) or with
+//     `mvaultd pair approve CODE [SCOPE]`. The request's scope is only a
+//     ceiling: anyone can ask for admin.
+//  3. The client polls GET /pair/{id} with its secret; once approved, the
+//     token is minted in the Store and handed out exactly once.
+//
+// Pending requests expire after pairTTL. Every local caller has the same
+// peer address, so new requests are rate limited per origin and peer, and a
+// caller's own older request makes way past pendingPerCaller or when the queue
+// is full. Other callers are refused while maxPending requests wait rather
+// than pushing out someone else's, so a page can neither flood the approver nor drop the
+// extension's request. An approved request is kept until its client collects
+// the token, however late it polls.
+
+// Pairing request states.
+const (
+	PairPending  = "pending"
+	PairApproved = "approved"
+	PairDenied   = "denied"
+	PairExpired  = "expired"
+)
+
+const (
+	pairTTL          = 5 * time.Minute
+	pairWindow       = time.Minute
+	pairPerWindow    = 5 // new requests per caller (origin and peer) per pairWindow
+	pendingPerCaller = 2 // a caller's pending requests; its oldest makes way
+	maxPending       = 8 // pending requests across all callers; then new ones are refused
+)
+
+var (
+	// ErrPairRateLimited is returned by Request when a caller asks too often.
+	ErrPairRateLimited = errors.New("too many pairing requests, try again later")
+	// ErrPairQueueFull is returned by Request while maxPending requests wait.
+	ErrPairQueueFull = errors.New("too many pairing requests are waiting for approval; approve or deny them first")
+	// ErrPairNotFound is returned for an unknown (or already collected) request,
+	// a wrong poll secret, or an approve / deny code nothing is waiting for.
+	ErrPairNotFound = errors.New("pairing request not found")
+	// ErrPairScope is returned by Approve for a scope the request did not ask for.
+	ErrPairScope = errors.New("invalid scope to grant")
+)
+
+// PairRequest is one client's request for a token.
+type PairRequest struct {
+	ID          string   `json:"id"`
+	Client      string   `json:"client"`
+	Origin      string   `json:"origin,omitempty"`
+	Code        string   `json:"code"`              // "482-913"
+	Scope       Scope    `json:"scope"`             // requested
+	Granted     Scope    `json:"granted,omitempty"` // set on approval
+	Libraries   []string `json:"libraries,omitempty"`
+	State       string   `json:"state"`
+	RequestedAt int64    `json:"requestedAt"` // Unix ms
+	ExpiresAt   int64    `json:"expiresAt"`   // Unix ms
+
+	caller     string // origin and peer, for the limits
+	secretHash string
+}
+
+// Pairer tracks pending pairing requests in memory; safe for concurrent use.
+type Pairer struct {
+	store *Store
+	// OnRequest, if set, is called (without locks held) for every new request,
+	// e.g. to print its code in the daemon's terminal.
+	OnRequest func(PairRequest)
+
+	mu   sync.Mutex
+	reqs map[string]*PairRequest
+	hits map[string][]time.Time // caller → request times within pairWindow
+	now  func() time.Time
+}
+
+// NewPairer returns a Pairer that issues tokens into store.
+func NewPairer(store *Store) *Pairer {
+	return &Pairer{store: store, reqs: map[string]*PairRequest{}, hits: map[string][]time.Time{}, now: time.Now}
+}
+
+// Request registers a pairing request from client (a display name) and
+// returns it with the poll secret only the requester gets. origin and peer
+// (the requester's IP) together identify the caller the limits apply to.
+// scope defaults to write.
+func (p *Pairer) Request(client, origin, peer string, scope Scope, libraries []string) (PairRequest, string, error) {
+	client = strings.TrimSpace(client)
+	if scope == "" {
+		scope = ScopeWrite
+	}
+	switch {
+	case client == "" || len(client) > 64:
+		return PairRequest{}, "", fmt.Errorf("client name must be 1-64 characters")
+	case scope.rank() == 0:
+		return PairRequest{}, "", fmt.Errorf("scope must be read, write or admin, got %q", scope)
+	case scope == ScopeAdmin && len(libraries) > 0:
+		return PairRequest{}, "", fmt.Errorf("admin tokens cannot be restricted to libraries")
+	}
+
+	caller := origin + " " + peer
+	p.mu.Lock()
+	now := p.now()
+	p.expire(now)
+	recent := p.hits[caller][:0]
+	for _, t := range p.hits[caller] {
+		if now.Sub(t) < pairWindow {
+			recent = append(recent, t)
+		}
+	}
+	p.hits[caller] = recent
+	if len(recent) >= pairPerWindow {
+		p.mu.Unlock()
+		return PairRequest{}, "", ErrPairRateLimited
+	}
+	var pending, own []*PairRequest
+	for _, r := range p.reqs {
+		if r.State == PairPending {
+			pending = append(pending, r)
+			if r.caller == caller {
+				own = append(own, r)
+			}
+		}
+	}
+	drop := len(own) - pendingPerCaller + 1
+	if len(pending) >= maxPending && drop < 1 {
+		if len(own) == 0 {
+			p.mu.Unlock()
+			return PairRequest{}, "", ErrPairQueueFull
+		}
+		drop = 1
+	}
+	if drop > 0 {
+		sort.Slice(own, func(i, j int) bool { return own[i].RequestedAt < own[j].RequestedAt })
+		for _, r := range own[:drop] {
+			r.State = PairExpired // its client learns on the next poll
+		}
+	}
+	p.hits[caller] = append(recent, now)
+
+	secret, err := generateToken()
+	if err != nil {
+		p.mu.Unlock()
+		return PairRequest{}, "", err
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	r := &PairRequest{
+		ID: hex.EncodeToString(id), Client: client, Origin: origin,
+		Code: p.newCode(), Scope: scope, Libraries: libraries, State: PairPending,
+		RequestedAt: now.UnixMilli(), ExpiresAt: now.Add(pairTTL).UnixMilli(),
+		caller: caller, secretHash: hashSecret(secret),
+	}
+	p.reqs[r.ID] = r
+	out := *r
+	p.mu.Unlock()
+
+	if p.OnRequest != nil {
+		p.OnRequest(out)
+	}
+	return out, secret, nil
+}
+
+// Poll reports the state of request id to the holder of its secret. Once the
+// request is approved the token is created and returned — only on that call,
+// even if it comes after ExpiresAt; approved, denied and expired requests are
+// forgotten after being reported.
+func (p *Pairer) Poll(id, secret string) (PairRequest, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	r := p.reqs[id]
+	if r == nil || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(r.secretHash)) != 1 {
+		return PairRequest{}, "", ErrPairNotFound
+	}
+	if now.UnixMilli() > r.ExpiresAt && r.State == PairPending {
+		r.State = PairExpired
+	}
+	out := *r
+	switch r.State {
+	case PairPending:
+		return out, "", nil
+	case PairApproved:
+		name := fmt.Sprintf("%s (%s)", r.Client, r.ID[:6])
+		_, tok, err := p.store.create(name, r.Granted, r.Libraries, r.Origin, 0)
+		if err != nil {
+			return out, "", err
+		}
+		delete(p.reqs, id)
+		return out, tok, nil
+	}
+	delete(p.reqs, id)
+	return out, "", nil
+}
+
+// Pending returns the requests waiting for approval, oldest first.
+func (p *Pairer) Pending() []PairRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(p.now())
+	list := []PairRequest{}
+	for _, r := range p.reqs {
+		if r.State == PairPending {
+			list = append(list, *r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RequestedAt < list[j].RequestedAt })
+	return list
+}
+
+// Approve approves the pending request showing code ("482-913" or "482913")
+// with scope, which the approver states explicitly since anyone may request
+// admin: the requested scope or a narrower one.
+func (p *Pairer) Approve(code string, scope Scope) (PairRequest, error) {
+	return p.decide(code, PairApproved, scope)
+}
+
+// Deny rejects the pending request showing code.
+func (p *Pairer) Deny(code string) (PairRequest, error) {
+	return p.decide(code, PairDenied, "")
+}
+
+func (p *Pairer) decide(code, state string, scope Scope) (PairRequest, error) {
+	code = normalizeCode(code)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(p.now())
+	for _, r := range p.reqs {
+		if r.State == PairPending && normalizeCode(r.Code) == code {
+			switch {
+			case state != PairApproved:
+			case scope.rank() == 0:
+				return PairRequest{}, fmt.Errorf("%w: must be read, write or admin, got %q", ErrPairScope, scope)
+			case !r.Scope.Includes(scope):
+				return PairRequest{}, fmt.Errorf("%w: %s requested %s, cannot grant %s", ErrPairScope, r.Client, r.Scope, scope)
+			}
+			r.State, r.Granted = state, scope
+			return *r, nil
+		}
+	}
+	return PairRequest{}, fmt.Errorf("%w: no pending request with code %s", ErrPairNotFound, code)
+}
+
+// expire marks pending requests past their deadline and drops denied or
+// expired ones nobody polled for another pairTTL. Approved requests stay
+// until collected; no token exists before then. Caller holds mu.
+func (p *Pairer) expire(now time.Time) {
+	ms := now.UnixMilli()
+	for id, r := range p.reqs {
+		if ms > r.ExpiresAt && r.State == PairPending {
+			r.State = PairExpired
+		}
+		if ms > r.ExpiresAt+pairTTL.Milliseconds() && r.State != PairApproved {
+			delete(p.reqs, id)
+		}
+	}
+}
+
+// newCode returns a random "ddd-ddd" code not used by a live request.
+// Caller holds mu.
+func (p *Pairer) newCode() string {
+	for {
+		n, _ := rand.Int(rand.Reader, big.NewInt(1_000_000))
+		code := fmt.Sprintf("%03d-%03d", n.Int64()/1000, n.Int64()%1000)
+		taken := false
+		for _, r := range p.reqs {
+			taken = taken || r.Code == code
+		}
+		if !taken {
+			return code
+		}
+	}
+}
+
+func normalizeCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code))
+}
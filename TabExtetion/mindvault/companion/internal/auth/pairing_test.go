@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPairingExpiryAndRateLimit(t *testing.T) {
+	store, _ := OpenStore("", "")
+	p := NewPairer(store)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	r, secret, err := p.Request("Chrome", "chrome-extension://abc", "10.0.0.1", "", nil)
+	if err != nil || r.Scope != ScopeWrite || r.State != PairPending {
+		t.Fatalf("Request: %+v, %v", r, err)
+	}
+	if _, _, err := p.Request("x", "", "10.0.0.1", ScopeAdmin, []string{"lib-1"}); err == nil {
+		t.Error("library-restricted admin pairing accepted")
+	}
+
+	// Pending requests expire; approving one afterwards fails.
+	now = now.Add(pairTTL + time.Second)
+	if _, err := p.Approve(r.Code, ScopeWrite); !errors.Is(err, ErrPairNotFound) {
+		t.Errorf("approved an expired request: %v", err)
+	}
+	if got, tok, _ := p.Poll(r.ID, secret); got.State != PairExpired || tok != "" {
+		t.Errorf("poll expired: %+v %q", got, tok)
+	}
+	if _, _, err := p.Poll(r.ID, secret); !errors.Is(err, ErrPairNotFound) {
+		t.Errorf("expired request not forgotten: %v", err)
+	}
+
+	// Limited per origin and peer: local callers all share one address.
+	for i := 0; i < pairPerWindow; i++ {
+		if _, _, err := p.Request("page", "http://localhost:3000", "127.0.0.1", "", nil); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if _, _, err := p.Request("page", "http://localhost:3000", "127.0.0.1", "", nil); !errors.Is(err, ErrPairRateLimited) {
+		t.Errorf("caller not rate limited: %v", err)
+	}
+	if _, _, err := p.Request("Chrome", "chrome-extension://abc", "127.0.0.1", "", nil); err != nil {
+		t.Errorf("other origin on the same address limited too: %v", err)
+	}
+	if n := len(p.Pending()); n != pendingPerCaller+1 {
+		t.Errorf("pending = %d, want %d (the page's older requests make way)", n, pendingPerCaller+1)
+	}
+
+	// Denied requests never yield a token.
+	d, dsecret, _ := p.Request("Denied", "chrome-extension://def", "10.0.0.3", ScopeRead, nil)
+	if _, err := p.Deny(d.Code); err != nil {
+		t.Fatalf("Deny: %v", err)
+	}
+	if got, tok, _ := p.Poll(d.ID, dsecret); got.State != PairDenied || tok != "" {
+		t.Errorf("poll denied: %+v %q", got, tok)
+	}
+	if list, _ := store.List(); len(list) != 0 {
+		t.Errorf("tokens created without approval: %+v", list)
+	}
+}
+
+func TestPairingApprovedLateAndPendingCap(t *testing.T) {
+	store, _ := OpenStore("", "")
+	p := NewPairer(store)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	// Approved just before the deadline, polled well after it.
+	r, secret, _ := p.Request("Chrome", "chrome-extension://abc", "10.0.0.1", "", nil)
+	if _, err := p.Approve(r.Code, ScopeWrite); err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+	now = now.Add(3 * pairTTL)
+	p.Pending() // runs expire
+	if got, tok, err := p.Poll(r.ID, secret); err != nil || got.State != PairApproved || tok == "" {
+		t.Fatalf("late poll of an approved request: %+v %q %v", got, tok, err)
+	}
+
+	// Past maxPending new requests are refused; nothing pending is dropped.
+	type req struct{ id, secret string }
+	var reqs []req
+	for i := 0; i < maxPending; i++ {
+		now = now.Add(time.Second)
+		r, secret, err := p.Request("c", fmt.Sprintf("http://localhost:%d", 3000+i), "127.0.0.1", "", nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		reqs = append(reqs, req{r.ID, secret})
+	}
+	if _, _, err := p.Request("Chrome", "chrome-extension://abc", "127.0.0.1", "", nil); !errors.Is(err, ErrPairQueueFull) {
+		t.Errorf("request past maxPending: %v, want ErrPairQueueFull", err)
+	}
+	if n := len(p.Pending()); n != maxPending {
+		t.Errorf("pending = %d, want %d", n, maxPending)
+	}
+	if got, _, _ := p.Poll(reqs[0].id, reqs[0].secret); got.State != PairPending {
+		t.Errorf("oldest request: %s, want pending", got.State)
+	}
+
+	// A caller with a request pending may still replace it.
+	if _, _, err := p.Request("c", "http://localhost:3000", "127.0.0.1", "", nil); err != nil {
+		t.Fatalf("repeat request of a pending caller: %v", err)
+	}
+	if n := len(p.Pending()); n != maxPending {
+		t.Errorf("pending = %d, want %d", n, maxPending)
+	}
+	if got, _, _ := p.Poll(reqs[0].id, reqs[0].secret); got.State != PairExpired {
+		t.Errorf("replaced request: %s, want expired", got.State)
+	}
+	if got, _, _ := p.Poll(reqs[1].id, reqs[1].secret); got.State != PairPending {
+		t.Errorf("other caller's request: %s, want pending", got.State)
+	}
+}
+
+func TestPairingGrantedScope(t *testing.T) {
+	store, _ := OpenStore("", "")
+	p := NewPairer(store)
+
+	// Anyone may ask for admin; the approver states what is granted.
+	r, secret, _ := p.Request("page", "http://localhost:3000", "127.0.0.1", ScopeAdmin, nil)
+	if _, err := p.Approve(r.Code, ""); !errors.Is(err, ErrPairScope) {
+		t.Errorf("approved without a scope: %v", err)
+	}
+	got, err := p.Approve(r.Code, ScopeWrite)
+	if err != nil || got.Scope != ScopeAdmin || got.Granted != ScopeWrite {
+		t.Fatalf("Approve as write: %+v, %v", got, err)
+	}
+	if _, tok, _ := p.Poll(r.ID, secret); tok == "" {
+		t.Fatal("no token for the approved request")
+	} else if issued, ok := store.Authenticate(tok); !ok || issued.Scope != ScopeWrite {
+		t.Errorf("issued token: %+v, want scope write", issued)
+	}
+
+	// Never more than requested.
+	r, _, _ = p.Request("Chrome", "chrome-extension://abc", "127.0.0.1", ScopeRead, nil)
+	if _, err := p.Approve(r.Code, ScopeAdmin); !errors.Is(err, ErrPairScope) {
+		t.Errorf("granted admin to a read request: %v", err)
+	}
+	if list := p.Pending(); len(list) != 1 || list[0].State != PairPending {
+		t.Errorf("refused approval changed the request: %+v", list)
+	}
+}
@@ -0,0 +1,427 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Token store ───────────────────────────────────────────────────────────────
+// Every client (each browser, the PWA, a script) gets its own named token with
+// a scope and optionally a set of libraries. tokens.json (next to the token
+// file) keeps only SHA-256 hashes of the secrets; a secret is shown once, at
+// creation. The legacy shared secret from the token file is imported as the
+// admin token "default" so existing clients keep working until it is revoked.
+//
+// `mvaultd token create|list|revoke` edits the file while the daemon runs; the
+// daemon reloads it whenever it changes on disk, so a revocation takes effect
+// on the next request. Every write re-reads the file under an OS lock on
+// tokens.json.lock, so the daemon's last-used updates and the CLI's edits do
+// not overwrite each other.
+//
+// Other mvaultd commands talk to the daemon with a temporary admin token
+// (CreateTemporary) that they Delete when done. If the command dies first the
+// token expires on its own and the next write drops it.
+
+// Scope is what a token may do. Each scope includes the ones before it.
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"  // GET requests only
+	ScopeWrite Scope = "write" // read + create / update / delete library data
+	ScopeAdmin Scope = "admin" // everything, including backup, restore and autostart
+)
+
+// rank orders scopes; unknown scopes rank below read.
+func (s Scope) rank() int {
+	switch s {
+	case ScopeRead:
+		return 1
+	case ScopeWrite:
+		return 2
+	case ScopeAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Includes reports whether s grants at least need.
+func (s Scope) Includes(need Scope) bool { return s.rank() >= need.rank() && need.rank() > 0 }
+
+// ErrTokenNotFound is returned by Revoke for an unknown ID or name.
+var ErrTokenNotFound = errors.New("token not found")
+
+// Token is one stored API token. Libraries restricts it to those library IDs
+// (empty = all libraries). Origin is the browser origin of a paired client,
+// which the CORS allowlist admits while the token is active. Timestamps are
+// Unix ms; RevokedAt 0 = not revoked, ExpiresAt 0 = never expires.
+type Token struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Scope      Scope    `json:"scope"`
+	Libraries  []string `json:"libraries,omitempty"`
+	Origin     string   `json:"origin,omitempty"`
+	Hash       string   `json:"hash"` // hex SHA-256 of the secret
+	CreatedAt  int64    `json:"createdAt"`
+	LastUsedAt int64    `json:"lastUsedAt,omitempty"`
+	RevokedAt  int64    `json:"revokedAt,omitempty"`
+	ExpiresAt  int64    `json:"expiresAt,omitempty"`
+}
+
+// Active reports whether the token has neither been revoked nor expired.
+func (t Token) Active() bool { return t.RevokedAt == 0 && !t.expired(time.Now().UnixMilli()) }
+
+// expired reports whether a temporary token is past its deadline at now (Unix ms).
+func (t Token) expired(now int64) bool { return t.ExpiresAt != 0 && now >= t.ExpiresAt }
+
+// legacyCLIPrefix names the admin tokens older mvaultd commands created for
+// every call and revoked afterwards; save drops those leftovers.
+const legacyCLIPrefix = "mvaultd cli ("
+
+// errUnchanged tells update that fn changed nothing, so nothing is written.
+var errUnchanged = errors.New("unchanged")
+
+// AllowsLibrary reports whether the token may touch library id.
+func (t Token) AllowsLibrary(id string) bool {
+	return len(t.Libraries) == 0 || slices.Contains(t.Libraries, id)
+}
+
+// lastUsedFlush is how often last-used times are written back to disk.
+const lastUsedFlush = time.Minute
+
+// Store is the token store; safe for concurrent use.
+type Store struct {
+	path string // "" = memory only (tests)
+
+	mu        sync.Mutex
+	tokens    []Token
+	modTime   time.Time // of path when last loaded / saved
+	lastUsed  map[string]int64
+	lastFlush time.Time
+}
+
+// StorePath returns the path of tokens.json, next to the token file.
+func StorePath() string {
+	return filepath.Join(filepath.Dir(TokenPath()), "tokens.json")
+}
+
+// OpenStore loads the token store at path (path "" keeps it in memory) and
+// imports bootstrap, the legacy shared secret, as the admin token "default"
+// unless a token with that secret already exists (active or revoked).
+func OpenStore(path, bootstrap string) (*Store, error) {
+	s := &Store{path: path, lastUsed: map[string]int64{}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if bootstrap == "" {
+		return s, nil
+	}
+	h := hashSecret(bootstrap)
+	err := s.update(func() error {
+		for _, t := range s.tokens {
+			if t.Hash == h {
+				return errUnchanged
+			}
+		}
+		id := "default"
+		if s.find(id) >= 0 {
+			id = newTokenID()
+		}
+		s.tokens = append(s.tokens, Token{ID: id, Name: id, Scope: ScopeAdmin, Hash: h, CreatedAt: time.Now().UnixMilli()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Create adds a token and returns it with its secret, which is not stored
+// and cannot be shown again. Names must be unique among active tokens; admin
+// tokens cannot be library-restricted.
+func (s *Store) Create(name string, scope Scope, libraries []string) (Token, string, error) {
+	return s.create(name, scope, libraries, "", 0)
+}
+
+// CreateTemporary is Create for a token that expires after ttl. Delete it
+// when done; an expired one is dropped from the store on the next write.
+func (s *Store) CreateTemporary(name string, scope Scope, ttl time.Duration) (Token, string, error) {
+	return s.create(name, scope, nil, "", ttl)
+}
+
+// create is Create, recording the client's origin (pairing) and, for ttl > 0,
+// an expiry.
+func (s *Store) create(name string, scope Scope, libraries []string, origin string, ttl time.Duration) (Token, string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return Token{}, "", fmt.Errorf("token name is required")
+	case scope.rank() == 0:
+		return Token{}, "", fmt.Errorf("scope must be read, write or admin, got %q", scope)
+	case scope == ScopeAdmin && len(libraries) > 0:
+		return Token{}, "", fmt.Errorf("admin tokens cannot be restricted to libraries")
+	}
+	secret, err := generateToken()
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = "mv_" + secret
+
+	now := time.Now()
+	t := Token{
+		ID: newTokenID(), Name: name, Scope: scope, Libraries: libraries, Origin: origin,
+		Hash: hashSecret(secret), CreatedAt: now.UnixMilli(),
+	}
+	if ttl > 0 {
+		t.ExpiresAt = now.Add(ttl).UnixMilli()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.update(func() error {
+		for _, o := range s.tokens {
+			if o.Active() && o.Name == name {
+				return fmt.Errorf("an active token named %q already exists", name)
+			}
+		}
+		s.tokens = append(s.tokens, t)
+		return nil
+	})
+	if err != nil {
+		return Token{}, "", err
+	}
+	return t, secret, nil
+}
+
+// List returns all tokens, revoked ones included, oldest first.
+func (s *Store) List() ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	out := make([]Token, len(s.tokens))
+	for i, t := range s.tokens {
+		if ts := s.lastUsed[t.ID]; ts > t.LastUsedAt {
+			t.LastUsedAt = ts
+		}
+		out[i] = t
+	}
+	return out, nil
+}
+
+// Origins returns the distinct origins of active paired tokens.
+func (s *Store) Origins() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.reload()
+	var out []string
+	for _, t := range s.tokens {
+		if t.Active() && t.Origin != "" && !slices.Contains(out, t.Origin) {
+			out = append(out, t.Origin)
+		}
+	}
+	return out
+}
+
+// Revoke marks the active token with the given ID or name as revoked.
+func (s *Store) Revoke(idOrName string) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var revoked Token
+	err := s.update(func() error {
+		for i := range s.tokens {
+			t := &s.tokens[i]
+			if t.Active() && (t.ID == idOrName || t.Name == idOrName) {
+				t.RevokedAt = time.Now().UnixMilli()
+				revoked = *t
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrTokenNotFound, idOrName)
+	})
+	return revoked, err
+}
+
+// Delete removes the token with the given ID from the store altogether,
+// leaving no revoked entry behind. For temporary tokens.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(func() error {
+		i := s.find(id)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrTokenNotFound, id)
+		}
+		s.tokens = slices.Delete(s.tokens, i, i+1)
+		return nil
+	})
+}
+
+// Authenticate returns the active token whose secret is secret. The hash is
+// compared against every stored token in constant time. Last-used times are
+// kept in memory and written back at most once a minute.
+func (s *Store) Authenticate(secret string) (Token, bool) {
+	if secret == "" {
+		return Token{}, false
+	}
+	h := []byte(hashSecret(secret))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.reload() // keep serving the last good copy if the file is unreadable
+	match := -1
+	for i, t := range s.tokens {
+		if subtle.ConstantTimeCompare(h, []byte(t.Hash)) == 1 && t.Active() {
+			match = i
+		}
+	}
+	if match < 0 {
+		return Token{}, false
+	}
+	now := time.Now()
+	t := s.tokens[match]
+	s.lastUsed[t.ID] = now.UnixMilli()
+	t.LastUsedAt = now.UnixMilli()
+	if now.Sub(s.lastFlush) >= lastUsedFlush {
+		s.lastFlush = now
+		_ = s.update(func() error { return nil })
+	}
+	return t, true
+}
+
+// find returns the index of the token with id, or -1.
+func (s *Store) find(id string) int {
+	for i, t := range s.tokens {
+		if t.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// load reads the store file; a missing file is an empty store.
+func (s *Store) load() error {
+	if s.path == "" {
+		return nil
+	}
+	fi, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("parse %s: %w", s.path, err)
+	}
+	s.tokens, s.modTime = tokens, fi.ModTime()
+	return nil
+}
+
+// reload re-reads the store file if another process changed it.
+func (s *Store) reload() error {
+	if s.path == "" {
+		return nil
+	}
+	fi, err := os.Stat(s.path)
+	if err != nil || fi.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	return s.load()
+}
+
+// update re-reads the store and, if fn succeeds, saves what fn left in
+// s.tokens, holding an exclusive lock on <path>.lock throughout so another
+// process cannot write in between. Caller holds mu.
+func (s *Store) update(fn func() error) error {
+	if s.path != "" {
+		if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+			return fmt.Errorf("create token dir: %w", err)
+		}
+		f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("lock tokens: %w", err)
+		}
+		defer f.Close()
+		if err := lockFile(f); err != nil {
+			return fmt.Errorf("lock tokens: %w", err)
+		}
+		defer unlockFile(f)
+		if err := s.load(); err != nil {
+			return err
+		}
+	}
+	if err := fn(); err != nil {
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		return err
+	}
+	return s.save()
+}
+
+// save writes the store atomically (temp file + rename), folding in the
+// in-memory last-used times and dropping expired temporary tokens and the
+// revoked per-call tokens of older mvaultd commands. Use update, which
+// re-reads the file under its lock first.
+func (s *Store) save() error {
+	now := time.Now().UnixMilli()
+	s.tokens = slices.DeleteFunc(s.tokens, func(t Token) bool {
+		return t.expired(now) || (t.RevokedAt != 0 && strings.HasPrefix(t.Name, legacyCLIPrefix))
+	})
+	for i := range s.tokens {
+		if ts := s.lastUsed[s.tokens[i].ID]; ts > s.tokens[i].LastUsedAt {
+			s.tokens[i].LastUsedAt = ts
+		}
+	}
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("create token dir: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("write tokens: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write tokens: %w", err)
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTokenID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return "tok_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorePersistsAndReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	daemon, err := OpenStore(path, "legacy-secret")
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if tok, ok := daemon.Authenticate("legacy-secret"); !ok || tok.ID != "default" || tok.Scope != ScopeAdmin {
+		t.Fatalf("legacy secret: %+v, %v", tok, ok)
+	}
+
+	// A second process (the CLI) creates a token; the daemon sees it.
+	cli, err := OpenStore(path, "legacy-secret")
+	if err != nil {
+		t.Fatalf("OpenStore (cli): %v", err)
+	}
+	if list, _ := cli.List(); len(list) != 1 {
+		t.Fatalf("legacy token imported twice: %+v", list)
+	}
+	tok, secret, err := cli.Create("script", ScopeRead, []string{"lib-1"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, _, err := cli.Create("script", ScopeRead, nil); err == nil {
+		t.Error("duplicate active name accepted")
+	}
+	if _, _, err := cli.Create("x", ScopeAdmin, []string{"lib-1"}); err == nil {
+		t.Error("library-restricted admin token accepted")
+	}
+	data, _ := os.ReadFile(path)
+	if len(secret) < 60 || strings.Contains(string(data), secret) {
+		t.Error("secret stored in clear or too short")
+	}
+	got, ok := daemon.Authenticate(secret)
+	if !ok || got.ID != tok.ID || !got.AllowsLibrary("lib-1") || got.AllowsLibrary("lib-2") {
+		t.Fatalf("daemon did not pick up the new token: %+v, %v", got, ok)
+	}
+	if got.Scope.Includes(ScopeWrite) || !got.Scope.Includes(ScopeRead) {
+		t.Errorf("scope %s", got.Scope)
+	}
+
+	// Revocation through the CLI takes effect on the daemon's next request.
+	time.Sleep(10 * time.Millisecond) // distinct mtime on coarse filesystems
+	if _, err := cli.Revoke("script"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, ok := daemon.Authenticate(secret); ok {
+		t.Error("revoked token still accepted")
+	}
+	if _, err := cli.Revoke("default"); err != nil {
+		t.Fatalf("Revoke default: %v", err)
+	}
+	if _, ok := daemon.Authenticate("legacy-secret"); ok {
+		t.Error("revoked legacy secret still accepted")
+	}
+	if _, err := cli.Revoke("missing"); err == nil {
+		t.Error("revoking an unknown token succeeded")
+	}
+}
+
+func TestTemporaryTokensAndLockedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	// A file left by an older CLI: one revoked token per call.
+	legacy := `[{"id":"old1","name":"mvaultd cli (1700000000)","scope":"admin","hash":"x","createdAt":1,"revokedAt":2}]`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	daemon, err := OpenStore(path, "legacy-secret")
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if list, _ := daemon.List(); len(list) != 1 || list[0].ID != "default" {
+		t.Errorf("leftover CLI tokens not pruned: %+v", list)
+	}
+
+	// The CLI's token works, and is gone without a trace once deleted.
+	cli, _ := OpenStore(path, "legacy-secret")
+	tok, secret, err := cli.CreateTemporary("mvaultd command (pid 1)", ScopeAdmin, time.Minute)
+	if err != nil || tok.ExpiresAt == 0 {
+		t.Fatalf("CreateTemporary: %+v, %v", tok, err)
+	}
+	if _, ok := daemon.Authenticate(secret); !ok {
+		t.Fatal("temporary token rejected")
+	}
+	if err := cli.Delete(tok.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if list, _ := daemon.List(); len(list) != 1 {
+		t.Errorf("deleted token left an entry: %+v", list)
+	}
+
+	// A CLI that dies leaves a token that expires and is dropped on the next write.
+	tok, secret, _ = cli.CreateTemporary("mvaultd command (pid 2)", ScopeAdmin, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := daemon.Authenticate(secret); ok {
+		t.Error("expired temporary token accepted")
+	}
+	if _, _, err := cli.Create("script", ScopeRead, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), tok.ID) {
+		t.Error("expired temporary token kept in the file")
+	}
+
+	// The daemon's last-used flush re-reads the file under the lock, so a
+	// token another process just added survives even if the mtime did not move.
+	fi, _ := os.Stat(path)
+	before := fi.ModTime()
+	if _, _, err := cli.Create("late", ScopeRead, nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(path, before, before)
+	daemon.lastFlush = time.Time{}
+	if _, ok := daemon.Authenticate("legacy-secret"); !ok {
+		t.Fatal("legacy secret rejected")
+	}
+	data, _ = os.ReadFile(path)
+	if !strings.Contains(string(data), `"late"`) {
+		t.Error("daemon's last-used save dropped a token created by the CLI")
+	}
+}
@@ -16,9 +16,10 @@ import (
 const tokenLength = 32
 
 // TokenPath returns the platform-appropriate path to the token file.
-//   Windows: %APPDATA%\MindVault\token
-//   macOS:   ~/Library/Application Support/MindVault/token
-//   Linux:   ~/.local/share/MindVault/token
+//
+//	Windows: %APPDATA%\MindVault\token
+//	macOS:   ~/Library/Application Support/MindVault/token
+//	Linux:   ~/.local/share/MindVault/token
 func TokenPath() string {
 	var base string
 	switch runtime.GOOS {
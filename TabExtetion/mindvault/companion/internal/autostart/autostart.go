@@ -0,0 +1,147 @@
+// Package autostart registers the daemon to start when the user logs in: a
+// systemd user unit or an XDG autostart entry on Linux (and the BSDs), a
+// LaunchAgent on macOS and a Task Scheduler logon task on Windows.
+//
+// Backends only write files below Env's directories and run commands through
+// Env.Run, so tests point them at a temporary home directory.
+package autostart
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnknown is returned by Select for a backend name it does not know.
+var ErrUnknown = errors.New("unknown autostart backend")
+
+// ErrUnsupported is returned by Select when no backend works on this system.
+var ErrUnsupported = errors.New("autostart is not supported on this system")
+
+// Backend registers a command to run at login.
+type Backend interface {
+	Name() string // "systemd" | "xdg" | "launchd" | "schtasks"
+	// Available reports whether the backend works on this system (e.g. a
+	// systemd user instance is running).
+	Available() bool
+	Enabled() (bool, error)
+	// Enable registers cmd (cmd[0] is the executable), replacing an earlier
+	// registration. It does not start anything now.
+	Enable(cmd []string) error
+	// Disable removes the registration; it is a no-op if there is none.
+	Disable() error
+}
+
+// Env is where backends keep their files and how they run commands.
+type Env struct {
+	Home       string // the user's home directory
+	ConfigHome string // $XDG_CONFIG_HOME; "" = Home/.config
+	// Run runs a command and returns its combined output; nil runs it for real.
+	Run func(name string, args ...string) ([]byte, error)
+}
+
+// UserEnv returns the Env of the current user.
+func UserEnv() (Env, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return Env{}, err
+	}
+	return Env{Home: home, ConfigHome: os.Getenv("XDG_CONFIG_HOME")}, nil
+}
+
+func (e Env) configHome() string {
+	if e.ConfigHome != "" {
+		return e.ConfigHome
+	}
+	return filepath.Join(e.Home, ".config")
+}
+
+func (e Env) run(name string, args ...string) ([]byte, error) {
+	if e.Run != nil {
+		return e.Run(name, args...)
+	}
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// Backends returns the backends for goos, most preferred first.
+func Backends(goos string, env Env) []Backend {
+	switch goos {
+	case "windows":
+		return []Backend{NewSchtasks(env)}
+	case "darwin":
+		return []Backend{NewLaunchd(env)}
+	default:
+		return []Backend{NewSystemd(env), NewXDG(env)}
+	}
+}
+
+// Select returns the backend called name ("" or "auto" = the first available
+// one) among those for goos.
+func Select(goos, name string, env Env) (Backend, error) {
+	for _, b := range Backends(goos, env) {
+		if name == "" || name == "auto" {
+			if b.Available() {
+				return b, nil
+			}
+		} else if b.Name() == name {
+			return b, nil
+		}
+	}
+	if name == "" || name == "auto" {
+		return nil, ErrUnsupported
+	}
+	return nil, fmt.Errorf("%w %q on %s", ErrUnknown, name, goos)
+}
+
+// writeFile writes data to path atomically, creating its directory.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeFile removes path; a missing file is not an error.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// quoteArgs joins args for a command line that splits on spaces and honours
+// double quotes with backslash escapes (systemd units, .desktop files). Only
+// arguments that need it are quoted; escape lists the characters escaped
+// inside quotes besides '"' and '\'.
+func quoteArgs(args []string, escape string) string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && !strings.ContainsAny(a, " \t\"\\'"+escape) {
+			out[i] = a
+			continue
+		}
+		var b strings.Builder
+		b.WriteByte('"')
+		for _, r := range a {
+			if r == '"' || r == '\\' || strings.ContainsRune(escape, r) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+		out[i] = b.String()
+	}
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,153 @@
+package autostart
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSystemctl stands in for `systemctl --user`, tracking enabled units.
+type fakeSystemctl struct {
+	running bool
+	enabled map[string]bool
+	calls   []string
+}
+
+func (f *fakeSystemctl) run(name string, args ...string) ([]byte, error) {
+	f.calls = append(f.calls, name+" "+strings.Join(args, " "))
+	if name != "systemctl" || !f.running {
+		return nil, errors.New("not found")
+	}
+	switch args[1] {
+	case "enable":
+		f.enabled[args[2]] = true
+	case "disable":
+		delete(f.enabled, args[2])
+	case "is-enabled":
+		if !f.enabled[args[2]] {
+			return []byte("disabled\n"), errors.New("exit status 1")
+		}
+		return []byte("enabled\n"), nil
+	}
+	return nil, nil
+}
+
+func testEnv(t *testing.T, f *fakeSystemctl) Env {
+	return Env{Home: t.TempDir(), Run: f.run}
+}
+
+// exercise enables, checks and disables any backend; it returns the file the
+// registration was written to.
+func exercise(t *testing.T, b Backend, file string) string {
+	t.Helper()
+	if on, err := b.Enabled(); err != nil || on {
+		t.Fatalf("%s enabled before Enable: %v, %v", b.Name(), on, err)
+	}
+	cmd := []string{"/opt/Mind Vault/mvaultd", "serve", "-config", `/home/u/100%"x"$HOME.json`}
+	if err := b.Enable(cmd); err != nil {
+		t.Fatalf("%s Enable: %v", b.Name(), err)
+	}
+	if on, err := b.Enabled(); err != nil || !on {
+		t.Fatalf("%s not enabled after Enable: %v, %v", b.Name(), on, err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%s file: %v", b.Name(), err)
+	}
+	if err := b.Enable(cmd); err != nil { // replacing is fine
+		t.Fatalf("%s Enable again: %v", b.Name(), err)
+	}
+	if err := b.Disable(); err != nil {
+		t.Fatalf("%s Disable: %v", b.Name(), err)
+	}
+	if on, _ := b.Enabled(); on {
+		t.Errorf("%s still enabled after Disable", b.Name())
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("%s file left behind: %v", b.Name(), err)
+	}
+	if err := b.Disable(); err != nil {
+		t.Errorf("%s second Disable: %v", b.Name(), err)
+	}
+	return string(data)
+}
+
+func TestSystemdBackend(t *testing.T) {
+	f := &fakeSystemctl{running: true, enabled: map[string]bool{}}
+	env := testEnv(t, f)
+	unit := exercise(t, NewSystemd(env), filepath.Join(env.Home, ".config", "systemd", "user", "mvaultd.service"))
+	want := `ExecStart="/opt/Mind Vault/mvaultd" serve -config "/home/u/100%%\"x\"$$HOME.json"`
+	if !strings.Contains(unit, want+"\n") || !strings.Contains(unit, "WantedBy=default.target") {
+		t.Errorf("unit:\n%s\nwant %s", unit, want)
+	}
+	if !strings.Contains(strings.Join(f.calls, "\n"), "systemctl --user daemon-reload\nsystemctl --user enable mvaultd.service") {
+		t.Errorf("systemctl calls: %q", f.calls)
+	}
+}
+
+func TestXDGBackend(t *testing.T) {
+	env := testEnv(t, &fakeSystemctl{})
+	env.ConfigHome = filepath.Join(env.Home, "cfg")
+	x := NewXDG(env)
+	path := filepath.Join(env.ConfigHome, "autostart", "mvaultd.desktop")
+	entry := exercise(t, x, path)
+	want := `Exec="/opt/Mind Vault/mvaultd" serve -config "/home/u/100%%\\"x\\"\\$HOME.json"`
+	if !strings.Contains(entry, want+"\n") {
+		t.Errorf("desktop entry:\n%s\nwant %s", entry, want)
+	}
+
+	// A session that switched the entry off leaves it hidden.
+	if err := x.Enable([]string{"/usr/bin/mvaultd"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, append(data, "Hidden=true\n"...), 0644)
+	if on, _ := x.Enabled(); on {
+		t.Error("hidden entry reported enabled")
+	}
+}
+
+func TestLaunchdBackend(t *testing.T) {
+	env := testEnv(t, &fakeSystemctl{})
+	plist := exercise(t, NewLaunchd(env), filepath.Join(env.Home, "Library", "LaunchAgents", "com.mindvault.companion.plist"))
+	for _, want := range []string{
+		"<string>/opt/Mind Vault/mvaultd</string>",
+		"<string>/home/u/100%&#34;x&#34;$HOME.json</string>",
+		"<key>RunAtLoad</key>\n\t<true/>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("plist lacks %q:\n%s", want, plist)
+		}
+	}
+}
+
+func TestSchtasksCommandLine(t *testing.T) {
+	if got := windowsArgs([]string{`C:\Program Files\MindVault\mvaultd.exe`, "serve"}); got != `"C:\Program Files\MindVault\mvaultd.exe" serve` {
+		t.Errorf("windowsArgs: %s", got)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	f := &fakeSystemctl{enabled: map[string]bool{}}
+	env := testEnv(t, f)
+
+	// No systemd user instance: auto falls back to XDG autostart.
+	if b, err := Select("linux", "auto", env); err != nil || b.Name() != "xdg" {
+		t.Errorf("auto without systemd: %v, %v", b, err)
+	}
+	f.running = true
+	if b, err := Select("linux", "", env); err != nil || b.Name() != "systemd" {
+		t.Errorf("auto with systemd: %v, %v", b, err)
+	}
+	if b, err := Select("linux", "xdg", env); err != nil || b.Name() != "xdg" {
+		t.Errorf("xdg: %v, %v", b, err)
+	}
+	if b, err := Select("darwin", "", env); err != nil || b.Name() != "launchd" {
+		t.Errorf("darwin: %v, %v", b, err)
+	}
+	if _, err := Select("darwin", "systemd", env); !errors.Is(err, ErrUnknown) {
+		t.Errorf("systemd on darwin: %v", err)
+	}
+}
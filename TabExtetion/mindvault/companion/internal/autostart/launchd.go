@@ -0,0 +1,67 @@
+package autostart
+
+import (
+	"bytes"
+	"encoding/xml"
+	"path/filepath"
+)
+
+// launchdLabel names the LaunchAgent (and its plist file).
+const launchdLabel = "com.mindvault.companion"
+
+// Launchd writes a LaunchAgent to ~/Library/LaunchAgents, which launchd loads
+// at login. The agent runs the daemon at load and restarts it after a crash.
+// Enable does not load it now (launchctl bootstrap would start a second
+// daemon) and Disable does not unload it (that would stop this one).
+type Launchd struct{ env Env }
+
+// NewLaunchd returns the macOS LaunchAgent backend.
+func NewLaunchd(env Env) *Launchd { return &Launchd{env: env} }
+
+func (l *Launchd) Name() string { return "launchd" }
+
+func (l *Launchd) path() string {
+	return filepath.Join(l.env.Home, "Library", "LaunchAgents", launchdLabel+".plist")
+}
+
+func (l *Launchd) Available() bool { return true }
+
+func (l *Launchd) Enabled() (bool, error) { return exists(l.path()), nil }
+
+func (l *Launchd) Enable(cmd []string) error {
+	var args bytes.Buffer
+	for _, a := range cmd {
+		args.WriteString("\n\t\t<string>")
+		_ = xml.EscapeText(&args, []byte(a))
+		args.WriteString("</string>")
+	}
+	logPath := filepath.Join(l.env.Home, "Library", "Logs", "mvaultd.log")
+	var logFile bytes.Buffer
+	_ = xml.EscapeText(&logFile, []byte(logPath))
+	plist := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + launchdLabel + `</string>
+	<key>ProgramArguments</key>
+	<array>` + args.String() + `
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>` + logFile.String() + `</string>
+	<key>StandardErrorPath</key>
+	<string>` + logFile.String() + `</string>
+</dict>
+</plist>
+`
+	return writeFile(l.path(), []byte(plist))
+}
+
+func (l *Launchd) Disable() error { return removeFile(l.path()) }
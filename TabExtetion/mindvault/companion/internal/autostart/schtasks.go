@@ -0,0 +1,62 @@
+package autostart
+
+import (
+	"fmt"
+	"strings"
+)
+
+// taskName is the Task Scheduler job.
+const taskName = "MindVault Companion Daemon"
+
+// Schtasks registers a Task Scheduler logon task with schtasks.exe (built into
+// Windows). /RL LIMITED runs it without elevation, so no UAC prompt.
+type Schtasks struct{ env Env }
+
+// NewSchtasks returns the Windows Task Scheduler backend.
+func NewSchtasks(env Env) *Schtasks { return &Schtasks{env: env} }
+
+func (s *Schtasks) Name() string { return "schtasks" }
+
+func (s *Schtasks) Available() bool { return true }
+
+func (s *Schtasks) Enabled() (bool, error) {
+	_, err := s.env.run("schtasks", "/Query", "/TN", taskName)
+	return err == nil, nil
+}
+
+func (s *Schtasks) Enable(cmd []string) error {
+	// /F — overwrite if the task already exists.
+	out, err := s.env.run("schtasks", "/Create",
+		"/F", "/TN", taskName,
+		"/TR", windowsArgs(cmd),
+		"/SC", "ONLOGON",
+		"/RL", "LIMITED",
+	)
+	if err != nil {
+		return fmt.Errorf("schtasks: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (s *Schtasks) Disable() error {
+	if on, _ := s.Enabled(); !on {
+		return nil
+	}
+	if out, err := s.env.run("schtasks", "/Delete", "/TN", taskName, "/F"); err != nil {
+		return fmt.Errorf("schtasks: %v: %s", err, out)
+	}
+	return nil
+}
+
+// windowsArgs quotes the arguments that contain spaces; backslashes in paths
+// stay as they are.
+func windowsArgs(cmd []string) string {
+	out := make([]string, len(cmd))
+	for i, a := range cmd {
+		if a == "" || strings.ContainsAny(a, " \t") {
+			a = `"` + a + `"`
+		}
+		out[i] = a
+	}
+	return strings.Join(out, " ")
+}
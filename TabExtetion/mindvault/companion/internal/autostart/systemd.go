@@ -0,0 +1,140 @@
+package autostart
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// unitName is the systemd user unit, desktopName the XDG autostart entry.
+const (
+	unitName    = "mvaultd.service"
+	desktopName = "mvaultd.desktop"
+)
+
+// Systemd installs a user unit in $XDG_CONFIG_HOME/systemd/user and enables it
+// for default.target, so the user's systemd instance starts the daemon at
+// login and restarts it if it crashes.
+type Systemd struct{ env Env }
+
+// NewSystemd returns the systemd --user backend.
+func NewSystemd(env Env) *Systemd { return &Systemd{env: env} }
+
+func (s *Systemd) Name() string { return "systemd" }
+
+func (s *Systemd) path() string {
+	return filepath.Join(s.env.configHome(), "systemd", "user", unitName)
+}
+
+// Available reports whether a systemd user instance answers.
+func (s *Systemd) Available() bool {
+	_, err := s.env.run("systemctl", "--user", "show-environment")
+	return err == nil
+}
+
+func (s *Systemd) Enabled() (bool, error) {
+	if !exists(s.path()) {
+		return false, nil
+	}
+	out, err := s.env.run("systemctl", "--user", "is-enabled", unitName)
+	return err == nil && strings.TrimSpace(string(out)) == "enabled", nil
+}
+
+func (s *Systemd) Enable(cmd []string) error {
+	unit := fmt.Sprintf(`[Unit]
+Description=MindVault Companion Daemon
+After=default.target
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=default.target
+`, systemdArgs(cmd))
+	if err := writeFile(s.path(), []byte(unit)); err != nil {
+		return err
+	}
+	if out, err := s.env.run("systemctl", "--user", "daemon-reload"); err != nil {
+		return fmt.Errorf("systemctl daemon-reload: %v: %s", err, out)
+	}
+	// Not --now: the daemon asking is usually the one that would start.
+	if out, err := s.env.run("systemctl", "--user", "enable", unitName); err != nil {
+		return fmt.Errorf("systemctl enable: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (s *Systemd) Disable() error {
+	if !exists(s.path()) {
+		return nil
+	}
+	if out, err := s.env.run("systemctl", "--user", "disable", unitName); err != nil {
+		return fmt.Errorf("systemctl disable: %v: %s", err, out)
+	}
+	if err := removeFile(s.path()); err != nil {
+		return err
+	}
+	_, _ = s.env.run("systemctl", "--user", "daemon-reload")
+	return nil
+}
+
+// XDG writes an autostart entry to $XDG_CONFIG_HOME/autostart, which desktop
+// sessions (GNOME, KDE, Xfce, …) run at login. It needs no running service.
+type XDG struct{ env Env }
+
+// NewXDG returns the XDG autostart backend.
+func NewXDG(env Env) *XDG { return &XDG{env: env} }
+
+func (x *XDG) Name() string { return "xdg" }
+
+func (x *XDG) path() string {
+	return filepath.Join(x.env.configHome(), "autostart", desktopName)
+}
+
+func (x *XDG) Available() bool { return true }
+
+// Enabled reports whether the entry exists and is not hidden or disabled (a
+// session's settings dialog may have turned it off).
+func (x *XDG) Enabled() (bool, error) {
+	data, err := os.ReadFile(x.path())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch strings.TrimSpace(line) {
+		case "Hidden=true", "X-GNOME-Autostart-enabled=false":
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (x *XDG) Enable(cmd []string) error {
+	// Inside quotes $ and ` are escaped too. The file's own string escapes
+	// apply first, so every backslash is doubled, and % (a field code) as well.
+	exec := strings.NewReplacer(`\`, `\\`, "%", "%%").Replace(quoteArgs(cmd, "$`"))
+	entry := fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=MindVault Companion
+Comment=Local companion daemon for the MindVault extension
+Exec=%s
+Terminal=false
+NoDisplay=true
+X-GNOME-Autostart-enabled=true
+`, exec)
+	return writeFile(x.path(), []byte(entry))
+}
+
+func (x *XDG) Disable() error { return removeFile(x.path()) }
+
+// systemdArgs quotes cmd for ExecStart, where % starts a specifier and $ a
+// variable; both are doubled to stay literal.
+func systemdArgs(cmd []string) string {
+	return strings.NewReplacer("%", "%%", "$", "$$").Replace(quoteArgs(cmd, ""))
+}
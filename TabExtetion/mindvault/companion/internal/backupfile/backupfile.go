@@ -0,0 +1,401 @@
+// Package backupfile encodes database backup files: optional gzip compression
+// and optional passphrase-based authenticated encryption.
+//
+// File extensions:
+//
+//	.sqlite      plain SQLite database
+//	.sqlite.gz   gzip-compressed database
+//	.sqlite.enc  encrypted (and optionally compressed) database
+//
+// Encrypted layout:
+//
+//	"MVBK" | version (1 byte) | header length (uint32 BE) | header JSON | chunks…
+//
+// The header records the KDF (scrypt) and its parameters, the salt, the cipher
+// and the compression applied before encryption. Each chunk is
+//
+//	length (uint32 BE, high bit set on the final chunk) | AES-256-GCM ciphertext
+//
+// sealed with nonce = noncePrefix(7) | chunk counter (uint32 BE) | final flag
+// and the whole header as additional data, so reordered, truncated or
+// re-parameterised files fail to decrypt.
+package backupfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Backup filename extensions.
+const (
+	ExtPlain     = ".sqlite"
+	ExtGzip      = ".sqlite.gz"
+	ExtEncrypted = ".sqlite.enc"
+)
+
+// Compression values for Options.Compression and Header.Compression.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+const (
+	magic      = "MVBK"
+	version    = 1
+	chunkSize  = 64 << 10
+	finalFlag  = 1 << 31
+	prefixSize = 7
+)
+
+// scrypt parameters for new files (~100 ms on a laptop). Decoding always uses
+// the parameters recorded in the header.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	// ErrNoPassphrase is returned when an encrypted backup is read or written
+	// without a passphrase.
+	ErrNoPassphrase = errors.New("backup is encrypted: passphrase required")
+	// ErrDecrypt covers a wrong passphrase as well as a tampered or truncated file.
+	ErrDecrypt = errors.New("wrong passphrase or corrupted backup")
+)
+
+// Options selects how Encode writes a backup.
+type Options struct {
+	Compression string // CompressionNone (or "") | CompressionGzip
+	Passphrase  string // non-empty = encrypt
+}
+
+// Ext returns the filename extension for backups written with o.
+func (o Options) Ext() string {
+	switch {
+	case o.Passphrase != "":
+		return ExtEncrypted
+	case o.Compression == CompressionGzip:
+		return ExtGzip
+	}
+	return ExtPlain
+}
+
+// Validate rejects unknown compression names.
+func (o Options) Validate() error {
+	switch o.Compression {
+	case "", CompressionNone, CompressionGzip:
+		return nil
+	}
+	return fmt.Errorf("unknown backup compression %q (want none or gzip)", o.Compression)
+}
+
+// Header is the JSON header of an encrypted backup.
+type Header struct {
+	KDF         string `json:"kdf"` // "scrypt"
+	N           int    `json:"n"`
+	R           int    `json:"r"`
+	P           int    `json:"p"`
+	Salt        []byte `json:"salt"`
+	Cipher      string `json:"cipher"` // "aes-256-gcm"
+	ChunkSize   int    `json:"chunkSize"`
+	NoncePrefix []byte `json:"noncePrefix"`
+	Compression string `json:"compression"`
+}
+
+// IsBackupName reports whether name has one of the backup extensions.
+func IsBackupName(name string) bool {
+	return strings.HasSuffix(name, ExtPlain) || strings.HasSuffix(name, ExtGzip) || strings.HasSuffix(name, ExtEncrypted)
+}
+
+// TrimExt strips the backup extension from name.
+func TrimExt(name string) string {
+	for _, ext := range []string{ExtEncrypted, ExtGzip, ExtPlain} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// IsEncrypted reports whether name is an encrypted backup.
+func IsEncrypted(name string) bool { return strings.HasSuffix(name, ExtEncrypted) }
+
+// IsCompressed reports whether the backup name is gzip-compressed. A .sqlite.gz
+// always is; an encrypted backup records it in its header, which is read from
+// src, the start of the file (nil when the content is not at hand: reported as
+// not compressed).
+func IsCompressed(name string, src io.Reader) bool {
+	switch {
+	case strings.HasSuffix(name, ExtGzip):
+		return true
+	case IsEncrypted(name) && src != nil:
+		h, _, err := ReadHeader(src)
+		return err == nil && h.Compression == CompressionGzip
+	}
+	return false
+}
+
+// Encode writes src to dst as described by o.
+func Encode(dst io.Writer, src io.Reader, o Options) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if o.Passphrase == "" {
+		if o.Compression != CompressionGzip {
+			_, err := io.Copy(dst, src)
+			return err
+		}
+		return gzipTo(dst, src)
+	}
+
+	h := Header{KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Cipher: "aes-256-gcm",
+		ChunkSize: chunkSize, Compression: CompressionNone, Salt: make([]byte, 16), NoncePrefix: make([]byte, prefixSize)}
+	if o.Compression == CompressionGzip {
+		h.Compression = CompressionGzip
+	}
+	if _, err := rand.Read(h.Salt); err != nil {
+		return err
+	}
+	if _, err := rand.Read(h.NoncePrefix); err != nil {
+		return err
+	}
+	hdr, err := marshalHeader(h)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(o.Passphrase, h)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(hdr); err != nil {
+		return err
+	}
+	sw := &sealWriter{dst: dst, aead: aead, prefix: h.NoncePrefix, aad: hdr}
+	if h.Compression == CompressionGzip {
+		err = gzipTo(sw, src)
+	} else {
+		_, err = io.Copy(sw, src)
+	}
+	if err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// Decode writes the plain database held in src to dst. name is the backup's
+// filename and selects the format; passphrase is needed for ExtEncrypted.
+func Decode(dst io.Writer, src io.Reader, name, passphrase string) error {
+	switch {
+	case IsEncrypted(name):
+		return decrypt(dst, src, passphrase)
+	case strings.HasSuffix(name, ExtGzip):
+		return gunzipTo(dst, src)
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// ReadHeader parses the header of an encrypted backup.
+func ReadHeader(src io.Reader) (Header, []byte, error) {
+	var h Header
+	pre := make([]byte, len(magic)+1+4)
+	if _, err := io.ReadFull(src, pre); err != nil {
+		return h, nil, fmt.Errorf("read header: %w", err)
+	}
+	if string(pre[:len(magic)]) != magic {
+		return h, nil, fmt.Errorf("not an encrypted MindVault backup")
+	}
+	if pre[len(magic)] != version {
+		return h, nil, fmt.Errorf("unsupported backup format version %d", pre[len(magic)])
+	}
+	n := binary.BigEndian.Uint32(pre[len(magic)+1:])
+	if n > 64<<10 {
+		return h, nil, fmt.Errorf("backup header too large")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(src, body); err != nil {
+		return h, nil, fmt.Errorf("read header: %w", err)
+	}
+	if err := json.Unmarshal(body, &h); err != nil {
+		return h, nil, fmt.Errorf("parse header: %w", err)
+	}
+	if h.KDF != "scrypt" || h.Cipher != "aes-256-gcm" || len(h.NoncePrefix) != prefixSize || h.ChunkSize <= 0 {
+		return h, nil, fmt.Errorf("unsupported backup header %s/%s", h.KDF, h.Cipher)
+	}
+	return h, append(pre, body...), nil
+}
+
+func decrypt(dst io.Writer, src io.Reader, passphrase string) error {
+	if passphrase == "" {
+		return ErrNoPassphrase
+	}
+	br := bufio.NewReader(src)
+	h, hdr, err := ReadHeader(br)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(passphrase, h)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		if h.Compression == CompressionGzip {
+			done <- gunzipTo(dst, pr)
+		} else {
+			_, err := io.Copy(dst, pr)
+			done <- err
+		}
+		pr.Close()
+	}()
+	err = openChunks(pw, br, aead, h, hdr)
+	pw.CloseWithError(err)
+	if werr := <-done; err == nil {
+		err = werr
+	}
+	return err
+}
+
+// openChunks authenticates and decrypts every chunk, requiring a final one.
+func openChunks(dst io.Writer, src io.Reader, aead cipher.AEAD, h Header, aad []byte) error {
+	var lenBuf [4]byte
+	for counter := uint32(0); ; counter++ {
+		if _, err := io.ReadFull(src, lenBuf[:]); err != nil {
+			return ErrDecrypt // truncated before the final chunk
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		final := n&finalFlag != 0
+		n &^= finalFlag
+		if int(n) > h.ChunkSize+aead.Overhead() {
+			return ErrDecrypt
+		}
+		ct := make([]byte, n)
+		if _, err := io.ReadFull(src, ct); err != nil {
+			return ErrDecrypt
+		}
+		pt, err := aead.Open(ct[:0], nonce(h.NoncePrefix, counter, final), ct, aad)
+		if err != nil {
+			return ErrDecrypt
+		}
+		if _, err := dst.Write(pt); err != nil {
+			return err
+		}
+		if final {
+			if _, err := src.Read(lenBuf[:1]); err != io.EOF {
+				return ErrDecrypt // trailing data after the final chunk
+			}
+			return nil
+		}
+	}
+}
+
+// sealWriter buffers plaintext into chunks and seals them; Close seals the
+// final (possibly empty) chunk.
+type sealWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	buf     []byte
+	counter uint32
+}
+
+func (w *sealWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > chunkSize {
+		if err := w.seal(w.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[chunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *sealWriter) Close() error {
+	return w.seal(w.buf, true)
+}
+
+func (w *sealWriter) seal(pt []byte, final bool) error {
+	ct := w.aead.Seal(nil, nonce(w.prefix, w.counter, final), pt, w.aad)
+	w.counter++
+	n := uint32(len(ct))
+	if final {
+		n |= finalFlag
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], n)
+	if _, err := w.dst.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.dst.Write(ct)
+	return err
+}
+
+func nonce(prefix []byte, counter uint32, final bool) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[prefixSize:], counter)
+	if final {
+		n[11] = 1
+	}
+	return n
+}
+
+func newAEAD(passphrase string, h Header) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), h.Salt, h.N, h.R, h.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func marshalHeader(h Header) ([]byte, error) {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(version)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(body)))
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+func gzipTo(dst io.Writer, src io.Reader) error {
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+func gunzipTo(dst io.Writer, src io.Reader) error {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return fmt.Errorf("gunzip: %w", err)
+	}
+	defer zr.Close()
+	if _, err := io.Copy(dst, zr); err != nil {
+		return fmt.Errorf("gunzip: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package backupfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestEncryptedRoundTripAndTamper(t *testing.T) {
+	plain := make([]byte, 3*chunkSize+123) // several chunks plus a partial one
+	_, _ = rand.Read(plain)
+
+	for _, comp := range []string{CompressionNone, CompressionGzip} {
+		var enc bytes.Buffer
+		opts := Options{Compression: comp, Passphrase: "correct horse"}
+		if err := Encode(&enc, bytes.NewReader(plain), opts); err != nil {
+			t.Fatalf("Encode(%s): %v", comp, err)
+		}
+		if opts.Ext() != ExtEncrypted {
+			t.Errorf("Ext: got %s", opts.Ext())
+		}
+		h, _, err := ReadHeader(bytes.NewReader(enc.Bytes()))
+		if err != nil || h.KDF != "scrypt" || h.Compression != comp {
+			t.Fatalf("header: %+v, %v", h, err)
+		}
+		if got := IsCompressed("x"+ExtEncrypted, bytes.NewReader(enc.Bytes())); got != (comp == CompressionGzip) {
+			t.Errorf("IsCompressed(%s) = %v", comp, got)
+		}
+
+		var out bytes.Buffer
+		if err := Decode(&out, bytes.NewReader(enc.Bytes()), "x"+ExtEncrypted, "correct horse"); err != nil {
+			t.Fatalf("Decode(%s): %v", comp, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("%s: round trip mismatch", comp)
+		}
+
+		if err := Decode(&out, bytes.NewReader(enc.Bytes()), "x"+ExtEncrypted, "wrong"); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("wrong passphrase: want ErrDecrypt, got %v", err)
+		}
+		truncated := enc.Bytes()[:enc.Len()-10]
+		if err := Decode(&out, bytes.NewReader(truncated), "x"+ExtEncrypted, "correct horse"); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("truncated: want ErrDecrypt, got %v", err)
+		}
+		if err := Decode(&out, bytes.NewReader(enc.Bytes()), "x"+ExtEncrypted, ""); !errors.Is(err, ErrNoPassphrase) {
+			t.Errorf("no passphrase: want ErrNoPassphrase, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Package backuptarget implements destinations that backups are replicated to
+// besides the local backups directory: another directory (a mounted NAS, a
+// Syncthing folder, …) or an S3-compatible bucket (AWS, MinIO, …).
+package backuptarget
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Object is one file stored on a target.
+type Object struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Target is a backup destination. Names are plain filenames (no directories).
+type Target interface {
+	Name() string
+	Type() string // "dir" | "s3"
+	Put(ctx context.Context, name string, r io.ReadSeeker, size int64) error
+	List(ctx context.Context) ([]Object, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// Dir stores backups in a local (or mounted) directory.
+type Dir struct {
+	name, path string
+}
+
+// NewDir returns a directory target; path is created on first Put.
+func NewDir(name, path string) *Dir {
+	return &Dir{name: name, path: path}
+}
+
+func (d *Dir) Name() string { return d.name }
+func (d *Dir) Type() string { return "dir" }
+
+// Put writes r to a temp file and renames it into place, so a sync client
+// watching the folder never picks up a half-written backup.
+func (d *Dir) Put(ctx context.Context, name string, r io.ReadSeeker, size int64) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.path, 0700); err != nil {
+		return fmt.Errorf("create %s: %w", d.path, err)
+	}
+	dst := filepath.Join(d.path, name)
+	tmp, err := os.CreateTemp(d.path, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("short write: %d of %d bytes", n, size)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// List returns the regular files in the directory (temp files excluded).
+func (d *Dir) List(ctx context.Context) ([]Object, error) {
+	entries, err := os.ReadDir(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var objs []Object
+	for _, e := range entries {
+		if e.IsDir() || e.Name()[0] == '.' {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		objs = append(objs, Object{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Name < objs[j].Name })
+	return objs, nil
+}
+
+// Delete removes name; a missing file is not an error.
+func (d *Dir) Delete(ctx context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(d.path, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkName rejects names that would escape the target.
+func checkName(name string) error {
+	if name == "" || filepath.Base(name) != name || name[0] == '.' {
+		return fmt.Errorf("invalid object name %q", name)
+	}
+	return nil
+}
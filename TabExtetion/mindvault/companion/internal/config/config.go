@@ -0,0 +1,483 @@
+// Package config loads the daemon's optional JSON configuration file.
+// A missing file is not an error: every setting has a default.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Backup configures the in-daemon backup scheduler and its
+// grandfather-father-son retention policy.
+//
+//	IntervalMinutes: time between scheduled backups (0 disables the scheduler).
+//	Keep*: how many of the newest hourly / daily / weekly / monthly backups to
+//	       keep — a backup survives if any of the four rules keeps it.
+//	MaxTotalMB: after the rules, drop the oldest kept backups until the backup
+//	            directory fits (0 = unlimited). The newest backup is never dropped.
+//	Compression: "none" or "gzip".
+//	Encrypt: encrypt backup files with the passphrase from the
+//	         MINDVAULT_BACKUP_PASSPHRASE environment variable or, failing
+//	         that, the first line of PassphraseFile.
+//	Targets: extra destinations every backup is copied to, each pruned with
+//	         its own retention.
+//
+// With the scheduler off the daemon takes one backup a day at startup. Every
+// local backup, however taken, is pruned with the same policy; pre-restore
+// and pre-import snapshots never are.
+// StartupRetainDays is accepted for older config files and ignored.
+type Backup struct {
+	IntervalMinutes int `json:"intervalMinutes"`
+	Retention
+	StartupRetainDays int            `json:"startupRetainDays,omitempty"`
+	Compression       string         `json:"compression"`
+	Encrypt           bool           `json:"encrypt"`
+	PassphraseFile    string         `json:"passphraseFile,omitempty"`
+	Targets           []BackupTarget `json:"targets,omitempty"`
+}
+
+// Retention is a grandfather-father-son policy. Its fields appear inline in
+// the "backup" section and as a "retention" object in a target.
+type Retention struct {
+	KeepHourly  int   `json:"keepHourly"`
+	KeepDaily   int   `json:"keepDaily"`
+	KeepWeekly  int   `json:"keepWeekly"`
+	KeepMonthly int   `json:"keepMonthly"`
+	MaxTotalMB  int64 `json:"maxTotalMB"`
+}
+
+// Backup target types.
+const (
+	TargetDir = "dir"
+	TargetS3  = "s3"
+)
+
+// BackupTarget is a replica destination for backups.
+//
+//	Type "dir": Path is a directory, e.g. a mounted NAS share or a Syncthing folder.
+//	Type "s3":  Endpoint + Bucket (+ Region, Prefix) of an S3-compatible store.
+//	            Credentials are read from the environment variables named by
+//	            AccessKeyEnv / SecretKeyEnv (default AWS_ACCESS_KEY_ID /
+//	            AWS_SECRET_ACCESS_KEY), never from config.json.
+//
+// A target without "retention" uses the backup section's policy.
+type BackupTarget struct {
+	Name         string     `json:"name"`
+	Type         string     `json:"type"`
+	Path         string     `json:"path,omitempty"`
+	Endpoint     string     `json:"endpoint,omitempty"`
+	Region       string     `json:"region,omitempty"`
+	Bucket       string     `json:"bucket,omitempty"`
+	Prefix       string     `json:"prefix,omitempty"`
+	AccessKeyEnv string     `json:"accessKeyEnv,omitempty"`
+	SecretKeyEnv string     `json:"secretKeyEnv,omitempty"`
+	Retention    *Retention `json:"retention,omitempty"`
+}
+
+// Credentials returns the S3 access and secret key from the environment.
+func (t BackupTarget) Credentials() (access, secret string) {
+	ak, sk := t.AccessKeyEnv, t.SecretKeyEnv
+	if ak == "" {
+		ak = "AWS_ACCESS_KEY_ID"
+	}
+	if sk == "" {
+		sk = "AWS_SECRET_ACCESS_KEY"
+	}
+	return os.Getenv(ak), os.Getenv(sk)
+}
+
+// TargetRetention returns t's retention, falling back to the backup section's.
+func (b Backup) TargetRetention(t BackupTarget) Retention {
+	if t.Retention != nil {
+		return *t.Retention
+	}
+	return b.Retention
+}
+
+// PassphraseEnv names the environment variable holding the backup passphrase.
+const PassphraseEnv = "MINDVAULT_BACKUP_PASSPHRASE"
+
+// Passphrase returns the backup passphrase from PassphraseEnv or
+// PassphraseFile ("" when neither is set).
+func (b Backup) Passphrase() (string, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return p, nil
+	}
+	if b.PassphraseFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(b.PassphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("read passphrase file: %w", err)
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimRight(line, "\r"), nil
+}
+
+// Encryption configures server-side encryption of encrypted libraries.
+//
+//	UnlockIdleMinutes: how long an unlocked library's key stays in memory
+//	                   without use before the library locks again.
+type Encryption struct {
+	UnlockIdleMinutes int `json:"unlockIdleMinutes"`
+}
+
+// CORS is the allowlist of browser origins that may call the API. Entries are
+// matched exactly — no prefixes or wildcards.
+//
+//	Origins: web origins, "scheme://host[:port]" without a path,
+//	         e.g. "http://127.0.0.1:8080".
+//	ExtensionIDs: browser extension IDs; each allows chrome-extension://ID,
+//	              moz-extension://ID and safari-web-extension://ID.
+//
+// The dashboard's own origin and the origins of paired clients are always
+// allowed in addition.
+type CORS struct {
+	Origins      []string `json:"origins,omitempty"`
+	ExtensionIDs []string `json:"extensionIds,omitempty"`
+}
+
+// extensionSchemes are the origin schemes of browser extensions.
+var extensionSchemes = []string{"chrome-extension", "moz-extension", "safari-web-extension"}
+
+// AllowedOrigins returns Origins plus the extension origins of ExtensionIDs.
+func (c CORS) AllowedOrigins() []string {
+	out := append([]string{}, c.Origins...)
+	for _, id := range c.ExtensionIDs {
+		for _, scheme := range extensionSchemes {
+			out = append(out, scheme+"://"+id)
+		}
+	}
+	return out
+}
+
+// validOrigin reports whether o is a bare "scheme://host[:port]" origin.
+func validOrigin(o string) bool {
+	u, err := url.Parse(o)
+	return err == nil && u.Scheme != "" && u.Host != "" && u.Scheme+"://"+u.Host == o && u.User == nil
+}
+
+// Listen configures where the REST API is served.
+//
+//	TCP: serve on Address (default true).
+//	Address: TCP "host:port"; default 127.0.0.1:<-port>. Also the -listen
+//	         flag; -port replaces only its port. A non-loopback address
+//	         requires TLS.
+//	Socket: serve on a Unix domain socket as well (or instead, with TCP off).
+//	        The socket is 0600 and requests from other users are refused.
+//	SocketPath: default $XDG_RUNTIME_DIR/mindvault.sock, or mindvault.sock
+//	            in DataDir() when XDG_RUNTIME_DIR is unset.
+type Listen struct {
+	TCP        bool   `json:"tcp"`
+	Address    string `json:"address,omitempty"`
+	Socket     bool   `json:"socket"`
+	SocketPath string `json:"socketPath,omitempty"`
+}
+
+// SocketFile returns the Unix socket path to listen on.
+func (l Listen) SocketFile() string {
+	if l.SocketPath != "" {
+		return l.SocketPath
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "mindvault.sock")
+	}
+	return filepath.Join(DataDir(), "mindvault.sock")
+}
+
+// WithPort returns Address with its port replaced by port, keeping the host
+// (127.0.0.1 when Address is unset). The -port flag applies it after the file
+// and MINDVAULT_LISTEN, so the flag wins.
+func (l Listen) WithPort(port int) string {
+	host := "127.0.0.1"
+	if h, _, err := net.SplitHostPort(l.Address); err == nil && h != "" {
+		host = h
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// TLS configures HTTPS on the TCP listener (see internal/tlscert).
+//
+//	Enabled: serve HTTPS instead of plain HTTP. Also the -tls flag.
+//	Hosts: extra certificate names / IPs, e.g. the machine's LAN hostname for
+//	       a phone; 127.0.0.1, ::1 and localhost are always covered.
+type TLS struct {
+	Enabled bool     `json:"enabled"`
+	Hosts   []string `json:"hosts,omitempty"`
+}
+
+// Dir returns the directory holding the local CA and certificate.
+func (t TLS) Dir() string {
+	return filepath.Join(DataDir(), "tls")
+}
+
+// DB locates the database.
+//
+//	Path: the SQLite file; default db.DefaultDBPath(). Also -db.
+type DB struct {
+	Path string `json:"path,omitempty"`
+}
+
+// Log configures logging.
+//
+//	Level: debug, info, warn or error.
+//	Requests: the level successful requests log at (default info); 4xx
+//	          responses log at warn and 5xx at error.
+//	Format: "text" (key=value) or "json", for stderr and the file alike.
+//	File: also write to <data dir>/logs/mvaultd.log, or to FilePath.
+//	MaxSizeMB / MaxFiles: rotate the file at this size, keeping this many
+//	                      old files (mvaultd.log.1 is the newest).
+type Log struct {
+	Level     string `json:"level"`
+	Requests  string `json:"requests"`
+	Format    string `json:"format"`
+	File      bool   `json:"file"`
+	FilePath  string `json:"filePath,omitempty"`
+	MaxSizeMB int    `json:"maxSizeMB"`
+	MaxFiles  int    `json:"maxFiles"`
+}
+
+// LogFile returns the log file path (default <data dir>/logs/mvaultd.log).
+func (l Log) LogFile() string {
+	if l.FilePath != "" {
+		return l.FilePath
+	}
+	return filepath.Join(DataDir(), "logs", "mvaultd.log")
+}
+
+// History configures retention of captured browsing history.
+//
+//	RetentionDays: delete history entries older than this, except those
+//	               marked important (0 = keep everything).
+type History struct {
+	RetentionDays int `json:"retentionDays"`
+}
+
+// Features switches optional parts of the daemon on and off.
+//
+//	Dashboard: serve the web dashboard under /ui/.
+//	Pairing: accept new pairing requests (POST /pair). With it off, new
+//	         clients need a token from `mvaultd token create`.
+type Features struct {
+	Dashboard bool `json:"dashboard"`
+	Pairing   bool `json:"pairing"`
+}
+
+// Config is the root of config.json.
+type Config struct {
+	Listen     Listen     `json:"listen"`
+	TLS        TLS        `json:"tls"`
+	DB         DB         `json:"db"`
+	Backup     Backup     `json:"backup"`
+	Encryption Encryption `json:"encryption"`
+	CORS       CORS       `json:"cors"`
+	Log        Log        `json:"log"`
+	History    History    `json:"history"`
+	Features   Features   `json:"features"`
+}
+
+// Default returns the settings used when config.json is absent or a field is omitted.
+func Default() Config {
+	return Config{
+		Backup: Backup{
+			IntervalMinutes: 60,
+			Retention: Retention{
+				KeepHourly:  24,
+				KeepDaily:   7,
+				KeepWeekly:  4,
+				KeepMonthly: 12,
+				MaxTotalMB:  0,
+			},
+			Compression: "none",
+		},
+		Encryption: Encryption{UnlockIdleMinutes: 15},
+		Listen:     Listen{TCP: true},
+		Log:        Log{Level: "info", Requests: "info", Format: "text", MaxSizeMB: 10, MaxFiles: 5},
+		Features:   Features{Dashboard: true, Pairing: true},
+	}
+}
+
+// PathEnv names the environment variable that overrides the config file path.
+const PathEnv = "MINDVAULT_CONFIG"
+
+// Path returns the config file to use:
+//
+//	$MINDVAULT_CONFIG, if set;
+//	Linux:   $XDG_CONFIG_HOME/mindvault/config.json (~/.config/mindvault/…),
+//	         or the older ~/.local/share/MindVault/config.json while only
+//	         that one exists;
+//	Windows: %APPDATA%\MindVault\config.json
+//	macOS:   ~/Library/Application Support/MindVault/config.json
+func Path() string {
+	if p := os.Getenv(PathEnv); p != "" {
+		return p
+	}
+	legacy := filepath.Join(DataDir(), "config.json")
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		return legacy
+	}
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		home, _ := os.UserHomeDir()
+		base = filepath.Join(home, ".config")
+	}
+	p := filepath.Join(base, "mindvault", "config.json")
+	if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return p
+}
+
+// DataDir returns the platform's MindVault data directory, which holds the
+// token files, TLS certificates and (by default) the database.
+//
+//	Windows: %APPDATA%\MindVault
+//	macOS:   ~/Library/Application Support/MindVault
+//	Linux:   ~/.local/share/MindVault
+func DataDir() string {
+	var base string
+	switch runtime.GOOS {
+	case "windows":
+		base = os.Getenv("APPDATA")
+	case "darwin":
+		home, _ := os.UserHomeDir()
+		base = filepath.Join(home, "Library", "Application Support")
+	default:
+		home, _ := os.UserHomeDir()
+		base = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(base, "MindVault")
+}
+
+// Load reads the config file at path over Default(). Fields omitted from the
+// file keep their defaults; a missing file yields Default(). Unknown fields
+// are an error, so typos do not go unnoticed.
+func Load(path string) (Config, error) {
+	cfg, err := loadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// LoadLayered returns the effective configuration below command-line flags:
+// Default(), then the file at path, then MINDVAULT_* environment variables
+// (see Env). It also returns the names of the variables that were applied.
+// The caller applies flags on top and validates again.
+func LoadLayered(path string) (Config, []string, error) {
+	cfg, err := loadFile(path)
+	if err != nil {
+		return cfg, nil, err
+	}
+	applied, err := ApplyEnv(&cfg, os.Getenv)
+	if err != nil {
+		return cfg, applied, err
+	}
+	return cfg, applied, cfg.Validate()
+}
+
+func loadFile(path string) (Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("read config: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate rejects settings the daemon cannot act on.
+func (c Config) Validate() error {
+	b := c.Backup
+	if b.IntervalMinutes < 0 || b.KeepHourly < 0 || b.KeepDaily < 0 || b.KeepWeekly < 0 || b.KeepMonthly < 0 || b.MaxTotalMB < 0 {
+		return fmt.Errorf("backup: values must not be negative")
+	}
+	if b.KeepHourly+b.KeepDaily+b.KeepWeekly+b.KeepMonthly == 0 {
+		return fmt.Errorf("backup: retention keeps nothing")
+	}
+	if b.Compression != "" && b.Compression != "none" && b.Compression != "gzip" {
+		return fmt.Errorf("backup: compression must be none or gzip, got %q", b.Compression)
+	}
+	for _, l := range []struct{ name, value string }{{"level", c.Log.Level}, {"requests", c.Log.Requests}} {
+		switch l.value {
+		case "debug", "info", "warn", "error":
+		default:
+			return fmt.Errorf("log: %s must be debug, info, warn or error, got %q", l.name, l.value)
+		}
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("log: format must be text or json, got %q", c.Log.Format)
+	}
+	if c.Log.File && (c.Log.MaxSizeMB <= 0 || c.Log.MaxFiles < 0) {
+		return fmt.Errorf("log: maxSizeMB must be positive and maxFiles not negative")
+	}
+	if c.History.RetentionDays < 0 {
+		return fmt.Errorf("history: retentionDays must not be negative")
+	}
+	if c.Encryption.UnlockIdleMinutes <= 0 {
+		return fmt.Errorf("encryption: unlockIdleMinutes must be positive")
+	}
+	if !c.Listen.TCP && !c.Listen.Socket {
+		return fmt.Errorf("listen: enable tcp, socket or both")
+	}
+	if a := c.Listen.Address; a != "" {
+		_, port, err := net.SplitHostPort(a)
+		if err != nil {
+			return fmt.Errorf("listen: address %q: %w", a, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return fmt.Errorf("listen: address %q: port must be 0-65535", a)
+		}
+	}
+	for _, o := range c.CORS.Origins {
+		if !validOrigin(o) {
+			return fmt.Errorf("cors: origin %q must be scheme://host[:port] without a path", o)
+		}
+	}
+	for _, id := range c.CORS.ExtensionIDs {
+		if id == "" || strings.IndexFunc(id, func(r rune) bool {
+			return !(r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+		}) >= 0 {
+			return fmt.Errorf("cors: extension ID %q may only contain letters, digits and dashes", id)
+		}
+	}
+	seen := map[string]bool{}
+	for i, t := range b.Targets {
+		switch {
+		case t.Name == "" || t.Name == "local":
+			return fmt.Errorf("backup.targets[%d]: name must be set and not \"local\"", i)
+		case seen[t.Name]:
+			return fmt.Errorf("backup.targets[%d]: duplicate name %q", i, t.Name)
+		case t.Type == TargetDir && t.Path == "":
+			return fmt.Errorf("backup.targets[%d] %s: dir target needs a path", i, t.Name)
+		case t.Type == TargetS3 && (t.Endpoint == "" || t.Bucket == ""):
+			return fmt.Errorf("backup.targets[%d] %s: s3 target needs endpoint and bucket", i, t.Name)
+		case t.Type != TargetDir && t.Type != TargetS3:
+			return fmt.Errorf("backup.targets[%d] %s: type must be dir or s3, got %q", i, t.Name, t.Type)
+		}
+		r := b.TargetRetention(t)
+		if r.KeepHourly < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 || r.MaxTotalMB < 0 {
+			return fmt.Errorf("backup.targets[%d] %s: retention values must not be negative", i, t.Name)
+		}
+		seen[t.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayeredPrecedence(t *testing.T) {
+	const file = `{"listen":{"address":"127.0.0.1:5000"},"db":{"path":"/file.db"},"log":{"level":"warn"}}`
+	env := map[string]string{
+		"MINDVAULT_LISTEN":    "[::1]:6000",
+		"MINDVAULT_DB":        "/env.db",
+		"MINDVAULT_LOG_LEVEL": "DEBUG",
+	}
+	cases := []struct {
+		name  string
+		file  string            // config.json; "" = no file
+		env   map[string]string // MINDVAULT_* variables
+		port  int               // -port flag; 0 = not given
+		addr  string
+		db    string
+		level string
+	}{
+		{"defaults", "", nil, 0, "", "", "info"},
+		{"file over defaults", file, nil, 0, "127.0.0.1:5000", "/file.db", "warn"},
+		{"env over file", file, env, 0, "[::1]:6000", "/env.db", "debug"},
+		{"env without file", "", env, 0, "[::1]:6000", "/env.db", "debug"},
+		{"-port alone", "", nil, 7000, "127.0.0.1:7000", "", "info"},
+		{"-port over file", file, nil, 7000, "127.0.0.1:7000", "/file.db", "warn"},
+		{"-port over env keeps its host", file, env, 7000, "[::1]:7000", "/env.db", "debug"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, e := range Env {
+				t.Setenv(e.name, "")
+			}
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+			path := filepath.Join(t.TempDir(), "config.json")
+			if c.file != "" {
+				if err := os.WriteFile(path, []byte(c.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg, _, err := LoadLayered(path)
+			if err != nil {
+				t.Fatalf("LoadLayered: %v", err)
+			}
+			if c.port != 0 { // as cmd/mvaultd applies the flag
+				cfg.Listen.Address = cfg.Listen.WithPort(c.port)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if cfg.Listen.Address != c.addr || cfg.DB.Path != c.db || cfg.Log.Level != c.level {
+				t.Errorf("address %q, db %q, level %q; want %q, %q, %q",
+					cfg.Listen.Address, cfg.DB.Path, cfg.Log.Level, c.addr, c.db, c.level)
+			}
+		})
+	}
+}
+
+func TestLoadLayeredErrors(t *testing.T) {
+	cases := []struct {
+		name, file, envName, envValue, want string
+	}{
+		{"unknown field", `{"listen":{"port":1}}`, "", "", "unknown field"},
+		{"bad JSON", `{`, "", "", "parse"},
+		{"bad env bool", "", "MINDVAULT_TCP", "maybe", "MINDVAULT_TCP"},
+		{"bad env number", "", "MINDVAULT_UNLOCK_IDLE_MINUTES", "soon", "MINDVAULT_UNLOCK_IDLE_MINUTES"},
+		{"env fails validation", "", "MINDVAULT_LOG_FORMAT", "xml", "log: format"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, e := range Env {
+				t.Setenv(e.name, "")
+			}
+			if c.envName != "" {
+				t.Setenv(c.envName, c.envValue)
+			}
+			path := filepath.Join(t.TempDir(), "config.json")
+			if c.file != "" {
+				if err := os.WriteFile(path, []byte(c.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, _, err := LoadLayered(path); err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(c *Config)
+		want   string // "" = valid
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"socket only", func(c *Config) { c.Listen.TCP, c.Listen.Socket = false, true }, ""},
+		{"nothing to listen on", func(c *Config) { c.Listen.TCP = false }, "enable tcp, socket or both"},
+		{"address without port", func(c *Config) { c.Listen.Address = "localhost" }, "listen: address"},
+		{"port out of range", func(c *Config) { c.Listen.Address = "127.0.0.1:70000" }, "port must be 0-65535"},
+		{"negative interval", func(c *Config) { c.Backup.IntervalMinutes = -1 }, "must not be negative"},
+		{"retention keeps nothing", func(c *Config) { c.Backup.Retention = Retention{} }, "keeps nothing"},
+		{"unknown compression", func(c *Config) { c.Backup.Compression = "zip" }, "compression"},
+		{"unknown log level", func(c *Config) { c.Log.Level = "loud" }, "log: level"},
+		{"unknown request level", func(c *Config) { c.Log.Requests = "trace" }, "log: requests"},
+		{"log file without size", func(c *Config) { c.Log.File, c.Log.MaxSizeMB = true, 0 }, "maxSizeMB"},
+		{"negative history retention", func(c *Config) { c.History.RetentionDays = -1 }, "retentionDays"},
+		{"zero idle timeout", func(c *Config) { c.Encryption.UnlockIdleMinutes = 0 }, "unlockIdleMinutes"},
+		{"origin with path", func(c *Config) { c.CORS.Origins = []string{"https://x.example/app"} }, "cors: origin"},
+		{"bad extension ID", func(c *Config) { c.CORS.ExtensionIDs = []string{"a/b"} }, "extension ID"},
+		{"target named local", func(c *Config) {
+			c.Backup.Targets = []BackupTarget{{Name: "local", Type: TargetDir, Path: "/x"}}
+		}, "not \"local\""},
+		{"duplicate target", func(c *Config) {
+			t := BackupTarget{Name: "nas", Type: TargetDir, Path: "/x"}
+			c.Backup.Targets = []BackupTarget{t, t}
+		}, "duplicate name"},
+		{"s3 target without bucket", func(c *Config) {
+			c.Backup.Targets = []BackupTarget{{Name: "s3", Type: TargetS3, Endpoint: "https://s3.example"}}
+		}, "endpoint and bucket"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := Default()
+			c.mutate(&cfg)
+			err := cfg.Validate()
+			switch {
+			case c.want == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+				t.Errorf("err = %v, want one mentioning %q", err, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// envVar binds one MINDVAULT_* environment variable to a config field.
+type envVar struct {
+	name  string
+	apply func(c *Config, v string) error
+}
+
+// Env lists the environment variables ApplyEnv reads. List values are
+// comma-separated; booleans accept anything strconv.ParseBool does.
+var Env = []envVar{
+	{"MINDVAULT_LISTEN", func(c *Config, v string) error { c.Listen.Address = v; return nil }},
+	{"MINDVAULT_TCP", boolVar(func(c *Config) *bool { return &c.Listen.TCP })},
+	{"MINDVAULT_SOCKET", boolVar(func(c *Config) *bool { return &c.Listen.Socket })},
+	{"MINDVAULT_SOCKET_PATH", func(c *Config, v string) error { c.Listen.SocketPath = v; return nil }},
+	{"MINDVAULT_TLS", boolVar(func(c *Config) *bool { return &c.TLS.Enabled })},
+	{"MINDVAULT_TLS_HOSTS", func(c *Config, v string) error { c.TLS.Hosts = splitList(v); return nil }},
+	{"MINDVAULT_DB", func(c *Config, v string) error { c.DB.Path = v; return nil }},
+	{"MINDVAULT_BACKUP_INTERVAL_MINUTES", intVar(func(c *Config) *int { return &c.Backup.IntervalMinutes })},
+	{"MINDVAULT_UNLOCK_IDLE_MINUTES", intVar(func(c *Config) *int { return &c.Encryption.UnlockIdleMinutes })},
+	{"MINDVAULT_CORS_ORIGINS", func(c *Config, v string) error { c.CORS.Origins = splitList(v); return nil }},
+	{"MINDVAULT_CORS_EXTENSION_IDS", func(c *Config, v string) error { c.CORS.ExtensionIDs = splitList(v); return nil }},
+	{"MINDVAULT_LOG_LEVEL", func(c *Config, v string) error { c.Log.Level = strings.ToLower(v); return nil }},
+	{"MINDVAULT_LOG_REQUESTS", func(c *Config, v string) error { c.Log.Requests = strings.ToLower(v); return nil }},
+	{"MINDVAULT_LOG_FORMAT", func(c *Config, v string) error { c.Log.Format = strings.ToLower(v); return nil }},
+	{"MINDVAULT_LOG_FILE", boolVar(func(c *Config) *bool { return &c.Log.File })},
+	{"MINDVAULT_HISTORY_RETENTION_DAYS", intVar(func(c *Config) *int { return &c.History.RetentionDays })},
+	{"MINDVAULT_FEATURE_DASHBOARD", boolVar(func(c *Config) *bool { return &c.Features.Dashboard })},
+	{"MINDVAULT_FEATURE_PAIRING", boolVar(func(c *Config) *bool { return &c.Features.Pairing })},
+}
+
+// ApplyEnv overrides c with the variables in Env that getenv returns
+// non-empty, and returns the names of those it applied.
+func ApplyEnv(c *Config, getenv func(string) string) ([]string, error) {
+	var applied []string
+	for _, e := range Env {
+		v := strings.TrimSpace(getenv(e.name))
+		if v == "" {
+			continue
+		}
+		if err := e.apply(c, v); err != nil {
+			return applied, fmt.Errorf("%s: %w", e.name, err)
+		}
+		applied = append(applied, e.name)
+	}
+	return applied, nil
+}
+
+func boolVar(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("want true or false, got %q", v)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func intVar(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("want a number, got %q", v)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,390 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mindvault/companion/internal/backupfile"
+)
+
+// ── Backup snapshots ──────────────────────────────────────────────────────────
+// Backups are written with VACUUM INTO, which reads the live database inside a
+// single read transaction: the snapshot is consistent even while the daemon is
+// accepting writes, and it comes out compacted. Each snapshot is checked with
+// PRAGMA integrity_check before it is published, and its SHA-256 is stored in a
+// "<file>.sha256" sidecar in sha256sum format (so `sha256sum -c` works too).
+// A backup is reported Verified only when that sidecar exists.
+
+// checksumExt is appended to a backup filename to name its checksum sidecar.
+const checksumExt = ".sha256"
+
+// snapshotTo writes a consistent, compacted copy of the live database to dest
+// (which must not exist yet).
+func (d *DB) snapshotTo(dest string) error {
+	if _, err := d.sql.Exec(`VACUUM INTO ?`, dest); err != nil {
+		return fmt.Errorf("vacuum into: %w", err)
+	}
+	return nil
+}
+
+// verifyDatabaseFile opens the SQLite file at path and runs PRAGMA
+// integrity_check, returning an error unless SQLite answers "ok".
+func verifyDatabaseFile(path string) error {
+	sqlDB, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+	rows, err := sqlDB.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChecksum records sum for the backup at path in its sidecar file.
+func writeChecksum(path, filename, sum string) error {
+	return os.WriteFile(path+checksumExt, []byte(sum+"  "+filename+"\n"), 0600)
+}
+
+// readChecksum returns the SHA-256 recorded for the backup at path, or ""
+// when there is no (readable) sidecar — i.e. the backup is unverified.
+func readChecksum(path string) string {
+	b, err := os.ReadFile(path + checksumExt)
+	if err != nil {
+		return ""
+	}
+	sum, _, _ := strings.Cut(strings.TrimSpace(string(b)), " ")
+	return sum
+}
+
+// removeBackupFile deletes a backup and its checksum sidecar.
+func removeBackupFile(path string) error {
+	_ = os.Remove(path + checksumExt)
+	return os.Remove(path)
+}
+
+// SetBackupOptions sets compression / encryption for backups written from
+// now on, and the passphrase used to read encrypted ones.
+func (d *DB) SetBackupOptions(o backupfile.Options) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	d.enc.Store(&o)
+	return nil
+}
+
+// backupOptions returns the current backup encoding (zero value = plain).
+func (d *DB) backupOptions() backupfile.Options {
+	if o := d.enc.Load(); o != nil {
+		return *o
+	}
+	return backupfile.Options{}
+}
+
+// Backup filename prefixes. Pre-restore and pre-import backups are safety
+// snapshots of the state before a restore or import replaced it.
+const (
+	backupPrefix     = "mindvault-"
+	preRestorePrefix = "mindvault-pre-restore-"
+	preImportPrefix  = "mindvault-pre-import-"
+)
+
+// isSafetySnapshot reports whether name is a pre-restore or pre-import backup.
+func isSafetySnapshot(name string) bool {
+	return strings.HasPrefix(name, preRestorePrefix) || strings.HasPrefix(name, preImportPrefix)
+}
+
+// backupName returns prefix + the current UTC timestamp + the extension for
+// the current backup options, with a "-2", "-3", … suffix when a backup with
+// that stem already exists in any format (two backups within one second must
+// not overwrite each other — the first may be the very file being restored).
+func (d *DB) backupName(prefix string) string {
+	ext := d.backupOptions().Ext()
+	stamp := prefix + time.Now().UTC().Format("2006-01-02T15-04-05")
+	stem := stamp
+	for n := 2; ; n++ {
+		taken := false
+		for _, e := range []string{backupfile.ExtPlain, backupfile.ExtGzip, backupfile.ExtEncrypted} {
+			if _, err := os.Stat(filepath.Join(d.BackupDir(), stem+e)); err == nil {
+				taken = true
+			}
+		}
+		if !taken {
+			return stem + ext
+		}
+		stem = fmt.Sprintf("%s-%d", stamp, n)
+	}
+}
+
+// writeBackup snapshots the live database to filename in BackupDir(),
+// verifies it, records its checksum and returns its info. The snapshot is
+// only moved into place once verified, so a failed backup never leaves a file
+// that ListBackups would offer for restore.
+func (d *DB) writeBackup(filename string) (BackupInfo, error) {
+	if err := os.MkdirAll(d.BackupDir(), 0700); err != nil {
+		return BackupInfo{}, fmt.Errorf("create backup dir: %w", err)
+	}
+	dest := filepath.Join(d.BackupDir(), filename)
+	tmp := filepath.Join(d.BackupDir(), backupfile.TrimExt(filename)+".snapshot.tmp")
+	_ = os.Remove(tmp) // leftover from a crashed run; VACUUM INTO refuses existing files
+	if err := d.snapshotTo(tmp); err != nil {
+		return BackupInfo{}, err
+	}
+	defer os.Remove(tmp)
+	if err := verifyDatabaseFile(tmp); err != nil {
+		return BackupInfo{}, err
+	}
+	// Encode (compress / encrypt) into a second temp file, then publish.
+	if err := encodeFile(tmp, dest+".tmp", d.backupOptions()); err != nil {
+		os.Remove(dest + ".tmp")
+		return BackupInfo{}, fmt.Errorf("encode backup: %w", err)
+	}
+	if err := os.Rename(dest+".tmp", dest); err != nil {
+		os.Remove(dest + ".tmp")
+		return BackupInfo{}, fmt.Errorf("publish backup: %w", err)
+	}
+	sum, err := fileSHA256(dest)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("hash backup: %w", err)
+	}
+	if err := writeChecksum(dest, filename, sum); err != nil {
+		return BackupInfo{}, fmt.Errorf("write checksum: %w", err)
+	}
+	fi, err := os.Stat(dest)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("stat backup: %w", err)
+	}
+	return BackupInfo{
+		Filename:   filename,
+		CreatedAt:  fi.ModTime().UnixMilli(),
+		SizeBytes:  fi.Size(),
+		Verified:   true,
+		SHA256:     sum,
+		Compressed: d.backupCompressed(filename),
+		Encrypted:  backupfile.IsEncrypted(filename),
+		Target:     LocalTarget,
+	}, nil
+}
+
+// backupCompressed reports whether the local backup filename is gzip-compressed,
+// reading the header of an encrypted one.
+func (d *DB) backupCompressed(filename string) bool {
+	if !backupfile.IsEncrypted(filename) {
+		return backupfile.IsCompressed(filename, nil)
+	}
+	f, err := os.Open(filepath.Join(d.BackupDir(), filename))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return backupfile.IsCompressed(filename, f)
+}
+
+// encodeFile writes src to dst with o applied.
+func encodeFile(src, dst string, o backupfile.Options) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := backupfile.Encode(out, in, o); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// openBackup resolves filename in BackupDir(), decodes it to a plain SQLite
+// file when compressed or encrypted, and validates it. cleanup removes the
+// decoded temp file (it is a no-op for plain backups). A missing passphrase
+// or a wrong one is reported as ErrInvalid.
+func (d *DB) openBackup(filename string) (path string, cleanup func(), err error) {
+	path, err = d.backupPath(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() {}
+	if filename != backupfile.TrimExt(filename)+backupfile.ExtPlain {
+		plain := filepath.Join(d.BackupDir(), backupfile.TrimExt(filename)+".decoded.tmp")
+		if err := decodeFile(path, plain, filename, d.backupOptions().Passphrase); err != nil {
+			os.Remove(plain)
+			if errors.Is(err, backupfile.ErrNoPassphrase) || errors.Is(err, backupfile.ErrDecrypt) {
+				return "", nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+			}
+			return "", nil, fmt.Errorf("decode backup: %w", err)
+		}
+		path, cleanup = plain, func() { os.Remove(plain) }
+	}
+	if err := validateBackupFile(path); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return path, cleanup, nil
+}
+
+// decodeFile writes the plain database held in backup src (named name) to dst.
+func decodeFile(src, dst, name, passphrase string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := backupfile.Decode(out, in, name, passphrase); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ── Restore ───────────────────────────────────────────────────────────────────
+
+// Acquire takes the request gate shared and returns its release func. The HTTP
+// layer wraps every request in Acquire so Restore (which takes the gate
+// exclusively) waits for in-flight requests and holds off new ones while the
+// underlying handle is swapped. Restore must not be called while holding it.
+func (d *DB) Acquire() (release func()) {
+	d.gate.RLock()
+	return d.gate.RUnlock
+}
+
+// LatestSchemaVersion is the highest migration version this build knows.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// validateBackupFile checks that path is a healthy MindVault database whose
+// schema this build can open (equal or older — Migrate upgrades older ones).
+func validateBackupFile(path string) error {
+	if err := verifyDatabaseFile(path); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	v, err := schemaVersionOf(path)
+	if err != nil {
+		return fmt.Errorf("%w: not a MindVault database: %v", ErrInvalid, err)
+	}
+	if v > LatestSchemaVersion() {
+		return fmt.Errorf("%w: backup schema version %d is newer than supported %d", ErrInvalid, v, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// schemaVersionOf returns the highest applied migration in the database at path.
+func schemaVersionOf(path string) (int, error) {
+	sqlDB, err := sql.Open("sqlite", path)
+	if err != nil {
+		return 0, err
+	}
+	defer sqlDB.Close()
+	var v sql.NullInt64
+	if err := sqlDB.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// rollbackTo puts the named (pre-restore) backup back in place after a failed
+// swap. Caller must hold d.gate exclusively.
+func (d *DB) rollbackTo(filename string) error {
+	plain, cleanup, err := d.openBackup(filename)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return d.swapFile(plain)
+}
+
+// swapFile closes the live handle, moves the plain database file replacement
+// over the database file, reopens and migrates. replacement is left in place:
+// it is first copied next to the live file so the final rename stays on one
+// filesystem. Blobs of the swapped-in file are renumbered above the live blob
+// sequence so devices pull them again. Unlocked keys are dropped: the new
+// file may hold other salts and key hashes. Caller must hold d.gate
+// exclusively.
+func (d *DB) swapFile(replacement string) error {
+	d.keys.clear()
+	staged := d.path + ".restore"
+	if err := copyFile(replacement, staged); err != nil {
+		return fmt.Errorf("stage backup: %w", err)
+	}
+	replacement = staged
+	floor, err := d.blobSeq()
+	if err != nil {
+		return fmt.Errorf("read blob seq: %w", err)
+	}
+	// Flush WAL before closing; a stale -wal next to the new file would be replayed into it.
+	_, _ = d.sql.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if err := d.sql.Close(); err != nil {
+		return fmt.Errorf("close db: %w", err)
+	}
+	_ = os.Remove(d.path + "-wal")
+	_ = os.Remove(d.path + "-shm")
+	renameErr := os.Rename(replacement, d.path)
+	sqlDB, err := openFile(d.path)
+	if err != nil {
+		return fmt.Errorf("reopen db: %w", err)
+	}
+	d.sql = sqlDB
+	if renameErr != nil {
+		return fmt.Errorf("rename into place: %w", renameErr)
+	}
+	if err := migrate(d.sql); err != nil {
+		return fmt.Errorf("migrate restored db: %w", err)
+	}
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := renumberBlobs(tx, "", floor); err != nil {
+		return fmt.Errorf("renumber blobs: %w", err)
+	}
+	return tx.Commit()
+}
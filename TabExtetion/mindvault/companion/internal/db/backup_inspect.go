@@ -0,0 +1,511 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mindvault/companion/internal/backupfile"
+)
+
+// ── Backup preview, diff and selective restore ────────────────────────────────
+// The backup file is ATTACHed to the live connection as schema "bk" so that
+// counts, diffs and row copies are plain cross-schema SQL. Row copies use the
+// columns both schemas share, so a backup taken before a later migration (no
+// sort_order, no session_windows, …) still restores; missing columns take
+// their DEFAULTs.
+
+// LibrarySummary holds per-library entity counts inside a backup.
+type LibrarySummary struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Sessions  int    `json:"sessions"`
+	Tabs      int    `json:"tabs"`
+	Bookmarks int    `json:"bookmarks"`
+	History   int    `json:"history"`
+	Downloads int    `json:"downloads"`
+}
+
+// BackupSummary describes what a backup contains.
+type BackupSummary struct {
+	Filename      string           `json:"filename"`
+	SchemaVersion int              `json:"schemaVersion"`
+	Libraries     []LibrarySummary `json:"libraries"`
+}
+
+// Diff statuses, from the backup's point of view.
+const (
+	DiffBackupOnly = "backupOnly" // in the backup, deleted from the live DB since
+	DiffLiveOnly   = "liveOnly"   // created in the live DB after the backup
+	DiffChanged    = "changed"    // in both, with different column values
+)
+
+// DiffEntry is one entity that differs between a backup and the live DB.
+type DiffEntry struct {
+	Entity    string `json:"entity"` // library|session|tab|bookmark|history|download
+	ID        string `json:"id"`
+	LibraryID string `json:"libraryId"`
+	Label     string `json:"label"` // name / title / url, whichever the entity has
+	Status    string `json:"status"`
+}
+
+// DiffCounts tallies DiffEntry statuses for one entity type.
+type DiffCounts struct {
+	BackupOnly int `json:"backupOnly"`
+	LiveOnly   int `json:"liveOnly"`
+	Changed    int `json:"changed"`
+}
+
+// BackupDiff compares a backup with the live DB. Counts are always complete;
+// Entries stops at the requested limit and sets Truncated.
+type BackupDiff struct {
+	Filename  string                `json:"filename"`
+	Counts    map[string]DiffCounts `json:"counts"`
+	Entries   []DiffEntry           `json:"entries"`
+	Truncated bool                  `json:"truncated"`
+}
+
+// RestoreSelection names what a selective restore pulls back from a backup.
+type RestoreSelection struct {
+	LibraryIDs []string `json:"libraryIds"`
+	SessionIDs []string `json:"sessionIds"`
+}
+
+// SelectiveRestoreResult reports rows written per table and the snapshot of
+// the live DB taken beforehand.
+type SelectiveRestoreResult struct {
+	PreRestore BackupInfo     `json:"preRestore"`
+	Rows       map[string]int `json:"rows"`
+}
+
+// diffEntity maps a diffable table to its entity name and label column.
+type diffEntity struct {
+	table, entity, label string
+}
+
+var diffEntities = []diffEntity{
+	{"libraries", "library", "name"},
+	{"sessions", "session", "name"},
+	{"saved_tabs", "tab", "title"},
+	{"bookmarks", "bookmark", "title"},
+	{"history_entries", "history", "url"},
+	{"downloads", "download", "filename"},
+}
+
+// libraryCol returns the column holding a table's library ID.
+func libraryCol(table string) string {
+	if table == "libraries" {
+		return "id"
+	}
+	return "library_id"
+}
+
+// backupPath validates filename and returns its full path in BackupDir().
+func (d *DB) backupPath(filename string) (string, error) {
+	if d.path == "" {
+		return "", fmt.Errorf("backups not supported for in-memory database")
+	}
+	if filepath.Base(filename) != filename || !backupfile.IsBackupName(filename) {
+		return "", fmt.Errorf("%w: invalid backup filename", ErrInvalid)
+	}
+	path := filepath.Join(d.BackupDir(), filename)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("backup not found: %w", sql.ErrNoRows)
+	}
+	return path, nil
+}
+
+// withAttachedBackup opens and validates the named backup, then runs fn
+// against it via attachAndRun.
+func (d *DB) withAttachedBackup(filename string, commit bool, fn func(tx *sql.Tx) error) error {
+	path, cleanup, err := d.openBackup(filename)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return d.attachAndRun(path, commit, fn)
+}
+
+// attachAndRun attaches the plain database at path as "bk" on a pinned
+// connection and runs fn inside a transaction, committing only when commit is
+// set. The backup is detached again before the connection is released.
+func (d *DB) attachAndRun(path string, commit bool, fn func(tx *sql.Tx) error) error {
+	ctx := context.Background()
+	conn, err := d.sql.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS bk`, path); err != nil {
+		return fmt.Errorf("attach backup: %w", err)
+	}
+	defer func() { _, _ = conn.ExecContext(ctx, `DETACH DATABASE bk`) }()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if commit {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// tableCols returns the column names of table in schema, in declaration order
+// (nil when the table does not exist there).
+func tableCols(q querier, schema, table string) ([]string, error) {
+	rows, err := q.Query(fmt.Sprintf(`SELECT name FROM pragma_table_info('%s', '%s')`, table, schema))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	return cols, rows.Err()
+}
+
+// sharedCols returns the columns of table present in both main and bk.
+func sharedCols(q querier, table string) ([]string, error) {
+	live, err := tableCols(q, "main", table)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := tableCols(q, "bk", table)
+	if err != nil {
+		return nil, err
+	}
+	inBackup := map[string]bool{}
+	for _, c := range backup {
+		inBackup[c] = true
+	}
+	var cols []string
+	for _, c := range live {
+		if inBackup[c] {
+			cols = append(cols, c)
+		}
+	}
+	return cols, nil
+}
+
+// BackupSummary returns per-library counts of what the named backup contains.
+func (d *DB) BackupSummary(filename string) (*BackupSummary, error) {
+	sum := &BackupSummary{Filename: filename, Libraries: []LibrarySummary{}}
+	err := d.withAttachedBackup(filename, false, func(tx *sql.Tx) error {
+		var v sql.NullInt64
+		if err := tx.QueryRow(`SELECT MAX(version) FROM bk.schema_migrations`).Scan(&v); err != nil {
+			return err
+		}
+		sum.SchemaVersion = int(v.Int64)
+		rows, err := tx.Query(`
+			SELECT l.id, l.name,
+			       (SELECT COUNT(*) FROM bk.sessions        WHERE library_id = l.id),
+			       (SELECT COUNT(*) FROM bk.saved_tabs      WHERE library_id = l.id),
+			       (SELECT COUNT(*) FROM bk.bookmarks       WHERE library_id = l.id),
+			       (SELECT COUNT(*) FROM bk.history_entries WHERE library_id = l.id),
+			       (SELECT COUNT(*) FROM bk.downloads       WHERE library_id = l.id)
+			FROM bk.libraries l ORDER BY l.created_at`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var l LibrarySummary
+			if err := rows.Scan(&l.ID, &l.Name, &l.Sessions, &l.Tabs, &l.Bookmarks, &l.History, &l.Downloads); err != nil {
+				return err
+			}
+			sum.Libraries = append(sum.Libraries, l)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+// DiffBackup lists entities that differ between the named backup and the live
+// DB, optionally only for libraryID. limit caps Entries (≤0 means 500).
+func (d *DB) DiffBackup(filename, libraryID string, limit int) (*BackupDiff, error) {
+	if limit <= 0 {
+		limit = 500
+	}
+	diff := &BackupDiff{Filename: filename, Counts: map[string]DiffCounts{}, Entries: []DiffEntry{}}
+	err := d.withAttachedBackup(filename, false, func(tx *sql.Tx) error {
+		for _, e := range diffEntities {
+			cols, err := sharedCols(tx, e.table)
+			if err != nil {
+				return err
+			}
+			var changed []string
+			for _, c := range cols {
+				if c != "id" {
+					changed = append(changed, fmt.Sprintf("b.%s IS NOT m.%s", c, c))
+				}
+			}
+			lib := libraryCol(e.table)
+			queries := []struct{ status, sql string }{
+				{DiffBackupOnly, fmt.Sprintf(`SELECT b.id, b.%[2]s, IFNULL(b.%[3]s,'') FROM bk.%[1]s b
+					WHERE NOT EXISTS (SELECT 1 FROM main.%[1]s m WHERE m.id = b.id) AND (? = '' OR b.%[2]s = ?)`, e.table, lib, e.label)},
+				{DiffLiveOnly, fmt.Sprintf(`SELECT m.id, m.%[2]s, IFNULL(m.%[3]s,'') FROM main.%[1]s m
+					WHERE NOT EXISTS (SELECT 1 FROM bk.%[1]s b WHERE b.id = m.id) AND (? = '' OR m.%[2]s = ?)`, e.table, lib, e.label)},
+			}
+			if len(changed) > 0 {
+				queries = append(queries, struct{ status, sql string }{DiffChanged, fmt.Sprintf(`SELECT b.id, b.%[2]s, IFNULL(b.%[3]s,'') FROM bk.%[1]s b
+					JOIN main.%[1]s m ON m.id = b.id
+					WHERE (%[4]s) AND (? = '' OR b.%[2]s = ?)`, e.table, lib, e.label, strings.Join(changed, " OR "))})
+			}
+			counts := DiffCounts{}
+			for _, qry := range queries {
+				n, err := diff.collect(tx, qry.sql, e.entity, qry.status, libraryID, limit)
+				if err != nil {
+					return fmt.Errorf("diff %s: %w", e.table, err)
+				}
+				switch qry.status {
+				case DiffBackupOnly:
+					counts.BackupOnly = n
+				case DiffLiveOnly:
+					counts.LiveOnly = n
+				case DiffChanged:
+					counts.Changed = n
+				}
+			}
+			diff.Counts[e.entity] = counts
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// collect runs one diff query, appending rows to Entries until limit is hit,
+// and returns the total number of matching rows.
+func (b *BackupDiff) collect(q querier, query, entity, status, libraryID string, limit int) (int, error) {
+	rows, err := q.Query(query, libraryID, libraryID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		e := DiffEntry{Entity: entity, Status: status}
+		if err := rows.Scan(&e.ID, &e.LibraryID, &e.Label); err != nil {
+			return 0, err
+		}
+		n++
+		if len(b.Entries) < limit {
+			b.Entries = append(b.Entries, e)
+		} else {
+			b.Truncated = true
+		}
+	}
+	return n, rows.Err()
+}
+
+// restoreStep deletes live rows matching del and copies backup rows matching
+// sel for one table. Both conditions take the same single argument.
+type restoreStep struct {
+	table, del, sel string
+}
+
+// libraryRestoreSteps replace a whole library: every child table, plus the
+// window / tab-group structure of its sessions. Children are deleted before
+// parents and copied after them.
+var libraryRestoreSteps = []restoreStep{
+	{"session_windows", `session_id IN (SELECT id FROM main.sessions WHERE library_id = ?)`, `session_id IN (SELECT id FROM bk.sessions WHERE library_id = ?)`},
+	{"tab_groups", `session_id IN (SELECT id FROM main.sessions WHERE library_id = ?)`, `session_id IN (SELECT id FROM bk.sessions WHERE library_id = ?)`},
+	{"audit_log", `library_id = ?`, `library_id = ?`},
+	{"encrypted_blobs", `library_id = ?`, `library_id = ?`},
+	{"tags", `library_id = ?`, `library_id = ?`},
+	{"downloads", `library_id = ?`, `library_id = ?`},
+	{"history_entries", `library_id = ?`, `library_id = ?`},
+	{"bookmarks", `library_id = ?`, `library_id = ?`},
+	{"saved_tabs", `library_id = ?`, `library_id = ?`},
+	{"sessions", `library_id = ?`, `library_id = ?`},
+	{"libraries", `id = ?`, `id = ?`},
+}
+
+// sessionRestoreSteps replace one session with its tabs and structure.
+var sessionRestoreSteps = []restoreStep{
+	{"session_windows", `session_id = ?`, `session_id = ?`},
+	{"tab_groups", `session_id = ?`, `session_id = ?`},
+	{"saved_tabs", `session_id = ?`, `session_id = ?`},
+	{"sessions", `id = ?`, `id = ?`},
+}
+
+// runRestoreSteps deletes in step order, then copies in reverse (parents first).
+// Foreign keys are checked at commit, after repairOrphans.
+func runRestoreSteps(tx *sql.Tx, steps []restoreStep, arg string, rowsOut map[string]int) error {
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		return err
+	}
+	for _, s := range steps {
+		if cols, err := tableCols(tx, "main", s.table); err != nil || cols == nil {
+			continue // table not in this schema
+		}
+		if _, err := tx.Exec(`DELETE FROM main.`+s.table+` WHERE `+s.del, arg); err != nil {
+			return fmt.Errorf("clear %s: %w", s.table, err)
+		}
+	}
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+		cols, err := sharedCols(tx, s.table)
+		if err != nil {
+			return err
+		}
+		if len(cols) == 0 {
+			continue // backup predates this table
+		}
+		list := strings.Join(cols, ", ")
+		r, err := tx.Exec(`INSERT OR REPLACE INTO main.`+s.table+` (`+list+`) SELECT `+list+` FROM bk.`+s.table+` WHERE `+s.sel, arg)
+		if err != nil {
+			return fmt.Errorf("copy %s: %w", s.table, err)
+		}
+		n, _ := r.RowsAffected()
+		rowsOut[s.table] += int(n)
+	}
+	return repairOrphans(tx, steps, arg)
+}
+
+// repairOrphans fixes the restored rows that point to a missing parent — rows
+// a build without enforced foreign keys left in older backups and exports —
+// the way the key's ON DELETE rule would have: CASCADE deletes the row, SET
+// NULL clears the column. Only rows matching a step's del are touched. It
+// needs PRAGMA defer_foreign_keys, or the copy would have failed first.
+func repairOrphans(tx *sql.Tx, steps []restoreStep, arg string) error {
+	for i := len(steps) - 1; i >= 0; i-- { // parents first; their CASCADEs reach the children
+		s := steps[i]
+		if cols, err := tableCols(tx, "main", s.table); err != nil || cols == nil {
+			continue
+		}
+		type violation struct {
+			rowid int64
+			fkid  int
+		}
+		rows, err := tx.Query(fmt.Sprintf(`PRAGMA main.foreign_key_check('%s')`, s.table))
+		if err != nil {
+			return err
+		}
+		var found []violation
+		for rows.Next() {
+			var table, parent string
+			var rowid sql.NullInt64
+			var v violation
+			if err := rows.Scan(&table, &rowid, &parent, &v.fkid); err != nil {
+				rows.Close()
+				return err
+			}
+			if rowid.Valid {
+				v.rowid = rowid.Int64
+				found = append(found, v)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, v := range found {
+			var from, onDelete string
+			if err := tx.QueryRow(fmt.Sprintf(`SELECT "from", on_delete FROM pragma_foreign_key_list('%s') WHERE id = ?`, s.table), v.fkid).Scan(&from, &onDelete); err != nil {
+				return err
+			}
+			var stmt string
+			switch onDelete {
+			case "CASCADE":
+				stmt = `DELETE FROM main.` + s.table + ` WHERE rowid = ? AND ` + s.del
+			case "SET NULL":
+				stmt = `UPDATE main.` + s.table + ` SET "` + from + `" = NULL WHERE rowid = ? AND ` + s.del
+			default:
+				continue // left for the commit to reject
+			}
+			if _, err := tx.Exec(stmt, v.rowid, arg); err != nil {
+				return fmt.Errorf("repair %s: %w", s.table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RestoreSelected pulls the chosen libraries and/or sessions from a backup into
+// the live DB, replacing their current state, and leaves everything else
+// untouched. A session can only be restored into a library that exists live.
+// A pre-restore backup of the live DB is written first; the copy itself runs
+// in one transaction.
+func (d *DB) RestoreSelected(filename string, sel RestoreSelection) (*SelectiveRestoreResult, error) {
+	if len(sel.LibraryIDs) == 0 && len(sel.SessionIDs) == 0 {
+		return nil, fmt.Errorf("%w: choose at least one library or session", ErrInvalid)
+	}
+	path, cleanup, err := d.openBackup(filename)
+	if err != nil {
+		return nil, err // reject before taking a pre-restore snapshot
+	}
+	defer cleanup()
+	pre, err := d.writeBackup(d.backupName(preRestorePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("pre-restore backup: %w", err)
+	}
+	res := &SelectiveRestoreResult{PreRestore: pre, Rows: map[string]int{}}
+	err = d.attachAndRun(path, true, func(tx *sql.Tx) error {
+		for _, id := range sel.LibraryIDs {
+			var n int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM bk.libraries WHERE id = ?`, id).Scan(&n); err != nil {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("%w: library %s not in backup", ErrInvalid, id)
+			}
+			if err := runRestoreSteps(tx, libraryRestoreSteps, id, res.Rows); err != nil {
+				return err
+			}
+			if err := renumberBlobs(tx, id, 0); err != nil {
+				return err
+			}
+		}
+		for _, id := range sel.SessionIDs {
+			var libID string
+			if err := tx.QueryRow(`SELECT library_id FROM bk.sessions WHERE id = ?`, id).Scan(&libID); err != nil {
+				return fmt.Errorf("%w: session %s not in backup", ErrInvalid, id)
+			}
+			var n int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM main.libraries WHERE id = ?`, libID).Scan(&n); err != nil {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("%w: library %s of session %s no longer exists; restore the library instead", ErrInvalid, libID, id)
+			}
+			// The session's values are sealed with the backup's key.
+			var rekeyed bool
+			if err := tx.QueryRow(`SELECT m.is_encrypted AND m.password_salt IS NOT b.password_salt FROM main.libraries m, bk.libraries b WHERE m.id = ? AND b.id = m.id`, libID).Scan(&rekeyed); err != nil {
+				return err
+			}
+			if rekeyed {
+				return fmt.Errorf("%w: library %s was rekeyed since this backup; restore the library instead", ErrInvalid, libID)
+			}
+			if err := runRestoreSteps(tx, sessionRestoreSteps, id, res.Rows); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range sel.LibraryIDs {
+		d.keys.drop(id, nil) // the restored salt and key hash may differ
+	}
+	return res, nil
+}
@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mindvault/companion/internal/backupfile"
+	"github.com/mindvault/companion/internal/backuptarget"
+)
+
+// ── Backup replication ────────────────────────────────────────────────────────
+// Every backup is first written to BackupDir() (target "local"), then copied
+// to each configured ReplicaTarget together with its checksum sidecar, and
+// pruned there with that target's own RetentionPolicy. Uploads are retried;
+// the outcome per target is kept for GET /backups/status.
+
+// LocalTarget is the BackupInfo.Target of backups in BackupDir().
+const LocalTarget = "local"
+
+// ReplicaTarget is a backup destination with its own retention.
+type ReplicaTarget struct {
+	Target backuptarget.Target
+	Policy RetentionPolicy
+}
+
+// ReplicaResult is the outcome of replicating one backup to one target.
+type ReplicaResult struct {
+	At       int64    `json:"at"` // Unix ms
+	Filename string   `json:"filename"`
+	OK       bool     `json:"ok"`
+	Attempts int      `json:"attempts"`
+	Pruned   []string `json:"pruned,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// TargetStatus reports one replica target in BackupStatus.
+type TargetStatus struct {
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	Policy     RetentionPolicy `json:"policy"`
+	LastResult *ReplicaResult  `json:"lastResult,omitempty"`
+}
+
+// replicaSet holds the configured targets and their last results; guarded by mu.
+type replicaSet struct {
+	mu      sync.Mutex
+	targets []ReplicaTarget
+	last    map[string]*ReplicaResult
+}
+
+// Upload retry schedule: attempts and the base delay (doubled per retry).
+// Variables so tests can shorten them.
+var (
+	replicaAttempts = 3
+	replicaBackoff  = 2 * time.Second
+)
+
+// SetBackupTargets replaces the replica targets (nil = local only).
+func (d *DB) SetBackupTargets(targets []ReplicaTarget) {
+	d.repl.Store(&replicaSet{targets: targets, last: map[string]*ReplicaResult{}})
+}
+
+// replicaTarget looks up a configured target by name.
+func (d *DB) replicaTarget(name string) (ReplicaTarget, bool) {
+	rs := d.repl.Load()
+	if rs == nil {
+		return ReplicaTarget{}, false
+	}
+	for _, t := range rs.targets {
+		if t.Target.Name() == name {
+			return t, true
+		}
+	}
+	return ReplicaTarget{}, false
+}
+
+// replicate copies the local backup info to every target, retrying failed
+// uploads, then applies each target's retention. Results are recorded for
+// BackupStatus and returned; it never fails the backup itself.
+func (d *DB) replicate(ctx context.Context, info BackupInfo) []ReplicaResult {
+	rs := d.repl.Load()
+	if rs == nil || len(rs.targets) == 0 {
+		return nil
+	}
+	var results []ReplicaResult
+	for _, rt := range rs.targets {
+		res := d.replicateTo(ctx, rt, info)
+		if !res.OK {
+			slog.Error("backup replication failed", "target", rt.Target.Name(), "err", res.Error)
+		}
+		rs.mu.Lock()
+		rs.last[rt.Target.Name()] = &res
+		rs.mu.Unlock()
+		results = append(results, res)
+	}
+	return results
+}
+
+func (d *DB) replicateTo(ctx context.Context, rt ReplicaTarget, info BackupInfo) ReplicaResult {
+	res := ReplicaResult{At: time.Now().UnixMilli(), Filename: info.Filename}
+	src := filepath.Join(d.BackupDir(), info.Filename)
+	delay := replicaBackoff
+	var err error
+	for res.Attempts < replicaAttempts {
+		res.Attempts++
+		if err = putFile(ctx, rt.Target, src, info.Filename); err == nil {
+			err = putFile(ctx, rt.Target, src+checksumExt, info.Filename+checksumExt)
+		}
+		if err == nil || res.Attempts == replicaAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(delay):
+			delay *= 2
+			continue
+		}
+		break
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	pruned, err := pruneTarget(ctx, rt)
+	if err != nil {
+		res.Error = "retention: " + err.Error()
+		return res
+	}
+	res.OK, res.Pruned = true, pruned
+	return res
+}
+
+// putFile uploads the local file path to t as name.
+func putFile(ctx context.Context, t backuptarget.Target, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return t.Put(ctx, name, f, fi.Size())
+}
+
+// ListTargetBackups lists the backups stored on the named replica target.
+// Verified means the checksum sidecar was replicated too.
+func (d *DB) ListTargetBackups(ctx context.Context, name string) ([]BackupInfo, error) {
+	if name == "" || name == LocalTarget {
+		return d.ListBackups()
+	}
+	rt, ok := d.replicaTarget(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown backup target %q", ErrInvalid, name)
+	}
+	infos, err := listTarget(ctx, rt.Target)
+	if err != nil {
+		return nil, err
+	}
+	// Copies are byte-identical to the local backup of the same name, whose
+	// header tells whether an encrypted one is compressed.
+	for i := range infos {
+		if infos[i].Encrypted {
+			infos[i].Compressed = d.backupCompressed(infos[i].Filename)
+		}
+	}
+	return infos, nil
+}
+
+func listTarget(ctx context.Context, t backuptarget.Target) ([]BackupInfo, error) {
+	objs, err := t.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sidecars := map[string]bool{}
+	for _, o := range objs {
+		if strings.HasSuffix(o.Name, checksumExt) {
+			sidecars[strings.TrimSuffix(o.Name, checksumExt)] = true
+		}
+	}
+	infos := []BackupInfo{}
+	for _, o := range objs {
+		if !backupfile.IsBackupName(o.Name) {
+			continue
+		}
+		infos = append(infos, BackupInfo{
+			Filename:   o.Name,
+			CreatedAt:  backupTime(o.Name, o.ModTime).UnixMilli(),
+			SizeBytes:  o.Size,
+			Verified:   sidecars[o.Name],
+			Compressed: backupfile.IsCompressed(o.Name, nil),
+			Encrypted:  backupfile.IsEncrypted(o.Name),
+			Target:     t.Name(),
+		})
+	}
+	sortBackupsNewestFirst(infos)
+	return infos, nil
+}
+
+// pruneTarget applies rt's retention to what is stored on it.
+func pruneTarget(ctx context.Context, rt ReplicaTarget) ([]string, error) {
+	infos, err := listTarget(ctx, rt.Target)
+	if err != nil {
+		return nil, err
+	}
+	drop := selectRetained(infos, rt.Policy)
+	for _, name := range drop {
+		if err := rt.Target.Delete(ctx, name); err != nil {
+			return nil, fmt.Errorf("delete %s: %w", name, err)
+		}
+		_ = rt.Target.Delete(ctx, name+checksumExt)
+	}
+	return drop, nil
+}
+
+// backupTime recovers when a backup was taken from its name
+// (mindvault-[pre-restore-|pre-import-]2006-01-02T15-04-05[-n].ext), falling
+// back to fallback (upload time on most targets).
+func backupTime(name string, fallback time.Time) time.Time {
+	stem := strings.TrimPrefix(backupfile.TrimExt(name), backupPrefix)
+	stem = strings.TrimPrefix(strings.TrimPrefix(stem, "pre-restore-"), "pre-import-")
+	const layout = "2006-01-02T15-04-05"
+	if len(stem) >= len(layout) {
+		if t, err := time.Parse(layout, stem[:len(layout)]); err == nil {
+			return t
+		}
+	}
+	return fallback
+}
+
+// targetStatuses reports every replica target for BackupStatus.
+func (d *DB) targetStatuses() []TargetStatus {
+	rs := d.repl.Load()
+	if rs == nil {
+		return nil
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var out []TargetStatus
+	for _, rt := range rs.targets {
+		out = append(out, TargetStatus{
+			Name:       rt.Target.Name(),
+			Type:       rt.Target.Type(),
+			Policy:     rt.Policy,
+			LastResult: rs.last[rt.Target.Name()],
+		})
+	}
+	return out
+}
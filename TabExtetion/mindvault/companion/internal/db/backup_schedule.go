@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ── Scheduled backups & GFS retention ─────────────────────────────────────────
+// AutoBackup only runs at startup, so a daemon that stays up for weeks never
+// backs up again. StartBackupScheduler takes a backup every Interval while the
+// daemon runs and then prunes with a grandfather-father-son policy.
+
+// RetentionPolicy keeps the newest backup of each of the KeepHourly most recent
+// hours, KeepDaily days, KeepWeekly ISO weeks and KeepMonthly months (UTC). A
+// backup survives if any rule keeps it. MaxTotalBytes (0 = unlimited) then
+// drops the oldest survivors until the total fits; the newest is always kept.
+type RetentionPolicy struct {
+	KeepHourly    int   `json:"keepHourly"`
+	KeepDaily     int   `json:"keepDaily"`
+	KeepWeekly    int   `json:"keepWeekly"`
+	KeepMonthly   int   `json:"keepMonthly"`
+	MaxTotalBytes int64 `json:"maxTotalBytes"`
+}
+
+// BackupRunResult is the outcome of one scheduled backup.
+type BackupRunResult struct {
+	At     int64       `json:"at"` // Unix ms
+	OK     bool        `json:"ok"`
+	Backup *BackupInfo `json:"backup,omitempty"`
+	Pruned []string    `json:"pruned,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	// Replicas holds the copy to each replica target; a failed upload does
+	// not fail the run but is reported here and in BackupStatus.Targets.
+	Replicas []ReplicaResult `json:"replicas,omitempty"`
+}
+
+// BackupStatus is reported by GET /backups/status.
+type BackupStatus struct {
+	Enabled         bool             `json:"enabled"`
+	IntervalSeconds int64            `json:"intervalSeconds"`
+	Policy          RetentionPolicy  `json:"policy"`
+	NextRun         int64            `json:"nextRun,omitempty"` // Unix ms
+	LastResult      *BackupRunResult `json:"lastResult,omitempty"`
+	Targets         []TargetStatus   `json:"targets,omitempty"`
+}
+
+// backupScheduler holds the scheduler's state; guarded by mu.
+type backupScheduler struct {
+	mu       sync.Mutex
+	interval time.Duration
+	policy   RetentionPolicy
+	nextRun  time.Time
+	last     *BackupRunResult
+}
+
+// retentionBucket is one GFS rule applied to one backup: the period the backup
+// falls in and how many such periods the rule keeps.
+type retentionBucket struct {
+	key  string
+	keep int
+}
+
+// retentionBuckets returns the hourly, daily, weekly and monthly bucket of t.
+func retentionBuckets(t time.Time, p RetentionPolicy) [4]retentionBucket {
+	t = t.UTC()
+	y, w := t.ISOWeek()
+	return [4]retentionBucket{
+		{t.Format("2006-01-02T15"), p.KeepHourly},
+		{t.Format("2006-01-02"), p.KeepDaily},
+		{fmt.Sprintf("%d-W%02d", y, w), p.KeepWeekly},
+		{t.Format("2006-01"), p.KeepMonthly},
+	}
+}
+
+// selectRetained applies p to backups and returns the filenames to delete.
+// Pre-restore and pre-import snapshots are left out: they are the way back
+// from a restore or import and are only ever deleted by hand.
+func selectRetained(backups []BackupInfo, p RetentionPolicy) []string {
+	var sorted []BackupInfo
+	for _, b := range backups {
+		if !isSafetySnapshot(b.Filename) {
+			sorted = append(sorted, b)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CreatedAt > sorted[j].CreatedAt })
+
+	keep := make([]bool, len(sorted))
+	var seen [4]map[string]bool
+	for r := range seen {
+		seen[r] = map[string]bool{}
+	}
+	for i, b := range sorted {
+		for r, bucket := range retentionBuckets(time.UnixMilli(b.CreatedAt), p) {
+			if seen[r][bucket.key] || len(seen[r]) >= bucket.keep {
+				continue
+			}
+			seen[r][bucket.key] = true
+			keep[i] = true
+		}
+	}
+	if len(sorted) > 0 {
+		keep[0] = true // never prune the newest backup
+	}
+	if p.MaxTotalBytes > 0 {
+		var total int64
+		for i, b := range sorted {
+			if !keep[i] {
+				continue
+			}
+			if total+b.SizeBytes > p.MaxTotalBytes && i > 0 {
+				keep[i] = false
+				continue
+			}
+			total += b.SizeBytes
+		}
+	}
+	var drop []string
+	for i, b := range sorted {
+		if !keep[i] {
+			drop = append(drop, b.Filename)
+		}
+	}
+	return drop
+}
+
+// SetRetentionPolicy sets the policy every local backup (scheduled, manual
+// or at startup) is pruned with afterwards. Until it is set nothing is pruned.
+func (d *DB) SetRetentionPolicy(p RetentionPolicy) {
+	d.retention.Store(&p)
+}
+
+// ApplyRetention deletes the backups p does not keep and returns their names.
+// Safety snapshots are never deleted (see selectRetained).
+func (d *DB) ApplyRetention(p RetentionPolicy) ([]string, error) {
+	backups, err := d.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+	drop := selectRetained(backups, p)
+	for _, name := range drop {
+		if err := removeBackupFile(filepath.Join(d.BackupDir(), name)); err != nil {
+			return nil, fmt.Errorf("prune %s: %w", name, err)
+		}
+	}
+	return drop, nil
+}
+
+// StartBackupScheduler takes a backup every interval until ctx is cancelled,
+// applying p after each one; p also becomes the policy of Backup. The first
+// run is due one interval after the newest existing backup other than a
+// pre-restore or pre-import safety snapshot (immediately when there is none).
+// No-op for in-memory databases or a non-positive interval.
+func (d *DB) StartBackupScheduler(ctx context.Context, interval time.Duration, p RetentionPolicy) {
+	s := &backupScheduler{interval: interval, policy: p}
+	d.sched.Store(s)
+	d.SetRetentionPolicy(p)
+	if d.path == "" || interval <= 0 {
+		return
+	}
+	next := time.Now()
+	if list, err := d.ListBackups(); err == nil {
+		for _, b := range list { // newest first
+			if !isSafetySnapshot(b.Filename) {
+				next = time.UnixMilli(b.CreatedAt).Add(interval)
+				break
+			}
+		}
+	}
+	s.setNext(next)
+	go func() {
+		for {
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			res := d.runScheduledBackup(ctx, p)
+			next = time.Now().Add(interval)
+			s.mu.Lock()
+			s.last, s.nextRun = res, next
+			s.mu.Unlock()
+			if !res.OK {
+				slog.Error("scheduled backup failed", "err", res.Error)
+			}
+		}
+	}()
+}
+
+// runScheduledBackup takes one backup, prunes, then copies it to the replica
+// targets. The backup itself holds the request gate so it never races a
+// Restore swapping the database handle; uploads run after the gate is released.
+func (d *DB) runScheduledBackup(ctx context.Context, p RetentionPolicy) *BackupRunResult {
+	res := d.backupAndPrune(p)
+	if res.Backup != nil {
+		res.Replicas = d.replicate(ctx, *res.Backup)
+	}
+	return res
+}
+
+func (d *DB) backupAndPrune(p RetentionPolicy) *BackupRunResult {
+	release := d.Acquire()
+	defer release()
+	res := &BackupRunResult{At: time.Now().UnixMilli()}
+	info, err := d.writeBackup(d.backupName(backupPrefix))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Backup = &info
+	pruned, err := d.ApplyRetention(p)
+	if err != nil {
+		res.Error = "retention: " + err.Error()
+		return res
+	}
+	res.OK, res.Pruned = true, pruned
+	return res
+}
+
+func (s *backupScheduler) setNext(t time.Time) {
+	s.mu.Lock()
+	s.nextRun = t
+	s.mu.Unlock()
+}
+
+// BackupStatus reports the scheduler's configuration, next run and last result.
+func (d *DB) BackupStatus() BackupStatus {
+	s := d.sched.Load()
+	if s == nil {
+		return BackupStatus{Targets: d.targetStatuses()}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := BackupStatus{
+		Enabled:         d.path != "" && s.interval > 0,
+		IntervalSeconds: int64(s.interval / time.Second),
+		Policy:          s.policy,
+		LastResult:      s.last,
+		Targets:         d.targetStatuses(),
+	}
+	if st.Enabled {
+		st.NextRun = s.nextRun.UnixMilli()
+	}
+	return st
+}
@@ -0,0 +1,330 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ── Bookmark tree ─────────────────────────────────────────────────────────────
+// Bookmarks form a forest per library via parent_id (NULL = root). Siblings are
+// ordered by sort_order (migration 003), ties broken by created_at then id.
+// All structural edits (move, copy, reorder) renumber siblings 0..n-1 so the
+// order stays dense and predictable for the dashboard's drag-and-drop.
+
+// BookmarkNode is a bookmark with its children, as returned by GET …/bookmarks/tree.
+type BookmarkNode struct {
+	Bookmark
+	Children []*BookmarkNode `json:"children,omitempty"`
+}
+
+// treeOrder is the ORDER BY used wherever siblings are listed.
+const treeOrder = `ORDER BY sort_order, created_at, id`
+
+// buildBookmarkForest links a flat, treeOrder-sorted list into nodes.
+// Rows whose parent is missing from the library are surfaced as roots so they
+// are never silently hidden. Rows stuck in a parent_id cycle are unreachable
+// from any root and are dropped from the result.
+func buildBookmarkForest(items []Bookmark) (roots []*BookmarkNode, byID map[string]*BookmarkNode) {
+	byID = make(map[string]*BookmarkNode, len(items))
+	for i := range items {
+		byID[items[i].ID] = &BookmarkNode{Bookmark: items[i]}
+	}
+	for i := range items {
+		n := byID[items[i].ID]
+		if p := n.ParentID; p != nil {
+			if parent, ok := byID[*p]; ok {
+				parent.Children = append(parent.Children, n)
+				continue
+			}
+		}
+		roots = append(roots, n)
+	}
+	return roots, byID
+}
+
+// BookmarkTree returns the library's bookmarks as a nested tree.
+// parentID == "" returns every root; otherwise only the subtree rooted at
+// that bookmark (sql.ErrNoRows if it is not in the library).
+func (d *DB) BookmarkTree(libraryID, parentID string) ([]*BookmarkNode, error) {
+	items, err := d.listOpenBookmarks(d.sql, libraryID, treeOrder)
+	if err != nil {
+		return nil, err
+	}
+	roots, byID := buildBookmarkForest(items)
+	if parentID == "" {
+		if roots == nil {
+			roots = []*BookmarkNode{}
+		}
+		return roots, nil
+	}
+	n, ok := byID[parentID]
+	if !ok {
+		return nil, fmt.Errorf("bookmark %s: %w", parentID, sql.ErrNoRows)
+	}
+	return []*BookmarkNode{n}, nil
+}
+
+// getBookmark loads one bookmark, enforcing library membership.
+func getBookmark(q querier, libraryID, id string) (*Bookmark, error) {
+	b, err := scanBookmark(q.QueryRow(`SELECT `+bookmarkCols+` FROM bookmarks WHERE id = ? AND library_id = ?`, id, libraryID))
+	if err != nil {
+		return nil, fmt.Errorf("bookmark %s: %w", id, err)
+	}
+	return &b, nil
+}
+
+// siblingIDs lists the children of parentID (nil = root) in display order.
+func siblingIDs(q querier, libraryID string, parentID *string) ([]string, error) {
+	rows, err := q.Query(`SELECT id FROM bookmarks WHERE library_id = ? AND parent_id IS ? `+treeOrder, libraryID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// renumber writes sort_order = position for each id.
+func renumber(ex execer, ids []string) error {
+	for i, id := range ids {
+		if _, err := ex.Exec(`UPDATE bookmarks SET sort_order = ? WHERE id = ?`, i, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertAt returns ids with id inserted at index (index < 0 or past the end = append).
+func insertAt(ids []string, id string, index int) []string {
+	if index < 0 || index > len(ids) {
+		index = len(ids)
+	}
+	out := make([]string, 0, len(ids)+1)
+	out = append(out, ids[:index]...)
+	out = append(out, id)
+	return append(out, ids[index:]...)
+}
+
+// without returns ids with every occurrence of id removed.
+func without(ids []string, id string) []string {
+	out := ids[:0:0]
+	for _, x := range ids {
+		if x != id {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// checkTarget validates that parentID (nil = root) can receive nodeID:
+// it must be a folder in the same library and must not be nodeID itself or
+// one of its descendants. The ancestor walk is bounded so a corrupt cycle
+// already present in the table cannot loop forever.
+func checkTarget(q querier, libraryID, nodeID string, parentID *string) error {
+	if parentID == nil {
+		return nil
+	}
+	p, err := getBookmark(q, libraryID, *parentID)
+	if err != nil {
+		return err
+	}
+	if !p.IsFolder {
+		return fmt.Errorf("%w: target %s is not a folder", ErrInvalid, p.ID)
+	}
+	seen := map[string]bool{}
+	cur := p.ID
+	for {
+		if cur == nodeID {
+			return fmt.Errorf("%w: cannot place %s inside itself or its descendants (cycle)", ErrInvalid, nodeID)
+		}
+		if seen[cur] {
+			return fmt.Errorf("%w: existing parent cycle detected at %s", ErrInvalid, cur)
+		}
+		seen[cur] = true
+		var next *string
+		if err := q.QueryRow(`SELECT parent_id FROM bookmarks WHERE id = ?`, cur).Scan(&next); err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		cur = *next
+	}
+}
+
+// ReorderBookmarks sets the display order of parentID's children (nil = root).
+// order must list every current child exactly once.
+func (d *DB) ReorderBookmarks(libraryID string, parentID *string, order []string) error {
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	current, err := siblingIDs(tx, libraryID, parentID)
+	if err != nil {
+		return err
+	}
+	if len(order) != len(current) {
+		return fmt.Errorf("%w: order lists %d ids, folder has %d children", ErrInvalid, len(order), len(current))
+	}
+	want := make(map[string]bool, len(current))
+	for _, id := range current {
+		want[id] = true
+	}
+	for _, id := range order {
+		if !want[id] {
+			return fmt.Errorf("%w: %s is not a child of this folder (or is listed twice)", ErrInvalid, id)
+		}
+		delete(want, id)
+	}
+	if err := renumber(tx, order); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MoveBookmark re-parents a bookmark (and implicitly its whole subtree) under
+// parentID (nil = root) at position index (-1 = append). Both the old and
+// new sibling lists are renumbered.
+func (d *DB) MoveBookmark(libraryID, id string, parentID *string, index int) (*Bookmark, error) {
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	b, err := getBookmark(tx, libraryID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTarget(tx, libraryID, id, parentID); err != nil {
+		return nil, err
+	}
+	oldSiblings, err := siblingIDs(tx, libraryID, b.ParentID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE bookmarks SET parent_id = ? WHERE id = ?`, parentID, id); err != nil {
+		return nil, err
+	}
+	if err := renumber(tx, without(oldSiblings, id)); err != nil {
+		return nil, err
+	}
+	newSiblings, err := siblingIDs(tx, libraryID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	if err := renumber(tx, insertAt(without(newSiblings, id), id, index)); err != nil {
+		return nil, err
+	}
+	moved, err := getBookmark(tx, libraryID, id)
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.crypter(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.openBookmark(moved); err != nil {
+		return nil, err
+	}
+	return moved, tx.Commit()
+}
+
+// CopyBookmark deep-copies the subtree rooted at id under parentID (nil =
+// root) at position index (-1 = append). Every copied row gets a fresh ID from
+// newID; the copy keeps titles, URLs, notes, colours and relative order.
+// Returns the root of the copied subtree.
+func (d *DB) CopyBookmark(libraryID, id string, parentID *string, index int, newID func() string) (*BookmarkNode, error) {
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := getBookmark(tx, libraryID, id); err != nil {
+		return nil, err
+	}
+	if err := checkTarget(tx, libraryID, id, parentID); err != nil {
+		return nil, err
+	}
+	// Sealed values are bound to the library, not the row, so the copy can
+	// reuse them as stored; only the returned tree is decrypted.
+	c, err := d.crypter(tx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.aead(libraryID); err != nil {
+		return nil, err
+	}
+	items, err := listBookmarks(tx, libraryID, treeOrder)
+	if err != nil {
+		return nil, err
+	}
+	_, byID := buildBookmarkForest(items)
+	src := byID[id]
+
+	var clone func(n *BookmarkNode, parent *string) (*BookmarkNode, error)
+	clone = func(n *BookmarkNode, parent *string) (*BookmarkNode, error) {
+		c := &BookmarkNode{Bookmark: n.Bookmark}
+		c.ID = newID()
+		c.ParentID = parent
+		if err := createBookmark(tx, c.Bookmark); err != nil {
+			return nil, err
+		}
+		cid := c.ID
+		for _, ch := range n.Children {
+			cc, err := clone(ch, &cid)
+			if err != nil {
+				return nil, err
+			}
+			c.Children = append(c.Children, cc)
+		}
+		return c, nil
+	}
+	root, err := clone(src, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("copy subtree: %w", err)
+	}
+
+	siblings, err := siblingIDs(tx, libraryID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	order := insertAt(without(siblings, root.ID), root.ID, index)
+	if err := renumber(tx, order); err != nil {
+		return nil, err
+	}
+	for i, sid := range order {
+		if sid == root.ID {
+			root.SortOrder = i
+		}
+	}
+	var openTree func(n *BookmarkNode) error
+	openTree = func(n *BookmarkNode) error {
+		if err := c.openBookmark(&n.Bookmark); err != nil {
+			return err
+		}
+		for _, ch := range n.Children {
+			if err := openTree(ch); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := openTree(root); err != nil {
+		return nil, err
+	}
+	return root, tx.Commit()
+}
@@ -1,8 +1,21 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/mindvault/companion/internal/backupfile"
+	"github.com/mindvault/companion/internal/backuptarget"
 )
 
 // seed inserts a minimal library + session + 2 tabs into db.
@@ -182,3 +195,1556 @@ func TestMigrateIdempotent(t *testing.T) {
 		}
 	}
 }
+
+func TestMergeSessions(t *testing.T) {
+	d, _ := OpenInMemory()
+	defer d.Close()
+	_ = d.Migrate()
+
+	libID, sessID := seed(t, d)
+	now := time.Now().UnixMilli()
+	if err := d.CreateSession(Session{
+		ID: "sess-test-002", LibraryID: libID, Name: "Restored",
+		Notes: "after crash", CreatedAt: now, UpdatedAt: now, SourceBrowser: "Firefox",
+	}); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	sid2 := "sess-test-002"
+	for _, row := range []struct{ id, url, notes string }{
+		{"tab-101", "https://example.com", "dup note"},
+		{"tab-102", "https://sqlite.org", ""},
+	} {
+		if err := d.CreateTab(Tab{ID: row.id, LibraryID: libID, SessionID: &sid2, URL: row.url, Title: row.url, SavedAt: now, Notes: row.notes}); err != nil {
+			t.Fatalf("CreateTab: %v", err)
+		}
+	}
+
+	res, err := d.MergeSessions(MergeSessionsOpts{SessionIDs: []string{sessID, sid2}, NewID: "sess-merged"})
+	if err != nil {
+		t.Fatalf("MergeSessions: %v", err)
+	}
+	if res.TabsKept != 3 || res.TabsDropped != 1 {
+		t.Errorf("want kept=3 dropped=1, got kept=%d dropped=%d", res.TabsKept, res.TabsDropped)
+	}
+	if res.Session.Notes != "after crash" {
+		t.Errorf("want merged notes, got %q", res.Session.Notes)
+	}
+	if res.Session.SourceBrowser != "Firefox" {
+		t.Errorf("want browser set Firefox, got %q", res.Session.SourceBrowser)
+	}
+	sessions, _ := d.ListSessions(libID, true)
+	if len(sessions) != 1 || sessions[0].ID != "sess-merged" || sessions[0].TabCount != 3 {
+		t.Fatalf("want only merged session with 3 tabs, got %+v", sessions)
+	}
+	tabs, _ := d.ListTabs(libID)
+	for _, tb := range tabs {
+		if tb.ID == "tab-001" && tb.Notes != "dup note" {
+			t.Errorf("want duplicate tab notes carried over, got %q", tb.Notes)
+		}
+	}
+
+	if _, err := d.MergeSessions(MergeSessionsOpts{SessionIDs: []string{"sess-merged", "missing"}, NewID: "x"}); err == nil {
+		t.Fatal("expected error for missing session")
+	}
+}
+
+func TestSplitSession(t *testing.T) {
+	d, _ := OpenInMemory()
+	defer d.Close()
+	_ = d.Migrate()
+
+	libID, sessID := seed(t, d)
+	res, err := d.SplitSession(sessID, "sess-split", "", []string{"tab-002"}, func() string { return "gen" })
+	if err != nil {
+		t.Fatalf("SplitSession: %v", err)
+	}
+	if res.TabsMoved != 1 || res.Session.Name != "Morning tabs (split)" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	sessions, _ := d.ListSessions(libID, false)
+	counts := map[string]int{}
+	for _, s := range sessions {
+		counts[s.ID] = s.TabCount
+	}
+	if counts[sessID] != 1 || counts["sess-split"] != 1 {
+		t.Errorf("want 1 tab each, got %v", counts)
+	}
+
+	if _, err := d.SplitSession(sessID, "sess-bad", "", []string{"tab-002"}, func() string { return "gen" }); err == nil {
+		t.Fatal("expected error splitting a tab that is no longer in the session")
+	}
+
+	// A taken ID fails the split instead of reporting a session that was never written.
+	if _, err := d.SplitSession(sessID, "sess-split", "", []string{"tab-001"}, func() string { return "gen2" }); !errors.Is(err, ErrConflict) {
+		t.Fatalf("split into a taken ID: want ErrConflict, got %v", err)
+	}
+	var n int
+	_ = d.sql.QueryRow(`SELECT COUNT(*) FROM saved_tabs WHERE id = 'tab-001' AND session_id = ?`, sessID).Scan(&n)
+	if n != 1 {
+		t.Error("failed split moved tab-001 anyway")
+	}
+}
+
+func TestMergeLibraries(t *testing.T) {
+	d, _ := OpenInMemory()
+	defer d.Close()
+	_ = d.Migrate()
+
+	srcID, _ := seed(t, d)
+	now := time.Now().UnixMilli()
+	dstID := "lib-test-002"
+	if err := d.CreateLibrary(Library{ID: dstID, Name: "Default (Firefox — user)", CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatalf("CreateLibrary: %v", err)
+	}
+	for _, h := range []HistoryEntry{
+		{ID: "h-src", LibraryID: srcID, URL: "https://go.dev", Title: "Go", VisitTime: now, Domain: "go.dev", IsImportant: true},
+		// An older visit whose title sorts after the newer one: the newest title must win.
+		{ID: "h-src-old", LibraryID: srcID, URL: "https://go.dev", Title: "Zz old title", VisitTime: now - 5000, Domain: "go.dev"},
+		{ID: "h-dst", LibraryID: dstID, URL: "https://go.dev", VisitTime: now - 1000, Domain: "go.dev"},
+	} {
+		if err := d.UpsertHistoryEntry(h); err != nil {
+			t.Fatalf("UpsertHistoryEntry: %v", err)
+		}
+	}
+	for _, tag := range []struct{ id, lib string }{{"tag-src", srcID}, {"tag-dst", dstID}} {
+		if _, err := d.sql.Exec(`INSERT INTO tags (id, library_id, name, created_at) VALUES (?, ?, 'work', ?)`, tag.id, tag.lib, now); err != nil {
+			t.Fatalf("insert tag: %v", err)
+		}
+	}
+
+	if err := writeAudit(d.sql, srcID, AuditLock, "manual"); err != nil {
+		t.Fatalf("writeAudit: %v", err)
+	}
+
+	res, err := d.MergeLibraries(srcID, dstID)
+	if err != nil {
+		t.Fatalf("MergeLibraries: %v", err)
+	}
+	// The source's audit trail is not passed off as the target's.
+	if log, _ := d.ListAuditLog(dstID, 0); len(log) != 1 || log[0].Action != AuditUpdate || log[0].Detail != "merged from "+srcID {
+		t.Errorf("target audit log: %+v", log)
+	}
+	if res.Sessions != 1 || res.Tabs != 2 || res.HistoryMerged != 2 || res.TagsMerged != 1 {
+		t.Errorf("unexpected counts %+v", res)
+	}
+	if _, err := d.GetLibrary(srcID); err == nil {
+		t.Error("source library should be deleted")
+	}
+	hist, _ := d.ListHistory(dstID)
+	if len(hist) != 1 || hist[0].ID != "h-dst" || !hist[0].IsImportant || hist[0].VisitTime != now || hist[0].Title != "Go" {
+		t.Errorf("want folded history row, got %+v", hist)
+	}
+	tabs, _ := d.ListTabs(dstID)
+	if len(tabs) != 2 {
+		t.Errorf("want 2 tabs in target, got %d", len(tabs))
+	}
+
+	if _, err := d.MergeLibraries(dstID, dstID); err == nil {
+		t.Error("expected error merging a library into itself")
+	}
+}
+
+func TestBookmarkTreeMoveCopy(t *testing.T) {
+	d, _ := OpenInMemory()
+	defer d.Close()
+	_ = d.Migrate()
+
+	libID, _ := seed(t, d)
+	now := time.Now().UnixMilli()
+	str := func(s string) *string { return &s }
+	for i, b := range []Bookmark{
+		{ID: "f1", Title: "Work", IsFolder: true},
+		{ID: "f2", Title: "Sub", IsFolder: true, ParentID: str("f1")},
+		{ID: "b1", Title: "Go", URL: str("https://go.dev"), ParentID: str("f2")},
+		{ID: "b2", Title: "SQLite", URL: str("https://sqlite.org")},
+	} {
+		b.LibraryID = libID
+		b.CreatedAt = now + int64(i)
+		b.SortOrder, _ = d.NextBookmarkSortOrder(libID, b.ParentID)
+		if err := d.CreateBookmark(b); err != nil {
+			t.Fatalf("CreateBookmark %s: %v", b.ID, err)
+		}
+	}
+
+	tree, err := d.BookmarkTree(libID, "")
+	if err != nil {
+		t.Fatalf("BookmarkTree: %v", err)
+	}
+	if len(tree) != 2 || tree[0].ID != "f1" || tree[0].Children[0].Children[0].ID != "b1" {
+		t.Fatalf("unexpected tree shape")
+	}
+
+	if _, err := d.MoveBookmark(libID, "f1", str("f2"), -1); err == nil {
+		t.Error("expected cycle error moving folder into its own child")
+	}
+	if _, err := d.MoveBookmark(libID, "b2", str("b1"), -1); err == nil {
+		t.Error("expected error moving into a non-folder")
+	}
+	if _, err := d.MoveBookmark(libID, "b2", str("f1"), 0); err != nil {
+		t.Fatalf("MoveBookmark: %v", err)
+	}
+	sub, _ := d.BookmarkTree(libID, "f1")
+	if len(sub[0].Children) != 2 || sub[0].Children[0].ID != "b2" {
+		t.Errorf("want b2 first in f1, got %+v", sub[0].Children)
+	}
+
+	if err := d.ReorderBookmarks(libID, str("f1"), []string{"f2", "b2"}); err != nil {
+		t.Fatalf("ReorderBookmarks: %v", err)
+	}
+	if err := d.ReorderBookmarks(libID, str("f1"), []string{"f2"}); err == nil {
+		t.Error("expected error for incomplete order")
+	}
+
+	n := 0
+	cp, err := d.CopyBookmark(libID, "f2", nil, -1, func() string { n++; return "copy-" + string(rune('a'+n)) })
+	if err != nil {
+		t.Fatalf("CopyBookmark: %v", err)
+	}
+	if cp.ParentID != nil || len(cp.Children) != 1 || cp.Children[0].URL == nil || *cp.Children[0].URL != "https://go.dev" {
+		t.Errorf("unexpected copy %+v", cp)
+	}
+	if _, err := d.CopyBookmark(libID, "f1", str("f2"), -1, func() string { return "x" }); err == nil {
+		t.Error("expected cycle error copying folder into its descendant")
+	}
+}
+
+func TestSessionDetailStructure(t *testing.T) {
+	d, _ := OpenInMemory()
+	defer d.Close()
+	_ = d.Migrate()
+
+	libID, sessID := seed(t, d)
+	now := time.Now().UnixMilli()
+	for i, w := range []string{"win-1", "win-2"} {
+		if err := d.CreateWindow(SessionWindow{ID: w, SessionID: sessID, SortOrder: i, CreatedAt: now}); err != nil {
+			t.Fatalf("CreateWindow: %v", err)
+		}
+	}
+	win2 := "win-2"
+	if err := d.CreateTabGroup(TabGroup{ID: "grp-1", SessionID: sessID, WindowID: &win2, Name: "Docs", Colour: "blue", CreatedAt: now}); err != nil {
+		t.Fatalf("CreateTabGroup: %v", err)
+	}
+	if err := d.CreateTabGroup(TabGroup{ID: "grp-bad", SessionID: sessID, Colour: "magenta", CreatedAt: now}); err == nil {
+		t.Error("expected error for invalid group colour")
+	}
+	sid, grp, pinned := sessID, "grp-1", true
+	if err := d.CreateTab(Tab{ID: "tab-003", LibraryID: libID, SessionID: &sid, URL: "https://pkg.go.dev", Title: "pkg", SavedAt: now,
+		WindowID: &win2, GroupID: &grp, TabIndex: 1}); err != nil {
+		t.Fatalf("CreateTab: %v", err)
+	}
+	if err := d.UpdateTab("tab-002", TabPatch{WindowID: &win2, IsPinned: &pinned}); err != nil {
+		t.Fatalf("UpdateTab: %v", err)
+	}
+
+	detail, err := d.GetSessionDetail(sessID)
+	if err != nil {
+		t.Fatalf("GetSessionDetail: %v", err)
+	}
+	if detail.WindowCount != 2 || len(detail.Windows) != 2 {
+		t.Fatalf("want 2 windows, got %d/%d", detail.WindowCount, len(detail.Windows))
+	}
+	w2 := detail.Windows[1]
+	if len(w2.Tabs) != 2 || w2.Tabs[0].ID != "tab-002" || !w2.Tabs[0].IsPinned || len(w2.Groups) != 1 {
+		t.Errorf("unexpected window 2 layout: %+v", w2)
+	}
+	if len(detail.LooseTabs) != 1 || detail.LooseTabs[0].ID != "tab-001" {
+		t.Errorf("want tab-001 loose, got %+v", detail.LooseTabs)
+	}
+
+	n := 0
+	res, err := d.SplitSession(sessID, "sess-split", "", []string{"tab-003"}, func() string { n++; return "gen-" + string(rune('0'+n)) })
+	if err != nil {
+		t.Fatalf("SplitSession: %v", err)
+	}
+	split, _ := d.GetSessionDetail(res.Session.ID)
+	if len(split.Windows) != 1 || len(split.Windows[0].Groups) != 1 || split.Windows[0].Tabs[0].GroupID == nil ||
+		*split.Windows[0].Tabs[0].GroupID != split.Windows[0].Groups[0].ID {
+		t.Errorf("want split tab to keep its window and group, got %+v", split.Windows)
+	}
+
+	if err := d.DeleteSession(libID, sessID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	var left int
+	_ = d.sql.QueryRow(`SELECT COUNT(*) FROM session_windows WHERE session_id = ?`, sessID).Scan(&left)
+	if left != 0 {
+		t.Errorf("want windows removed with their session, %d left", left)
+	}
+}
+
+func TestSessionStructureOwnership(t *testing.T) {
+	d, _ := OpenInMemory()
+	defer d.Close()
+	_ = d.Migrate()
+	libID, sessID := seed(t, d)
+
+	now := time.Now().UnixMilli()
+	other, win, grp := "sess-other", "win-other", "grp-other"
+	if err := d.CreateSession(Session{ID: other, LibraryID: libID, Name: "Other", CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateWindow(SessionWindow{ID: win, SessionID: other, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateTabGroup(TabGroup{ID: grp, SessionID: other, WindowID: &win, Colour: "red", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateTab(Tab{ID: "tab-other", LibraryID: libID, SessionID: &other, URL: "https://example.org", SavedAt: now,
+		WindowID: &win, GroupID: &grp}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another session's window or group through this session's path: not found, nothing touched.
+	if err := d.DeleteWindow(sessID, win); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeleteWindow of another session: want ErrNoRows, got %v", err)
+	}
+	if err := d.DeleteTabGroup(sessID, grp); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeleteTabGroup of another session: want ErrNoRows, got %v", err)
+	}
+	detail, _ := d.GetSessionDetail(other)
+	if len(detail.Windows) != 1 || len(detail.Windows[0].Groups) != 1 || len(detail.Windows[0].Tabs) != 1 ||
+		*detail.Windows[0].Tabs[0].GroupID != grp {
+		t.Errorf("other session's layout changed: %+v", detail.Windows)
+	}
+
+	// Tabs cannot be placed in another session's window or group.
+	sid := sessID
+	if err := d.CreateTab(Tab{ID: "tab-x", LibraryID: libID, SessionID: &sid, URL: "https://x", SavedAt: now, WindowID: &win}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("CreateTab into another session's window: want ErrInvalid, got %v", err)
+	}
+	if err := d.UpdateTab("tab-001", TabPatch{GroupID: &grp}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("UpdateTab into another session's group: want ErrInvalid, got %v", err)
+	}
+}
+
+func TestSessionTabsPageStatsAndUnsorted(t *testing.T) {
+	d, _ := OpenInMemory()
+	defer d.Close()
+	_ = d.Migrate()
+	libID, sessID := seed(t, d)
+
+	red := "R"
+	sid := sessID
+	if err := d.CreateTab(Tab{ID: "tab-003", LibraryID: libID, SessionID: &sid, URL: "https://www.example.com/a",
+		Title: "A", Colour: &red, SavedAt: time.Now().UnixMilli()}); err != nil {
+		t.Fatalf("CreateTab: %v", err)
+	}
+
+	page, err := d.ListSessionTabsPage(libID, sessID, 2, 1)
+	if err != nil {
+		t.Fatalf("ListSessionTabsPage: %v", err)
+	}
+	if page.Total != 3 || len(page.Tabs) != 2 || page.Offset != 1 {
+		t.Errorf("unexpected page: total=%d len=%d offset=%d", page.Total, len(page.Tabs), page.Offset)
+	}
+
+	stats, err := d.SessionStats(libID, sessID)
+	if err != nil {
+		t.Fatalf("SessionStats: %v", err)
+	}
+	if stats.TabCount != 3 || stats.ByColour["R"] != 1 || stats.ByColour["none"] != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.Domains[0].Domain != "example.com" || stats.Domains[0].Count != 2 {
+		t.Errorf("want example.com×2 first, got %+v", stats.Domains)
+	}
+
+	if _, err := d.GetLibrarySession("other-lib", sessID); err == nil {
+		t.Error("expected error for session outside library")
+	}
+
+	if err := d.DeleteSession(libID, sessID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	u, err := d.GetLibrarySession(libID, UnsortedSessionID)
+	if err != nil {
+		t.Fatalf("Unsorted: %v", err)
+	}
+	if !u.Virtual || u.TabCount != 3 {
+		t.Errorf("want virtual session with 3 tabs, got %+v", u)
+	}
+}
+
+func TestHotBackupVerified(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	if err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	seed(t, d)
+
+	info, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if !info.Verified || len(info.SHA256) != 64 {
+		t.Errorf("want verified backup with sha256, got %+v", info)
+	}
+	path := filepath.Join(d.BackupDir(), info.Filename)
+	if sum, _ := fileSHA256(path); sum != info.SHA256 {
+		t.Errorf("sha256 mismatch: file %s, reported %s", sum, info.SHA256)
+	}
+
+	list, err := d.ListBackups()
+	if err != nil || len(list) != 1 {
+		t.Fatalf("ListBackups: %v (%d entries)", err, len(list))
+	}
+	if !list[0].Verified || list[0].SHA256 != info.SHA256 {
+		t.Errorf("listed backup lost verification: %+v", list[0])
+	}
+
+	if err := d.DeleteBackup(info.Filename); err != nil {
+		t.Fatalf("DeleteBackup: %v", err)
+	}
+	if _, err := os.Stat(path + checksumExt); !os.IsNotExist(err) {
+		t.Errorf("checksum sidecar not removed")
+	}
+}
+
+func TestVerifyDatabaseFileRejectsGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.sqlite")
+	if err := os.WriteFile(path, []byte("not a database at all, just some bytes padding it out"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDatabaseFile(path); err == nil {
+		t.Error("expected integrity check to fail on a non-database file")
+	}
+}
+
+func TestRestoreSafe(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	libID, _ := seed(t, d)
+
+	snap, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if err := d.CreateTab(Tab{ID: "tab-after", LibraryID: libID, URL: "https://after.example", SavedAt: 1}); err != nil {
+		t.Fatalf("CreateTab: %v", err)
+	}
+
+	// Restore must wait for in-flight requests holding the gate.
+	release := d.Acquire()
+	done := make(chan error, 1)
+	var pre BackupInfo
+	go func() {
+		var err error
+		pre, err = d.Restore(snap.Filename)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("Restore did not wait for in-flight request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	tabs, _ := d.ListTabs(libID)
+	if len(tabs) != 2 {
+		t.Errorf("want 2 tabs after restore, got %d", len(tabs))
+	}
+	if !pre.Verified || !strings.HasPrefix(pre.Filename, "mindvault-pre-restore-") {
+		t.Errorf("unexpected pre-restore backup %+v", pre)
+	}
+
+	// The pre-restore snapshot still holds the tab added after the first backup.
+	if _, err := d.Restore(pre.Filename); err != nil {
+		t.Fatalf("Restore pre-restore: %v", err)
+	}
+	tabs, _ = d.ListTabs(libID)
+	if len(tabs) != 3 {
+		t.Errorf("want 3 tabs after restoring pre-restore snapshot, got %d", len(tabs))
+	}
+}
+
+func TestRestoreRejectsInvalidBackups(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	seed(t, d)
+
+	info, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	future, _ := sql.Open("sqlite", filepath.Join(d.BackupDir(), info.Filename))
+	_, _ = future.Exec(`INSERT INTO schema_migrations(version, applied_at) VALUES(?, 0)`, LatestSchemaVersion()+1)
+	future.Close()
+	if _, err := d.Restore(info.Filename); !errors.Is(err, ErrInvalid) {
+		t.Errorf("newer schema: want ErrInvalid, got %v", err)
+	}
+
+	garbage := filepath.Join(d.BackupDir(), "mindvault-garbage.sqlite")
+	_ = os.WriteFile(garbage, []byte("definitely not sqlite, but long enough to look like a header"), 0600)
+	if _, err := d.Restore("mindvault-garbage.sqlite"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("corrupt file: want ErrInvalid, got %v", err)
+	}
+
+	// Nothing was touched: no pre-restore backup, data still readable.
+	list, _ := d.ListBackups()
+	for _, b := range list {
+		if strings.HasPrefix(b.Filename, "mindvault-pre-restore-") {
+			t.Errorf("pre-restore backup written for rejected restore: %s", b.Filename)
+		}
+	}
+	if libs, err := d.ListLibraries(); err != nil || len(libs) != 1 {
+		t.Errorf("live db damaged: %v (%d libraries)", err, len(libs))
+	}
+}
+
+func TestBackupSummaryDiffAndSelectiveRestore(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	libID, sessID := seed(t, d)
+
+	snap, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	sum, err := d.BackupSummary(snap.Filename)
+	if err != nil {
+		t.Fatalf("BackupSummary: %v", err)
+	}
+	if len(sum.Libraries) != 1 || sum.Libraries[0].Sessions != 1 || sum.Libraries[0].Tabs != 2 {
+		t.Errorf("unexpected summary %+v", sum)
+	}
+	if sum.SchemaVersion != LatestSchemaVersion() {
+		t.Errorf("schemaVersion: want %d, got %d", LatestSchemaVersion(), sum.SchemaVersion)
+	}
+
+	// Diverge: delete the session (with its tabs), add a new tab, retitle nothing else.
+	if err := d.DeleteSessionWithTabs(libID, sessID); err != nil {
+		t.Fatalf("DeleteSessionWithTabs: %v", err)
+	}
+	if err := d.CreateTab(Tab{ID: "tab-new", LibraryID: libID, URL: "https://new.example", Title: "New", SavedAt: 1}); err != nil {
+		t.Fatalf("CreateTab: %v", err)
+	}
+
+	diff, err := d.DiffBackup(snap.Filename, "", 0)
+	if err != nil {
+		t.Fatalf("DiffBackup: %v", err)
+	}
+	if c := diff.Counts["session"]; c.BackupOnly != 1 {
+		t.Errorf("session counts: %+v", c)
+	}
+	if c := diff.Counts["tab"]; c.BackupOnly != 2 || c.LiveOnly != 1 {
+		t.Errorf("tab counts: %+v", c)
+	}
+	if diff.Counts["library"].Changed != 0 {
+		t.Errorf("library should be unchanged: %+v", diff.Counts["library"])
+	}
+
+	res, err := d.RestoreSelected(snap.Filename, RestoreSelection{SessionIDs: []string{sessID}})
+	if err != nil {
+		t.Fatalf("RestoreSelected: %v", err)
+	}
+	if res.Rows["sessions"] != 1 || res.Rows["saved_tabs"] != 2 || !res.PreRestore.Verified {
+		t.Errorf("unexpected result %+v", res)
+	}
+	tabs, _ := d.ListTabs(libID)
+	if len(tabs) != 3 {
+		t.Errorf("want 2 restored + 1 new tab, got %d", len(tabs))
+	}
+
+	if _, err := d.RestoreSelected(snap.Filename, RestoreSelection{LibraryIDs: []string{"nope"}}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("unknown library: want ErrInvalid, got %v", err)
+	}
+	// Restoring the whole library drops the tab created after the backup.
+	if _, err := d.RestoreSelected(snap.Filename, RestoreSelection{LibraryIDs: []string{libID}}); err != nil {
+		t.Fatalf("RestoreSelected library: %v", err)
+	}
+	tabs, _ = d.ListTabs(libID)
+	if len(tabs) != 2 {
+		t.Errorf("want library back at 2 tabs, got %d", len(tabs))
+	}
+}
+
+func TestSelectRetainedGFS(t *testing.T) {
+	base := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	var backups []BackupInfo
+	// One backup every 6 hours for 60 days, newest first.
+	for i := 0; i < 60*4; i++ {
+		at := base.Add(-time.Duration(i) * 6 * time.Hour)
+		backups = append(backups, BackupInfo{Filename: at.Format(time.RFC3339), CreatedAt: at.UnixMilli(), SizeBytes: 10})
+	}
+	drop := selectRetained(backups, RetentionPolicy{KeepHourly: 2, KeepDaily: 3, KeepWeekly: 2, KeepMonthly: 2})
+	kept := map[string]bool{}
+	for _, b := range backups {
+		kept[b.Filename] = true
+	}
+	for _, name := range drop {
+		delete(kept, name)
+	}
+	for _, want := range []time.Time{
+		base,                      // newest: hourly + daily + weekly + monthly
+		base.Add(-6 * time.Hour),  // 2nd hourly
+		base.Add(-18 * time.Hour), // 2nd day (newest of 2026-03-30)
+		base.Add(-42 * time.Hour), // 3rd day
+		time.Date(2026, 2, 28, 18, 0, 0, 0, time.UTC), // newest of February
+	} {
+		if !kept[want.Format(time.RFC3339)] {
+			t.Errorf("expected %s to be kept", want)
+		}
+	}
+	if len(kept) > 2+3+2+2 {
+		t.Errorf("kept too many: %d", len(kept))
+	}
+
+	// A size cap keeps the newest even when it alone is over budget.
+	drop = selectRetained(backups[:3], RetentionPolicy{KeepHourly: 3, MaxTotalBytes: 5})
+	if len(drop) != 2 {
+		t.Errorf("size cap: want 2 dropped, got %v", drop)
+	}
+}
+
+func TestManualBackupAppliesRetentionPolicy(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	seed(t, d)
+
+	// An old monthly backup and old safety snapshots, as a restore or import leaves them.
+	if err := os.MkdirAll(d.BackupDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().AddDate(0, -3, 0)
+	monthly := "mindvault-2026-01-15T00-00-00.sqlite"
+	safety := []string{"mindvault-pre-restore-2026-01-10T00-00-00.sqlite", "mindvault-pre-import-2026-01-11T00-00-00.sqlite"}
+	for _, name := range append([]string{monthly}, safety...) {
+		path := filepath.Join(d.BackupDir(), name)
+		if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(path, old, old)
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(d.BackupDir(), name))
+		return err == nil
+	}
+
+	// Without a policy a manual backup prunes nothing.
+	if _, err := d.Backup(); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if !exists(monthly) {
+		t.Fatal("backup without a policy deleted an old backup")
+	}
+	// The monthly rule keeps the old backup.
+	d.SetRetentionPolicy(RetentionPolicy{KeepDaily: 7, KeepMonthly: 12})
+	if _, err := d.Backup(); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if !exists(monthly) {
+		t.Error("backup deleted a backup the monthly rule keeps")
+	}
+	// A policy that does not keep it prunes it; safety snapshots stay regardless.
+	d.SetRetentionPolicy(RetentionPolicy{KeepDaily: 1})
+	if _, err := d.Backup(); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if exists(monthly) {
+		t.Error("backup outside the policy was not pruned")
+	}
+	for _, name := range safety {
+		if !exists(name) {
+			t.Errorf("safety snapshot %s was pruned", name)
+		}
+	}
+}
+
+func TestBackupSchedulerRunsAndReportsStatus(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	seed(t, d)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.StartBackupScheduler(ctx, time.Hour, RetentionPolicy{KeepHourly: 24})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.BackupStatus().LastResult == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := d.BackupStatus()
+	if !st.Enabled || st.LastResult == nil || !st.LastResult.OK {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if st.NextRun < time.Now().Add(59*time.Minute).UnixMilli() {
+		t.Errorf("next run should be ~1h out, got %d", st.NextRun)
+	}
+	if list, _ := d.ListBackups(); len(list) != 1 {
+		t.Errorf("want 1 backup, got %d", len(list))
+	}
+}
+
+func TestBackupSchedulerIgnoresSafetySnapshots(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	seed(t, d)
+
+	// A scheduled backup two hours old, then a fresh pre-restore snapshot:
+	// the schedule is overdue all the same.
+	old, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	then := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(d.BackupDir(), old.Filename), then, then); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if _, err := d.writeBackup(d.backupName(preRestorePrefix)); err != nil {
+		t.Fatalf("safety snapshot: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.StartBackupScheduler(ctx, time.Hour, RetentionPolicy{KeepHourly: 24})
+	if next := d.BackupStatus().NextRun; next > time.Now().UnixMilli() {
+		t.Errorf("first run due at %d, want now (the last scheduled backup is 2h old)", next)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for d.BackupStatus().LastResult == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEncryptedBackupRestore(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	libID, _ := seed(t, d)
+	if err := d.SetBackupOptions(backupfile.Options{Compression: backupfile.CompressionGzip, Passphrase: "s3cret"}); err != nil {
+		t.Fatalf("SetBackupOptions: %v", err)
+	}
+
+	info, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if !strings.HasSuffix(info.Filename, backupfile.ExtEncrypted) || !info.Encrypted || !info.Compressed {
+		t.Errorf("unexpected info %+v", info)
+	}
+	raw, _ := os.ReadFile(filepath.Join(d.BackupDir(), info.Filename))
+	if bytes.Contains(raw, []byte("example.com")) || bytes.Contains(raw, []byte("SQLite format")) {
+		t.Error("encrypted backup contains cleartext")
+	}
+
+	if sum, err := d.BackupSummary(info.Filename); err != nil || sum.Libraries[0].Tabs != 2 {
+		t.Fatalf("BackupSummary: %+v, %v", sum, err)
+	}
+	_ = d.DeleteLibrary(libID)
+	if _, err := d.Restore(info.Filename); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if tabs, _ := d.ListTabs(libID); len(tabs) != 2 {
+		t.Errorf("want 2 tabs after restore, got %d", len(tabs))
+	}
+
+	_ = d.SetBackupOptions(backupfile.Options{Compression: backupfile.CompressionGzip, Passphrase: "other"})
+	if _, err := d.Restore(info.Filename); !errors.Is(err, ErrInvalid) {
+		t.Errorf("wrong passphrase: want ErrInvalid, got %v", err)
+	}
+	if list, _ := d.ListBackups(); len(list) != 2 { // backup + pre-restore
+		t.Errorf("want 2 backups listed, got %d", len(list))
+	}
+	if err := d.DeleteBackup(info.Filename); err != nil {
+		t.Errorf("DeleteBackup: %v", err)
+	}
+
+	// Encrypt-only: the header, not the extension, says it is not compressed.
+	_ = d.SetBackupOptions(backupfile.Options{Compression: backupfile.CompressionNone, Passphrase: "other"})
+	plain, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if !plain.Encrypted || plain.Compressed {
+		t.Errorf("encrypt-only backup: %+v", plain)
+	}
+	list, _ := d.ListBackups()
+	for _, b := range list {
+		if b.Filename == plain.Filename && b.Compressed {
+			t.Errorf("ListBackups reports encrypt-only %s as compressed", b.Filename)
+		}
+	}
+}
+
+// flakyTarget fails the first fails Put calls, then delegates to Dir.
+type flakyTarget struct {
+	*backuptarget.Dir
+	fails int
+}
+
+func (f *flakyTarget) Put(ctx context.Context, name string, r io.ReadSeeker, size int64) error {
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("connection reset")
+	}
+	return f.Dir.Put(ctx, name, r, size)
+}
+
+func TestBackupReplicationRetentionAndRetry(t *testing.T) {
+	defer func(b time.Duration) { replicaBackoff = b }(replicaBackoff)
+	replicaBackoff = time.Millisecond
+
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	seed(t, d)
+
+	nasDir := t.TempDir()
+	nas := &flakyTarget{Dir: backuptarget.NewDir("nas", nasDir), fails: 1}
+	down := &flakyTarget{Dir: backuptarget.NewDir("down", t.TempDir()), fails: 100}
+	d.SetBackupTargets([]ReplicaTarget{
+		{Target: nas, Policy: RetentionPolicy{KeepHourly: 1}},
+		{Target: down, Policy: RetentionPolicy{KeepHourly: 1}},
+	})
+
+	// An older copy already on the NAS falls out of its one-hour retention.
+	old := "mindvault-2020-01-01T00-00-00.sqlite"
+	_ = os.WriteFile(filepath.Join(nasDir, old), []byte("old"), 0600)
+
+	res := d.runScheduledBackup(context.Background(), RetentionPolicy{KeepHourly: 24})
+	if !res.OK || res.Backup.Target != LocalTarget {
+		t.Fatalf("backup: %+v", res)
+	}
+	if len(res.Replicas) != 2 {
+		t.Fatalf("want 2 replica results, got %+v", res.Replicas)
+	}
+	if r := res.Replicas[0]; !r.OK || r.Attempts != 2 || len(r.Pruned) != 1 || r.Pruned[0] != old {
+		t.Errorf("nas: %+v", r)
+	}
+	if r := res.Replicas[1]; r.OK || r.Attempts != replicaAttempts || !strings.Contains(r.Error, "connection reset") {
+		t.Errorf("down: %+v", r)
+	}
+
+	list, err := d.ListTargetBackups(context.Background(), "nas")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("nas backups: %+v, %v", list, err)
+	}
+	if b := list[0]; b.Filename != res.Backup.Filename || b.Target != "nas" || !b.Verified || b.SizeBytes != res.Backup.SizeBytes {
+		t.Errorf("nas copy: %+v", b)
+	}
+	if _, err := d.ListTargetBackups(context.Background(), "nope"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("unknown target: want ErrInvalid, got %v", err)
+	}
+
+	st := d.BackupStatus()
+	if len(st.Targets) != 2 || st.Targets[1].LastResult == nil || st.Targets[1].LastResult.OK {
+		t.Errorf("status should surface the failed upload: %+v", st.Targets)
+	}
+}
+
+func TestLibraryEncryptionAtRest(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	plainID, _ := seed(t, d)
+	now := time.Now().UnixMilli()
+	const encID = "lib-enc"
+	if err := d.CreateLibrary(Library{ID: encID, Name: "Private", CreatedAt: now, UpdatedAt: now, IsEncrypted: true}); err != nil {
+		t.Fatalf("CreateLibrary: %v", err)
+	}
+	tab := Tab{ID: "enc-tab", LibraryID: encID, URL: "https://secret.example/diary", Title: "Secret diary", SavedAt: now}
+
+	// Locked: per-library reads and writes answer ErrLocked.
+	if err := d.CreateTab(tab); !errors.Is(err, ErrLocked) {
+		t.Fatalf("CreateTab while locked: want ErrLocked, got %v", err)
+	}
+	if _, err := d.UnlockLibrary(plainID, "pw"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("unlocking a plaintext library: want ErrInvalid, got %v", err)
+	}
+	if _, err := d.UnlockLibrary(encID, "correct horse"); err != nil {
+		t.Fatalf("UnlockLibrary: %v", err)
+	}
+	if err := d.CreateTab(tab); err != nil {
+		t.Fatalf("CreateTab: %v", err)
+	}
+
+	var rawURL, rawTitle string
+	if err := d.sql.QueryRow(`SELECT url, title FROM saved_tabs WHERE id = ?`, tab.ID).Scan(&rawURL, &rawTitle); err != nil {
+		t.Fatalf("raw select: %v", err)
+	}
+	if !strings.HasPrefix(rawURL, cipherPrefix) || !strings.HasPrefix(rawTitle, cipherPrefix) || strings.Contains(rawURL, "secret") {
+		t.Errorf("stored in cleartext: url=%q title=%q", rawURL, rawTitle)
+	}
+
+	tabs, err := d.ListTabs(encID)
+	if err != nil || len(tabs) != 1 || tabs[0].URL != tab.URL || tabs[0].Title != tab.Title {
+		t.Fatalf("ListTabs unlocked: %+v, %v", tabs, err)
+	}
+	res, err := d.Search("", "diary")
+	if err != nil || len(res) != 1 || res[0].EntityID != tab.ID {
+		t.Errorf("Search unlocked: %+v, %v", res, err)
+	}
+
+	// Wrong password is rejected once something is sealed.
+	d.LockLibrary(encID)
+	if _, err := d.UnlockLibrary(encID, "wrong"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("wrong password: want ErrInvalid, got %v", err)
+	}
+	if _, err := d.ListTabs(encID); !errors.Is(err, ErrLocked) {
+		t.Errorf("ListTabs locked: want ErrLocked, got %v", err)
+	}
+	if _, err := d.Search(encID, "diary"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Search locked library: want ErrLocked, got %v", err)
+	}
+	if res, err := d.Search("", "diary"); err != nil || len(res) != 0 {
+		t.Errorf("global Search must skip locked libraries: %+v, %v", res, err)
+	}
+	all, err := d.ListAllTabs()
+	if err != nil {
+		t.Fatalf("ListAllTabs: %v", err)
+	}
+	for _, at := range all {
+		if at.LibraryID == encID {
+			t.Errorf("ListAllTabs returned a tab of a locked library: %+v", at)
+		}
+	}
+
+	// Idle timeout drops the key.
+	d.SetUnlockIdleTimeout(50 * time.Millisecond)
+	st, err := d.UnlockLibrary(encID, "correct horse")
+	if err != nil || !st.Unlocked {
+		t.Fatalf("re-unlock: %+v, %v", st, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if st, _ := d.LibraryLockStatus(encID); st.Unlocked {
+		t.Error("key survived the idle timeout")
+	}
+	if _, err := d.ListTabs(encID); !errors.Is(err, ErrLocked) {
+		t.Errorf("after idle timeout: want ErrLocked, got %v", err)
+	}
+}
+
+func TestZeroKnowledgeBlobs(t *testing.T) {
+	d, err := OpenInMemory()
+	if err != nil {
+		t.Fatalf("OpenInMemory: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	plainID, _ := seed(t, d)
+	now := time.Now().UnixMilli()
+	const zkID = "lib-zk"
+	if err := d.CreateLibrary(Library{ID: zkID, Name: "E2E", CreatedAt: now, UpdatedAt: now, ZeroKnowledge: true}); err != nil {
+		t.Fatalf("CreateLibrary: %v", err)
+	}
+	if lib, _ := d.GetLibrary(zkID); !lib.ZeroKnowledge || !lib.IsEncrypted || lib.PasswordSalt != nil {
+		t.Errorf("library flags: %+v", lib)
+	}
+
+	// Arbitrary bytes (invalid UTF-8, NULs) round-trip unchanged.
+	data := []byte{0x00, 0xff, 0xfe, '{', '"', 0x80, 0x00}
+	res, err := d.PushBlobs(zkID, []Blob{
+		{ID: "b1", Data: data, CreatedAt: now, UpdatedAt: now},
+		{ID: "b2", Data: []byte("ct2"), UpdatedAt: now},
+		{ID: "b3", Data: []byte("ct3"), UpdatedAt: now + 1},
+	})
+	if err != nil || res.Stored != 3 || len(res.Stale) != 0 {
+		t.Fatalf("PushBlobs: %+v, %v", res, err)
+	}
+	b, err := d.GetBlob(zkID, "b1")
+	if err != nil || !bytes.Equal(b.Data, data) || b.CreatedAt != now {
+		t.Fatalf("GetBlob: %+v, %v", b, err)
+	}
+
+	// Older update is stale; tombstone of b2 wins.
+	res, err = d.PushBlobs(zkID, []Blob{
+		{ID: "b1", Data: []byte("old"), UpdatedAt: now - 1},
+		{ID: "b2", Deleted: true, UpdatedAt: now + 2},
+	})
+	if err != nil || res.Stored != 1 || len(res.Stale) != 1 || res.Stale[0] != "b1" {
+		t.Fatalf("second push: %+v, %v", res, err)
+	}
+	if b, _ := d.GetBlob(zkID, "b1"); !bytes.Equal(b.Data, data) {
+		t.Error("stale push overwrote the blob")
+	}
+
+	// Paging with the seq cursor, in store order: b1 | b3 | b2 (tombstone).
+	var got []string
+	cursor := int64(0)
+	for i := 0; i < 5; i++ {
+		page, err := d.ListBlobs(zkID, cursor, 1)
+		if err != nil {
+			t.Fatalf("ListBlobs: %v", err)
+		}
+		for _, b := range page.Blobs {
+			got = append(got, fmt.Sprintf("%s:%v", b.ID, b.Deleted))
+		}
+		cursor = page.Cursor
+		if !page.More {
+			break
+		}
+	}
+	if strings.Join(got, ",") != "b1:false,b3:false,b2:true" {
+		t.Errorf("pull order: %v", got)
+	}
+
+	// A device whose clock lags still reaches the others: its push sorts
+	// after their cursor even though its updatedAt is older.
+	if _, err := d.PushBlobs(zkID, []Blob{{ID: "b4", Data: []byte("ct4"), UpdatedAt: now - 1000}}); err != nil {
+		t.Fatalf("PushBlobs: %v", err)
+	}
+	page, err := d.ListBlobs(zkID, cursor, 0)
+	if err != nil || len(page.Blobs) != 1 || page.Blobs[0].ID != "b4" || page.More || page.Cursor <= cursor {
+		t.Errorf("incremental pull: %+v, %v", page, err)
+	}
+	if page, _ := d.ListBlobs(zkID, page.Cursor, 0); len(page.Blobs) != 0 || page.Cursor == 0 {
+		t.Errorf("pull with nothing new: %+v", page)
+	}
+
+	// The companion never handles plaintext of this library.
+	if _, err := d.Search(zkID, "x"); !errors.Is(err, ErrZeroKnowledge) {
+		t.Errorf("Search: want ErrZeroKnowledge, got %v", err)
+	}
+	if _, err := d.Search("", "x"); err != nil {
+		t.Errorf("global Search: %v", err)
+	}
+	if err := d.CreateTab(Tab{ID: "zk-tab", LibraryID: zkID, URL: "https://x", SavedAt: now}); !errors.Is(err, ErrZeroKnowledge) {
+		t.Errorf("CreateTab: want ErrZeroKnowledge, got %v", err)
+	}
+	if _, err := d.UnlockLibrary(zkID, "pw"); !errors.Is(err, ErrZeroKnowledge) {
+		t.Errorf("UnlockLibrary: want ErrZeroKnowledge, got %v", err)
+	}
+	if _, err := d.PushBlobs(plainID, []Blob{{ID: "x", Data: []byte("x"), UpdatedAt: now}}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("blobs into a normal library: want ErrInvalid, got %v", err)
+	}
+	if _, err := d.PushBlobs(zkID, []Blob{{ID: "x", UpdatedAt: now}}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("blob without data: want ErrInvalid, got %v", err)
+	}
+}
+
+func TestLibraryRekeyAndAudit(t *testing.T) {
+	d, err := OpenInMemory()
+	if err != nil {
+		t.Fatalf("OpenInMemory: %v", err)
+	}
+	defer d.Close()
+	_ = d.Migrate()
+	now := time.Now().UnixMilli()
+	const libID = "lib-rekey"
+	if err := d.CreateLibrary(Library{ID: libID, Name: "Private", CreatedAt: now, UpdatedAt: now, IsEncrypted: true}); err != nil {
+		t.Fatalf("CreateLibrary: %v", err)
+	}
+	if _, err := d.UnlockLibrary(libID, "old"); err != nil {
+		t.Fatalf("UnlockLibrary: %v", err)
+	}
+	if lib, _ := d.GetLibrary(libID); lib.KeyHash == nil || *lib.KeyHash == "" {
+		t.Fatal("key hash not stored on first unlock")
+	}
+	sid := "rk-sess"
+	if err := d.CreateSession(Session{ID: sid, LibraryID: libID, Name: "Leaked", CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := d.CreateTab(Tab{ID: "rk-tab", LibraryID: libID, SessionID: &sid, URL: "https://a.example", Title: "A", SavedAt: now}); err != nil {
+		t.Fatalf("CreateTab: %v", err)
+	}
+
+	if _, err := d.RekeyLibrary(libID, "wrong", "new"); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("rekey with wrong password: want ErrInvalid, got %v", err)
+	}
+	job, err := d.RekeyLibrary(libID, "old", "new")
+	if err != nil {
+		t.Fatalf("RekeyLibrary: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for job.State == JobRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if job, err = d.Job(job.ID); err != nil {
+			t.Fatalf("Job: %v", err)
+		}
+	}
+	if job.State != JobDone || job.Total != 3 || job.Done != 3 {
+		t.Fatalf("job: %+v", job)
+	}
+
+	tabs, err := d.ListTabs(libID)
+	if err != nil || len(tabs) != 1 || tabs[0].URL != "https://a.example" {
+		t.Fatalf("ListTabs after rekey: %+v, %v", tabs, err)
+	}
+	if err := d.LockLibrary(libID); err != nil {
+		t.Fatalf("LockLibrary: %v", err)
+	}
+	if _, err := d.UnlockLibrary(libID, "old"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("old password after rekey: want ErrInvalid, got %v", err)
+	}
+	if _, err := d.UnlockLibrary(libID, "new"); err != nil {
+		t.Fatalf("new password after rekey: %v", err)
+	}
+	if s, err := d.GetSession(sid); err != nil || s.Name != "Leaked" {
+		t.Errorf("GetSession after rekey: %+v, %v", s, err)
+	}
+
+	// Idle expiry is audited too.
+	d.SetUnlockIdleTimeout(30 * time.Millisecond)
+	if _, err := d.UnlockLibrary(libID, "new"); err != nil {
+		t.Fatalf("UnlockLibrary: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	entries, err := d.ListAuditLog(libID, 0)
+	if err != nil {
+		t.Fatalf("ListAuditLog: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Action+"/"+e.Detail)
+	}
+	want := "LOCK/idle timeout,UNLOCK/,UNLOCK/,UNLOCK_FAILED/wrong password,LOCK/manual,REKEY/,UNLOCK_FAILED/rekey: wrong password,UNLOCK/"
+	if strings.Join(got, ",") != want {
+		t.Errorf("audit log:\n got %s\nwant %s", strings.Join(got, ","), want)
+	}
+}
+
+// rekeyed opens a file DB with an encrypted library holding one tab under
+// password "old" (in session rk-sess), backs it up, then rekeys it to "new". It returns the
+// library ID and the backup taken before the rekey.
+func rekeyed(t *testing.T) (*DB, string, BackupInfo) {
+	t.Helper()
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	now := time.Now().UnixMilli()
+	const libID = "lib-rekey"
+	if err := d.CreateLibrary(Library{ID: libID, Name: "Private", CreatedAt: now, UpdatedAt: now, IsEncrypted: true}); err != nil {
+		t.Fatalf("CreateLibrary: %v", err)
+	}
+	if _, err := d.UnlockLibrary(libID, "old"); err != nil {
+		t.Fatalf("UnlockLibrary: %v", err)
+	}
+	sid := "rk-sess"
+	if err := d.CreateSession(Session{ID: sid, LibraryID: libID, Name: "S", CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := d.CreateTab(Tab{ID: "rk-tab", LibraryID: libID, SessionID: &sid, URL: "https://a.example", Title: "A", SavedAt: now}); err != nil {
+		t.Fatalf("CreateTab: %v", err)
+	}
+	snap, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	job, err := d.RekeyLibrary(libID, "old", "new")
+	if err != nil {
+		t.Fatalf("RekeyLibrary: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); job.State == JobRunning && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		if job, err = d.Job(job.ID); err != nil {
+			t.Fatalf("Job: %v", err)
+		}
+	}
+	if job.State != JobDone {
+		t.Fatalf("rekey job: %+v", job)
+	}
+	return d, libID, snap
+}
+
+// checkRestoredKey expects libID locked after a restore of a backup from
+// before the rekey, then readable and writable with the old password.
+func checkRestoredKey(t *testing.T, d *DB, libID string) {
+	t.Helper()
+	if _, err := d.ListTabs(libID); !errors.Is(err, ErrLocked) {
+		t.Fatalf("ListTabs right after restore: want ErrLocked, got %v", err)
+	}
+	if _, err := d.UnlockLibrary(libID, "old"); err != nil {
+		t.Fatalf("UnlockLibrary with the restored password: %v", err)
+	}
+	if err := d.CreateTab(Tab{ID: "rk-tab-2", LibraryID: libID, URL: "https://b.example", Title: "B", SavedAt: 1}); err != nil {
+		t.Fatalf("CreateTab after restore: %v", err)
+	}
+	if err := d.LockLibrary(libID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.UnlockLibrary(libID, "old"); err != nil {
+		t.Fatalf("UnlockLibrary: %v", err)
+	}
+	tabs, err := d.ListTabs(libID)
+	if err != nil || len(tabs) != 2 {
+		t.Fatalf("ListTabs after restore: %+v, %v", tabs, err)
+	}
+	for _, tab := range tabs {
+		if tab.URL != "https://a.example" && tab.URL != "https://b.example" {
+			t.Errorf("tab %s reads as %q", tab.ID, tab.URL)
+		}
+	}
+}
+
+func TestRestoreDropsUnlockedKeys(t *testing.T) {
+	d, libID, snap := rekeyed(t)
+	if _, err := d.Restore(snap.Filename); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	checkRestoredKey(t, d, libID)
+}
+
+func TestSelectiveRestoreDropsUnlockedKey(t *testing.T) {
+	d, libID, snap := rekeyed(t)
+	// A session alone would come back sealed with the old key.
+	if _, err := d.RestoreSelected(snap.Filename, RestoreSelection{SessionIDs: []string{"rk-sess"}}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("session of a rekeyed library: want ErrInvalid, got %v", err)
+	}
+	if _, err := d.RestoreSelected(snap.Filename, RestoreSelection{LibraryIDs: []string{libID}}); err != nil {
+		t.Fatalf("RestoreSelected: %v", err)
+	}
+	checkRestoredKey(t, d, libID)
+}
+
+func TestPruneHistoryKeepsImportant(t *testing.T) {
+	d, err := OpenInMemory()
+	if err != nil {
+		t.Fatalf("OpenInMemory: %v", err)
+	}
+	defer d.Close()
+	if err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	libID, _ := seed(t, d)
+
+	now := time.Now()
+	old := now.Add(-100 * 24 * time.Hour).UnixMilli()
+	for _, h := range []HistoryEntry{
+		{ID: "h-old", URL: "https://old.example", VisitTime: old},
+		{ID: "h-old-important", URL: "https://keep.example", VisitTime: old, IsImportant: true},
+		{ID: "h-new", URL: "https://new.example", VisitTime: now.UnixMilli()},
+	} {
+		h.LibraryID = libID
+		if err := d.UpsertHistoryEntry(h); err != nil {
+			t.Fatalf("UpsertHistoryEntry %s: %v", h.ID, err)
+		}
+	}
+
+	n, err := d.PruneHistory(now.Add(-90 * 24 * time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("PruneHistory: deleted %d, %v; want 1", n, err)
+	}
+	list, err := d.ListHistory(libID)
+	if err != nil {
+		t.Fatalf("ListHistory: %v", err)
+	}
+	var ids []string
+	for _, h := range list {
+		ids = append(ids, h.ID)
+	}
+	if strings.Join(ids, ",") != "h-new,h-old-important" {
+		t.Errorf("history after prune: %v", ids)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	d, err := OpenInMemory()
+	if err != nil {
+		t.Fatalf("OpenInMemory: %v", err)
+	}
+	defer d.Close()
+	if err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	libID, sessID := seed(t, d)
+	const zkID = "lib-zk"
+	if err := d.CreateLibrary(Library{ID: zkID, Name: "ZK", CreatedAt: 1, UpdatedAt: 1, ZeroKnowledge: true}); err != nil {
+		t.Fatalf("CreateLibrary: %v", err)
+	}
+	if _, err := d.PushBlobs(zkID, []Blob{{ID: "b1", Data: []byte{0, 1, 2, 255}, UpdatedAt: 1}}); err != nil {
+		t.Fatalf("PushBlobs: %v", err)
+	}
+
+	e, err := d.Export(nil)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(e); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the library after exporting; the import puts it back.
+	if err := d.RenameLibrary(libID, "Renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteSessionWithTabs(libID, sessID); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ReadExport(&buf)
+	if err != nil {
+		t.Fatalf("ReadExport: %v", err)
+	}
+	res, err := d.Import(parsed)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if res.Rows["saved_tabs"] != 2 || res.Rows["sessions"] != 1 || res.Rows["libraries"] != 2 {
+		t.Errorf("rows imported: %v", res.Rows)
+	}
+	if l, err := d.GetLibrary(libID); err != nil || l.Name != "Test Library" {
+		t.Errorf("library after import: %+v, %v", l, err)
+	}
+	if tabs, err := d.ListTabs(libID); err != nil || len(tabs) != 2 {
+		t.Errorf("tabs after import: %d, %v", len(tabs), err)
+	}
+	if b, err := d.GetBlob(zkID, "b1"); err != nil || !bytes.Equal(b.Data, []byte{0, 1, 2, 255}) {
+		t.Errorf("blob after import: %+v, %v", b, err)
+	}
+	// Imported blobs are renumbered so devices past the old seq pull them.
+	if page, err := d.ListBlobs(zkID, 1, 0); err != nil || len(page.Blobs) != 1 {
+		t.Errorf("pull after import from the old cursor: %+v, %v", page, err)
+	}
+
+	if _, err := ReadExport(strings.NewReader(`{"format":"other"}`)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("foreign file: want ErrInvalid, got %v", err)
+	}
+
+	// An import may only write the libraries it lists, and never takes over
+	// another library's row by reusing its ID.
+	tabs, err := d.ListTabs(libID)
+	if err != nil || len(tabs) == 0 {
+		t.Fatalf("ListTabs: %d, %v", len(tabs), err)
+	}
+	lib := map[string]any{"id": "lib-new", "name": "New", "created_at": json.Number("1"), "updated_at": json.Number("1")}
+	for _, c := range []struct {
+		name string
+		tab  map[string]any
+		want error
+	}{
+		{"unlisted library", map[string]any{"id": "t-new", "library_id": libID, "url": "https://x.example", "title": "x", "saved_at": json.Number("1")}, ErrInvalid},
+		{"taken ID", map[string]any{"id": tabs[0].ID, "library_id": "lib-new", "url": "https://x.example", "title": "x", "saved_at": json.Number("1")}, ErrConflict},
+	} {
+		bad := &Export{Format: ExportFormat, Version: exportVersion, Libraries: []string{"lib-new"},
+			Tables: map[string][]map[string]any{"libraries": {lib}, "saved_tabs": {c.tab}}}
+		if _, err := d.Import(bad); !errors.Is(err, c.want) {
+			t.Errorf("%s: want %v, got %v", c.name, c.want, err)
+		}
+	}
+	var owner string
+	if err := d.sql.QueryRow(`SELECT library_id FROM saved_tabs WHERE id = ?`, tabs[0].ID).Scan(&owner); err != nil || owner != libID {
+		t.Errorf("tab after refused imports: library %q, %v", owner, err)
+	}
+	if _, err := d.GetLibrary("lib-new"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("refused import left its library behind: %v", err)
+	}
+	status, err := d.MigrationStatus()
+	if err != nil || len(status) != len(migrations) || !status[len(status)-1].Applied {
+		t.Errorf("MigrationStatus: %+v, %v", status, err)
+	}
+}
+
+func TestLegacyOrphansRestoreAndImport(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	if err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	var mode string
+	if err := d.sql.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode = %q, %v; want wal", mode, err)
+	}
+	libID, sessID := seed(t, d)
+
+	// Rows a build without enforced foreign keys could have written; the
+	// child bookmark comes before its folder in rowid (and export) order.
+	now := time.Now().UnixMilli()
+	for _, stmt := range []string{
+		`PRAGMA foreign_keys = OFF`,
+		`UPDATE saved_tabs SET session_id = 'sess-gone' WHERE id = 'tab-001'`,
+		`UPDATE saved_tabs SET group_id = 'grp-gone' WHERE id = 'tab-002'`,
+		fmt.Sprintf(`INSERT INTO bookmarks (id, library_id, parent_id, title, created_at) VALUES ('bm-orphan', '%s', 'bm-gone', 'Orphan', %d)`, libID, now),
+		fmt.Sprintf(`INSERT INTO bookmarks (id, library_id, parent_id, title, created_at) VALUES ('bm-child', '%s', 'bm-folder', 'Child', %d)`, libID, now),
+		fmt.Sprintf(`INSERT INTO bookmarks (id, library_id, title, created_at, is_folder) VALUES ('bm-folder', '%s', 'Folder', %d, 1)`, libID, now),
+		`PRAGMA foreign_keys = ON`,
+	} {
+		if _, err := d.sql.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	snap, err := d.Backup()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	e, err := d.Export([]string{libID})
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(e); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = ReadExport(&buf); err != nil {
+		t.Fatalf("ReadExport: %v", err)
+	}
+
+	// Orphans are repaired as their ON DELETE rule would have; the rest lands.
+	check := func(when string, tabs int) {
+		t.Helper()
+		var n int
+		if err := d.sql.QueryRow(`SELECT COUNT(*) FROM saved_tabs WHERE session_id = 'sess-gone' OR group_id = 'grp-gone'`).Scan(&n); err != nil || n != 0 {
+			t.Errorf("%s: %d tabs still point to missing parents, %v", when, n, err)
+		}
+		if err := d.sql.QueryRow(`SELECT COUNT(*) FROM saved_tabs WHERE library_id = ?`, libID).Scan(&n); err != nil || n != tabs {
+			t.Errorf("%s: %d tabs, want %d (%v)", when, n, tabs, err)
+		}
+		var ids []string
+		rows, err := d.sql.Query(`SELECT id FROM bookmarks WHERE library_id = ? ORDER BY id`, libID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var id string
+			_ = rows.Scan(&id)
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if strings.Join(ids, ",") != "bm-child,bm-folder" {
+			t.Errorf("%s: bookmarks %v, want bm-child and bm-folder", when, ids)
+		}
+	}
+	if _, err := d.RestoreSelected(snap.Filename, RestoreSelection{SessionIDs: []string{sessID}}); err != nil {
+		t.Fatalf("RestoreSelected session: %v", err)
+	}
+	if _, err := d.RestoreSelected(snap.Filename, RestoreSelection{LibraryIDs: []string{libID}}); err != nil {
+		t.Fatalf("RestoreSelected library: %v", err)
+	}
+	check("after restore", 2)
+	if _, err := d.Import(e); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	check("after import", 2)
+	if report, err := d.Doctor(false); err != nil || !report.Healthy {
+		t.Errorf("Doctor after restore and import: %+v, %v", report, err)
+	}
+}
+
+func TestDoctorFindsAndFixes(t *testing.T) {
+	d, err := OpenInMemory()
+	if err != nil {
+		t.Fatalf("OpenInMemory: %v", err)
+	}
+	defer d.Close()
+	if err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	libID, sessID := seed(t, d)
+
+	report, err := d.Doctor(false)
+	if err != nil || !report.Healthy {
+		t.Fatalf("Doctor on a sound DB: %+v, %v", report, err)
+	}
+
+	// Damage the DB the way a build without enforced foreign keys could have.
+	now := time.Now().UnixMilli()
+	for _, stmt := range []string{
+		`PRAGMA foreign_keys = OFF`,
+		`PRAGMA ignore_check_constraints = ON`,
+		`UPDATE saved_tabs SET session_id = 'sess-gone' WHERE id = 'tab-001'`,
+		fmt.Sprintf(`INSERT INTO history_entries (id, library_id, url, visit_time, domain) VALUES ('h-orphan', 'lib-gone', 'https://x.example', %d, 'x.example')`, now),
+		fmt.Sprintf(`INSERT INTO session_windows (id, session_id, created_at) VALUES ('win-orphan', 'sess-gone', %d)`, now),
+		`UPDATE saved_tabs SET colour = 'r' WHERE id = 'tab-002'`,
+		fmt.Sprintf(`INSERT INTO tab_groups (id, session_id, colour, created_at) VALUES ('grp-1', '%s', 'BLUE', %d)`, sessID, now),
+		`DELETE FROM schema_migrations WHERE version = 2`,
+		`PRAGMA ignore_check_constraints = OFF`,
+		`PRAGMA foreign_keys = ON`,
+	} {
+		if _, err := d.sql.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	report, err = d.Doctor(false)
+	if err != nil {
+		t.Fatalf("Doctor: %v", err)
+	}
+	if report.Healthy {
+		t.Error("damaged DB reported healthy")
+	}
+	found := map[string]int{}
+	for _, f := range report.Findings {
+		found[f.Check] += f.Count
+		if f.Fixed {
+			t.Errorf("%s fixed without -fix", f.Check)
+		}
+	}
+	want := map[string]int{"orphan_tabs": 1, "orphan_history": 1, "foreign_key_check": 1, "colours": 2, "migrations": 1, "fts": 2}
+	for check, n := range want {
+		if found[check] != n {
+			t.Errorf("%s: %d findings, want %d (%+v)", check, found[check], n, report.Findings)
+		}
+	}
+
+	report, err = d.Doctor(true)
+	if err != nil {
+		t.Fatalf("Doctor(fix): %v", err)
+	}
+	if report.Healthy {
+		t.Error("a migration gap cannot be fixed; report should stay unhealthy")
+	}
+	for _, f := range report.Findings {
+		if f.Check != "migrations" && !f.Fixed {
+			t.Errorf("%s not fixed: %s", f.Check, f.Message)
+		}
+	}
+
+	var sess sql.NullString
+	if err := d.sql.QueryRow(`SELECT session_id FROM saved_tabs WHERE id = 'tab-001'`).Scan(&sess); err != nil || sess.Valid {
+		t.Errorf("orphan tab session_id = %v, %v; want NULL", sess, err)
+	}
+	var colour, groupColour string
+	d.sql.QueryRow(`SELECT colour FROM saved_tabs WHERE id = 'tab-002'`).Scan(&colour)
+	d.sql.QueryRow(`SELECT colour FROM tab_groups WHERE id = 'grp-1'`).Scan(&groupColour)
+	if colour != "R" || groupColour != "blue" {
+		t.Errorf("colours after fix: %q, %q", colour, groupColour)
+	}
+	if _, err := d.sql.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (2, 0)`); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := d.Doctor(false); err != nil || !report.Healthy || len(report.Findings) != 0 {
+		t.Errorf("Doctor after fix: %+v, %v", report, err)
+	}
+	if l, err := d.ListHistory(libID); err != nil || len(l) != 0 {
+		t.Errorf("history of seeded library: %v, %v", l, err)
+	}
+}
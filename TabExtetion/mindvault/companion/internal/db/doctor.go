@@ -0,0 +1,401 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ── Doctor ────────────────────────────────────────────────────────────────────
+// Doctor checks the database file and the consistency of its rows. With fix
+// set it repairs what it safely can — what the schema's ON DELETE rules would
+// have done had they run, or normalising values — in one transaction. Nothing
+// is repaired when the file itself fails integrity_check: restore a backup.
+
+// Severities of a finding. Only errors make a report unhealthy.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// doctorSample caps the example IDs listed per finding.
+const doctorSample = 10
+
+// Finding is one problem a doctor check found.
+// Sample holds up to doctorSample affected row IDs (rowids where rows have no ID).
+type Finding struct {
+	Check    string   `json:"check"`
+	Severity string   `json:"severity"`
+	Message  string   `json:"message"`
+	Table    string   `json:"table,omitempty"`
+	Count    int      `json:"count"`
+	Sample   []string `json:"sample,omitempty"`
+	Fixable  bool     `json:"fixable"`
+	Fixed    bool     `json:"fixed"`
+}
+
+// DoctorReport lists the checks run and what they found. Healthy is false
+// while an error-severity finding remains unfixed.
+type DoctorReport struct {
+	Healthy   bool      `json:"healthy"`
+	CheckedAt int64     `json:"checkedAt"` // Unix ms
+	Fix       bool      `json:"fix"`
+	Checks    []string  `json:"checks"`
+	Findings  []Finding `json:"findings"`
+}
+
+// doctorCheck inspects the database and, when fix is set, repairs its
+// findings. It appends to the report itself.
+type doctorCheck struct {
+	name string
+	run  func(tx *sql.Tx, fix bool, r *DoctorReport) error
+}
+
+var doctorChecks = []doctorCheck{
+	{"foreign_keys", checkForeignKeysEnforced},
+	{"migrations", checkMigrations},
+	{"orphan_tabs", checkOrphanTabs},
+	{"orphan_history", checkOrphanHistory},
+	{"foreign_key_check", checkForeignKeyViolations},
+	{"colours", checkColours},
+	{"fts", checkFTS},
+}
+
+// Doctor runs every check and, with fix, repairs what it can.
+func (d *DB) Doctor(fix bool) (*DoctorReport, error) {
+	r := &DoctorReport{CheckedAt: time.Now().UnixMilli(), Fix: fix, Checks: []string{"integrity"}, Findings: []Finding{}}
+	problems, err := d.IntegrityCheck()
+	if err != nil {
+		return nil, fmt.Errorf("integrity_check: %w", err)
+	}
+	damage, constraints := splitIntegrity(problems)
+	if len(damage) > 0 {
+		r.Findings = append(r.Findings, Finding{
+			Check: "integrity", Severity: SeverityError,
+			Message: "the database file is damaged; restore a backup (" + damage[0] + ")",
+			Count:   len(damage), Sample: limit(damage),
+		})
+		fix = false // never write to a damaged file
+	}
+	if len(constraints) > 0 {
+		r.Findings = append(r.Findings, Finding{
+			Check: "integrity", Severity: SeverityError,
+			Message: "rows violate CHECK or NOT NULL constraints (" + constraints[0] + ")",
+			Count:   len(constraints), Sample: limit(constraints),
+		})
+	}
+
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, c := range doctorChecks {
+		r.Checks = append(r.Checks, c.name)
+		if err := c.run(tx, fix, r); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	if fix {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	r.Healthy = true
+	for _, f := range r.Findings {
+		if f.Severity == SeverityError && !f.Fixed {
+			r.Healthy = false
+		}
+	}
+	return r, nil
+}
+
+// colourTables are the tables whose only CHECK constraint is on colour, which
+// checkColours reports and repairs.
+var colourTables = map[string]bool{"saved_tabs": true, "bookmarks": true, "tab_groups": true}
+
+// splitIntegrity separates integrity_check problems that mean a damaged file
+// from rows that merely violate a constraint (written while a check was off).
+// Colour CHECK failures are left to checkColours.
+func splitIntegrity(problems []string) (damage, constraints []string) {
+	for _, p := range problems {
+		switch {
+		case strings.HasPrefix(p, "CHECK constraint failed in "):
+			if !colourTables[strings.TrimPrefix(p, "CHECK constraint failed in ")] {
+				constraints = append(constraints, p)
+			}
+		case strings.HasPrefix(p, "NULL value in "):
+			constraints = append(constraints, p)
+		default:
+			damage = append(damage, p)
+		}
+	}
+	return damage, constraints
+}
+
+// checkForeignKeysEnforced verifies that the connection enforces foreign
+// keys. The driver ignores DSN options it does not know (such as
+// _foreign_keys=on); without enforcement ON DELETE rules never run.
+func checkForeignKeysEnforced(tx *sql.Tx, _ bool, r *DoctorReport) error {
+	var on int
+	if err := tx.QueryRow(`PRAGMA foreign_keys`).Scan(&on); err != nil {
+		return err
+	}
+	if on != 1 {
+		r.Findings = append(r.Findings, Finding{
+			Check: "foreign_keys", Severity: SeverityError,
+			Message: "foreign keys are not enforced on this connection; check the DSN passed to sql.Open",
+		})
+	}
+	return nil
+}
+
+// checkMigrations reports gaps in the applied migration versions and versions
+// this build does not know.
+func checkMigrations(tx *sql.Tx, _ bool, r *DoctorReport) error {
+	rows, err := tx.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	applied := map[int]bool{}
+	highest := 0
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return err
+		}
+		applied[v] = true
+		highest = max(highest, v)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var missing, unknown []string
+	for v := 1; v < highest; v++ {
+		if !applied[v] {
+			missing = append(missing, fmt.Sprint(v))
+		}
+	}
+	if latest := migrations[len(migrations)-1].version; highest > latest {
+		for v := latest + 1; v <= highest; v++ {
+			if applied[v] {
+				unknown = append(unknown, fmt.Sprint(v))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		r.Findings = append(r.Findings, Finding{
+			Check: "migrations", Severity: SeverityError, Table: "schema_migrations",
+			Message: "migrations were skipped although later ones are applied: " + strings.Join(missing, ", "),
+			Count:   len(missing), Sample: limit(missing),
+		})
+	}
+	if len(unknown) > 0 {
+		r.Findings = append(r.Findings, Finding{
+			Check: "migrations", Severity: SeverityError, Table: "schema_migrations",
+			Message: "the database has migrations from a newer mvaultd (" + strings.Join(unknown, ", ") + ")",
+			Count:   len(unknown), Sample: limit(unknown),
+		})
+	}
+	return nil
+}
+
+// checkOrphanTabs finds tabs whose session no longer exists. The fix detaches
+// them (session_id NULL, ON DELETE SET NULL), which lists them under Unsorted.
+func checkOrphanTabs(tx *sql.Tx, fix bool, r *DoctorReport) error {
+	const where = `session_id IS NOT NULL AND session_id NOT IN (SELECT id FROM sessions)`
+	return checkRows(tx, fix, r, Finding{
+		Check: "orphan_tabs", Severity: SeverityError, Table: "saved_tabs",
+		Message: "tabs point to sessions that no longer exist",
+	}, `SELECT id FROM saved_tabs WHERE `+where, `UPDATE saved_tabs SET session_id = NULL WHERE `+where)
+}
+
+// checkOrphanHistory finds history entries of deleted libraries. The fix
+// deletes them (ON DELETE CASCADE).
+func checkOrphanHistory(tx *sql.Tx, fix bool, r *DoctorReport) error {
+	const where = `library_id NOT IN (SELECT id FROM libraries)`
+	return checkRows(tx, fix, r, Finding{
+		Check: "orphan_history", Severity: SeverityError, Table: "history_entries",
+		Message: "history entries belong to deleted libraries",
+	}, `SELECT id FROM history_entries WHERE `+where, `DELETE FROM history_entries WHERE `+where)
+}
+
+// fkCovered lists the foreign keys that have their own check above, so
+// foreign_key_check does not report them twice.
+var fkCovered = map[string]bool{
+	"saved_tabs.session_id":      true,
+	"history_entries.library_id": true,
+}
+
+// checkForeignKeyViolations runs PRAGMA foreign_key_check. Each violation is
+// fixed the way its foreign key's ON DELETE rule would have: CASCADE deletes
+// the row, SET NULL clears the column; other rules are left for the user.
+func checkForeignKeyViolations(tx *sql.Tx, fix bool, r *DoctorReport) error {
+	type key struct {
+		table  string
+		fkid   int
+		parent string
+	}
+	rows, err := tx.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	violations := map[key][]sql.NullInt64{}
+	var order []key
+	for rows.Next() {
+		var k key
+		var rowid sql.NullInt64
+		if err := rows.Scan(&k.table, &rowid, &k.parent, &k.fkid); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := violations[k]; !ok {
+			order = append(order, k)
+		}
+		violations[k] = append(violations[k], rowid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range order {
+		var from, onDelete string
+		if err := tx.QueryRow(fmt.Sprintf(`SELECT "from", on_delete FROM pragma_foreign_key_list('%s') WHERE id = ?`, k.table), k.fkid).Scan(&from, &onDelete); err != nil {
+			return err
+		}
+		if fkCovered[k.table+"."+from] {
+			continue
+		}
+		ids := violations[k]
+		f := Finding{
+			Check: "foreign_key_check", Severity: SeverityError, Table: k.table,
+			Message: fmt.Sprintf("%s.%s points to missing %s rows", k.table, from, k.parent),
+			Count:   len(ids),
+			Fixable: onDelete == "CASCADE" || onDelete == "SET NULL",
+		}
+		for _, id := range ids {
+			if len(f.Sample) < doctorSample && id.Valid {
+				f.Sample = append(f.Sample, fmt.Sprintf("rowid %d", id.Int64))
+			}
+		}
+		if fix && f.Fixable {
+			for _, id := range ids {
+				if !id.Valid {
+					continue
+				}
+				stmt := `DELETE FROM ` + k.table + ` WHERE rowid = ?`
+				if onDelete == "SET NULL" {
+					stmt = `UPDATE ` + k.table + ` SET "` + from + `" = NULL WHERE rowid = ?`
+				}
+				if _, err := tx.Exec(stmt, id.Int64); err != nil {
+					return fmt.Errorf("fix %s: %w", k.table, err)
+				}
+			}
+			f.Fixed = true
+		}
+		r.Findings = append(r.Findings, f)
+	}
+	return nil
+}
+
+// checkColours finds colour values outside the sets the schema allows. The fix
+// keeps values that differ only in case (normalised) and resets the rest:
+// tab and bookmark colours to none, tab group colours to grey.
+func checkColours(tx *sql.Tx, fix bool, r *DoctorReport) error {
+	tabColours := `('R','G','Y','B')`
+	groupColours := `('` + strings.Join(TabGroupColours, `','`) + `')`
+	for _, table := range []string{"saved_tabs", "bookmarks"} {
+		const where = `colour IS NOT NULL AND colour NOT IN `
+		err := checkRows(tx, fix, r, Finding{
+			Check: "colours", Severity: SeverityWarning, Table: table,
+			Message: table + " have colours other than R, G, Y, B",
+		}, `SELECT id FROM `+table+` WHERE `+where+tabColours,
+			`UPDATE `+table+` SET colour = CASE WHEN UPPER(colour) IN `+tabColours+` THEN UPPER(colour) ELSE NULL END WHERE `+where+tabColours)
+		if err != nil {
+			return err
+		}
+	}
+	where := `colour NOT IN ` + groupColours
+	return checkRows(tx, fix, r, Finding{
+		Check: "colours", Severity: SeverityWarning, Table: "tab_groups",
+		Message: "tab groups have colours other than " + strings.Join(TabGroupColours, ", "),
+	}, `SELECT id FROM tab_groups WHERE `+where,
+		`UPDATE tab_groups SET colour = CASE WHEN LOWER(colour) IN `+groupColours+` THEN LOWER(colour) ELSE 'grey' END WHERE `+where)
+}
+
+// checkFTS compares the tabs_fts full-text index with saved_tabs. The fix
+// rebuilds the index.
+func checkFTS(tx *sql.Tx, fix bool, r *DoctorReport) error {
+	var indexed, tabs int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM tabs_fts_docsize`).Scan(&indexed); err != nil {
+		return err
+	}
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM saved_tabs`).Scan(&tabs); err != nil {
+		return err
+	}
+	_, checkErr := tx.Exec(`INSERT INTO tabs_fts(tabs_fts, rank) VALUES('integrity-check', 1)`)
+	if indexed == tabs && checkErr == nil {
+		return nil
+	}
+	f := Finding{
+		Check: "fts", Severity: SeverityWarning, Table: "tabs_fts",
+		Message: fmt.Sprintf("the full-text index is out of date (%d of %d tabs indexed)", indexed, tabs),
+		Count:   abs(tabs - indexed), Fixable: true,
+	}
+	if fix {
+		if _, err := tx.Exec(`INSERT INTO tabs_fts(tabs_fts) VALUES('rebuild')`); err != nil {
+			return fmt.Errorf("rebuild: %w", err)
+		}
+		f.Fixed = true
+	}
+	r.Findings = append(r.Findings, f)
+	return nil
+}
+
+// checkRows records f if query (selecting IDs) returns rows and, with fix,
+// runs repair.
+func checkRows(tx *sql.Tx, fix bool, r *DoctorReport, f Finding, query, repair string) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return err
+	}
+	f.Count, f.Sample, f.Fixable = len(ids), limit(ids), true
+	if fix {
+		if _, err := tx.Exec(repair); err != nil {
+			return fmt.Errorf("fix %s: %w", f.Table, err)
+		}
+		f.Fixed = true
+	}
+	r.Findings = append(r.Findings, f)
+	return nil
+}
+
+func limit(ids []string) []string {
+	if len(ids) > doctorSample {
+		return ids[:doctorSample]
+	}
+	return ids
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
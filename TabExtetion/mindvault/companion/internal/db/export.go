@@ -0,0 +1,320 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ── Export / import ───────────────────────────────────────────────────────────
+// An export is a JSON dump of whole libraries: every row of every table that
+// belongs to them, column by column as stored. Encrypted libraries stay
+// encrypted (their password still unlocks them after import), and rows keep
+// their IDs, so an import replaces the libraries it contains — exactly like a
+// selective restore from a backup — and leaves all others untouched.
+
+// ExportFormat identifies MindVault export files.
+const ExportFormat = "mindvault-export"
+
+// exportVersion is the version of the export file layout (not the schema).
+const exportVersion = 1
+
+// Export is the content of an export file.
+// Tables maps a table name to its rows; BLOB columns are base64 strings.
+type Export struct {
+	Format        string                      `json:"format"`
+	Version       int                         `json:"version"`
+	SchemaVersion int                         `json:"schemaVersion"`
+	ExportedAt    int64                       `json:"exportedAt"` // Unix ms
+	Libraries     []string                    `json:"libraries"`
+	Tables        map[string][]map[string]any `json:"tables"`
+}
+
+// ImportResult reports rows written per table and the snapshot of the live DB
+// taken beforehand (zero for an in-memory DB).
+type ImportResult struct {
+	PreImport BackupInfo     `json:"preImport"`
+	Libraries []string       `json:"libraries"`
+	Rows      map[string]int `json:"rows"`
+}
+
+// Export dumps the given libraries (none = all).
+func (d *DB) Export(libraryIDs []string) (*Export, error) {
+	if len(libraryIDs) == 0 {
+		libs, err := d.ListLibraries()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range libs {
+			libraryIDs = append(libraryIDs, l.ID)
+		}
+	}
+	libraryIDs = slices.Clone(libraryIDs)
+	slices.Sort(libraryIDs)
+	libraryIDs = slices.Compact(libraryIDs) // a library listed twice would dump its rows twice
+	e := &Export{
+		Format:     ExportFormat,
+		Version:    exportVersion,
+		ExportedAt: time.Now().UnixMilli(),
+		Libraries:  libraryIDs,
+		Tables:     map[string][]map[string]any{},
+	}
+	if err := d.sql.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&e.SchemaVersion); err != nil {
+		return nil, err
+	}
+	for _, id := range libraryIDs {
+		var n int
+		if err := d.sql.QueryRow(`SELECT COUNT(*) FROM libraries WHERE id = ?`, id).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("library %s: %w", id, sql.ErrNoRows)
+		}
+		// Parents first, so an import can insert in file order.
+		for i := len(libraryRestoreSteps) - 1; i >= 0; i-- {
+			s := libraryRestoreSteps[i]
+			rows, err := dumpRows(d.sql, s.table, s.del, id)
+			if err != nil {
+				return nil, fmt.Errorf("export %s: %w", s.table, err)
+			}
+			e.Tables[s.table] = append(e.Tables[s.table], rows...)
+		}
+	}
+	return e, nil
+}
+
+// dumpRows returns the rows of main.table matching where (one argument).
+func dumpRows(q querier, table, where, arg string) ([]map[string]any, error) {
+	cols, err := tableCols(q, "main", table)
+	if err != nil || cols == nil {
+		return nil, err // table not in this schema
+	}
+	rows, err := q.Query(`SELECT `+strings.Join(cols, ", ")+` FROM main.`+table+` WHERE `+where, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []map[string]any
+	for rows.Next() {
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]any, len(cols))
+		for i, c := range cols {
+			row[c] = vals[i] // []byte marshals as base64
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+// ReadExport parses an export file.
+func ReadExport(r io.Reader) (*Export, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var e Export
+	if err := dec.Decode(&e); err != nil {
+		return nil, fmt.Errorf("%w: not an export file: %v", ErrInvalid, err)
+	}
+	if e.Format != ExportFormat {
+		return nil, fmt.Errorf("%w: not an export file (format %q)", ErrInvalid, e.Format)
+	}
+	if e.Version > exportVersion {
+		return nil, fmt.Errorf("%w: export version %d is newer than this daemon supports", ErrInvalid, e.Version)
+	}
+	return &e, nil
+}
+
+// Import replaces the libraries in e with their exported state. A pre-import
+// backup of the live DB is written first; the import itself runs in one
+// transaction. Columns the live schema lacks are ignored and columns the
+// export lacks take their DEFAULTs, so exports from older schemas import.
+// Every row must belong to one of e.Libraries, and no row may take the ID of
+// a row another library still holds; either makes the whole import fail.
+func (d *DB) Import(e *Export) (*ImportResult, error) {
+	var current int
+	if err := d.sql.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return nil, err
+	}
+	if e.SchemaVersion > current {
+		return nil, fmt.Errorf("%w: export has schema version %d, this database %d — upgrade mvaultd first", ErrInvalid, e.SchemaVersion, current)
+	}
+	if len(e.Libraries) == 0 {
+		return nil, fmt.Errorf("%w: export contains no libraries", ErrInvalid)
+	}
+	libs := make(map[string]bool, len(e.Libraries))
+	for _, id := range e.Libraries {
+		libs[id] = true
+	}
+	res := &ImportResult{Libraries: e.Libraries, Rows: map[string]int{}}
+	if d.path != "" {
+		pre, err := d.writeBackup(d.backupName(preImportPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("pre-import backup: %w", err)
+		}
+		res.PreImport = pre
+	}
+
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	// Rows of one table arrive in file order (a bookmark may precede its
+	// folder), so foreign keys are checked at commit, after repairOrphans.
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		return nil, err
+	}
+	for _, id := range e.Libraries {
+		for _, s := range libraryRestoreSteps {
+			if cols, err := tableCols(tx, "main", s.table); err != nil || cols == nil {
+				continue
+			}
+			if _, err := tx.Exec(`DELETE FROM main.`+s.table+` WHERE `+s.del, id); err != nil {
+				return nil, fmt.Errorf("clear %s: %w", s.table, err)
+			}
+		}
+	}
+	for i := len(libraryRestoreSteps) - 1; i >= 0; i-- {
+		table := libraryRestoreSteps[i].table
+		n, err := insertRows(tx, table, e.Tables[table], libs)
+		if err != nil {
+			return nil, fmt.Errorf("import %s: %w", table, err)
+		}
+		res.Rows[table] += n
+	}
+	for _, id := range e.Libraries {
+		if err := repairOrphans(tx, libraryRestoreSteps, id); err != nil {
+			return nil, err
+		}
+		if err := renumberBlobs(tx, id, 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, id := range e.Libraries {
+		d.keys.drop(id, nil) // the imported key hash may differ
+	}
+	return res, nil
+}
+
+// insertRows inserts exported rows into main.table, using the columns both
+// the row and the live table have. Rows of libraries outside libs are
+// ErrInvalid; a row whose ID is still taken is ErrConflict — the libraries
+// being imported were cleared first, so that row belongs to another one.
+func insertRows(tx *sql.Tx, table string, rows []map[string]any, libs map[string]bool) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	types, err := colTypes(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, row := range rows {
+		lib, err := importOwner(tx, table, row)
+		if err != nil {
+			return n, err
+		}
+		if !libs[lib] {
+			return n, fmt.Errorf("%w: row of library %q, which the export does not list", ErrInvalid, lib)
+		}
+		var cols, marks []string
+		var args []any
+		for c, v := range row {
+			typ, ok := types[c]
+			if !ok {
+				continue
+			}
+			arg, err := importValue(v, typ)
+			if err != nil {
+				return n, fmt.Errorf("column %s: %w", c, err)
+			}
+			cols, marks, args = append(cols, c), append(marks, "?"), append(args, arg)
+		}
+		if len(cols) == 0 {
+			continue
+		}
+		if err := insertNew(tx, table, fmt.Sprint(row["id"]), `INSERT INTO main.`+table+` (`+strings.Join(cols, ", ")+`) VALUES (`+strings.Join(marks, ", ")+`)`, args...); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// importOwner returns the library an exported row belongs to. Window and
+// tab-group rows belong to their session's library; their sessions are
+// inserted before them.
+func importOwner(q querier, table string, row map[string]any) (string, error) {
+	col := "library_id"
+	switch table {
+	case "libraries":
+		col = "id"
+	case "session_windows", "tab_groups":
+		col = "session_id"
+	}
+	v, ok := row[col].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: row without %s", ErrInvalid, col)
+	}
+	if col != "session_id" {
+		return v, nil
+	}
+	var lib string
+	err := q.QueryRow(`SELECT library_id FROM main.sessions WHERE id = ?`, v).Scan(&lib)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: row of session %s, which the export does not contain", ErrInvalid, v)
+	}
+	return lib, err
+}
+
+// colTypes maps the columns of main.table to their declared types.
+func colTypes(q querier, table string) (map[string]string, error) {
+	rows, err := q.Query(fmt.Sprintf(`SELECT name, type FROM pragma_table_info('%s', 'main')`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types := map[string]string{}
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		types[name] = strings.ToUpper(typ)
+	}
+	return types, rows.Err()
+}
+
+// importValue converts a decoded JSON value back to a column value.
+func importValue(v any, typ string) (any, error) {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+		return x.Float64()
+	case string:
+		if typ == "BLOB" {
+			return base64.StdEncoding.DecodeString(x)
+		}
+		return x, nil
+	case nil, bool:
+		return x, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected value %T", ErrInvalid, v)
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// historyPruneEvery is how often StartHistoryPruner applies the retention.
+const historyPruneEvery = 6 * time.Hour
+
+// SetHistoryRetention sets how many days of browsing history to keep
+// (0 = keep everything). Safe to call while the pruner runs (config reload).
+func (d *DB) SetHistoryRetention(days int) {
+	d.historyDays.Store(int64(days))
+}
+
+// PruneHistory deletes history entries visited before cutoff. Entries marked
+// important are kept regardless of age.
+func (d *DB) PruneHistory(cutoff time.Time) (int64, error) {
+	res, err := d.sql.Exec(
+		`DELETE FROM history_entries WHERE visit_time < ? AND is_important = 0`, cutoff.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// StartHistoryPruner applies the history retention now and every
+// historyPruneEvery until ctx is done.
+func (d *DB) StartHistoryPruner(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(historyPruneEvery)
+		defer ticker.Stop()
+		for {
+			if days := d.historyDays.Load(); days > 0 {
+				release := d.Acquire()
+				n, err := d.PruneHistory(time.Now().Add(-time.Duration(days) * 24 * time.Hour))
+				release()
+				if err != nil {
+					slog.Error("history retention", "err", err)
+				} else if n > 0 {
+					slog.Info("history retention: pruned", "deleted", n, "olderThanDays", days)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ── Background jobs ───────────────────────────────────────────────────────────
+// Work too long for one request (re-encrypting a library) runs in a goroutine
+// and reports progress through a Job. Jobs live in memory only; finished ones
+// are forgotten after jobRetention. GET /jobs/{id} is served without the
+// request gate so progress stays visible while a job holds the DB exclusively.
+
+// Job states.
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// jobRetention is how long a finished job stays queryable.
+const jobRetention = time.Hour
+
+// Job is a snapshot of a background job.
+// Done / Total count work items (for rekey: encrypted values).
+type Job struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	LibraryID  string `json:"libraryId,omitempty"`
+	State      string `json:"state"`
+	Done       int    `json:"done"`
+	Total      int    `json:"total"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  int64  `json:"startedAt"`            // Unix ms
+	FinishedAt int64  `json:"finishedAt,omitempty"` // Unix ms
+}
+
+// jobRegistry holds all jobs; guarded by mu.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// start registers a running job of kind for libID. At most one job per
+// (kind, libID) runs at a time: ErrInvalid otherwise.
+func (r *jobRegistry) start(kind, libID string) (*Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.jobs == nil {
+		r.jobs = map[string]*Job{}
+	}
+	now := time.Now()
+	for id, j := range r.jobs {
+		if j.State != JobRunning && now.Sub(time.UnixMilli(j.FinishedAt)) > jobRetention {
+			delete(r.jobs, id)
+			continue
+		}
+		if j.State == JobRunning && j.Kind == kind && j.LibraryID == libID {
+			return nil, fmt.Errorf("%w: %s of %s already running (job %s)", ErrInvalid, kind, libID, j.ID)
+		}
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	j := &Job{ID: hex.EncodeToString(b), Kind: kind, LibraryID: libID, State: JobRunning, StartedAt: now.UnixMilli()}
+	r.jobs[j.ID] = j
+	cp := *j
+	return &cp, nil
+}
+
+// update runs fn on job id under the lock.
+func (r *jobRegistry) update(id string, fn func(*Job)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if j := r.jobs[id]; j != nil {
+		fn(j)
+	}
+}
+
+// finish marks job id done, or failed with err.
+func (r *jobRegistry) finish(id string, err error) {
+	r.update(id, func(j *Job) {
+		j.State, j.FinishedAt = JobDone, time.Now().UnixMilli()
+		if err != nil {
+			j.State, j.Error = JobFailed, err.Error()
+		}
+	})
+}
+
+// Job returns a snapshot of job id; sql.ErrNoRows (wrapped) if unknown.
+func (d *DB) Job(id string) (*Job, error) {
+	d.jobs.mu.Lock()
+	defer d.jobs.mu.Unlock()
+	j := d.jobs.jobs[id]
+	if j == nil {
+		return nil, fmt.Errorf("job %s: %w", id, sql.ErrNoRows)
+	}
+	cp := *j
+	return &cp, nil
+}
+
+// ListJobs returns snapshots of all known jobs, newest first.
+func (d *DB) ListJobs() []Job {
+	d.jobs.mu.Lock()
+	defer d.jobs.mu.Unlock()
+	list := make([]Job, 0, len(d.jobs.jobs))
+	for _, j := range d.jobs.jobs {
+		list = append(list, *j)
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].StartedAt > list[k].StartedAt })
+	return list
+}
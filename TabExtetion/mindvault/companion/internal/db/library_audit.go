@@ -0,0 +1,70 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// ── Audit log ─────────────────────────────────────────────────────────────────
+// audit_log rows written by the companion itself record the key lifecycle of
+// encrypted libraries (migration 006) and library merges. entity_type is
+// "library" and entity_id the library ID; detail says why (e.g. "idle
+// timeout", "merged from lib-…").
+
+// Audit actions the companion writes: key lifecycle, and UPDATE for merges.
+const (
+	AuditUpdate       = "UPDATE"
+	AuditUnlock       = "UNLOCK"
+	AuditUnlockFailed = "UNLOCK_FAILED"
+	AuditLock         = "LOCK"
+	AuditRekey        = "REKEY"
+)
+
+// AuditEntry is one audit_log row.
+type AuditEntry struct {
+	ID         string `json:"id"`
+	LibraryID  string `json:"libraryId"`
+	Action     string `json:"action"`
+	EntityType string `json:"entityType"`
+	EntityID   string `json:"entityId"`
+	Timestamp  int64  `json:"timestamp"` // Unix ms
+	Detail     string `json:"detail,omitempty"`
+}
+
+// writeAudit appends a key-lifecycle entry for library libID.
+func writeAudit(e execer, libID, action, detail string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	_, err := e.Exec(`INSERT INTO audit_log (id, library_id, action, entity_type, entity_id, timestamp, detail)
+		VALUES (?, ?, ?, 'library', ?, ?, ?)`,
+		hex.EncodeToString(b), libID, action, libID, time.Now().UnixMilli(), detail)
+	return err
+}
+
+// ListAuditLog returns the newest audit entries of library libID.
+// limit ≤ 0 means 100.
+func (d *DB) ListAuditLog(libID string, limit int) ([]AuditEntry, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := d.sql.Query(`
+		SELECT id, library_id, action, entity_type, entity_id, timestamp, detail
+		FROM audit_log WHERE library_id = ?
+		ORDER BY timestamp DESC, rowid DESC LIMIT ?`, libID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.LibraryID, &e.Action, &e.EntityType, &e.EntityID, &e.Timestamp, &e.Detail); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,287 @@
+package db
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ── Zero-knowledge libraries ──────────────────────────────────────────────────
+// A library created with zeroKnowledge=true is encrypted by the extension
+// (packages/shared crypto/encryption.ts) with a key the companion never sees.
+// Its sessions, tabs, bookmarks, … are pushed as opaque blobs: the companion
+// stores each one with only its ID, the library ID and timestamps in clear,
+// and hands the exact bytes back on pull. What a blob contains (entity kind,
+// fields, EncryptedField JSON) is entirely up to the extension.
+//
+// Sync is last-writer-wins on updatedAt. A deletion is pushed as a tombstone
+// (deleted=true, no data) so it reaches other devices like any update. Every
+// stored write gets a server-assigned seq (migration 007); pulls page on it,
+// never on the client clocks in updatedAt.
+//
+// The structured entity methods (ListTabs, CreateSession, Search, …) return
+// ErrZeroKnowledge for such a library.
+
+// ErrZeroKnowledge is returned when the companion would have to read or write
+// plaintext of a zero-knowledge library.
+var ErrZeroKnowledge = fmt.Errorf("%w: zero-knowledge library (client-encrypted blobs only)", ErrInvalid)
+
+// DefaultBlobPage is the page size of ListBlobs when none is given.
+const DefaultBlobPage = 500
+
+// Blob is one client-encrypted entity of a zero-knowledge library.
+// Data is base64 in JSON and returned byte-for-byte as pushed. Seq is set by
+// the companion and ignored on push.
+type Blob struct {
+	ID        string `json:"id"`
+	LibraryID string `json:"libraryId"`
+	Data      []byte `json:"data,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	UpdatedAt int64  `json:"updatedAt"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Seq       int64  `json:"seq,omitempty"`
+}
+
+// BlobPushResult reports what PushBlobs did with a batch.
+// Stale lists IDs skipped because the stored copy has a newer updatedAt.
+type BlobPushResult struct {
+	Stored int      `json:"stored"`
+	Stale  []string `json:"stale"`
+}
+
+// BlobPage is one page of ListBlobs. Cursor is the seq of the last blob
+// returned (the requested cursor if none were): pass it back to continue
+// while More is set, and keep it for the next incremental pull.
+type BlobPage struct {
+	Blobs  []Blob `json:"blobs"`
+	Cursor int64  `json:"cursor"`
+	More   bool   `json:"more,omitempty"`
+}
+
+// requireZeroKnowledge returns ErrInvalid unless libID is a zero-knowledge
+// library, and sql.ErrNoRows (wrapped) if it does not exist.
+func requireZeroKnowledge(q querier, libID string) error {
+	var zk bool
+	if err := q.QueryRow(`SELECT zero_knowledge FROM libraries WHERE id = ?`, libID).Scan(&zk); err != nil {
+		return fmt.Errorf("library %s: %w", libID, err)
+	}
+	if !zk {
+		return fmt.Errorf("%w: library %s is not a zero-knowledge library", ErrInvalid, libID)
+	}
+	return nil
+}
+
+// PushBlobs stores a batch of blobs for zero-knowledge library libID in one
+// transaction. A blob replaces the stored one unless that has a newer
+// updatedAt; deleted=true stores a tombstone. createdAt of an existing blob
+// is kept. Every blob needs an ID, updatedAt > 0 and, unless deleted, data.
+func (d *DB) PushBlobs(libID string, blobs []Blob) (*BlobPushResult, error) {
+	for i, b := range blobs {
+		switch {
+		case b.ID == "":
+			return nil, fmt.Errorf("%w: blobs[%d]: id is required", ErrInvalid, i)
+		case b.UpdatedAt <= 0:
+			return nil, fmt.Errorf("%w: blobs[%d]: updatedAt is required", ErrInvalid, i)
+		case !b.Deleted && len(b.Data) == 0:
+			return nil, fmt.Errorf("%w: blobs[%d]: data is required", ErrInvalid, i)
+		}
+	}
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := requireZeroKnowledge(tx, libID); err != nil {
+		return nil, err
+	}
+
+	res := &BlobPushResult{Stale: []string{}}
+	for _, b := range blobs {
+		var deletedAt any
+		data := b.Data
+		if b.Deleted {
+			deletedAt, data = b.UpdatedAt, []byte{}
+		}
+		if b.CreatedAt <= 0 {
+			b.CreatedAt = b.UpdatedAt
+		}
+		seq, err := nextBlobSeq(tx)
+		if err != nil {
+			return nil, err
+		}
+		r, err := tx.Exec(`
+			INSERT INTO encrypted_blobs (library_id, id, blob, created_at, updated_at, deleted_at, seq)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (library_id, id) DO UPDATE SET
+				blob = excluded.blob, updated_at = excluded.updated_at, deleted_at = excluded.deleted_at, seq = excluded.seq
+			WHERE excluded.updated_at >= encrypted_blobs.updated_at`,
+			libID, b.ID, data, b.CreatedAt, b.UpdatedAt, deletedAt, seq)
+		if err != nil {
+			return nil, fmt.Errorf("store blob %s: %w", b.ID, err)
+		}
+		if n, _ := r.RowsAffected(); n == 0 {
+			res.Stale = append(res.Stale, b.ID)
+			continue
+		}
+		res.Stored++
+	}
+	if _, err := tx.Exec(`UPDATE libraries SET updated_at = ? WHERE id = ?`, time.Now().UnixMilli(), libID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListBlobs returns blobs (tombstones included) of zero-knowledge library
+// libID stored after cursor, in the order the companion stored them: rows
+// with seq > cursor. cursor=0 pulls everything. limit ≤ 0 means
+// DefaultBlobPage.
+func (d *DB) ListBlobs(libID string, cursor int64, limit int) (*BlobPage, error) {
+	if err := requireZeroKnowledge(d.sql, libID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DefaultBlobPage
+	}
+	rows, err := d.sql.Query(`
+		SELECT id, library_id, blob, created_at, updated_at, deleted_at IS NOT NULL, seq
+		FROM encrypted_blobs
+		WHERE library_id = ? AND seq > ?
+		ORDER BY seq
+		LIMIT ?`, libID, cursor, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := &BlobPage{Blobs: []Blob{}, Cursor: cursor}
+	for rows.Next() {
+		b, err := scanBlob(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Blobs = append(page.Blobs, *b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Blobs) > limit {
+		page.Blobs, page.More = page.Blobs[:limit], true
+	}
+	if n := len(page.Blobs); n > 0 {
+		page.Cursor = page.Blobs[n-1].Seq
+	}
+	return page, nil
+}
+
+// GetBlob returns one blob of zero-knowledge library libID.
+// Returns sql.ErrNoRows (wrapped) if it does not exist.
+func (d *DB) GetBlob(libID, id string) (*Blob, error) {
+	if err := requireZeroKnowledge(d.sql, libID); err != nil {
+		return nil, err
+	}
+	b, err := scanBlob(d.sql.QueryRow(`
+		SELECT id, library_id, blob, created_at, updated_at, deleted_at IS NOT NULL, seq
+		FROM encrypted_blobs WHERE library_id = ? AND id = ?`, libID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("blob %s: %w", id, err)
+	}
+	return b, err
+}
+
+// VerifyKeyHash reports whether hash matches the encryptionKeyHash the
+// extension supplied for zero-knowledge library libID, so another device can
+// check a password without the stored value ever being handed out. Both
+// outcomes go to the audit log. ErrInvalid if the library has no key hash.
+func (d *DB) VerifyKeyHash(libID, hash string) (bool, error) {
+	if hash == "" {
+		return false, fmt.Errorf("%w: encryptionKeyHash is required", ErrInvalid)
+	}
+	if err := requireZeroKnowledge(d.sql, libID); err != nil {
+		return false, err
+	}
+	var stored sql.NullString
+	if err := d.sql.QueryRow(`SELECT key_hash FROM libraries WHERE id = ?`, libID).Scan(&stored); err != nil {
+		return false, err
+	}
+	if stored.String == "" {
+		return false, fmt.Errorf("%w: library %s has no key hash", ErrInvalid, libID)
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(stored.String)) != 1 {
+		return false, writeAudit(d.sql, libID, AuditUnlockFailed, "key check")
+	}
+	return true, writeAudit(d.sql, libID, AuditUnlock, "key check")
+}
+
+func scanBlob(s rowScanner) (*Blob, error) {
+	var b Blob
+	if err := s.Scan(&b.ID, &b.LibraryID, &b.Data, &b.CreatedAt, &b.UpdatedAt, &b.Deleted, &b.Seq); err != nil {
+		return nil, err
+	}
+	if b.Deleted {
+		b.Data = nil
+	}
+	return &b, nil
+}
+
+// nextBlobSeq hands out the next blob sequence number. It runs inside the
+// caller's write transaction, so numbers are unique and increase in commit
+// order; a number burnt on a stale push just leaves a gap.
+func nextBlobSeq(tx *sql.Tx) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(`UPDATE blob_seq SET value = value + 1 WHERE id = 1 RETURNING value`).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("blob seq: %w", err)
+	}
+	return seq, nil
+}
+
+// renumberBlobs gives the blobs of libID (every library when libID is "") fresh
+// sequence numbers above floor and above anything handed out so far. Restore
+// and import call it: the rows they bring back carry old numbers that devices
+// may already have pulled past.
+func renumberBlobs(tx *sql.Tx, libID string, floor int64) error {
+	if _, err := tx.Exec(`UPDATE blob_seq SET value = MAX(value, ?) WHERE id = 1`, floor); err != nil {
+		return fmt.Errorf("blob seq: %w", err)
+	}
+	rows, err := tx.Query(`
+		SELECT rowid FROM encrypted_blobs
+		WHERE ? = '' OR library_id = ?
+		ORDER BY seq, id`, libID, libID)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		seq, err := nextBlobSeq(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE encrypted_blobs SET seq = ? WHERE rowid = ?`, seq, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobSeq returns the last blob sequence number handed out.
+func (d *DB) blobSeq() (int64, error) {
+	var seq int64
+	err := d.sql.QueryRow(`SELECT value FROM blob_seq WHERE id = 1`).Scan(&seq)
+	return seq, err
+}
@@ -0,0 +1,668 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ── Library encryption at rest ────────────────────────────────────────────────
+// Libraries with is_encrypted=1 keep their sensitive columns as AES-256-GCM
+// ciphertext; IDs, timestamps, colours, flags and structure stay in clear so
+// ordering, paging and FK-style joins keep working:
+//
+//   sessions         name, notes
+//   saved_tabs       url, title, fav_icon_url, notes
+//   bookmarks        title, url, notes
+//   history_entries  url, title, domain
+//   downloads        filename, url, notes
+//
+// The key is scrypt(password, libraries.password_salt) and lives only in
+// memory after POST /libraries/{id}/unlock, until LockLibrary or the idle
+// timeout. A stored value is "mvenc1:" + base64(nonce | ciphertext), sealed
+// with the library ID as additional data so ciphertext cannot be moved to
+// another library. Values without the prefix (written before the library was
+// first unlocked) are read as-is and sealed by UnlockLibrary.
+//
+// Public DB methods seal on write and open on read. While a library is locked
+// its per-library reads and all writes return ErrLocked; cross-library views
+// (ListAllTabs, ListAllSessions, Search without libId) silently skip it.
+// Zero-knowledge libraries (library_blobs.go) are never unlocked here: every
+// entity method answers ErrZeroKnowledge and cross-library views skip them.
+
+// ErrLocked is returned for reads and writes of an encrypted library whose key
+// is not in memory. Handlers map it to 423 Locked.
+var ErrLocked = errors.New("library is locked")
+
+// DefaultUnlockIdle is how long an unlocked key stays in memory without use.
+const DefaultUnlockIdle = 15 * time.Minute
+
+const cipherPrefix = "mvenc1:"
+
+// Key derivation parameters (~100 ms on a laptop).
+const (
+	libScryptN = 1 << 15
+	libScryptR = 8
+	libScryptP = 1
+)
+
+// UnlockStatus reports whether a library's key is in memory.
+type UnlockStatus struct {
+	LibraryID   string `json:"libraryId"`
+	IsEncrypted bool   `json:"isEncrypted"`
+	Unlocked    bool   `json:"unlocked"`
+	ExpiresAt   int64  `json:"expiresAt,omitempty"` // Unix ms; pushed back on every use
+	Sealed      int    `json:"sealed,omitempty"`    // plaintext values encrypted by this unlock
+}
+
+// keyring holds the keys of unlocked libraries; guarded by mu.
+// onExpire (set once by newDB) runs after the idle timer drops a key.
+type keyring struct {
+	mu       sync.Mutex
+	idle     time.Duration
+	keys     map[string]*libKey
+	onExpire func(libID string)
+}
+
+type libKey struct {
+	aead    cipher.AEAD
+	expires time.Time
+	timer   *time.Timer // drops the key after idle
+}
+
+// SetUnlockIdleTimeout sets how long unlocked keys survive without use
+// (<= 0 restores DefaultUnlockIdle). Applies from each key's next use.
+func (d *DB) SetUnlockIdleTimeout(idle time.Duration) {
+	d.keys.mu.Lock()
+	d.keys.idle = idle
+	d.keys.mu.Unlock()
+}
+
+func (k *keyring) idleTimeout() time.Duration {
+	if k.idle <= 0 {
+		return DefaultUnlockIdle
+	}
+	return k.idle
+}
+
+// get returns the key of libID and extends its lifetime (nil if locked).
+func (k *keyring) get(libID string) cipher.AEAD {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	lk := k.keys[libID]
+	if lk == nil {
+		return nil
+	}
+	idle := k.idleTimeout()
+	lk.expires = time.Now().Add(idle)
+	lk.timer.Reset(idle)
+	return lk.aead
+}
+
+func (k *keyring) put(libID string, aead cipher.AEAD) time.Time {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys == nil {
+		k.keys = map[string]*libKey{}
+	}
+	if old := k.keys[libID]; old != nil {
+		old.timer.Stop()
+	}
+	idle := k.idleTimeout()
+	lk := &libKey{aead: aead, expires: time.Now().Add(idle)}
+	lk.timer = time.AfterFunc(idle, func() {
+		if k.drop(libID, lk) && k.onExpire != nil {
+			k.onExpire(libID)
+		}
+	})
+	k.keys[libID] = lk
+	return lk.expires
+}
+
+// drop removes libID's key; with only set, only if it is still that key.
+// Reports whether a key was removed.
+func (k *keyring) drop(libID string, only *libKey) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	lk := k.keys[libID]
+	if lk == nil || (only != nil && lk != only) {
+		return false
+	}
+	lk.timer.Stop()
+	delete(k.keys, libID)
+	return true
+}
+
+// clear removes every key, e.g. when the database file is replaced and its
+// salts and key hashes may no longer match them.
+func (k *keyring) clear() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, lk := range k.keys {
+		lk.timer.Stop()
+	}
+	k.keys = nil
+}
+
+func (k *keyring) expiry(libID string) (time.Time, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if lk := k.keys[libID]; lk != nil {
+		return lk.expires, true
+	}
+	return time.Time{}, false
+}
+
+// deriveLibraryKey turns a password and the library's salt into an AEAD and
+// the key's check value, base64(SHA-256(key || salt)).
+func deriveLibraryKey(password, salt string) (cipher.AEAD, string, error) {
+	key, err := scrypt.Key([]byte(password), []byte(salt), libScryptN, libScryptR, libScryptP, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("derive key: %w", err)
+	}
+	sum := sha256.Sum256(append(key, salt...))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, base64.StdEncoding.EncodeToString(sum[:]), err
+}
+
+// newSalt returns a random base64 salt for a library that has none.
+func newSalt() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func sealValue(aead cipher.AEAD, libID, plain string) (string, error) {
+	if plain == "" {
+		return plain, nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ct := aead.Seal(nonce, nonce, []byte(plain), []byte(libID))
+	return cipherPrefix + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+func openValue(aead cipher.AEAD, libID, stored string) (string, error) {
+	if !strings.HasPrefix(stored, cipherPrefix) {
+		return stored, nil // not sealed yet
+	}
+	raw, err := base64.StdEncoding.DecodeString(stored[len(cipherPrefix):])
+	if err != nil || len(raw) < aead.NonceSize() {
+		return "", fmt.Errorf("corrupt encrypted value in library %s", libID)
+	}
+	pt, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(libID))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt value in library %s: wrong key or tampered data", libID)
+	}
+	return string(pt), nil
+}
+
+// ── crypter ───────────────────────────────────────────────────────────────────
+
+// crypter seals and opens rows for one operation. It loads the set of
+// encrypted libraries up front, so it never queries while rows are open on
+// the single connection.
+type crypter struct {
+	keys *keyring
+	enc  map[string]bool
+	zk   map[string]bool // zero-knowledge: no key ever, blobs only
+}
+
+// crypter builds a crypter reading library flags through q (d.sql or a tx).
+func (d *DB) crypter(q querier) (*crypter, error) {
+	rows, err := q.Query(`SELECT id, zero_knowledge FROM libraries WHERE is_encrypted = 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c := &crypter{keys: &d.keys, enc: map[string]bool{}, zk: map[string]bool{}}
+	for rows.Next() {
+		var id string
+		var zk bool
+		if err := rows.Scan(&id, &zk); err != nil {
+			return nil, err
+		}
+		c.enc[id], c.zk[id] = true, zk
+	}
+	return c, rows.Err()
+}
+
+// aead returns libID's key: nil for plaintext libraries, ErrLocked if locked,
+// ErrZeroKnowledge for a library that only stores client-encrypted blobs.
+func (c *crypter) aead(libID string) (cipher.AEAD, error) {
+	if !c.enc[libID] {
+		return nil, nil
+	}
+	if c.zk[libID] {
+		return nil, fmt.Errorf("%w: %s", ErrZeroKnowledge, libID)
+	}
+	if a := c.keys.get(libID); a != nil {
+		return a, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrLocked, libID)
+}
+
+// readable reports whether rows of libID can be returned right now.
+func (c *crypter) readable(libID string) bool {
+	_, err := c.aead(libID)
+	return err == nil
+}
+
+// seal encrypts fields in place (no-op for plaintext libraries).
+func (c *crypter) seal(libID string, fields []*string, opt ...*string) error {
+	return c.apply(libID, sealValue, fields, opt)
+}
+
+// open decrypts fields in place (no-op for plaintext libraries).
+func (c *crypter) open(libID string, fields []*string, opt ...*string) error {
+	return c.apply(libID, openValue, fields, opt)
+}
+
+// apply runs fn over fields and the non-nil opt fields.
+func (c *crypter) apply(libID string, fn func(cipher.AEAD, string, string) (string, error), fields []*string, opt []*string) error {
+	aead, err := c.aead(libID)
+	if aead == nil {
+		return err
+	}
+	for _, f := range append(fields, opt...) {
+		if f == nil {
+			continue
+		}
+		if *f, err = fn(aead, libID, *f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *crypter) sealSession(s *Session) error {
+	return c.seal(s.LibraryID, []*string{&s.Name, &s.Notes})
+}
+
+func (c *crypter) openSession(s *Session) error {
+	return c.open(s.LibraryID, []*string{&s.Name, &s.Notes})
+}
+
+func (c *crypter) sealTab(t *Tab) error {
+	return c.seal(t.LibraryID, []*string{&t.URL, &t.Title, &t.Notes}, t.FavIconURL)
+}
+
+func (c *crypter) openTab(t *Tab) error {
+	return c.open(t.LibraryID, []*string{&t.URL, &t.Title, &t.Notes}, t.FavIconURL, t.SessionName)
+}
+
+func (c *crypter) sealBookmark(b *Bookmark) error {
+	return c.seal(b.LibraryID, []*string{&b.Title, &b.Notes}, b.URL)
+}
+
+func (c *crypter) openBookmark(b *Bookmark) error {
+	return c.open(b.LibraryID, []*string{&b.Title, &b.Notes}, b.URL)
+}
+
+func (c *crypter) sealHistory(h *HistoryEntry) error {
+	return c.seal(h.LibraryID, []*string{&h.URL, &h.Title, &h.Domain})
+}
+
+func (c *crypter) openHistory(h *HistoryEntry) error {
+	return c.open(h.LibraryID, []*string{&h.URL, &h.Title, &h.Domain})
+}
+
+func (c *crypter) sealDownload(dl *Download) error {
+	return c.seal(dl.LibraryID, []*string{&dl.Filename, &dl.URL, &dl.Notes})
+}
+
+func (c *crypter) openDownload(dl *Download) error {
+	return c.open(dl.LibraryID, []*string{&dl.Filename, &dl.URL, &dl.Notes})
+}
+
+// openTabs decrypts tabs in place.
+func (c *crypter) openTabs(tabs []Tab) error {
+	for i := range tabs {
+		if err := c.openTab(&tabs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openBookmarks decrypts bookmarks in place.
+func (c *crypter) openBookmarks(items []Bookmark) error {
+	for i := range items {
+		if err := c.openBookmark(&items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ── Lock / unlock ─────────────────────────────────────────────────────────────
+
+// encryptedColumns lists the sealed columns of each table (see the overview).
+var encryptedColumns = []struct {
+	table string
+	cols  []string
+}{
+	{"sessions", []string{"name", "notes"}},
+	{"saved_tabs", []string{"url", "title", "fav_icon_url", "notes"}},
+	{"bookmarks", []string{"title", "url", "notes"}},
+	{"history_entries", []string{"url", "title", "domain"}},
+	{"downloads", []string{"filename", "url", "notes"}},
+}
+
+// errWrongPassword is returned by libraryKey when the password does not match.
+var errWrongPassword = fmt.Errorf("%w: wrong password", ErrInvalid)
+
+// serverEncrypted returns library id if it is encrypted by the companion:
+// ErrInvalid if it is not encrypted, ErrZeroKnowledge if its key only exists
+// in the extension, sql.ErrNoRows (wrapped) if it does not exist.
+func (d *DB) serverEncrypted(id string) (*Library, error) {
+	lib, err := d.GetLibrary(id)
+	if err != nil {
+		return nil, fmt.Errorf("library %s: %w", id, err)
+	}
+	if !lib.IsEncrypted {
+		return nil, fmt.Errorf("%w: library %s is not encrypted", ErrInvalid, id)
+	}
+	if lib.ZeroKnowledge {
+		return nil, fmt.Errorf("%w: %s is unlocked in the extension only", ErrZeroKnowledge, id)
+	}
+	return lib, nil
+}
+
+// libraryKey derives lib's key from password and verifies it: against
+// key_hash when set, otherwise (libraries unlocked before migration 006) by
+// opening a value already sealed in the library. A library with neither
+// accepts the first password. A missing salt is generated; the caller stores
+// the returned salt and hash. errWrongPassword if the check fails.
+func libraryKey(q querier, lib *Library, password string) (aead cipher.AEAD, salt, hash string, err error) {
+	if password == "" {
+		return nil, "", "", fmt.Errorf("%w: password is required", ErrInvalid)
+	}
+	if lib.PasswordSalt != nil {
+		salt = *lib.PasswordSalt
+	}
+	if salt == "" {
+		if salt, err = newSalt(); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if aead, hash, err = deriveLibraryKey(password, salt); err != nil {
+		return nil, "", "", err
+	}
+	if lib.KeyHash != nil && *lib.KeyHash != "" {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(*lib.KeyHash)) != 1 {
+			return nil, "", "", errWrongPassword
+		}
+		return aead, salt, hash, nil
+	}
+	sample, ok, err := sealedSample(q, lib.ID)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if ok {
+		if _, err := openValue(aead, lib.ID, sample); err != nil {
+			return nil, "", "", errWrongPassword
+		}
+	}
+	return aead, salt, hash, nil
+}
+
+// UnlockLibrary derives the key of encrypted library id from password,
+// verifies it (see libraryKey), keeps it in memory and seals any values still
+// stored in cleartext. Successful and failed attempts go to the audit log.
+// Errors: sql.ErrNoRows (wrapped) if the library does not exist, ErrInvalid
+// if it is not encrypted or the password is wrong, ErrZeroKnowledge if its
+// key only exists in the extension.
+func (d *DB) UnlockLibrary(id, password string) (*UnlockStatus, error) {
+	if password == "" {
+		return nil, fmt.Errorf("%w: password is required", ErrInvalid)
+	}
+	lib, err := d.serverEncrypted(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, salt, hash, err := libraryKey(d.sql, lib, password)
+	if errors.Is(err, errWrongPassword) {
+		if aerr := writeAudit(d.sql, id, AuditUnlockFailed, "wrong password"); aerr != nil {
+			return nil, aerr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`UPDATE libraries SET password_salt = ?, key_hash = ? WHERE id = ?`, salt, hash, id); err != nil {
+		return nil, err
+	}
+	sealed, err := sealCleartext(tx, aead, id)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt existing data: %w", err)
+	}
+	if err := writeAudit(tx, id, AuditUnlock, ""); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	expires := d.keys.put(id, aead)
+	return &UnlockStatus{LibraryID: id, IsEncrypted: true, Unlocked: true, ExpiresAt: expires.UnixMilli(), Sealed: sealed}, nil
+}
+
+// LockLibrary forgets the key of library id and records that in the audit
+// log (no-op if it is not unlocked).
+func (d *DB) LockLibrary(id string) error {
+	if !d.keys.drop(id, nil) {
+		return nil
+	}
+	return writeAudit(d.sql, id, AuditLock, "manual")
+}
+
+// LibraryLockStatus reports whether library id is encrypted and unlocked.
+func (d *DB) LibraryLockStatus(id string) (*UnlockStatus, error) {
+	lib, err := d.GetLibrary(id)
+	if err != nil {
+		return nil, fmt.Errorf("library %s: %w", id, err)
+	}
+	st := &UnlockStatus{LibraryID: id, IsEncrypted: lib.IsEncrypted}
+	if exp, ok := d.keys.expiry(id); ok && lib.IsEncrypted {
+		st.Unlocked, st.ExpiresAt = true, exp.UnixMilli()
+	}
+	return st, nil
+}
+
+// sealedSample returns one sealed value stored in library libID, if any.
+func sealedSample(q querier, libID string) (string, bool, error) {
+	for _, t := range encryptedColumns {
+		for _, col := range t.cols {
+			var v string
+			err := q.QueryRow(`SELECT `+col+` FROM `+t.table+` WHERE library_id = ? AND `+col+` LIKE ? LIMIT 1`,
+				libID, cipherPrefix+"%").Scan(&v)
+			if err == nil {
+				return v, true, nil
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return "", false, err
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// sealCleartext encrypts every non-empty, not yet sealed value of libID.
+func sealCleartext(tx *sql.Tx, aead cipher.AEAD, libID string) (int, error) {
+	return rewriteColumns(tx, libID, true, func(v string) (string, error) {
+		return sealValue(aead, libID, v)
+	}, nil)
+}
+
+// rewriteColumns replaces every non-empty encrypted-column value of libID
+// (only unsealed ones with cleartextOnly) by fn(value), calling step after
+// each row written. Returns the number of values rewritten.
+func rewriteColumns(tx *sql.Tx, libID string, cleartextOnly bool, fn func(string) (string, error), step func()) (int, error) {
+	n := 0
+	for _, t := range encryptedColumns {
+		for _, col := range t.cols {
+			where := `library_id = ? AND IFNULL(` + col + `, '') != ''`
+			if cleartextOnly {
+				where += ` AND ` + col + ` NOT LIKE '` + cipherPrefix + `%'`
+			}
+			rows, err := tx.Query(`SELECT rowid, `+col+` FROM `+t.table+` WHERE `+where, libID)
+			if err != nil {
+				return n, err
+			}
+			type pending struct {
+				rowid int64
+				v     string
+			}
+			var todo []pending
+			for rows.Next() {
+				var p pending
+				if err := rows.Scan(&p.rowid, &p.v); err != nil {
+					rows.Close()
+					return n, err
+				}
+				todo = append(todo, p)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return n, err
+			}
+			for _, p := range todo {
+				v, err := fn(p.v)
+				if err != nil {
+					return n, err
+				}
+				if _, err := tx.Exec(`UPDATE `+t.table+` SET `+col+` = ? WHERE rowid = ?`, v, p.rowid); err != nil {
+					return n, err
+				}
+				n++
+				if step != nil {
+					step()
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// countEncryptedValues returns how many values rewriteColumns would visit
+// for libID (cleartextOnly=false).
+func countEncryptedValues(tx *sql.Tx, libID string) (int, error) {
+	total := 0
+	for _, t := range encryptedColumns {
+		for _, col := range t.cols {
+			var n int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM `+t.table+`
+				WHERE library_id = ? AND IFNULL(`+col+`, '') != ''`, libID).Scan(&n); err != nil {
+				return 0, err
+			}
+			total += n
+		}
+	}
+	return total, nil
+}
+
+// sealColumn seals v for storage in the row id of table (a table with
+// library_id). A missing row leaves v as is; the caller's UPDATE then matches
+// nothing.
+func (d *DB) sealColumn(table, id, v string) (string, error) {
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return "", err
+	}
+	var libID string
+	err = d.sql.QueryRow(`SELECT library_id FROM `+table+` WHERE id = ?`, id).Scan(&libID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return v, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return v, c.seal(libID, []*string{&v})
+}
+
+// searchEncrypted appends to results the matches in unlocked encrypted
+// libraries (only libraryID when set), decrypting rows in memory. Per-type
+// caps match Search: 30 tabs, 20 bookmarks, 20 history entries.
+func (d *DB) searchEncrypted(c *crypter, libraryID, query string, results []SearchResult) ([]SearchResult, error) {
+	caps := map[string]int{"tab": 30, "bookmark": 20, "history": 20}
+	for _, r := range results {
+		caps[r.EntityType]--
+	}
+	needle := strings.ToLower(query)
+	match := func(fields ...string) bool {
+		for _, f := range fields {
+			if strings.Contains(strings.ToLower(f), needle) {
+				return true
+			}
+		}
+		return false
+	}
+	add := func(r SearchResult) {
+		if caps[r.EntityType] > 0 {
+			caps[r.EntityType]--
+			results = append(results, r)
+		}
+	}
+	for libID := range c.enc {
+		if (libraryID != "" && libID != libraryID) || !c.readable(libID) {
+			continue
+		}
+		tabs, err := d.ListTabs(libID)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tabs {
+			if match(t.Title, t.URL, t.Notes) {
+				add(SearchResult{EntityType: "tab", EntityID: t.ID, Title: t.Title, URL: t.URL, Snippet: t.Notes})
+			}
+		}
+		bookmarks, err := d.ListBookmarks(libID)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bookmarks {
+			u := ""
+			if b.URL != nil {
+				u = *b.URL
+			}
+			if !b.IsFolder && match(b.Title, u, b.Notes) {
+				add(SearchResult{EntityType: "bookmark", EntityID: b.ID, Title: b.Title, URL: u, Snippet: b.Notes})
+			}
+		}
+		history, err := d.ListHistory(libID)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range history {
+			if match(h.Title, h.URL) {
+				add(SearchResult{EntityType: "history", EntityID: h.ID, Title: h.Title, URL: h.URL})
+			}
+		}
+	}
+	return results, nil
+}
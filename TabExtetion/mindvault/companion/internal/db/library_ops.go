@@ -0,0 +1,147 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// ── Library merge ─────────────────────────────────────────────────────────────
+// MigrateDefaultLibraryNames leaves one "Default (<Browser> — user)" library per
+// browser. MergeLibraries folds one library into another so those per-browser
+// defaults can be consolidated without re-importing anything.
+
+// MergeLibrariesResult reports how many rows moved from the source library.
+// HistoryMerged counts source history rows folded into an existing target row
+// with the same URL; TagsMerged counts source tags dropped on a name collision.
+type MergeLibrariesResult struct {
+	SourceID      string `json:"sourceId"`
+	TargetID      string `json:"targetId"`
+	Sessions      int    `json:"sessions"`
+	Tabs          int    `json:"tabs"`
+	Bookmarks     int    `json:"bookmarks"`
+	History       int    `json:"history"`
+	HistoryMerged int    `json:"historyMerged"`
+	Downloads     int    `json:"downloads"`
+	Tags          int    `json:"tags"`
+	TagsMerged    int    `json:"tagsMerged"`
+}
+
+// MergeLibraries moves every child row of library srcID into dstID and then
+// deletes srcID, all in one transaction.
+//   - sessions, saved_tabs, bookmarks (whole folder trees — parent_id links are
+//     library-independent) and downloads are re-pointed as-is.
+//   - audit_log: the source's rows stay on its ID and are deleted with it, so
+//     the target's log never shows entries it did not produce; the target
+//     gets one UPDATE entry "merged from <srcID>" instead.
+//   - history_entries: when the target already has a row for the same URL the
+//     two are folded: latest visit_time wins, is_important is OR-ed, an empty
+//     target title is filled in from the most recent titled source visit, and
+//     the source row is dropped.
+//   - tags: UNIQUE(library_id, name) collisions keep the target tag (adopting
+//     the source colour if the target has none) and drop the source tag.
+//
+// Encrypted libraries cannot be merged (their values are sealed to the
+// library ID and history is folded by URL in SQL): ErrInvalid.
+//
+// Returns sql.ErrNoRows (wrapped) if either library does not exist.
+func (d *DB) MergeLibraries(srcID, dstID string) (*MergeLibrariesResult, error) {
+	if srcID == dstID {
+		return nil, fmt.Errorf("%w: cannot merge a library into itself", ErrInvalid)
+	}
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, id := range []string{srcID, dstID} {
+		var encrypted bool
+		if err := tx.QueryRow(`SELECT is_encrypted FROM libraries WHERE id = ?`, id).Scan(&encrypted); err != nil {
+			return nil, fmt.Errorf("library %s: %w", id, err)
+		}
+		if encrypted {
+			return nil, fmt.Errorf("%w: library %s is encrypted and cannot be merged", ErrInvalid, id)
+		}
+	}
+
+	res := &MergeLibrariesResult{SourceID: srcID, TargetID: dstID}
+
+	// ── history: fold duplicate URLs into the target row first ────────────────
+	if _, err := tx.Exec(`
+		UPDATE history_entries AS t SET
+			visit_time   = MAX(t.visit_time, s.visit_time),
+			is_important = MAX(t.is_important, s.is_important),
+			title        = CASE WHEN IFNULL(t.title,'') = '' THEN s.title ELSE t.title END
+		FROM (SELECT url, MAX(visit_time) AS visit_time, MAX(is_important) AS is_important,
+		             (SELECT title FROM history_entries AS h
+		               WHERE h.library_id = g.library_id AND h.url = g.url AND IFNULL(h.title,'') <> ''
+		               ORDER BY h.visit_time DESC, h.rowid DESC LIMIT 1) AS title
+		        FROM history_entries AS g WHERE library_id = ? GROUP BY url) AS s
+		WHERE t.library_id = ? AND t.url = s.url`, srcID, dstID); err != nil {
+		return nil, fmt.Errorf("fold history: %w", err)
+	}
+	r, err := tx.Exec(`
+		DELETE FROM history_entries
+		 WHERE library_id = ?
+		   AND url IN (SELECT url FROM history_entries WHERE library_id = ?)`, srcID, dstID)
+	if err != nil {
+		return nil, fmt.Errorf("drop folded history: %w", err)
+	}
+	n, _ := r.RowsAffected()
+	res.HistoryMerged = int(n)
+
+	// ── tags: resolve name collisions before the UNIQUE constraint bites ──────
+	if _, err := tx.Exec(`
+		UPDATE tags AS t SET colour = s.colour
+		  FROM tags AS s
+		 WHERE t.library_id = ? AND s.library_id = ? AND t.name = s.name
+		   AND t.colour IS NULL AND s.colour IS NOT NULL`, dstID, srcID); err != nil {
+		return nil, fmt.Errorf("merge tag colours: %w", err)
+	}
+	r, err = tx.Exec(`
+		DELETE FROM tags
+		 WHERE library_id = ?
+		   AND name IN (SELECT name FROM tags WHERE library_id = ?)`, srcID, dstID)
+	if err != nil {
+		return nil, fmt.Errorf("drop colliding tags: %w", err)
+	}
+	n, _ = r.RowsAffected()
+	res.TagsMerged = int(n)
+
+	// ── re-point everything else ──────────────────────────────────────────────
+	moves := []struct {
+		table string
+		count *int
+	}{
+		{"sessions", &res.Sessions},
+		{"saved_tabs", &res.Tabs},
+		{"bookmarks", &res.Bookmarks},
+		{"history_entries", &res.History},
+		{"downloads", &res.Downloads},
+		{"tags", &res.Tags},
+	}
+	for _, m := range moves {
+		r, err := tx.Exec(`UPDATE `+m.table+` SET library_id = ? WHERE library_id = ?`, dstID, srcID)
+		if err != nil {
+			return nil, fmt.Errorf("move %s: %w", m.table, err)
+		}
+		if m.count != nil {
+			n, _ := r.RowsAffected()
+			*m.count = int(n)
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE libraries SET updated_at = ? WHERE id = ?`, time.Now().UnixMilli(), dstID); err != nil {
+		return nil, err
+	}
+	if err := writeAudit(tx, dstID, AuditUpdate, "merged from "+srcID); err != nil {
+		return nil, fmt.Errorf("audit merge: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM libraries WHERE id = ?`, srcID); err != nil {
+		return nil, fmt.Errorf("delete source library: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ── Password change (rekey) ───────────────────────────────────────────────────
+// A leaked library password is only harmless once every value sealed with the
+// old key is sealed again under a new one. RekeyLibrary does that as a
+// background job (see jobs.go) so the client can show progress.
+
+// JobRekey is the Job.Kind of RekeyLibrary jobs.
+const JobRekey = "rekey"
+
+// RekeyLibrary re-encrypts every encrypted value of library id under a key
+// derived from newPassword and a fresh salt. oldPassword is verified before
+// the job starts (a wrong one is audited like a failed unlock). The job runs
+// in one transaction and holds the request gate exclusively, so no request
+// can seal with the old key meanwhile; on failure nothing changes. On success
+// the library is left unlocked with the new key and a REKEY entry is audited.
+// Errors: as UnlockLibrary, plus ErrInvalid for an empty new password or a
+// rekey of the library already running.
+func (d *DB) RekeyLibrary(id, oldPassword, newPassword string) (*Job, error) {
+	if newPassword == "" {
+		return nil, fmt.Errorf("%w: new password is required", ErrInvalid)
+	}
+	lib, err := d.serverEncrypted(id)
+	if err != nil {
+		return nil, err
+	}
+	oldKey, _, _, err := libraryKey(d.sql, lib, oldPassword)
+	if errors.Is(err, errWrongPassword) {
+		if aerr := writeAudit(d.sql, id, AuditUnlockFailed, "rekey: wrong password"); aerr != nil {
+			return nil, aerr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	newKey, hash, err := deriveLibraryKey(newPassword, salt)
+	if err != nil {
+		return nil, err
+	}
+	job, err := d.jobs.start(JobRekey, id)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		d.gate.Lock()
+		defer d.gate.Unlock()
+		d.jobs.finish(job.ID, d.rekey(job.ID, id, oldKey, newKey, salt, hash))
+	}()
+	return job, nil
+}
+
+// rekey is the body of a RekeyLibrary job; the caller holds the gate.
+func (d *DB) rekey(jobID, libID string, oldKey, newKey cipher.AEAD, salt, hash string) error {
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	total, err := countEncryptedValues(tx, libID)
+	if err != nil {
+		return err
+	}
+	d.jobs.update(jobID, func(j *Job) { j.Total = total })
+	_, err = rewriteColumns(tx, libID, false, func(v string) (string, error) {
+		plain, err := openValue(oldKey, libID, v)
+		if err != nil {
+			return "", err
+		}
+		return sealValue(newKey, libID, plain)
+	}, func() {
+		d.jobs.update(jobID, func(j *Job) { j.Done++ })
+	})
+	if err != nil {
+		return fmt.Errorf("re-encrypt: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE libraries SET password_salt = ?, key_hash = ?, updated_at = ? WHERE id = ?`,
+		salt, hash, time.Now().UnixMilli(), libID); err != nil {
+		return err
+	}
+	if err := writeAudit(tx, libID, AuditRekey, ""); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.keys.put(libID, newKey)
+	return nil
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"fmt"
+	"os"
+)
+
+// MigrationState reports whether one schema migration has been applied.
+type MigrationState struct {
+	Version   int   `json:"version"`
+	Applied   bool  `json:"applied"`
+	AppliedAt int64 `json:"appliedAt,omitempty"` // Unix seconds
+}
+
+// MigrationStatus lists every migration this build knows, in order, and
+// whether the database has it. It does not apply anything.
+func (d *DB) MigrationStatus() ([]MigrationState, error) {
+	applied := map[int]int64{}
+	rows, err := d.sql.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var v int
+			var at int64
+			if err := rows.Scan(&v, &at); err != nil {
+				return nil, err
+			}
+			applied[v] = at
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	} // no schema_migrations table yet: nothing applied
+	out := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		at, ok := applied[m.version]
+		out = append(out, MigrationState{Version: m.version, Applied: ok, AppliedAt: at})
+	}
+	return out, nil
+}
+
+// VacuumResult reports the database file size around a VACUUM.
+type VacuumResult struct {
+	BeforeBytes int64 `json:"beforeBytes"`
+	AfterBytes  int64 `json:"afterBytes"`
+}
+
+// Vacuum rebuilds the database file, returning free pages to the OS, and
+// checkpoints the WAL so the size reported is the file's real size.
+func (d *DB) Vacuum() (VacuumResult, error) {
+	var res VacuumResult
+	res.BeforeBytes = d.fileSize()
+	if _, err := d.sql.Exec(`VACUUM`); err != nil {
+		return res, fmt.Errorf("vacuum: %w", err)
+	}
+	if _, err := d.sql.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return res, fmt.Errorf("checkpoint: %w", err)
+	}
+	res.AfterBytes = d.fileSize()
+	return res, nil
+}
+
+// fileSize returns the size of the database file plus its WAL (0 in memory).
+func (d *DB) fileSize() int64 {
+	if d.path == "" {
+		return 0
+	}
+	var n int64
+	for _, p := range []string{d.path, d.path + "-wal"} {
+		if fi, err := os.Stat(p); err == nil {
+			n += fi.Size()
+		}
+	}
+	return n
+}
+
+// IntegrityCheck runs PRAGMA integrity_check and returns its problems
+// (none = the file is sound).
+func (d *DB) IntegrityCheck() ([]string, error) {
+	rows, err := d.sql.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	return problems, rows.Err()
+}
@@ -12,6 +12,21 @@ var migration001 string
 //go:embed migrations/002_session_extras.sql
 var migration002 string
 
+//go:embed migrations/003_bookmark_order.sql
+var migration003 string
+
+//go:embed migrations/004_session_structure.sql
+var migration004 string
+
+//go:embed migrations/005_blob_libraries.sql
+var migration005 string
+
+//go:embed migrations/006_library_keys.sql
+var migration006 string
+
+//go:embed migrations/007_blob_seq.sql
+var migration007 string
+
 type migration struct {
 	version int
 	sql     string
@@ -20,6 +35,11 @@ type migration struct {
 var migrations = []migration{
 	{version: 1, sql: migration001},
 	{version: 2, sql: migration002},
+	{version: 3, sql: migration003},
+	{version: 4, sql: migration004},
+	{version: 5, sql: migration005},
+	{version: 6, sql: migration006},
+	{version: 7, sql: migration007},
 }
 
 // migrate applies any pending migrations in order.
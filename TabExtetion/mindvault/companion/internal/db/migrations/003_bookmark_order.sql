@@ -0,0 +1,19 @@
+-- Migration 003: Bookmark ordering
+-- Adds sort_order (position among siblings of the same parent) to bookmarks so
+-- folder trees can be rendered and reordered like the browser's own bookmark bar.
+-- Mirrors Bookmark.sortOrder in the extension's shared types.
+--
+-- Existing rows are numbered 0..n-1 within each (library_id, parent_id) group,
+-- keeping their previous created_at order.
+
+ALTER TABLE bookmarks ADD COLUMN sort_order INTEGER NOT NULL DEFAULT 0;
+
+UPDATE bookmarks SET sort_order = (
+    SELECT COUNT(*) FROM bookmarks b2
+     WHERE b2.library_id = bookmarks.library_id
+       AND b2.parent_id IS bookmarks.parent_id
+       AND (b2.created_at < bookmarks.created_at
+            OR (b2.created_at = bookmarks.created_at AND b2.id < bookmarks.id))
+);
+
+CREATE INDEX IF NOT EXISTS idx_bookmarks_order ON bookmarks(library_id, parent_id, sort_order);
@@ -0,0 +1,40 @@
+-- Migration 004: Window and tab-group structure inside sessions
+-- Sessions were flat tab lists; browsers have windows, tab groups and pinned
+-- tabs. These become first-class child records of a session so a multi-window
+-- session can be restored window by window.
+--
+-- session_windows : one row per browser window captured in a session
+-- tab_groups      : Chrome/Edge tab groups (name, colour, collapsed) per window
+-- saved_tabs gains window_id, group_id, tab_index (position inside its window)
+-- and is_pinned. Existing tabs keep NULL window/group and index 0 — they are
+-- reported as "loose" tabs by the session detail endpoint.
+--
+-- Group colours follow chrome.tabGroups.Color.
+
+CREATE TABLE IF NOT EXISTS session_windows (
+    id          TEXT PRIMARY KEY,
+    session_id  TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    sort_order  INTEGER NOT NULL DEFAULT 0,
+    focused     INTEGER NOT NULL DEFAULT 0,
+    created_at  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_windows_session ON session_windows(session_id, sort_order);
+
+CREATE TABLE IF NOT EXISTS tab_groups (
+    id          TEXT PRIMARY KEY,
+    session_id  TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    window_id   TEXT REFERENCES session_windows(id) ON DELETE CASCADE,
+    name        TEXT NOT NULL DEFAULT '',
+    colour      TEXT NOT NULL DEFAULT 'grey'
+                CHECK(colour IN ('grey','blue','red','yellow','green','pink','purple','cyan','orange')),
+    collapsed   INTEGER NOT NULL DEFAULT 0,
+    created_at  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_groups_session ON tab_groups(session_id);
+
+ALTER TABLE saved_tabs ADD COLUMN window_id TEXT REFERENCES session_windows(id) ON DELETE SET NULL;
+ALTER TABLE saved_tabs ADD COLUMN group_id  TEXT REFERENCES tab_groups(id) ON DELETE SET NULL;
+ALTER TABLE saved_tabs ADD COLUMN tab_index INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE saved_tabs ADD COLUMN is_pinned INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_tabs_window ON saved_tabs(window_id, tab_index);
@@ -0,0 +1,21 @@
+-- Migration 005: Zero-knowledge (client-encrypted) libraries
+-- A library created with zero_knowledge=1 is encrypted by the extension
+-- (packages/shared crypto/encryption.ts) before anything reaches the companion.
+-- Its entities are not stored in sessions / saved_tabs / … but as opaque
+-- blobs: only the entity ID, the library ID and timestamps are in clear. The
+-- companion mirrors and syncs them without ever seeing plaintext.
+--
+-- deleted_at marks a tombstone (blob emptied) so deletions sync like updates.
+
+ALTER TABLE libraries ADD COLUMN zero_knowledge INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS encrypted_blobs (
+    library_id  TEXT NOT NULL REFERENCES libraries(id) ON DELETE CASCADE,
+    id          TEXT NOT NULL,
+    blob        BLOB NOT NULL,
+    created_at  INTEGER NOT NULL,
+    updated_at  INTEGER NOT NULL,
+    deleted_at  INTEGER,
+    PRIMARY KEY (library_id, id)
+);
+CREATE INDEX IF NOT EXISTS idx_blobs_updated ON encrypted_blobs(library_id, updated_at, id);
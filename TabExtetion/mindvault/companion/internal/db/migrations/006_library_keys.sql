@@ -0,0 +1,29 @@
+-- Migration 006: Library key verification and key-lifecycle audit
+-- key_hash is base64(SHA-256(key || salt)) of an encrypted library's key.
+-- Unlock compares against it instead of trial-decrypting a stored value; NULL
+-- until the first unlock. The companion derives its keys with scrypt, the
+-- extension with PBKDF2, so the two values are not interchangeable: for a
+-- zero-knowledge library key_hash is the extension's encryptionKeyHash as
+-- supplied on create, for other encrypted libraries the companion's own.
+--
+-- audit_log gains the actions UNLOCK, UNLOCK_FAILED, LOCK and REKEY plus a
+-- free-text detail (e.g. "idle timeout"). SQLite cannot alter a CHECK
+-- constraint, so the table is rebuilt; existing rows are copied unchanged.
+
+ALTER TABLE libraries ADD COLUMN key_hash TEXT;
+
+CREATE TABLE audit_log_new (
+    id          TEXT PRIMARY KEY,
+    library_id  TEXT NOT NULL REFERENCES libraries(id) ON DELETE CASCADE,
+    action      TEXT NOT NULL
+                CHECK(action IN ('CREATE','UPDATE','DELETE','UNLOCK','UNLOCK_FAILED','LOCK','REKEY')),
+    entity_type TEXT NOT NULL,
+    entity_id   TEXT NOT NULL,
+    timestamp   INTEGER NOT NULL,
+    detail      TEXT NOT NULL DEFAULT ''
+);
+INSERT INTO audit_log_new (id, library_id, action, entity_type, entity_id, timestamp)
+    SELECT id, library_id, action, entity_type, entity_id, timestamp FROM audit_log;
+DROP TABLE audit_log;
+ALTER TABLE audit_log_new RENAME TO audit_log;
+CREATE INDEX IF NOT EXISTS idx_audit_library ON audit_log(library_id, timestamp);
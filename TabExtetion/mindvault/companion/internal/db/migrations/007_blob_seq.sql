@@ -0,0 +1,19 @@
+-- Migration 007: Server-assigned sync sequence for zero-knowledge blobs
+-- Pulls used to page on the client-sent updated_at, so a push carrying an
+-- older clock than a device's last pull was never seen by that device. seq is
+-- assigned by the companion on every stored write and is the pull cursor
+-- instead; updated_at only decides last-writer-wins.
+--
+-- blob_seq holds the last number handed out. It lives outside the library
+-- tables so a selective restore or import (which replaces a library's rows)
+-- cannot move it backwards; restored blobs are renumbered above it.
+
+ALTER TABLE encrypted_blobs ADD COLUMN seq INTEGER NOT NULL DEFAULT 0;
+UPDATE encrypted_blobs SET seq = rowid;
+CREATE INDEX IF NOT EXISTS idx_blobs_seq ON encrypted_blobs(library_id, seq);
+
+CREATE TABLE IF NOT EXISTS blob_seq (
+    id    INTEGER PRIMARY KEY CHECK (id = 1),
+    value INTEGER NOT NULL
+);
+INSERT INTO blob_seq (id, value) SELECT 1, COALESCE(MAX(seq), 0) FROM encrypted_blobs;
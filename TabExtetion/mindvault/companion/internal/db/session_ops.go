@@ -0,0 +1,350 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ── Session merge / split ─────────────────────────────────────────────────────
+// Both operations rewrite rows through addSession/addTab inside a single
+// transaction, so a crash mid-way never leaves tabs half-moved, and a taken ID
+// fails the whole operation with ErrConflict instead of losing the row.
+// Tab IDs are preserved: the extension keys its IndexedDB rows on the same IDs,
+// so re-inserting under the original ID keeps later syncs idempotent.
+
+// MergeSessionsOpts describes a POST /sessions:merge request.
+// SessionIDs order matters: the first session's tab wins when URLs collide,
+// and its library becomes the target unless LibraryID is set.
+type MergeSessionsOpts struct {
+	SessionIDs []string
+	NewID      string // ID for the merged session ("" = caller must supply)
+	Name       string // "" = first source session's name
+	LibraryID  string // "" = first source session's library
+}
+
+// MergeSessionsResult is returned by MergeSessions.
+// SourceBrowsers is the sorted set of non-empty source_browser values seen
+// across the merged sessions; it is also stored comma-joined in source_browser.
+type MergeSessionsResult struct {
+	Session        Session  `json:"session"`
+	SourceBrowsers []string `json:"sourceBrowsers"`
+	MergedFrom     []string `json:"mergedFrom"`
+	TabsKept       int      `json:"tabsKept"`
+	TabsDropped    int      `json:"tabsDropped"` // duplicate URLs removed
+}
+
+// SplitSessionResult is returned by SplitSession.
+type SplitSessionResult struct {
+	Session   Session `json:"session"` // the newly created session
+	TabsMoved int     `json:"tabsMoved"`
+}
+
+// listSessionTabs returns the tabs of one session, oldest first, so merge
+// order follows the order in which tabs were originally saved.
+func listSessionTabs(q querier, sessionID string) ([]Tab, error) {
+	rows, err := q.Query(
+		`SELECT `+tabCols+` FROM saved_tabs WHERE session_id = ? ORDER BY saved_at, rowid`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tabs []Tab
+	for rows.Next() {
+		t, err := scanTab(rows)
+		if err != nil {
+			return nil, err
+		}
+		tabs = append(tabs, t)
+	}
+	return tabs, rows.Err()
+}
+
+// splitBrowsers turns a stored source_browser value into its members.
+// Merged sessions store a comma-joined set ("Chrome,Firefox").
+func splitBrowsers(v string) []string {
+	var out []string
+	for _, b := range strings.Split(v, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// joinNotes concatenates non-empty, distinct notes separated by a blank line.
+func joinNotes(notes []string) string {
+	seen := map[string]bool{}
+	var parts []string
+	for _, n := range notes {
+		n = strings.TrimSpace(n)
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		parts = append(parts, n)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// MergeSessions combines two or more sessions into a new one.
+//   - Tabs are deduplicated by exact URL; the first occurrence (in SessionIDs
+//     order, then saved_at) is kept and the notes of dropped duplicates are
+//     appended to it. The first non-nil colour wins.
+//   - Session notes are concatenated in SessionIDs order.
+//   - Sessions may come from different libraries and browsers; all kept tabs
+//     move to the target library and the browser set is recorded.
+//   - Windows and tab groups of every source move to the merged session, so
+//     a crash-restored multi-window layout survives the merge.
+//   - Source sessions and their duplicate tabs are removed.
+//   - Tabs are compared and rewritten in plaintext, so sessions of encrypted
+//     libraries merge too (all involved libraries must be unlocked).
+//
+// Returns sql.ErrNoRows (wrapped) if any source session does not exist.
+func (d *DB) MergeSessions(o MergeSessionsOpts) (*MergeSessionsResult, error) {
+	if len(o.SessionIDs) < 2 {
+		return nil, fmt.Errorf("%w: at least two sessions are required", ErrInvalid)
+	}
+	if o.NewID == "" {
+		return nil, fmt.Errorf("%w: new session id is required", ErrInvalid)
+	}
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	c, err := d.crypter(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sources  []Session
+		notes    []string
+		browsers = map[string]bool{}
+		kept     []Tab
+		byURL    = map[string]int{} // url → index in kept
+		dropped  int
+		seenSess = map[string]bool{}
+	)
+	for _, id := range o.SessionIDs {
+		if seenSess[id] {
+			continue // tolerate the same ID listed twice
+		}
+		seenSess[id] = true
+		s, err := getSession(tx, id)
+		if err != nil {
+			return nil, fmt.Errorf("session %s: %w", id, err)
+		}
+		if err := c.openSession(s); err != nil {
+			return nil, err
+		}
+		sources = append(sources, *s)
+		notes = append(notes, s.Notes)
+		for _, b := range splitBrowsers(s.SourceBrowser) {
+			browsers[b] = true
+		}
+		tabs, err := listSessionTabs(tx, id)
+		if err != nil {
+			return nil, fmt.Errorf("list tabs of %s: %w", id, err)
+		}
+		if err := c.openTabs(tabs); err != nil {
+			return nil, err
+		}
+		for _, t := range tabs {
+			if i, dup := byURL[t.URL]; dup {
+				kept[i].Notes = joinNotes([]string{kept[i].Notes, t.Notes})
+				if kept[i].Colour == nil {
+					kept[i].Colour = t.Colour
+				}
+				dropped++
+				continue
+			}
+			byURL[t.URL] = len(kept)
+			kept = append(kept, t)
+		}
+	}
+	if len(sources) < 2 {
+		return nil, fmt.Errorf("%w: at least two distinct sessions are required", ErrInvalid)
+	}
+	if seenSess[o.NewID] {
+		return nil, fmt.Errorf("%w: merged session id must differ from the sources", ErrInvalid)
+	}
+
+	libID := o.LibraryID
+	if libID == "" {
+		libID = sources[0].LibraryID
+	}
+	var exists int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM libraries WHERE id = ?`, libID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, fmt.Errorf("library %s: %w", libID, sql.ErrNoRows)
+	}
+
+	browserList := make([]string, 0, len(browsers))
+	for b := range browsers {
+		browserList = append(browserList, b)
+	}
+	sort.Strings(browserList)
+
+	name := o.Name
+	if name == "" {
+		name = sources[0].Name
+	}
+	createdAt := sources[0].CreatedAt
+	mergedFrom := make([]string, 0, len(sources))
+	for _, s := range sources {
+		if s.CreatedAt < createdAt {
+			createdAt = s.CreatedAt // merged session spans the earliest source
+		}
+		mergedFrom = append(mergedFrom, s.ID)
+	}
+	merged := Session{
+		ID:            o.NewID,
+		LibraryID:     libID,
+		Name:          name,
+		Notes:         joinNotes(notes),
+		CreatedAt:     createdAt,
+		UpdatedAt:     time.Now().UnixMilli(),
+		SourceBrowser: strings.Join(browserList, ","),
+	}
+
+	// Create the target first so windows and groups can be re-pointed at it,
+	// then remove source tabs so kept tabs can be re-inserted under their own IDs.
+	stored := merged
+	if err := c.sealSession(&stored); err != nil {
+		return nil, err
+	}
+	if err := addSession(tx, stored); err != nil {
+		return nil, fmt.Errorf("create merged session: %w", err)
+	}
+	for _, s := range sources {
+		for _, table := range []string{"session_windows", "tab_groups"} {
+			if _, err := tx.Exec(`UPDATE `+table+` SET session_id = ? WHERE session_id = ?`, merged.ID, s.ID); err != nil {
+				return nil, fmt.Errorf("move %s: %w", table, err)
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM saved_tabs WHERE session_id = ?`, s.ID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`DELETE FROM sessions WHERE id = ?`, s.ID); err != nil {
+			return nil, err
+		}
+	}
+	sid := merged.ID
+	for _, t := range kept {
+		t.LibraryID = libID
+		t.SessionID = &sid
+		if err := c.sealTab(&t); err != nil {
+			return nil, err
+		}
+		if err := addTab(tx, t); err != nil {
+			return nil, fmt.Errorf("move tab %s: %w", t.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	merged.TabCount = len(kept)
+	return &MergeSessionsResult{
+		Session:        merged,
+		SourceBrowsers: browserList,
+		MergedFrom:     mergedFrom,
+		TabsKept:       len(kept),
+		TabsDropped:    dropped,
+	}, nil
+}
+
+// SplitSession moves the given tabs out of session id into a new session in
+// the same library. The new session inherits source_browser and notes.
+// Every tab ID must belong to the source session. Windows and groups used by
+// the moved tabs are cloned into the new session with IDs from genID.
+func (d *DB) SplitSession(id, newID, name string, tabIDs []string, genID func() string) (*SplitSessionResult, error) {
+	if len(tabIDs) == 0 {
+		return nil, fmt.Errorf("%w: tabIds must not be empty", ErrInvalid)
+	}
+	if newID == "" {
+		return nil, fmt.Errorf("%w: new session id is required", ErrInvalid)
+	}
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	src, err := d.getOpenSession(tx, id)
+	if err != nil {
+		return nil, fmt.Errorf("session %s: %w", id, err)
+	}
+	tabs, err := listSessionTabs(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Tab, len(tabs))
+	for _, t := range tabs {
+		byID[t.ID] = t
+	}
+	var moving []Tab
+	picked := map[string]bool{}
+	for _, tid := range tabIDs {
+		t, ok := byID[tid]
+		if !ok {
+			return nil, fmt.Errorf("%w: tab %s is not in session %s", ErrInvalid, tid, id)
+		}
+		if picked[tid] {
+			continue
+		}
+		picked[tid] = true
+		moving = append(moving, t)
+	}
+
+	if name == "" {
+		name = src.Name + " (split)"
+	}
+	now := time.Now().UnixMilli()
+	split := Session{
+		ID:            newID,
+		LibraryID:     src.LibraryID,
+		Name:          name,
+		Notes:         src.Notes,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		SourceBrowser: src.SourceBrowser,
+	}
+	stored := split
+	c, err := d.crypter(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sealSession(&stored); err != nil {
+		return nil, err
+	}
+	if err := addSession(tx, stored); err != nil {
+		return nil, fmt.Errorf("create split session: %w", err)
+	}
+	if err := copyStructureForTabs(tx, id, split.ID, moving, genID); err != nil {
+		return nil, fmt.Errorf("copy window structure: %w", err)
+	}
+	sid := split.ID
+	for _, t := range moving {
+		if _, err := tx.Exec(`DELETE FROM saved_tabs WHERE id = ?`, t.ID); err != nil {
+			return nil, err
+		}
+		t.SessionID = &sid
+		if err := addTab(tx, t); err != nil {
+			return nil, fmt.Errorf("move tab %s: %w", t.ID, err)
+		}
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET updated_at=? WHERE id=?`, now, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	split.TabCount = len(moving)
+	return &SplitSessionResult{Session: split, TabsMoved: len(moving)}, nil
+}
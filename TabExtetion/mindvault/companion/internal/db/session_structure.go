@@ -0,0 +1,461 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ── Session windows & tab groups (migration 004) ──────────────────────────────
+// A session holds windows; a window holds tab groups and tabs. Tabs carry
+// window_id, group_id, tab_index and is_pinned. Tabs saved before migration
+// 004 (or pushed without placement) have no window and are "loose".
+
+// TabGroupColours is the set accepted by tab_groups.colour (chrome.tabGroups.Color).
+var TabGroupColours = []string{"grey", "blue", "red", "yellow", "green", "pink", "purple", "cyan", "orange"}
+
+// ValidTabGroupColour reports whether c is one of TabGroupColours.
+func ValidTabGroupColour(c string) bool {
+	for _, v := range TabGroupColours {
+		if c == v {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionWindow is one browser window captured in a session.
+// Groups and Tabs are populated only by GetSessionDetail.
+type SessionWindow struct {
+	ID        string     `json:"id"`
+	SessionID string     `json:"sessionId"`
+	SortOrder int        `json:"sortOrder"`
+	Focused   bool       `json:"focused"`
+	CreatedAt int64      `json:"createdAt"`
+	Groups    []TabGroup `json:"groups,omitempty"`
+	Tabs      []Tab      `json:"tabs,omitempty"` // ordered by index
+}
+
+// TabGroup mirrors a browser tab group inside a session window.
+type TabGroup struct {
+	ID        string  `json:"id"`
+	SessionID string  `json:"sessionId"`
+	WindowID  *string `json:"windowId,omitempty"`
+	Name      string  `json:"name"`
+	Colour    string  `json:"colour"`
+	Collapsed bool    `json:"collapsed"`
+	CreatedAt int64   `json:"createdAt"`
+}
+
+// TabGroupPatch carries optional PATCH fields for UpdateTabGroup.
+type TabGroupPatch struct {
+	Name      *string `json:"name"`
+	Colour    *string `json:"colour"`
+	Collapsed *bool   `json:"collapsed"`
+}
+
+// SessionDetail is the nested GET /sessions/{id} response: the session, its
+// windows (each with groups and ordered tabs) and any loose tabs.
+type SessionDetail struct {
+	Session
+	Windows   []SessionWindow `json:"windows"`
+	LooseTabs []Tab           `json:"looseTabs"`
+}
+
+// CreateWindow inserts a window into a session. Ignores duplicate IDs.
+func (d *DB) CreateWindow(w SessionWindow) error {
+	return createWindow(d.sql, w)
+}
+
+func createWindow(ex execer, w SessionWindow) error {
+	_, err := ex.Exec(`INSERT OR IGNORE`+windowInsert, w.ID, w.SessionID, w.SortOrder, w.Focused, w.CreatedAt)
+	return err
+}
+
+const windowInsert = ` INTO session_windows (id, session_id, sort_order, focused, created_at)
+		 VALUES (?, ?, ?, ?, ?)`
+
+// addWindow inserts a window cloned under a new ID; a taken ID is an ErrConflict.
+func addWindow(ex execer, w SessionWindow) error {
+	return insertNew(ex, "window", w.ID, `INSERT`+windowInsert, w.ID, w.SessionID, w.SortOrder, w.Focused, w.CreatedAt)
+}
+
+// NextWindowSortOrder returns the sort_order that appends a window to a session.
+func (d *DB) NextWindowSortOrder(sessionID string) (int, error) {
+	var n int
+	err := d.sql.QueryRow(`SELECT IFNULL(MAX(sort_order) + 1, 0) FROM session_windows WHERE session_id = ?`, sessionID).Scan(&n)
+	return n, err
+}
+
+// CreateTabGroup inserts a tab group. If WindowID is set it must belong to the
+// same session. Ignores duplicate IDs.
+func (d *DB) CreateTabGroup(g TabGroup) error {
+	if !ValidTabGroupColour(g.Colour) {
+		return fmt.Errorf("%w: colour must be one of %s", ErrInvalid, strings.Join(TabGroupColours, ", "))
+	}
+	if g.WindowID != nil {
+		var sid string
+		err := d.sql.QueryRow(`SELECT session_id FROM session_windows WHERE id = ?`, *g.WindowID).Scan(&sid)
+		if err != nil {
+			return fmt.Errorf("window %s: %w", *g.WindowID, err)
+		}
+		if sid != g.SessionID {
+			return fmt.Errorf("%w: window %s belongs to another session", ErrInvalid, *g.WindowID)
+		}
+	}
+	return createTabGroup(d.sql, g)
+}
+
+func createTabGroup(ex execer, g TabGroup) error {
+	_, err := ex.Exec(`INSERT OR IGNORE`+tabGroupInsert,
+		g.ID, g.SessionID, g.WindowID, g.Name, g.Colour, g.Collapsed, g.CreatedAt)
+	return err
+}
+
+const tabGroupInsert = ` INTO tab_groups (id, session_id, window_id, name, colour, collapsed, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+// addTabGroup inserts a group cloned under a new ID; a taken ID is an ErrConflict.
+func addTabGroup(ex execer, g TabGroup) error {
+	return insertNew(ex, "tab group", g.ID, `INSERT`+tabGroupInsert,
+		g.ID, g.SessionID, g.WindowID, g.Name, g.Colour, g.Collapsed, g.CreatedAt)
+}
+
+// UpdateTabGroup applies a partial patch to a tab group of sessionID.
+// Returns sql.ErrNoRows if the group does not exist in that session.
+func (d *DB) UpdateTabGroup(sessionID, id string, p TabGroupPatch) error {
+	var sets []string
+	var args []any
+	if p.Name != nil {
+		sets, args = append(sets, "name = ?"), append(args, *p.Name)
+	}
+	if p.Colour != nil {
+		if !ValidTabGroupColour(*p.Colour) {
+			return fmt.Errorf("%w: colour must be one of %s", ErrInvalid, strings.Join(TabGroupColours, ", "))
+		}
+		sets, args = append(sets, "colour = ?"), append(args, *p.Colour)
+	}
+	if p.Collapsed != nil {
+		sets, args = append(sets, "collapsed = ?"), append(args, *p.Collapsed)
+	}
+	if len(sets) == 0 {
+		return nil // nothing to update
+	}
+	res, err := d.sql.Exec(`UPDATE tab_groups SET `+strings.Join(sets, ", ")+` WHERE id = ? AND session_id = ?`,
+		append(args, id, sessionID)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("tab group %s: %w", id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// DeleteTabGroup removes a group; its tabs stay in place, ungrouped.
+// Returns sql.ErrNoRows if the group does not exist in that session.
+func (d *DB) DeleteTabGroup(sessionID, id string) error {
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := inSession(tx, "tab_groups", "tab group", sessionID, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE saved_tabs SET group_id = NULL WHERE group_id = ? AND session_id = ?`, id, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM tab_groups WHERE id = ? AND session_id = ?`, id, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteWindow removes a window and its groups; its tabs become loose tabs of
+// the session (window_id / group_id cleared) rather than being deleted.
+// Returns sql.ErrNoRows if the window does not exist in that session.
+func (d *DB) DeleteWindow(sessionID, id string) error {
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := inSession(tx, "session_windows", "window", sessionID, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE saved_tabs SET window_id = NULL, group_id = NULL WHERE window_id = ? AND session_id = ?`, id, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM tab_groups WHERE window_id = ? AND session_id = ?`, id, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM session_windows WHERE id = ? AND session_id = ?`, id, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// inSession returns sql.ErrNoRows (wrapped) unless row id of table (a window
+// or tab group) belongs to sessionID. Checked before any statement that
+// detaches tabs, so a foreign ID in the URL changes nothing.
+func inSession(q querier, table, what, sessionID, id string) error {
+	var n int
+	if err := q.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE id = ? AND session_id = ?`, id, sessionID).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s %s in session %s: %w", what, id, sessionID, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// checkPlacement rejects a tab placement whose window or group is not part of
+// the tab's session (ErrInvalid). Empty or nil IDs place nothing.
+func checkPlacement(q querier, sessionID, windowID, groupID *string) error {
+	for _, ref := range []struct {
+		id          *string
+		table, what string
+	}{{windowID, "session_windows", "window"}, {groupID, "tab_groups", "tab group"}} {
+		if ref.id == nil || *ref.id == "" {
+			continue
+		}
+		if sessionID == nil || *sessionID == "" {
+			return fmt.Errorf("%w: a tab outside a session cannot be placed in %s %s", ErrInvalid, ref.what, *ref.id)
+		}
+		if err := inSession(q, ref.table, ref.what, *sessionID, *ref.id); errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s %s is not in session %s", ErrInvalid, ref.what, *ref.id, *sessionID)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSessionStructure removes a session's windows and groups and detaches
+// any surviving tabs from them. Called by the session delete paths so no
+// window/group rows outlive their session.
+func deleteSessionStructure(ex execer, sessionID string) error {
+	if _, err := ex.Exec(`UPDATE saved_tabs SET window_id = NULL, group_id = NULL WHERE session_id = ?`, sessionID); err != nil {
+		return err
+	}
+	if _, err := ex.Exec(`DELETE FROM tab_groups WHERE session_id = ?`, sessionID); err != nil {
+		return err
+	}
+	_, err := ex.Exec(`DELETE FROM session_windows WHERE session_id = ?`, sessionID)
+	return err
+}
+
+// listWindows returns a session's windows in display order.
+func listWindows(q querier, sessionID string) ([]SessionWindow, error) {
+	rows, err := q.Query(
+		`SELECT id, session_id, sort_order, focused, created_at
+		 FROM session_windows WHERE session_id = ? ORDER BY sort_order, created_at, id`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SessionWindow
+	for rows.Next() {
+		var w SessionWindow
+		var focused int
+		if err := rows.Scan(&w.ID, &w.SessionID, &w.SortOrder, &focused, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		w.Focused = focused != 0
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+// listTabGroups returns a session's tab groups, oldest first.
+func listTabGroups(q querier, sessionID string) ([]TabGroup, error) {
+	rows, err := q.Query(
+		`SELECT id, session_id, window_id, name, colour, collapsed, created_at
+		 FROM tab_groups WHERE session_id = ? ORDER BY created_at, id`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []TabGroup
+	for rows.Next() {
+		var g TabGroup
+		var collapsed int
+		if err := rows.Scan(&g.ID, &g.SessionID, &g.WindowID, &g.Name, &g.Colour, &collapsed, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		g.Collapsed = collapsed != 0
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+// GetSessionDetail returns a session with its windows, groups and tabs nested.
+// Tabs inside a window are ordered by index (pinned tabs first, as browsers
+// keep them); tabs with no window, or whose window no longer exists, are
+// returned in LooseTabs in saved order. UnsortedSessionID returns the virtual
+// session with (up to 500 of) its orphaned tabs as LooseTabs.
+func (d *DB) GetSessionDetail(id string) (*SessionDetail, error) {
+	if id == UnsortedSessionID {
+		s, err := d.UnsortedSession("")
+		if err != nil {
+			return nil, err
+		}
+		page, err := d.ListSessionTabsPage("", id, 500, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &SessionDetail{Session: *s, Windows: []SessionWindow{}, LooseTabs: page.Tabs}, nil
+	}
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
+	s, err := getSession(d.sql, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.openSession(s); err != nil {
+		return nil, err
+	}
+	windows, err := listWindows(d.sql, id)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := listTabGroups(d.sql, id)
+	if err != nil {
+		return nil, err
+	}
+	tabs, err := listSessionTabs(d.sql, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.openTabs(tabs); err != nil {
+		return nil, err
+	}
+
+	detail := &SessionDetail{Session: *s, Windows: windows, LooseTabs: []Tab{}}
+	if detail.Windows == nil {
+		detail.Windows = []SessionWindow{}
+	}
+	idx := make(map[string]int, len(windows))
+	for i, w := range windows {
+		idx[w.ID] = i
+	}
+	for _, g := range groups {
+		if g.WindowID != nil {
+			if i, ok := idx[*g.WindowID]; ok {
+				detail.Windows[i].Groups = append(detail.Windows[i].Groups, g)
+			}
+		}
+	}
+	for _, t := range tabs {
+		if t.WindowID != nil {
+			if i, ok := idx[*t.WindowID]; ok {
+				detail.Windows[i].Tabs = append(detail.Windows[i].Tabs, t)
+				continue
+			}
+		}
+		detail.LooseTabs = append(detail.LooseTabs, t)
+	}
+	for i := range detail.Windows {
+		sortWindowTabs(detail.Windows[i].Tabs)
+	}
+	return detail, nil
+}
+
+// sortWindowTabs orders tabs pinned-first, then by index (stable on saved order).
+func sortWindowTabs(tabs []Tab) {
+	sort.SliceStable(tabs, func(i, j int) bool {
+		if tabs[i].IsPinned != tabs[j].IsPinned {
+			return tabs[i].IsPinned
+		}
+		return tabs[i].TabIndex < tabs[j].TabIndex
+	})
+}
+
+// copyStructureForTabs clones the windows and groups referenced by tabs into
+// session dstID (new IDs from newID) and rewrites each tab's WindowID/GroupID
+// to the clones. Used by SplitSession so split-off tabs keep their layout.
+func copyStructureForTabs(tx *sql.Tx, srcID, dstID string, tabs []Tab, newID func() string) error {
+	windows, err := listWindows(tx, srcID)
+	if err != nil {
+		return err
+	}
+	groups, err := listTabGroups(tx, srcID)
+	if err != nil {
+		return err
+	}
+	winByID := map[string]SessionWindow{}
+	for _, w := range windows {
+		winByID[w.ID] = w
+	}
+	grpByID := map[string]TabGroup{}
+	for _, g := range groups {
+		grpByID[g.ID] = g
+	}
+
+	now := time.Now().UnixMilli()
+	winMap, grpMap := map[string]string{}, map[string]string{}
+	cloneWindow := func(id string) (string, error) {
+		if nid, ok := winMap[id]; ok {
+			return nid, nil
+		}
+		w, ok := winByID[id]
+		if !ok {
+			return "", nil // dangling reference — tab becomes loose
+		}
+		w.ID, w.SessionID, w.CreatedAt = newID(), dstID, now
+		if err := addWindow(tx, w); err != nil {
+			return "", err
+		}
+		winMap[id] = w.ID
+		return w.ID, nil
+	}
+	for i := range tabs {
+		t := &tabs[i]
+		if t.WindowID != nil {
+			nid, err := cloneWindow(*t.WindowID)
+			if err != nil {
+				return err
+			}
+			if nid == "" {
+				t.WindowID = nil
+			} else {
+				t.WindowID = &nid
+			}
+		}
+		if t.GroupID != nil {
+			g, ok := grpByID[*t.GroupID]
+			if !ok {
+				t.GroupID = nil
+				continue
+			}
+			nid, done := grpMap[g.ID]
+			if !done {
+				nid = newID()
+				clone := g
+				clone.ID, clone.SessionID, clone.CreatedAt = nid, dstID, now
+				if g.WindowID != nil {
+					wid, err := cloneWindow(*g.WindowID)
+					if err != nil {
+						return err
+					}
+					clone.WindowID = nil
+					if wid != "" {
+						clone.WindowID = &wid
+					}
+				}
+				if err := addTabGroup(tx, clone); err != nil {
+					return err
+				}
+				grpMap[g.ID] = nid
+			}
+			t.GroupID = &nid
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ── Session detail views ──────────────────────────────────────────────────────
+// Per-session tab paging and statistics, plus the virtual "Unsorted" session.
+//
+// DeleteSession keeps a session's tabs (ON DELETE SET NULL), so tabs can end up
+// with session_id NULL — or, on databases where the FK was never enforced, a
+// session_id pointing at a row that no longer exists. Both kinds are orphans
+// and are surfaced under the reserved session ID UnsortedSessionID.
+
+// UnsortedSessionID is the reserved ID of the virtual per-library session that
+// groups orphaned tabs. It is never stored in the sessions table.
+const UnsortedSessionID = "unsorted"
+
+// orphanCond matches saved_tabs rows (aliased st) that belong to no live session.
+const orphanCond = `(st.session_id IS NULL OR NOT EXISTS (SELECT 1 FROM sessions s WHERE s.id = st.session_id))`
+
+// DomainCount is one row of a session's domain breakdown.
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Count  int    `json:"count"`
+}
+
+// SessionStats summarises all tabs of a session (not just the current page).
+// ByColour keys are R/G/Y/B plus "none" for uncoloured tabs.
+type SessionStats struct {
+	TabCount    int            `json:"tabCount"`
+	PinnedCount int            `json:"pinnedCount"`
+	WindowCount int            `json:"windowCount"`
+	Domains     []DomainCount  `json:"domains"` // most frequent first
+	ByColour    map[string]int `json:"byColour"`
+}
+
+// TabPage is one page of a session's tabs.
+type TabPage struct {
+	Tabs   []Tab `json:"tabs"`
+	Total  int   `json:"total"`
+	Limit  int   `json:"limit"`
+	Offset int   `json:"offset"`
+}
+
+// UnsortedSession builds the virtual session for libraryID's orphaned tabs.
+// libraryID "" means orphans across all libraries.
+func (d *DB) UnsortedSession(libraryID string) (*Session, error) {
+	var n int
+	var oldest, newest sql.NullInt64
+	err := d.sql.QueryRow(`SELECT COUNT(*), MIN(st.saved_at), MAX(st.saved_at) FROM saved_tabs st
+		WHERE (? = '' OR st.library_id = ?) AND `+orphanCond, libraryID, libraryID).Scan(&n, &oldest, &newest)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		ID:        UnsortedSessionID,
+		LibraryID: libraryID,
+		Name:      "Unsorted",
+		Notes:     "Tabs whose session was deleted",
+		CreatedAt: oldest.Int64,
+		UpdatedAt: newest.Int64,
+		TabCount:  n,
+		Virtual:   true,
+	}, nil
+}
+
+// sessionTabsWhere returns the WHERE clause and args selecting the tabs of
+// sessionID, scoped to libraryID when non-empty.
+func sessionTabsWhere(libraryID, sessionID string) (string, []any) {
+	if sessionID == UnsortedSessionID {
+		return `(? = '' OR st.library_id = ?) AND ` + orphanCond, []any{libraryID, libraryID}
+	}
+	return `(? = '' OR st.library_id = ?) AND st.session_id = ?`, []any{libraryID, libraryID, sessionID}
+}
+
+// ListSessionTabsPage returns one page of a session's tabs, newest first.
+// sessionID may be UnsortedSessionID. limit is clamped to 1..500.
+func (d *DB) ListSessionTabsPage(libraryID, sessionID string, limit, offset int) (*TabPage, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 500
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.aead(libraryID); err != nil {
+		return nil, err
+	}
+	where, args := sessionTabsWhere(libraryID, sessionID)
+	page := &TabPage{Tabs: []Tab{}, Limit: limit, Offset: offset}
+	if err := d.sql.QueryRow(`SELECT COUNT(*) FROM saved_tabs st WHERE `+where, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+	rows, err := d.sql.Query(`SELECT `+prefixCols("st", tabCols)+` FROM saved_tabs st WHERE `+where+`
+		ORDER BY st.saved_at DESC, st.rowid LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanTab(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.openTab(&t); err != nil {
+			return nil, err
+		}
+		page.Tabs = append(page.Tabs, t)
+	}
+	return page, rows.Err()
+}
+
+// SessionStats computes the statistics for a session (or UnsortedSessionID).
+func (d *DB) SessionStats(libraryID, sessionID string) (*SessionStats, error) {
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
+	where, args := sessionTabsWhere(libraryID, sessionID)
+	rows, err := d.sql.Query(`SELECT st.library_id, st.url, st.colour, st.is_pinned FROM saved_tabs st WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := &SessionStats{ByColour: map[string]int{}, Domains: []DomainCount{}}
+	domains := map[string]int{}
+	for rows.Next() {
+		var libID, u string
+		var colour sql.NullString
+		var pinned int
+		if err := rows.Scan(&libID, &u, &colour, &pinned); err != nil {
+			return nil, err
+		}
+		if err := c.open(libID, []*string{&u}); err != nil {
+			return nil, err
+		}
+		stats.TabCount++
+		if pinned != 0 {
+			stats.PinnedCount++
+		}
+		if colour.Valid && colour.String != "" {
+			stats.ByColour[colour.String]++
+		} else {
+			stats.ByColour["none"]++
+		}
+		domains[DomainOf(u)]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for dom, n := range domains {
+		stats.Domains = append(stats.Domains, DomainCount{Domain: dom, Count: n})
+	}
+	sort.Slice(stats.Domains, func(i, j int) bool {
+		if stats.Domains[i].Count != stats.Domains[j].Count {
+			return stats.Domains[i].Count > stats.Domains[j].Count
+		}
+		return stats.Domains[i].Domain < stats.Domains[j].Domain
+	})
+	if sessionID != UnsortedSessionID {
+		if err := d.sql.QueryRow(`SELECT COUNT(*) FROM session_windows WHERE session_id = ?`, sessionID).Scan(&stats.WindowCount); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// DomainOf returns the host of rawURL without a leading "www.".
+// Non-URL values (about:blank, chrome://newtab) fall back to the scheme.
+func DomainOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if u.Host == "" {
+		if u.Scheme != "" {
+			return u.Scheme + ":"
+		}
+		return rawURL
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// GetLibrarySession returns session id only if it belongs to libraryID
+// (sql.ErrNoRows otherwise). UnsortedSessionID yields the virtual session.
+func (d *DB) GetLibrarySession(libraryID, id string) (*Session, error) {
+	if id == UnsortedSessionID {
+		return d.UnsortedSession(libraryID)
+	}
+	s, err := d.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+	if libraryID != "" && s.LibraryID != libraryID {
+		return nil, fmt.Errorf("session %s not in library %s: %w", id, libraryID, sql.ErrNoRows)
+	}
+	return s, nil
+}
+
+// prefixCols qualifies each column of a comma-separated list with alias.
+func prefixCols(alias, cols string) string {
+	parts := strings.Split(cols, ",")
+	for i, p := range parts {
+		parts[i] = alias + "." + strings.TrimSpace(p)
+	}
+	return strings.Join(parts, ", ")
+}
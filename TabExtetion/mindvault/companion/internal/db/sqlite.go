@@ -3,30 +3,102 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "modernc.org/sqlite" // register "sqlite" driver
+	"github.com/mindvault/companion/internal/backupfile"
+	"modernc.org/sqlite" // registers the "sqlite" driver
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
+// ErrInvalid marks caller mistakes (unknown child IDs, impossible moves, …) so
+// handlers can answer 400 instead of 500. Always wrapped with detail via %w.
+var ErrInvalid = errors.New("invalid request")
+
+// ErrConflict marks a write that collides with an existing row, such as a
+// new record whose ID is already taken, so handlers can answer 409.
+var ErrConflict = errors.New("conflict")
+
+// constraintCode returns the extended SQLite result code of a constraint
+// violation (sqlite3.SQLITE_CONSTRAINT_*), or 0 if err is not one.
+func constraintCode(err error) int {
+	var se *sqlite.Error
+	if errors.As(err, &se) && se.Code()&0xff == sqlite3.SQLITE_CONSTRAINT {
+		return se.Code()
+	}
+	return 0
+}
+
+// ConstraintKind classifies a constraint violation SQLite reported unwrapped:
+// ErrConflict for a taken key, ErrInvalid for a missing parent row (foreign
+// key), CHECK or NOT NULL. It returns nil for any other error.
+func ConstraintKind(err error) error {
+	switch constraintCode(err) {
+	case 0:
+		return nil
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		return ErrConflict
+	}
+	return ErrInvalid
+}
+
+// insertNew runs a plain INSERT of a record that must not exist yet and turns
+// a taken primary key into ErrConflict. The sync paths use INSERT OR IGNORE
+// instead, so re-pushing a record is harmless; a record created under a fresh
+// ID must never be dropped that way.
+func insertNew(ex execer, what, id, query string, args ...any) error {
+	_, err := ex.Exec(query, args...)
+	switch constraintCode(err) {
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		return fmt.Errorf("%w: %s %s already exists", ErrConflict, what, id)
+	}
+	return err
+}
+
 // DB wraps a sql.DB with MindVault-specific methods.
+// gate lets Restore swap sql out from under the HTTP layer: requests hold it
+// shared via Acquire, Restore holds it exclusively.
 type DB struct {
-	sql  *sql.DB
-	path string // absolute path to the db file ("" for in-memory)
+	sql   *sql.DB
+	path  string // absolute path to the db file ("" for in-memory)
+	gate  sync.RWMutex
+	sched atomic.Pointer[backupScheduler]    // set by StartBackupScheduler
+	enc   atomic.Pointer[backupfile.Options] // set by SetBackupOptions; nil = plain .sqlite
+	repl  atomic.Pointer[replicaSet]         // set by SetBackupTargets; nil = local only
+	keys  keyring                            // keys of unlocked encrypted libraries
+	jobs  jobRegistry                        // background jobs (rekey); in memory only
+
+	historyDays atomic.Int64                    // set by SetHistoryRetention; 0 = keep all
+	retention   atomic.Pointer[RetentionPolicy] // set by SetRetentionPolicy; nil = never prune
 }
 
 // BackupInfo describes a single database backup file.
+// Verified: the file passed PRAGMA integrity_check when it was written and
+// SHA256 (hex) was recorded alongside it. Backups taken before hot backups
+// existed have neither.
+// Target is LocalTarget for BackupDir(), else the name of the replica target
+// the file is stored on.
 type BackupInfo struct {
-	Filename  string `json:"filename"`
-	CreatedAt int64  `json:"createdAt"` // Unix ms
-	SizeBytes int64  `json:"sizeBytes"`
+	Filename   string `json:"filename"`
+	CreatedAt  int64  `json:"createdAt"` // Unix ms
+	SizeBytes  int64  `json:"sizeBytes"`
+	Verified   bool   `json:"verified"`
+	SHA256     string `json:"sha256,omitempty"`
+	Compressed bool   `json:"compressed"` // .sqlite.gz, or .sqlite.enc whose header records gzip
+	Encrypted  bool   `json:"encrypted"`  // .sqlite.enc — needs the backup passphrase
+	Target     string `json:"target"`
 }
 
 // Library mirrors the IndexedDB library shape.
@@ -38,10 +110,17 @@ type Library struct {
 	UpdatedAt    int64   `json:"updatedAt"`
 	IsEncrypted  bool    `json:"isEncrypted"`
 	PasswordSalt *string `json:"passwordSalt,omitempty"`
+	// ZeroKnowledge: encrypted by the extension and stored as opaque blobs
+	// (see library_blobs.go). Implies IsEncrypted.
+	ZeroKnowledge bool `json:"zeroKnowledge"`
+	// KeyHash: the key check value (migration 006). Never serialized; it is
+	// only compared on unlock (UnlockLibrary) or key check (VerifyKeyHash).
+	KeyHash *string `json:"-"`
 }
 
 // Session mirrors the IndexedDB session shape.
 // TabCount is computed via COUNT(saved_tabs WHERE session_id=s.id) — not stored.
+// WindowCount likewise counts session_windows rows.
 // SourceBrowser: originating browser e.g. "Chrome","Firefox","Edge","" (unknown).
 // Archived: soft-delete flag — false=active (normal), true=hidden unless requested.
 type Session struct {
@@ -51,9 +130,11 @@ type Session struct {
 	Notes         string `json:"notes"`
 	CreatedAt     int64  `json:"createdAt"`
 	UpdatedAt     int64  `json:"updatedAt"`
-	SourceBrowser string `json:"sourceBrowser"` // migration 002
-	Archived      bool   `json:"archived"`      // migration 002; stored as 0/1
-	TabCount      int    `json:"tabCount"`      // computed at query time, not stored
+	SourceBrowser string `json:"sourceBrowser"`     // migration 002
+	Archived      bool   `json:"archived"`          // migration 002; stored as 0/1
+	TabCount      int    `json:"tabCount"`          // computed at query time, not stored
+	WindowCount   int    `json:"windowCount"`       // computed from session_windows (migration 004)
+	Virtual       bool   `json:"virtual,omitempty"` // true only for the synthetic "Unsorted" session
 }
 
 // SessionPatch carries optional PATCH fields for UpdateSession.
@@ -66,10 +147,15 @@ type SessionPatch struct {
 // TabPatch carries optional PATCH fields for UpdateTab.
 // Only non-nil pointer fields are applied (partial update).
 type TabPatch struct {
-	Notes *string `json:"notes"` // new notes value; nil = no-op
+	Notes    *string `json:"notes"`    // new notes value; nil = no-op
+	IsPinned *bool   `json:"isPinned"` // migration 004 placement fields
+	WindowID *string `json:"windowId"`
+	GroupID  *string `json:"groupId"`
+	Index    *int    `json:"index"`
 }
 
 // Tab mirrors the IndexedDB savedTab shape.
+// WindowID/GroupID/TabIndex/IsPinned place the tab inside its session's window structure.
 // Fields SessionName, LibraryName, SourceBrowser are populated ONLY by ListAllTabs
 // (cross-library master view) via JOIN — they are omitted in per-library responses.
 type Tab struct {
@@ -82,6 +168,11 @@ type Tab struct {
 	SavedAt    int64   `json:"savedAt"`
 	Notes      string  `json:"notes"`
 	Colour     *string `json:"colour,omitempty"`
+	// Window / group placement (migration 004). nil window = "loose" tab.
+	WindowID *string `json:"windowId,omitempty"`
+	GroupID  *string `json:"groupId,omitempty"`
+	TabIndex int     `json:"index"`
+	IsPinned bool    `json:"isPinned"`
 	// Extra fields for master All-Tabs view (JOIN populated, nil in per-lib responses)
 	SessionName   *string `json:"sessionName,omitempty"`
 	LibraryName   *string `json:"libraryName,omitempty"`
@@ -98,9 +189,10 @@ type SearchResult struct {
 }
 
 // DefaultDBPath returns the platform-appropriate default database path.
-//   Windows: %APPDATA%\MindVault\db.sqlite
-//   macOS:   ~/Library/Application Support/MindVault/db.sqlite
-//   Linux:   ~/.local/share/MindVault/db.sqlite
+//
+//	Windows: %APPDATA%\MindVault\db.sqlite
+//	macOS:   ~/Library/Application Support/MindVault/db.sqlite
+//	Linux:   ~/.local/share/MindVault/db.sqlite
 func DefaultDBPath() string {
 	var base string
 	switch runtime.GOOS {
@@ -121,22 +213,43 @@ func Open(path string) (*DB, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return nil, fmt.Errorf("create db dir: %w", err)
 	}
-	sqlDB, err := sql.Open("sqlite", path+"?_journal_mode=WAL&_foreign_keys=on")
+	sqlDB, err := openFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
 	}
+	return newDB(sqlDB, path), nil
+}
+
+// newDB wraps an opened handle. Keys dropped by the unlock idle timer are
+// recorded in the audit log.
+func newDB(sqlDB *sql.DB, path string) *DB {
+	d := &DB{sql: sqlDB, path: path}
+	d.keys.onExpire = func(libID string) {
+		release := d.Acquire()
+		defer release()
+		_ = writeAudit(d.sql, libID, AuditLock, "idle timeout")
+	}
+	return d
+}
+
+// openFile opens the SQLite file at path with the daemon's connection settings.
+func openFile(path string) (*sql.DB, error) {
+	sqlDB, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
 	sqlDB.SetMaxOpenConns(1) // SQLite WAL supports one writer
-	return &DB{sql: sqlDB, path: path}, nil
+	return sqlDB, nil
 }
 
 // OpenInMemory opens a transient in-memory database for testing.
 func OpenInMemory() (*DB, error) {
-	sqlDB, err := sql.Open("sqlite", "file::memory:?_foreign_keys=on&cache=shared")
+	sqlDB, err := sql.Open("sqlite", "file::memory:?_pragma=foreign_keys(1)&cache=shared")
 	if err != nil {
 		return nil, fmt.Errorf("open in-memory sqlite: %w", err)
 	}
 	sqlDB.SetMaxOpenConns(1)
-	return &DB{sql: sqlDB}, nil
+	return newDB(sqlDB, ""), nil
 }
 
 // Close closes the underlying database connection.
@@ -155,52 +268,44 @@ func (d *DB) BackupDir() string {
 	return filepath.Join(filepath.Dir(d.path), "backups")
 }
 
-// Backup creates a timestamped copy of the database file in BackupDir(),
-// then removes backup files older than retainDays.
+// Backup writes a hot snapshot of the database (VACUUM INTO) to a timestamped
+// file in BackupDir(), verifies it with PRAGMA integrity_check and records its
+// SHA-256, then prunes with the retention policy (see SetRetentionPolicy).
+// Copies to the replica targets (see SetBackupTargets) are made in the
+// background. The snapshot is only moved into place once verified, so a
+// failed backup never leaves a file that ListBackups would offer for restore.
 // Returns the BackupInfo for the newly created file.
-func (d *DB) Backup(retainDays int) (BackupInfo, error) {
+func (d *DB) Backup() (BackupInfo, error) {
 	if d.path == "" {
 		return BackupInfo{}, fmt.Errorf("backup not supported for in-memory database")
 	}
-	if err := os.MkdirAll(d.BackupDir(), 0700); err != nil {
-		return BackupInfo{}, fmt.Errorf("create backup dir: %w", err)
-	}
-	// Flush WAL into the main file before copying.
-	if _, err := d.sql.Exec("PRAGMA wal_checkpoint(FULL)"); err != nil {
-		return BackupInfo{}, fmt.Errorf("wal checkpoint: %w", err)
-	}
-	filename := "mindvault-" + time.Now().UTC().Format("2006-01-02T15-04-05") + ".sqlite"
-	dest := filepath.Join(d.BackupDir(), filename)
-	if err := copyFile(d.path, dest); err != nil {
-		return BackupInfo{}, fmt.Errorf("copy db: %w", err)
-	}
-	fi, err := os.Stat(dest)
+	info, err := d.writeBackup(d.backupName(backupPrefix))
 	if err != nil {
-		return BackupInfo{}, fmt.Errorf("stat backup: %w", err)
+		return BackupInfo{}, err
 	}
-	// Clean up old backups (non-fatal).
-	_ = d.cleanOldBackups(retainDays)
-	return BackupInfo{
-		Filename:  filename,
-		CreatedAt: fi.ModTime().UnixMilli(),
-		SizeBytes: fi.Size(),
-	}, nil
+	if p := d.retention.Load(); p != nil {
+		if _, err := d.ApplyRetention(*p); err != nil {
+			slog.Warn("backup retention (non-fatal)", "err", err)
+		}
+	}
+	go d.replicate(context.Background(), info)
+	return info, nil
 }
 
 // AutoBackup takes a daily backup on daemon startup: if a backup whose filename
 // starts with today's date (UTC) already exists, it is a no-op.
-func (d *DB) AutoBackup(defaultRetain int) error {
+func (d *DB) AutoBackup() error {
 	if d.path == "" {
 		return nil
 	}
 	today := time.Now().UTC().Format("2006-01-02")
 	entries, _ := os.ReadDir(d.BackupDir()) // ok if dir doesn't exist yet
 	for _, e := range entries {
-		if strings.HasPrefix(e.Name(), "mindvault-"+today) && strings.HasSuffix(e.Name(), ".sqlite") {
+		if strings.HasPrefix(e.Name(), backupPrefix+today) && backupfile.IsBackupName(e.Name()) {
 			return nil // already backed up today
 		}
 	}
-	_, err := d.Backup(defaultRetain)
+	_, err := d.Backup()
 	return err
 }
 
@@ -218,68 +323,77 @@ func (d *DB) ListBackups() ([]BackupInfo, error) {
 	}
 	var infos []BackupInfo
 	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sqlite") {
+		if e.IsDir() || !backupfile.IsBackupName(e.Name()) {
 			continue
 		}
 		fi, err := e.Info()
 		if err != nil {
 			continue
 		}
+		sum := readChecksum(filepath.Join(d.BackupDir(), e.Name()))
 		infos = append(infos, BackupInfo{
-			Filename:  e.Name(),
-			CreatedAt: fi.ModTime().UnixMilli(),
-			SizeBytes: fi.Size(),
+			Filename:   e.Name(),
+			CreatedAt:  fi.ModTime().UnixMilli(),
+			SizeBytes:  fi.Size(),
+			Verified:   sum != "",
+			SHA256:     sum,
+			Compressed: d.backupCompressed(e.Name()),
+			Encrypted:  backupfile.IsEncrypted(e.Name()),
+			Target:     LocalTarget,
 		})
 	}
+	sortBackupsNewestFirst(infos)
+	return infos, nil
+}
+
+// sortBackupsNewestFirst orders infos by CreatedAt, newest first.
+func sortBackupsNewestFirst(infos []BackupInfo) {
 	sort.Slice(infos, func(i, j int) bool {
-		return infos[i].CreatedAt > infos[j].CreatedAt // newest first
+		return infos[i].CreatedAt > infos[j].CreatedAt
 	})
-	return infos, nil
 }
 
-// Restore replaces the live database file with the named backup file,
-// then reopens the connection in-place. The HTTP server keeps running.
-func (d *DB) Restore(filename string) error {
+// Restore replaces the live database with the named backup. The backup must
+// pass PRAGMA integrity_check and must not come from a newer schema than this
+// build knows. Before anything is touched a "pre-restore" backup of the current
+// state is written; then Restore waits for in-flight requests to drain (see
+// Acquire), blocks new ones, renames the backup into place, reopens and runs
+// Migrate. If any step after closing the live handle fails, the pre-restore
+// file is put back so the daemon keeps serving the data it had.
+// Returns the pre-restore backup's info. The HTTP server keeps running.
+func (d *DB) Restore(filename string) (BackupInfo, error) {
 	if d.path == "" {
-		return fmt.Errorf("restore not supported for in-memory database")
-	}
-	// Security: reject any path traversal attempt.
-	if filepath.Base(filename) != filename || !strings.HasSuffix(filename, ".sqlite") {
-		return fmt.Errorf("invalid backup filename")
+		return BackupInfo{}, fmt.Errorf("restore not supported for in-memory database")
 	}
-	src := filepath.Join(d.BackupDir(), filename)
-	if _, err := os.Stat(src); err != nil {
-		return fmt.Errorf("backup not found: %w", err)
+	src, cleanup, err := d.openBackup(filename)
+	if err != nil {
+		return BackupInfo{}, err
 	}
-	// Flush WAL before closing.
-	_, _ = d.sql.Exec("PRAGMA wal_checkpoint(FULL)")
-	if err := d.sql.Close(); err != nil {
-		return fmt.Errorf("close db: %w", err)
+	defer cleanup()
+
+	d.gate.Lock()
+	defer d.gate.Unlock()
+
+	pre, err := d.writeBackup(d.backupName(preRestorePrefix))
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("pre-restore backup: %w", err)
 	}
-	if err := copyFile(src, d.path); err != nil {
-		// Best-effort reopen even if copy failed.
-		sqlDB, _ := sql.Open("sqlite", d.path+"?_journal_mode=WAL&_foreign_keys=on")
-		if sqlDB != nil {
-			sqlDB.SetMaxOpenConns(1)
-			d.sql = sqlDB
+	if err := d.swapFile(src); err != nil {
+		rbErr := d.rollbackTo(pre.Filename)
+		if rbErr != nil {
+			return pre, fmt.Errorf("restore: %v; rollback to %s failed: %w", err, pre.Filename, rbErr)
 		}
-		return fmt.Errorf("copy backup: %w", err)
-	}
-	sqlDB, err := sql.Open("sqlite", d.path+"?_journal_mode=WAL&_foreign_keys=on")
-	if err != nil {
-		return fmt.Errorf("reopen db: %w", err)
+		return pre, fmt.Errorf("restore rolled back to %s: %w", pre.Filename, err)
 	}
-	sqlDB.SetMaxOpenConns(1)
-	d.sql = sqlDB
-	return nil
+	return pre, nil
 }
 
-// DeleteBackup removes a backup file by name.
+// DeleteBackup removes a backup file (and its checksum sidecar) by name.
 func (d *DB) DeleteBackup(filename string) error {
-	if filepath.Base(filename) != filename || !strings.HasSuffix(filename, ".sqlite") {
+	if filepath.Base(filename) != filename || !backupfile.IsBackupName(filename) {
 		return fmt.Errorf("invalid backup filename")
 	}
-	return os.Remove(filepath.Join(d.BackupDir(), filename))
+	return removeBackupFile(filepath.Join(d.BackupDir(), filename))
 }
 
 // copyFile copies src to dst atomically (write to temp, then rename).
@@ -306,65 +420,139 @@ func copyFile(src, dst string) error {
 	return os.Rename(tmp, dst)
 }
 
-// cleanOldBackups deletes backup files older than retainDays days.
-func (d *DB) cleanOldBackups(retainDays int) error {
-	cutoff := time.Now().UTC().AddDate(0, 0, -retainDays)
-	entries, err := os.ReadDir(d.BackupDir())
-	if err != nil {
-		return err
-	}
-	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sqlite") {
-			continue
-		}
-		fi, err := e.Info()
-		if err != nil {
-			continue
-		}
-		if fi.ModTime().Before(cutoff) {
-			_ = os.Remove(filepath.Join(d.BackupDir(), e.Name()))
+// CreateLibrary inserts a new library record. An encrypted library without a
+// salt gets a random one for its key derivation; a zero-knowledge library
+// keeps whatever salt and key hash the extension supplied, since only it
+// derives the key. Other libraries get their key hash on first unlock.
+func (d *DB) CreateLibrary(l Library) error {
+	if l.ZeroKnowledge {
+		l.IsEncrypted = true
+	} else {
+		l.KeyHash = nil
+		if l.IsEncrypted && (l.PasswordSalt == nil || *l.PasswordSalt == "") {
+			salt, err := newSalt()
+			if err != nil {
+				return err
+			}
+			l.PasswordSalt = &salt
 		}
 	}
-	return nil
-}
-
-// CreateLibrary inserts a new library record.
-func (d *DB) CreateLibrary(l Library) error {
 	_, err := d.sql.Exec(
-		`INSERT INTO libraries (id, name, description, created_at, updated_at, is_encrypted, password_salt)
-		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		l.ID, l.Name, l.Description, l.CreatedAt, l.UpdatedAt, l.IsEncrypted, l.PasswordSalt,
+		`INSERT INTO libraries (id, name, description, created_at, updated_at, is_encrypted, password_salt, zero_knowledge, key_hash)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		l.ID, l.Name, l.Description, l.CreatedAt, l.UpdatedAt, l.IsEncrypted, l.PasswordSalt, l.ZeroKnowledge, l.KeyHash,
 	)
 	return err
 }
 
+// execer is satisfied by both *sql.DB and *sql.Tx so insert helpers can run
+// standalone or as one step of a larger transaction (merge, split, …).
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// querier is the read-side counterpart of execer.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
 // CreateSession inserts a new session record.
 // SourceBrowser and Archived are stored from migration 002 columns.
 func (d *DB) CreateSession(s Session) error {
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return err
+	}
+	if err := c.sealSession(&s); err != nil {
+		return err
+	}
+	return createSession(d.sql, s)
+}
+
+// sessionInsert is the INSERT tail shared by createSession and addSession.
+const sessionInsert = ` INTO sessions
+		   (id, library_id, name, notes, created_at, updated_at, source_browser, archived)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+func sessionArgs(s Session) []any {
 	archivedInt := 0
 	if s.Archived {
 		archivedInt = 1
 	}
-	_, err := d.sql.Exec(
-		`INSERT OR IGNORE INTO sessions
-		   (id, library_id, name, notes, created_at, updated_at, source_browser, archived)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		s.ID, s.LibraryID, s.Name, s.Notes, s.CreatedAt, s.UpdatedAt,
-		s.SourceBrowser, archivedInt,
-	)
+	return []any{s.ID, s.LibraryID, s.Name, s.Notes, s.CreatedAt, s.UpdatedAt,
+		s.SourceBrowser, archivedInt}
+}
+
+// createSession is the execer-generic core of CreateSession.
+func createSession(ex execer, s Session) error {
+	_, err := ex.Exec(`INSERT OR IGNORE`+sessionInsert, sessionArgs(s)...)
 	return err
 }
 
-// CreateTab inserts a new saved_tab record.
+// addSession inserts a session created under a new ID (merge, split); a
+// taken ID is an ErrConflict.
+func addSession(ex execer, s Session) error {
+	return insertNew(ex, "session", s.ID, `INSERT`+sessionInsert, sessionArgs(s)...)
+}
+
+// CreateTab inserts a new saved_tab record. Its window and group, if any,
+// must belong to its session (ErrInvalid).
 func (d *DB) CreateTab(t Tab) error {
-	_, err := d.sql.Exec(
-		`INSERT OR IGNORE INTO saved_tabs (id, library_id, session_id, url, title, fav_icon_url, saved_at, notes, colour)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		t.ID, t.LibraryID, t.SessionID, t.URL, t.Title, t.FavIconURL, t.SavedAt, t.Notes, t.Colour,
-	)
+	if err := checkPlacement(d.sql, t.SessionID, t.WindowID, t.GroupID); err != nil {
+		return err
+	}
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return err
+	}
+	if err := c.sealTab(&t); err != nil {
+		return err
+	}
+	return createTab(d.sql, t)
+}
+
+// tabCols is the saved_tabs column list shared by inserts and scanTab.
+const tabCols = `id, library_id, session_id, url, title, fav_icon_url, saved_at, notes, colour,
+	window_id, group_id, tab_index, is_pinned`
+
+// scanTab reads one tabCols row; extra receives any trailing JOIN columns.
+func scanTab(row rowScanner, extra ...any) (Tab, error) {
+	var t Tab
+	var pinned int
+	dest := []any{&t.ID, &t.LibraryID, &t.SessionID, &t.URL, &t.Title, &t.FavIconURL, &t.SavedAt, &t.Notes, &t.Colour,
+		&t.WindowID, &t.GroupID, &t.TabIndex, &pinned}
+	err := row.Scan(append(dest, extra...)...)
+	t.IsPinned = pinned != 0
+	return t, err
+}
+
+// tabInsert is the INSERT tail shared by createTab and addTab.
+const tabInsert = ` INTO saved_tabs (` + tabCols + `)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+func tabArgs(t Tab) []any {
+	return []any{t.ID, t.LibraryID, t.SessionID, t.URL, t.Title, t.FavIconURL, t.SavedAt, t.Notes, t.Colour,
+		t.WindowID, t.GroupID, t.TabIndex, t.IsPinned}
+}
+
+// createTab is the execer-generic core of CreateTab.
+func createTab(ex execer, t Tab) error {
+	_, err := ex.Exec(`INSERT OR IGNORE`+tabInsert, tabArgs(t)...)
 	return err
 }
 
+// addTab inserts a tab that must not exist yet (a tab re-inserted by merge or
+// split after its old row was deleted); a taken ID is an ErrConflict.
+func addTab(ex execer, t Tab) error {
+	return insertNew(ex, "tab", t.ID, `INSERT`+tabInsert, tabArgs(t)...)
+}
+
 // Migrate runs all pending migrations.
 func (d *DB) Migrate() error {
 	return migrate(d.sql)
@@ -372,7 +560,7 @@ func (d *DB) Migrate() error {
 
 // ListLibraries returns all libraries.
 func (d *DB) ListLibraries() ([]Library, error) {
-	rows, err := d.sql.Query(`SELECT id, name, description, created_at, updated_at, is_encrypted, password_salt FROM libraries ORDER BY created_at`)
+	rows, err := d.sql.Query(`SELECT id, name, description, created_at, updated_at, is_encrypted, password_salt, zero_knowledge, key_hash FROM libraries ORDER BY created_at`)
 	if err != nil {
 		return nil, err
 	}
@@ -380,7 +568,7 @@ func (d *DB) ListLibraries() ([]Library, error) {
 	var libs []Library
 	for rows.Next() {
 		var l Library
-		if err := rows.Scan(&l.ID, &l.Name, &l.Description, &l.CreatedAt, &l.UpdatedAt, &l.IsEncrypted, &l.PasswordSalt); err != nil {
+		if err := rows.Scan(&l.ID, &l.Name, &l.Description, &l.CreatedAt, &l.UpdatedAt, &l.IsEncrypted, &l.PasswordSalt, &l.ZeroKnowledge, &l.KeyHash); err != nil {
 			return nil, err
 		}
 		libs = append(libs, l)
@@ -390,29 +578,30 @@ func (d *DB) ListLibraries() ([]Library, error) {
 
 // GetLibrary returns a library by ID.
 func (d *DB) GetLibrary(id string) (*Library, error) {
-	row := d.sql.QueryRow(`SELECT id, name, description, created_at, updated_at, is_encrypted, password_salt FROM libraries WHERE id = ?`, id)
+	row := d.sql.QueryRow(`SELECT id, name, description, created_at, updated_at, is_encrypted, password_salt, zero_knowledge, key_hash FROM libraries WHERE id = ?`, id)
 	var l Library
-	if err := row.Scan(&l.ID, &l.Name, &l.Description, &l.CreatedAt, &l.UpdatedAt, &l.IsEncrypted, &l.PasswordSalt); err != nil {
+	if err := row.Scan(&l.ID, &l.Name, &l.Description, &l.CreatedAt, &l.UpdatedAt, &l.IsEncrypted, &l.PasswordSalt, &l.ZeroKnowledge, &l.KeyHash); err != nil {
 		return nil, err
 	}
 	return &l, nil
 }
 
 // sessionScanCols is the SELECT column list shared by ListSessions and ListAllSessions.
-// tab_count is computed via a correlated subquery (always accurate, no denorm drift).
+// tab_count and window_count are computed via a correlated subquery (always accurate, no denorm drift).
 // archived is returned as an integer and converted to bool after scan.
 const sessionScanCols = `
 	s.id, s.library_id, s.name, s.notes, s.created_at, s.updated_at,
 	s.source_browser, s.archived,
-	(SELECT COUNT(*) FROM saved_tabs t WHERE t.session_id = s.id) AS tab_count`
+	(SELECT COUNT(*) FROM saved_tabs t WHERE t.session_id = s.id) AS tab_count,
+	(SELECT COUNT(*) FROM session_windows w WHERE w.session_id = s.id) AS window_count`
 
-// scanSession reads one session row from a *sql.Rows. archivedInt is converted to bool.
-func scanSession(rows *sql.Rows) (Session, error) {
+// scanSession reads one session row from a *sql.Rows or *sql.Row. archivedInt is converted to bool.
+func scanSession(rows rowScanner) (Session, error) {
 	var s Session
 	var archivedInt int
 	err := rows.Scan(
 		&s.ID, &s.LibraryID, &s.Name, &s.Notes, &s.CreatedAt, &s.UpdatedAt,
-		&s.SourceBrowser, &archivedInt, &s.TabCount,
+		&s.SourceBrowser, &archivedInt, &s.TabCount, &s.WindowCount,
 	)
 	s.Archived = archivedInt != 0
 	return s, err
@@ -428,6 +617,13 @@ func (d *DB) ListSessions(libraryID string, includeArchived bool) ([]Session, er
 		q += ` AND s.archived = 0`
 	}
 	q += ` ORDER BY s.created_at DESC`
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.aead(libraryID); err != nil {
+		return nil, err
+	}
 	rows, err := d.sql.Query(q, libraryID)
 	if err != nil {
 		return nil, err
@@ -439,6 +635,9 @@ func (d *DB) ListSessions(libraryID string, includeArchived bool) ([]Session, er
 		if err != nil {
 			return nil, err
 		}
+		if err := c.openSession(&s); err != nil {
+			return nil, err
+		}
 		sessions = append(sessions, s)
 	}
 	return sessions, rows.Err()
@@ -447,6 +646,7 @@ func (d *DB) ListSessions(libraryID string, includeArchived bool) ([]Session, er
 // ListAllSessions returns all sessions across all libraries (master view), newest first.
 // Includes library name via JOIN for display in the master sessions list.
 // includeArchived controls whether archived sessions are included.
+// Sessions of locked libraries are left out.
 func (d *DB) ListAllSessions(includeArchived bool) ([]Session, error) {
 	q := `SELECT` + sessionScanCols + `
 	      FROM sessions s`
@@ -454,6 +654,10 @@ func (d *DB) ListAllSessions(includeArchived bool) ([]Session, error) {
 		q += ` WHERE s.archived = 0`
 	}
 	q += ` ORDER BY s.created_at DESC`
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := d.sql.Query(q)
 	if err != nil {
 		return nil, err
@@ -465,16 +669,62 @@ func (d *DB) ListAllSessions(includeArchived bool) ([]Session, error) {
 		if err != nil {
 			return nil, err
 		}
+		if !c.readable(s.LibraryID) {
+			continue
+		}
+		if err := c.openSession(&s); err != nil {
+			return nil, err
+		}
 		sessions = append(sessions, s)
 	}
 	return sessions, rows.Err()
 }
 
-// UpdateSession applies a partial patch to a session.
+// GetSession returns a single session by ID (sql.ErrNoRows if missing,
+// ErrLocked if its library is locked).
+func (d *DB) GetSession(id string) (*Session, error) {
+	return d.getOpenSession(d.sql, id)
+}
+
+// getOpenSession is getSession with the session's fields decrypted.
+func (d *DB) getOpenSession(q querier, id string) (*Session, error) {
+	c, err := d.crypter(q)
+	if err != nil {
+		return nil, err
+	}
+	s, err := getSession(q, id)
+	if err != nil {
+		return nil, err
+	}
+	return s, c.openSession(s)
+}
+
+// getSession is the querier-generic core of GetSession.
+func getSession(q querier, id string) (*Session, error) {
+	s, err := scanSession(q.QueryRow(`SELECT`+sessionScanCols+`
+	      FROM sessions s WHERE s.id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UpdateSession applies a partial patch to session id of library libID.
 // Nil pointer fields in SessionPatch are not updated (partial update semantics).
 // Always updates updated_at to the current time.
-func (d *DB) UpdateSession(id string, p SessionPatch) error {
+// Returns sql.ErrNoRows (wrapped) if the session is not in that library.
+func (d *DB) UpdateSession(libID, id string, p SessionPatch) error {
+	if err := inLibrary(d.sql, "sessions", "session", libID, id); err != nil {
+		return err
+	}
 	now := time.Now().UnixMilli()
+	if p.Name != nil {
+		name, err := d.sealColumn("sessions", id, *p.Name)
+		if err != nil {
+			return err
+		}
+		p.Name = &name
+	}
 	switch {
 	case p.Name != nil && p.Archived != nil:
 		archivedInt := 0
@@ -482,14 +732,14 @@ func (d *DB) UpdateSession(id string, p SessionPatch) error {
 			archivedInt = 1
 		}
 		_, err := d.sql.Exec(
-			`UPDATE sessions SET name=?, archived=?, updated_at=? WHERE id=?`,
-			*p.Name, archivedInt, now, id,
+			`UPDATE sessions SET name=?, archived=?, updated_at=? WHERE id=? AND library_id=?`,
+			*p.Name, archivedInt, now, id, libID,
 		)
 		return err
 	case p.Name != nil:
 		_, err := d.sql.Exec(
-			`UPDATE sessions SET name=?, updated_at=? WHERE id=?`,
-			*p.Name, now, id,
+			`UPDATE sessions SET name=?, updated_at=? WHERE id=? AND library_id=?`,
+			*p.Name, now, id, libID,
 		)
 		return err
 	case p.Archived != nil:
@@ -498,8 +748,8 @@ func (d *DB) UpdateSession(id string, p SessionPatch) error {
 			archivedInt = 1
 		}
 		_, err := d.sql.Exec(
-			`UPDATE sessions SET archived=?, updated_at=? WHERE id=?`,
-			archivedInt, now, id,
+			`UPDATE sessions SET archived=?, updated_at=? WHERE id=? AND library_id=?`,
+			archivedInt, now, id, libID,
 		)
 		return err
 	}
@@ -507,31 +757,78 @@ func (d *DB) UpdateSession(id string, p SessionPatch) error {
 }
 
 // UpdateTab applies a TabPatch to a saved_tab row.
-// Currently supports notes only; add more fields to TabPatch as needed.
-// Returns nil immediately if no fields are set (no-op). Returns SQL error on failure.
+// Only non-nil fields are written. Returns nil immediately if no fields are set
+// (no-op). Returns SQL error on failure. An empty-string WindowID / GroupID
+// clears the placement (tab becomes loose / ungrouped); a window or group of
+// another session is ErrInvalid.
 //
 // @param id  UUID of the tab row to update.
-// @param p   TabPatch with optional Notes pointer.
+// @param p   TabPatch with optional Notes / placement pointers.
 func (d *DB) UpdateTab(id string, p TabPatch) error {
-	if p.Notes == nil {
+	var sets []string
+	var args []any
+	if p.Notes != nil {
+		notes, err := d.sealColumn("saved_tabs", id, *p.Notes)
+		if err != nil {
+			return err
+		}
+		sets, args = append(sets, "notes=?"), append(args, notes)
+	}
+	if p.IsPinned != nil {
+		sets, args = append(sets, "is_pinned=?"), append(args, *p.IsPinned)
+	}
+	if p.WindowID != nil || p.GroupID != nil {
+		var sessionID *string
+		if err := d.sql.QueryRow(`SELECT session_id FROM saved_tabs WHERE id=?`, id).Scan(&sessionID); err != nil {
+			return fmt.Errorf("tab %s: %w", id, err)
+		}
+		if err := checkPlacement(d.sql, sessionID, p.WindowID, p.GroupID); err != nil {
+			return err
+		}
+	}
+	if p.WindowID != nil {
+		sets, args = append(sets, "window_id=?"), append(args, nullIfEmpty(*p.WindowID))
+	}
+	if p.GroupID != nil {
+		sets, args = append(sets, "group_id=?"), append(args, nullIfEmpty(*p.GroupID))
+	}
+	if p.Index != nil {
+		sets, args = append(sets, "tab_index=?"), append(args, *p.Index)
+	}
+	if len(sets) == 0 {
 		return nil // nothing to update
 	}
-	_, err := d.sql.Exec(`UPDATE saved_tabs SET notes=? WHERE id=?`, *p.Notes, id)
+	_, err := d.sql.Exec(`UPDATE saved_tabs SET `+strings.Join(sets, ", ")+` WHERE id=?`, append(args, id)...)
 	return err
 }
 
-// DeleteSessionWithTabs removes a session AND all its saved_tabs in a single transaction.
+// nullIfEmpty maps "" to SQL NULL for optional reference columns.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// DeleteSessionWithTabs removes session id of library libID AND all its saved_tabs in a single transaction.
 // Use this for "Delete all data" — more destructive than DeleteSession which keeps tabs.
 // Tabs are deleted first to avoid FK constraint issues.
-func (d *DB) DeleteSessionWithTabs(id string) error {
+// Returns sql.ErrNoRows (wrapped) if the session is not in that library.
+func (d *DB) DeleteSessionWithTabs(libID, id string) error {
 	tx, err := d.sql.Begin()
 	if err != nil {
 		return err
 	}
 	defer func() { _ = tx.Rollback() }()
+	if err := inLibrary(tx, "sessions", "session", libID, id); err != nil {
+		return err
+	}
 	if _, err := tx.Exec(`DELETE FROM saved_tabs WHERE session_id = ?`, id); err != nil {
 		return err
 	}
+	if err := deleteSessionStructure(tx, id); err != nil {
+		return err
+	}
 	if _, err := tx.Exec(`DELETE FROM sessions WHERE id = ?`, id); err != nil {
 		return err
 	}
@@ -541,14 +838,20 @@ func (d *DB) DeleteSessionWithTabs(id string) error {
 // ListAllTabs returns all saved_tabs across all libraries (master view), newest first.
 // JOINs with sessions and libraries to populate SessionName, LibraryName, SourceBrowser.
 // Used by the companion UI "All Tabs" master page for the full-column table view.
+// Tabs of locked libraries are left out.
 //
 // @why  Master All-Tabs page needs session name, library name, and browser column.
 // @how  LEFT JOIN sessions + libraries; NULL-safe scan into *string pointers.
 func (d *DB) ListAllTabs() ([]Tab, error) {
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := d.sql.Query(`
 		SELECT
 			st.id, st.library_id, st.session_id, st.url, st.title,
 			st.fav_icon_url, st.saved_at, st.notes, st.colour,
+			st.window_id, st.group_id, st.tab_index, st.is_pinned,
 			s.name         AS session_name,
 			l.name         AS library_name,
 			s.source_browser
@@ -562,12 +865,16 @@ func (d *DB) ListAllTabs() ([]Tab, error) {
 	defer rows.Close()
 	var tabs []Tab
 	for rows.Next() {
-		var t Tab
-		if err := rows.Scan(
-			&t.ID, &t.LibraryID, &t.SessionID, &t.URL, &t.Title,
-			&t.FavIconURL, &t.SavedAt, &t.Notes, &t.Colour,
-			&t.SessionName, &t.LibraryName, &t.SourceBrowser,
-		); err != nil {
+		var sessionName, libraryName, sourceBrowser *string
+		t, err := scanTab(rows, &sessionName, &libraryName, &sourceBrowser)
+		if err != nil {
+			return nil, err
+		}
+		t.SessionName, t.LibraryName, t.SourceBrowser = sessionName, libraryName, sourceBrowser
+		if !c.readable(t.LibraryID) {
+			continue
+		}
+		if err := c.openTab(&t); err != nil {
 			return nil, err
 		}
 		tabs = append(tabs, t)
@@ -614,7 +921,7 @@ func OsUsername() string {
 // Delegates to MigrateDefaultLibraryNamesAs(OsUsername()) for testability.
 //
 // @why   Source-browser auto-rename only fires on new session pushes; libraries
-//        created before v4.1.0 or when daemon was offline were never renamed.
+// created before v4.1.0 or when daemon was offline were never renamed.
 // @where Called once in main.go immediately after database.Migrate().
 // @when  Daemon startup — idempotent; safe to call every start.
 func (d *DB) MigrateDefaultLibraryNames() error {
@@ -677,15 +984,25 @@ func (d *DB) MigrateDefaultLibraryNamesAs(username string) error {
 
 // ListTabs returns saved tabs for a library.
 func (d *DB) ListTabs(libraryID string) ([]Tab, error) {
-	rows, err := d.sql.Query(`SELECT id, library_id, session_id, url, title, fav_icon_url, saved_at, notes, colour FROM saved_tabs WHERE library_id = ? ORDER BY saved_at DESC`, libraryID)
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.aead(libraryID); err != nil {
+		return nil, err
+	}
+	rows, err := d.sql.Query(`SELECT `+tabCols+` FROM saved_tabs WHERE library_id = ? ORDER BY saved_at DESC`, libraryID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var tabs []Tab
 	for rows.Next() {
-		var t Tab
-		if err := rows.Scan(&t.ID, &t.LibraryID, &t.SessionID, &t.URL, &t.Title, &t.FavIconURL, &t.SavedAt, &t.Notes, &t.Colour); err != nil {
+		t, err := scanTab(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.openTab(&t); err != nil {
 			return nil, err
 		}
 		tabs = append(tabs, t)
@@ -695,15 +1012,31 @@ func (d *DB) ListTabs(libraryID string) ([]Tab, error) {
 
 // Search performs a LIKE search across tabs, bookmarks, and history entries.
 // If libraryID is empty, searches across all libraries.
+// Encrypted libraries cannot be matched in SQL: while unlocked their rows are
+// decrypted and matched in memory; while locked a search scoped to one
+// returns ErrLocked and an unscoped search skips it. Zero-knowledge libraries
+// hold nothing the companion can read: scoped to one, Search returns
+// ErrZeroKnowledge; unscoped, they are skipped.
 func (d *DB) Search(libraryID, query string) ([]SearchResult, error) {
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
+	if c.zk[libraryID] {
+		return nil, fmt.Errorf("%w: %s cannot be searched by the companion, search it in the extension", ErrZeroKnowledge, libraryID)
+	}
+	if _, err := c.aead(libraryID); err != nil {
+		return nil, err
+	}
 	like := "%" + query + "%"
 	var results []SearchResult
+	const plainOnly = ` AND library_id NOT IN (SELECT id FROM libraries WHERE is_encrypted = 1)`
 
 	// ── tabs ──────────────────────────────────────────────────────────────────
 	rows, err := d.sql.Query(`
 		SELECT 'tab', id, IFNULL(title,''), IFNULL(url,''), notes
 		FROM saved_tabs
-		WHERE (? = '' OR library_id = ?) AND (title LIKE ? OR url LIKE ? OR notes LIKE ?)
+		WHERE (? = '' OR library_id = ?) AND (title LIKE ? OR url LIKE ? OR notes LIKE ?)`+plainOnly+`
 		LIMIT 30`,
 		libraryID, libraryID, like, like, like)
 	if err != nil {
@@ -728,7 +1061,7 @@ func (d *DB) Search(libraryID, query string) ([]SearchResult, error) {
 	brows, err := d.sql.Query(`
 		SELECT 'bookmark', id, IFNULL(title,''), IFNULL(url,''), notes
 		FROM bookmarks
-		WHERE (? = '' OR library_id = ?) AND (title LIKE ? OR url LIKE ? OR notes LIKE ?) AND is_folder = 0
+		WHERE (? = '' OR library_id = ?) AND (title LIKE ? OR url LIKE ? OR notes LIKE ?) AND is_folder = 0`+plainOnly+`
 		LIMIT 20`,
 		libraryID, libraryID, like, like, like)
 	if err != nil {
@@ -753,7 +1086,7 @@ func (d *DB) Search(libraryID, query string) ([]SearchResult, error) {
 	hrows, err := d.sql.Query(`
 		SELECT 'history', id, IFNULL(title,''), url, ''
 		FROM history_entries
-		WHERE (? = '' OR library_id = ?) AND (title LIKE ? OR url LIKE ?)
+		WHERE (? = '' OR library_id = ?) AND (title LIKE ? OR url LIKE ?)`+plainOnly+`
 		LIMIT 20`,
 		libraryID, libraryID, like, like)
 	if err != nil {
@@ -769,7 +1102,10 @@ func (d *DB) Search(libraryID, query string) ([]SearchResult, error) {
 		results = append(results, r)
 	}
 	hrows.Close()
-	return results, hrows.Err()
+	if err := hrows.Err(); err != nil {
+		return nil, err
+	}
+	return d.searchEncrypted(c, libraryID, query, results)
 }
 
 // ─── Bookmark ─────────────────────────────────────────────────────────────────
@@ -785,36 +1121,88 @@ type Bookmark struct {
 	Colour    *string `json:"colour,omitempty"`
 	CreatedAt int64   `json:"createdAt"`
 	IsFolder  bool    `json:"isFolder"`
+	SortOrder int     `json:"sortOrder"` // position among siblings (migration 003)
 }
 
 // CreateBookmark inserts a new bookmark record. Ignores duplicate IDs (INSERT OR IGNORE).
 func (d *DB) CreateBookmark(b Bookmark) error {
-	_, err := d.sql.Exec(
-		`INSERT OR IGNORE INTO bookmarks (id, library_id, parent_id, title, url, notes, colour, created_at, is_folder)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		b.ID, b.LibraryID, b.ParentID, b.Title, b.URL, b.Notes, b.Colour, b.CreatedAt, b.IsFolder,
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return err
+	}
+	if err := c.sealBookmark(&b); err != nil {
+		return err
+	}
+	return createBookmark(d.sql, b)
+}
+
+// createBookmark is the execer-generic core of CreateBookmark.
+func createBookmark(ex execer, b Bookmark) error {
+	_, err := ex.Exec(
+		`INSERT OR IGNORE INTO bookmarks (id, library_id, parent_id, title, url, notes, colour, created_at, is_folder, sort_order)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.ID, b.LibraryID, b.ParentID, b.Title, b.URL, b.Notes, b.Colour, b.CreatedAt, b.IsFolder, b.SortOrder,
 	)
 	return err
 }
 
+// NextBookmarkSortOrder returns the sort_order that appends a new bookmark
+// after the last existing child of parentID (nil = library root).
+func (d *DB) NextBookmarkSortOrder(libraryID string, parentID *string) (int, error) {
+	var n int
+	err := d.sql.QueryRow(
+		`SELECT IFNULL(MAX(sort_order) + 1, 0) FROM bookmarks WHERE library_id = ? AND parent_id IS ?`,
+		libraryID, parentID).Scan(&n)
+	return n, err
+}
+
+// bookmarkCols is the SELECT column list read by scanBookmark.
+const bookmarkCols = `id, library_id, parent_id, title, url, notes, colour, created_at, is_folder, sort_order`
+
+// scanBookmark reads one bookmarkCols row. is_folder is converted to bool.
+func scanBookmark(row rowScanner) (Bookmark, error) {
+	var b Bookmark
+	var isFolder int
+	err := row.Scan(&b.ID, &b.LibraryID, &b.ParentID, &b.Title, &b.URL, &b.Notes, &b.Colour, &b.CreatedAt, &isFolder, &b.SortOrder)
+	b.IsFolder = isFolder == 1
+	return b, err
+}
+
 // ListBookmarks returns all bookmarks for a library ordered by created_at.
 func (d *DB) ListBookmarks(libraryID string) ([]Bookmark, error) {
-	rows, err := d.sql.Query(
-		`SELECT id, library_id, parent_id, title, url, notes, colour, created_at, is_folder
-		 FROM bookmarks WHERE library_id = ? ORDER BY created_at`,
-		libraryID)
+	return d.listOpenBookmarks(d.sql, libraryID, `ORDER BY created_at`)
+}
+
+// listOpenBookmarks is listBookmarks with the rows decrypted.
+func (d *DB) listOpenBookmarks(q querier, libraryID, order string) ([]Bookmark, error) {
+	c, err := d.crypter(q)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.aead(libraryID); err != nil {
+		return nil, err
+	}
+	items, err := listBookmarks(q, libraryID, order)
+	if err != nil {
+		return nil, err
+	}
+	return items, c.openBookmarks(items)
+}
+
+// listBookmarks is the querier-generic core of ListBookmarks; order is the
+// trailing ORDER BY clause.
+func listBookmarks(q querier, libraryID, order string) ([]Bookmark, error) {
+	rows, err := q.Query(`SELECT `+bookmarkCols+` FROM bookmarks WHERE library_id = ? `+order, libraryID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var items []Bookmark
 	for rows.Next() {
-		var b Bookmark
-		var isFolder int
-		if err := rows.Scan(&b.ID, &b.LibraryID, &b.ParentID, &b.Title, &b.URL, &b.Notes, &b.Colour, &b.CreatedAt, &isFolder); err != nil {
+		b, err := scanBookmark(rows)
+		if err != nil {
 			return nil, err
 		}
-		b.IsFolder = isFolder == 1
 		items = append(items, b)
 	}
 	return items, rows.Err()
@@ -835,7 +1223,14 @@ type HistoryEntry struct {
 
 // UpsertHistoryEntry inserts a history entry, ignoring duplicates (same ID).
 func (d *DB) UpsertHistoryEntry(h HistoryEntry) error {
-	_, err := d.sql.Exec(
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return err
+	}
+	if err := c.sealHistory(&h); err != nil {
+		return err
+	}
+	_, err = d.sql.Exec(
 		`INSERT OR IGNORE INTO history_entries (id, library_id, url, title, visit_time, domain, is_important)
 		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
 		h.ID, h.LibraryID, h.URL, h.Title, h.VisitTime, h.Domain, h.IsImportant,
@@ -845,6 +1240,13 @@ func (d *DB) UpsertHistoryEntry(h HistoryEntry) error {
 
 // ListHistory returns history entries for a library ordered newest-first. Capped at 500.
 func (d *DB) ListHistory(libraryID string) ([]HistoryEntry, error) {
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.aead(libraryID); err != nil {
+		return nil, err
+	}
 	rows, err := d.sql.Query(
 		`SELECT id, library_id, url, IFNULL(title,''), visit_time, domain, is_important
 		 FROM history_entries WHERE library_id = ? ORDER BY visit_time DESC LIMIT 500`,
@@ -861,6 +1263,9 @@ func (d *DB) ListHistory(libraryID string) ([]HistoryEntry, error) {
 			return nil, err
 		}
 		h.IsImportant = isImportant == 1
+		if err := c.openHistory(&h); err != nil {
+			return nil, err
+		}
 		items = append(items, h)
 	}
 	return items, rows.Err()
@@ -883,7 +1288,14 @@ type Download struct {
 
 // CreateDownload inserts a new download record. Ignores duplicate IDs.
 func (d *DB) CreateDownload(dl Download) error {
-	_, err := d.sql.Exec(
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return err
+	}
+	if err := c.sealDownload(&dl); err != nil {
+		return err
+	}
+	_, err = d.sql.Exec(
 		`INSERT OR IGNORE INTO downloads (id, library_id, filename, url, mime_type, file_size, downloaded_at, state, notes)
 		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		dl.ID, dl.LibraryID, dl.Filename, dl.URL, dl.MimeType, dl.FileSize, dl.DownloadedAt, dl.State, dl.Notes,
@@ -893,6 +1305,13 @@ func (d *DB) CreateDownload(dl Download) error {
 
 // ListDownloads returns downloads for a library ordered newest-first.
 func (d *DB) ListDownloads(libraryID string) ([]Download, error) {
+	c, err := d.crypter(d.sql)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.aead(libraryID); err != nil {
+		return nil, err
+	}
 	rows, err := d.sql.Query(
 		`SELECT id, library_id, filename, url, mime_type, file_size, downloaded_at, state, notes
 		 FROM downloads WHERE library_id = ? ORDER BY downloaded_at DESC`,
@@ -907,6 +1326,9 @@ func (d *DB) ListDownloads(libraryID string) ([]Download, error) {
 		if err := rows.Scan(&dl.ID, &dl.LibraryID, &dl.Filename, &dl.URL, &dl.MimeType, &dl.FileSize, &dl.DownloadedAt, &dl.State, &dl.Notes); err != nil {
 			return nil, err
 		}
+		if err := c.openDownload(&dl); err != nil {
+			return nil, err
+		}
 		items = append(items, dl)
 	}
 	return items, rows.Err()
@@ -924,32 +1346,78 @@ func (d *DB) DeleteLibrary(id string) error {
 	return err
 }
 
-// DeleteSession removes a session; its tabs remain (session_id set to NULL).
-func (d *DB) DeleteSession(id string) error {
-	_, err := d.sql.Exec(`DELETE FROM sessions WHERE id = ?`, id)
-	return err
+// DeleteSession removes session id of library libID; its tabs remain (session_id set to NULL).
+// Windows and tab groups go with the session; surviving tabs are detached.
+// Returns sql.ErrNoRows (wrapped) if the session is not in that library.
+func (d *DB) DeleteSession(libID, id string) error {
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := inLibrary(tx, "sessions", "session", libID, id); err != nil {
+		return err
+	}
+	if err := deleteSessionStructure(tx, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// DeleteTab removes a single saved tab.
-func (d *DB) DeleteTab(id string) error {
-	_, err := d.sql.Exec(`DELETE FROM saved_tabs WHERE id = ?`, id)
-	return err
+// DeleteTab removes a single saved tab of library libID ("" = any library,
+// for the cross-library All Tabs view).
+// Returns sql.ErrNoRows (wrapped) if there is no such tab.
+func (d *DB) DeleteTab(libID, id string) error {
+	return deleteInLibrary(d.sql, "saved_tabs", "tab", libID, id)
 }
 
-// DeleteBookmark removes a bookmark (and child bookmarks via CASCADE).
-func (d *DB) DeleteBookmark(id string) error {
-	_, err := d.sql.Exec(`DELETE FROM bookmarks WHERE id = ?`, id)
-	return err
+// DeleteBookmark removes a bookmark of library libID (and child bookmarks via CASCADE).
+// Returns sql.ErrNoRows (wrapped) if there is no such bookmark.
+func (d *DB) DeleteBookmark(libID, id string) error {
+	return deleteInLibrary(d.sql, "bookmarks", "bookmark", libID, id)
 }
 
-// DeleteHistoryEntry removes a single history entry.
-func (d *DB) DeleteHistoryEntry(id string) error {
-	_, err := d.sql.Exec(`DELETE FROM history_entries WHERE id = ?`, id)
-	return err
+// DeleteHistoryEntry removes a single history entry of library libID.
+// Returns sql.ErrNoRows (wrapped) if there is no such entry.
+func (d *DB) DeleteHistoryEntry(libID, id string) error {
+	return deleteInLibrary(d.sql, "history_entries", "history entry", libID, id)
 }
 
-// DeleteDownload removes a single download record.
-func (d *DB) DeleteDownload(id string) error {
-	_, err := d.sql.Exec(`DELETE FROM downloads WHERE id = ?`, id)
-	return err
+// DeleteDownload removes a single download record of library libID.
+// Returns sql.ErrNoRows (wrapped) if there is no such record.
+func (d *DB) DeleteDownload(libID, id string) error {
+	return deleteInLibrary(d.sql, "downloads", "download", libID, id)
+}
+
+// inLibrary returns sql.ErrNoRows (wrapped) unless row id of table belongs to
+// library libID. Library-scoped routes check it before touching a row, so a
+// token restricted to one library cannot reach another's rows by ID.
+func inLibrary(q querier, table, what, libID, id string) error {
+	var n int
+	if err := q.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE id = ? AND library_id = ?`, id, libID).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s %s in library %s: %w", what, id, libID, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// deleteInLibrary deletes row id of table if it belongs to library libID
+// ("" = any). Returns sql.ErrNoRows (wrapped) if nothing matched.
+func deleteInLibrary(ex execer, table, what, libID, id string) error {
+	r, err := ex.Exec(`DELETE FROM `+table+` WHERE id = ? AND (? = '' OR library_id = ?)`, id, libID, libID)
+	if err != nil {
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		if libID == "" {
+			return fmt.Errorf("%s %s: %w", what, id, sql.ErrNoRows)
+		}
+		return fmt.Errorf("%s %s in library %s: %w", what, id, libID, sql.ErrNoRows)
+	}
+	return nil
 }
@@ -0,0 +1,146 @@
+// Package instance keeps two processes from using one database and tells
+// clients where the daemon that owns it listens.
+//
+// The lock is an OS file lock (flock / LockFileEx) on <db>.lock, so it is
+// released when the process dies, however it dies; the PID written into the
+// file only names the holder. The discovery file <db>.daemon.json records the
+// daemon's address, port, PID, version and start time while it runs.
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is wrapped by the error Acquire returns when another process
+// holds the lock.
+var ErrLocked = errors.New("database is in use by another mvaultd")
+
+// LockPath is the lock file of the database at dbPath.
+func LockPath(dbPath string) string { return dbPath + ".lock" }
+
+// InfoPath is the discovery file of the database at dbPath.
+func InfoPath(dbPath string) string { return dbPath + ".daemon.json" }
+
+// Lock is a held database lock.
+type Lock struct {
+	f *os.File
+}
+
+// Acquire takes the lock of the database at dbPath without waiting. If another
+// process holds it the error wraps ErrLocked and names its PID.
+func Acquire(dbPath string) (*Lock, error) {
+	path := LockPath(dbPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			if pid := HolderPID(dbPath); pid != 0 {
+				return nil, fmt.Errorf("%w (pid %d, lock %s)", ErrLocked, pid, path)
+			}
+			return nil, fmt.Errorf("%w (lock %s)", ErrLocked, path)
+		}
+		// The previous holder may have removed the file between our open and
+		// lock; then the lock is on a file nobody else will find. Start over.
+		if !samePath(f, path) {
+			unlockFile(f)
+			f.Close()
+			continue
+		}
+		if err := f.Truncate(0); err == nil {
+			_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+		return &Lock{f: f}, nil
+	}
+}
+
+// samePath reports whether path still names the open file f.
+func samePath(f *os.File, path string) bool {
+	a, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(path)
+	return err == nil && os.SameFile(a, b)
+}
+
+// Release gives the lock up and removes the lock file.
+func (l *Lock) Release() {
+	if l == nil || l.f == nil {
+		return
+	}
+	// Remove first: once unlocked, another process may already own the path.
+	// Windows refuses to remove an open file; then remove it after closing.
+	err := os.Remove(l.f.Name())
+	unlockFile(l.f)
+	l.f.Close()
+	if err != nil {
+		os.Remove(l.f.Name())
+	}
+	l.f = nil
+}
+
+// HolderPID returns the PID recorded in the database's lock file (0 = none).
+func HolderPID(dbPath string) int {
+	data, err := os.ReadFile(LockPath(dbPath))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+// Info is the content of the discovery file.
+type Info struct {
+	PID       int    `json:"pid"`
+	Version   string `json:"version"`
+	StartedAt int64  `json:"startedAt"` // Unix ms
+	DBPath    string `json:"dbPath"`
+	// Scheme and Address (host:port) of the TCP listener; Port repeats its port.
+	// All empty when TCP is off.
+	Scheme  string `json:"scheme,omitempty"`
+	Address string `json:"address,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	Socket  string `json:"socket,omitempty"`
+}
+
+// WriteInfo writes the discovery file of the database at dbPath.
+func WriteInfo(dbPath string, info Info) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := InfoPath(dbPath)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadInfo reads the discovery file of the database at dbPath. It does not
+// check that the daemon still runs: a crash leaves the file behind.
+func ReadInfo(dbPath string) (Info, error) {
+	var info Info
+	data, err := os.ReadFile(InfoPath(dbPath))
+	if err != nil {
+		return info, err
+	}
+	return info, json.Unmarshal(data, &info)
+}
+
+// RemoveInfo deletes the discovery file (on shutdown).
+func RemoveInfo(dbPath string) {
+	os.Remove(InfoPath(dbPath))
+}
@@ -0,0 +1,61 @@
+package instance
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockExcludesSecondHolder(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	l, err := Acquire(dbPath)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if pid := HolderPID(dbPath); pid != os.Getpid() {
+		t.Errorf("HolderPID = %d, want %d", pid, os.Getpid())
+	}
+	if _, err := Acquire(dbPath); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second Acquire: %v, want ErrLocked", err)
+	}
+	l.Release()
+	if _, err := os.Stat(LockPath(dbPath)); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+	l2, err := Acquire(dbPath)
+	if err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+	l2.Release()
+}
+
+func TestLockIgnoresStaleFile(t *testing.T) {
+	// A crashed daemon leaves its lock file, but not its lock.
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	os.WriteFile(LockPath(dbPath), []byte("999999\n"), 0600)
+	l, err := Acquire(dbPath)
+	if err != nil {
+		t.Fatalf("Acquire over a stale file: %v", err)
+	}
+	defer l.Release()
+	if pid := HolderPID(dbPath); pid != os.Getpid() {
+		t.Errorf("HolderPID = %d", pid)
+	}
+}
+
+func TestInfoRoundTrip(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	want := Info{PID: 42, Version: "0.1.0", StartedAt: 1700000000000, DBPath: dbPath, Scheme: "http", Address: "127.0.0.1:47822", Port: 47822}
+	if err := WriteInfo(dbPath, want); err != nil {
+		t.Fatalf("WriteInfo: %v", err)
+	}
+	got, err := ReadInfo(dbPath)
+	if err != nil || got != want {
+		t.Fatalf("ReadInfo = %+v, %v", got, err)
+	}
+	RemoveInfo(dbPath)
+	if _, err := ReadInfo(dbPath); !os.IsNotExist(err) {
+		t.Errorf("ReadInfo after RemoveInfo: %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package instance
+
+import "os"
+
+// No file locking here: the lock file only records the PID.
+func lockFile(*os.File) error { return nil }
+
+func unlockFile(*os.File) {}
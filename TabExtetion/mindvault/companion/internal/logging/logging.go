@@ -0,0 +1,275 @@
+// Package logging sets up the daemon's log/slog logger: text or JSON on
+// stderr, optionally also a size-rotated log file, and an in-memory ring of
+// recent records that GET /admin/logs serves to the dashboard.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Options configures Configure (see config.Log).
+type Options struct {
+	Level     string // debug | info | warn | error
+	Format    string // text | json
+	File      string // also log here ("" = stderr only)
+	MaxSizeMB int    // rotate File at this size
+	MaxFiles  int    // rotated files to keep
+	Requests  string // level of successful request lines ("" = info)
+}
+
+// recentSize is the number of records Recent can return.
+const recentSize = 2000
+
+var (
+	mu       sync.Mutex
+	level    = new(slog.LevelVar)
+	requests = new(slog.LevelVar) // zero value: info
+	file     *rotatingFile
+	recent   = &ring{entries: make([]Entry, recentSize)}
+)
+
+// RequestLevel is the level successful requests are logged at.
+func RequestLevel() slog.Level { return requests.Level() }
+
+// Configure installs the default logger (slog and the log package) described
+// by o. It may be called again, e.g. on SIGHUP; the recent records survive.
+// On error the previous logger stays in place.
+func Configure(o Options, stderr io.Writer) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(o.Level)); err != nil {
+		return err
+	}
+	rl := slog.LevelInfo
+	if o.Requests != "" {
+		if err := rl.UnmarshalText([]byte(o.Requests)); err != nil {
+			return fmt.Errorf("request level: %w", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	var next *rotatingFile
+	if o.File != "" {
+		if file != nil && file.path == o.File {
+			next = file
+			next.setLimits(int64(o.MaxSizeMB)<<20, o.MaxFiles)
+		} else {
+			var err error
+			if next, err = openRotating(o.File, int64(o.MaxSizeMB)<<20, o.MaxFiles); err != nil {
+				return fmt.Errorf("log file: %w", err)
+			}
+		}
+	}
+	if file != nil && file != next {
+		file.Close()
+	}
+	file = next
+
+	opts := &slog.HandlerOptions{Level: level}
+	newHandler := func(w io.Writer) slog.Handler {
+		if o.Format == "json" {
+			return slog.NewJSONHandler(w, opts)
+		}
+		return slog.NewTextHandler(w, opts)
+	}
+	handlers := []slog.Handler{newHandler(stderr), &ringHandler{ring: recent, level: level}}
+	if file != nil {
+		handlers = append(handlers, newHandler(file))
+	}
+	level.Set(l)
+	requests.Set(rl)
+	slog.SetDefault(slog.New(fanout(handlers)))
+	return nil
+}
+
+// Close closes the log file, if any.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Close()
+		file = nil
+	}
+}
+
+// Fatal logs msg at error level and exits with status 1.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	Close()
+	os.Exit(1)
+}
+
+// fanout sends every record to all handlers.
+type fanout []slog.Handler
+
+func (f fanout) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanout) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (f fanout) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanout) WithGroup(name string) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// Entry is one log record as GET /admin/logs returns it. Attrs of groups are
+// keyed "group.key".
+type Entry struct {
+	Seq   uint64         `json:"seq"`
+	Time  time.Time      `json:"time"`
+	Level string         `json:"level"`
+	Msg   string         `json:"msg"`
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// Recent returns up to limit of the newest records after since (exclusive) at
+// min level or above, oldest first.
+func Recent(since time.Time, min slog.Level, limit int) []Entry {
+	return recent.since(since, min, limit)
+}
+
+// ring keeps the last len(entries) records.
+type ring struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    uint64 // sequence number of the next record
+}
+
+func (r *ring) add(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Seq = r.next
+	r.entries[r.next%uint64(len(r.entries))] = e
+	r.next++
+}
+
+func (r *ring) since(t time.Time, min slog.Level, limit int) []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := uint64(len(r.entries))
+	start := uint64(0)
+	if r.next > n {
+		start = r.next - n
+	}
+	var out []Entry
+	for seq := start; seq < r.next; seq++ {
+		e := r.entries[seq%n]
+		var l slog.Level
+		_ = l.UnmarshalText([]byte(e.Level))
+		if e.Time.After(t) && l >= min {
+			out = append(out, e)
+		}
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
+
+// ringHandler records into a ring.
+type ringHandler struct {
+	ring   *ring
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string // group prefix, "a.b."
+}
+
+func (h *ringHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *ringHandler) Handle(_ context.Context, r slog.Record) error {
+	e := Entry{Time: r.Time, Level: r.Level.String(), Msg: r.Message}
+	if len(h.attrs) > 0 || r.NumAttrs() > 0 {
+		e.Attrs = map[string]any{}
+		for _, a := range h.attrs {
+			addAttr(e.Attrs, "", a)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			addAttr(e.Attrs, h.prefix, a)
+			return true
+		})
+	}
+	h.ring.add(e)
+	return nil
+}
+
+func (h *ringHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		out.attrs = append(out.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &out
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	out := *h
+	out.prefix = h.prefix + name + "."
+	return &out
+}
+
+// addAttr flattens a into m under prefix.
+func addAttr(m map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		p := prefix
+		if a.Key != "" {
+			p += a.Key + "."
+		}
+		for _, g := range v.Group() {
+			addAttr(m, p, g)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	switch v.Kind() {
+	case slog.KindTime:
+		m[prefix+a.Key] = v.Time()
+	case slog.KindDuration:
+		m[prefix+a.Key] = v.Duration().String()
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			m[prefix+a.Key] = err.Error()
+			return
+		}
+		m[prefix+a.Key] = v.Any()
+	default:
+		m[prefix+a.Key] = v.Any()
+	}
+}
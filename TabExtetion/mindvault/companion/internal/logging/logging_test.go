@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigureFormatsAndRecent(t *testing.T) {
+	var out bytes.Buffer
+	if err := Configure(Options{Level: "info", Format: "json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	start := time.Now().Add(-time.Millisecond)
+
+	slog.Debug("hidden")
+	slog.With("component", "test").WithGroup("g").Info("hello", "n", 1, "err", errors.New("boom"))
+
+	var rec map[string]any
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatalf("stderr is not one JSON record: %v\n%s", err, out.String())
+	}
+	if rec["msg"] != "hello" || rec["component"] != "test" {
+		t.Errorf("record = %v", rec)
+	}
+
+	got := Recent(start, slog.LevelDebug, 0)
+	if len(got) != 1 {
+		t.Fatalf("Recent = %d entries, want 1 (debug is below the level)", len(got))
+	}
+	e := got[0]
+	if e.Msg != "hello" || e.Level != "INFO" || e.Attrs["component"] != "test" ||
+		e.Attrs["g.n"] != int64(1) || e.Attrs["g.err"] != "boom" {
+		t.Errorf("entry = %+v", e)
+	}
+	if n := len(Recent(start, slog.LevelWarn, 0)); n != 0 {
+		t.Errorf("Recent(warn) = %d entries, want 0", n)
+	}
+
+	// Reconfiguring changes the level and format; the ring is kept.
+	out.Reset()
+	if err := Configure(Options{Level: "debug", Format: "text"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	slog.Debug("now shown")
+	if !strings.Contains(out.String(), "msg=\"now shown\"") {
+		t.Errorf("text output = %q", out.String())
+	}
+	if n := len(Recent(start, slog.LevelDebug, 0)); n != 2 {
+		t.Errorf("Recent after reconfigure = %d entries, want 2", n)
+	}
+	if err := Configure(Options{Level: "loud"}, io.Discard); err == nil {
+		t.Error("Configure accepted an unknown level")
+	}
+}
+
+func TestRingWrapsAndLimits(t *testing.T) {
+	r := &ring{entries: make([]Entry, 3)}
+	t0 := time.Now()
+	for i := 0; i < 5; i++ {
+		r.add(Entry{Time: t0.Add(time.Duration(i) * time.Second), Level: "INFO", Msg: string(rune('a' + i))})
+	}
+	got := r.since(time.Time{}, slog.LevelDebug, 0)
+	if len(got) != 3 || got[0].Msg != "c" || got[2].Msg != "e" || got[2].Seq != 4 {
+		t.Fatalf("since = %+v, want c..e", got)
+	}
+	if got := r.since(t0.Add(3*time.Second), slog.LevelDebug, 0); len(got) != 1 || got[0].Msg != "e" {
+		t.Errorf("since(t3) = %+v, want e", got)
+	}
+	if got := r.since(time.Time{}, slog.LevelDebug, 2); len(got) != 2 || got[0].Msg != "d" {
+		t.Errorf("limit 2 = %+v, want the newest two", got)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "mvaultd.log")
+	f, err := openRotating(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{path: "dddddd\n", path + ".1": "cccccc\n", path + ".2": "bbbbbb\n"}
+	for p, w := range want {
+		data, err := os.ReadFile(p)
+		if err != nil || string(data) != w {
+			t.Errorf("%s = %q, %v; want %q", filepath.Base(p), data, err, w)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 rotated files")
+	}
+}
@@ -0,0 +1,245 @@
+// Package tlscert issues the daemon's HTTPS certificates from a local CA.
+//
+// On first use a private CA is generated (ca.pem / ca-key.pem, valid ten
+// years) and a leaf certificate for 127.0.0.1, ::1, localhost and any extra
+// LAN names is signed with it (cert.pem / key.pem). Trusting ca.pem once on a
+// device — the desktop browser, a phone — makes every later leaf trusted. The
+// leaf is short-lived and is re-issued automatically, without a restart, when
+// it nears expiry or no longer covers the configured names.
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 90 * 24 * time.Hour
+	// renewBefore is how long before expiry the leaf is re-issued.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// DefaultHosts are always covered by the leaf certificate.
+var DefaultHosts = []string{"127.0.0.1", "::1", "localhost"}
+
+// Manager holds the CA and the current leaf; safe for concurrent use.
+type Manager struct {
+	dir   string
+	hosts []string
+	now   func() time.Time
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	mu   sync.Mutex
+	leaf *tls.Certificate
+}
+
+// Load opens (or creates) the CA and leaf in dir. hosts are added to
+// DefaultHosts; each is a DNS name or an IP address.
+func Load(dir string, hosts []string) (*Manager, error) {
+	m := &Manager{dir: dir, now: time.Now}
+	for _, h := range append(append([]string{}, DefaultHosts...), hosts...) {
+		if h != "" && !slices.Contains(m.hosts, h) {
+			m.hosts = append(m.hosts, h)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create tls dir: %w", err)
+	}
+	if err := m.loadCA(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLeaf(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CAPath returns the path of the CA certificate to trust on client devices.
+func (m *Manager) CAPath() string { return filepath.Join(m.dir, "ca.pem") }
+
+// CAPEM returns the CA certificate, PEM-encoded.
+func (m *Manager) CAPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.ca.Raw})
+}
+
+// Hosts returns the names and addresses the leaf covers.
+func (m *Manager) Hosts() []string { return append([]string{}, m.hosts...) }
+
+// Leaf returns the current leaf certificate.
+func (m *Manager) Leaf() *x509.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.leaf.Leaf
+}
+
+// TLSConfig returns a server config that serves the current leaf and rotates
+// it when due.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: m.getCertificate}
+}
+
+func (m *Manager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.due(m.leaf.Leaf) {
+		if err := m.issueLeaf(); err != nil {
+			return nil, err
+		}
+	}
+	return m.leaf, nil
+}
+
+// due reports whether leaf must be re-issued: close to expiry, or missing
+// one of the configured hosts.
+func (m *Manager) due(leaf *x509.Certificate) bool {
+	if m.now().Add(renewBefore).After(leaf.NotAfter) {
+		return true
+	}
+	for _, h := range m.hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCA reads ca.pem / ca-key.pem, generating them if absent.
+func (m *Manager) loadCA() error {
+	certPEM, err1 := os.ReadFile(m.CAPath())
+	keyPEM, err2 := os.ReadFile(filepath.Join(m.dir, "ca-key.pem"))
+	if errors.Is(err1, os.ErrNotExist) && errors.Is(err2, os.ErrNotExist) {
+		return m.createCA()
+	}
+	if err := errors.Join(err1, err2); err != nil {
+		return fmt.Errorf("read local CA: %w", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("parse local CA: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("parse local CA: unexpected key type %T", pair.PrivateKey)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse local CA: %w", err)
+	}
+	m.ca, m.caKey = ca, key
+	return nil
+}
+
+func (m *Manager) createCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := m.now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: "MindVault Local CA", Organization: []string{"MindVault"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("create local CA: %w", err)
+	}
+	if err := writePair(m.CAPath(), filepath.Join(m.dir, "ca-key.pem"), der, key); err != nil {
+		return err
+	}
+	m.ca, _ = x509.ParseCertificate(der)
+	m.caKey = key
+	return nil
+}
+
+// loadLeaf reads cert.pem / key.pem and re-issues the leaf if it is missing,
+// unreadable, not signed by the CA, or due. Caller holds mu.
+func (m *Manager) loadLeaf() error {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(m.dir, "cert.pem"), filepath.Join(m.dir, "key.pem"))
+	if err == nil {
+		pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	}
+	if err != nil || pair.Leaf.CheckSignatureFrom(m.ca) != nil || m.due(pair.Leaf) {
+		return m.issueLeaf()
+	}
+	m.leaf = &pair
+	return nil
+}
+
+// issueLeaf signs a new leaf for m.hosts and writes it. Caller holds mu.
+func (m *Manager) issueLeaf() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := m.now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: "MindVault companion", Organization: []string{"MindVault"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range m.hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &key.PublicKey, m.caKey)
+	if err != nil {
+		return fmt.Errorf("issue certificate: %w", err)
+	}
+	if err := writePair(filepath.Join(m.dir, "cert.pem"), filepath.Join(m.dir, "key.pem"), der, key); err != nil {
+		return err
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	m.leaf = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	return nil
+}
+
+// writePair writes a certificate (0644) and its private key (0600) as PEM.
+func writePair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("write %s: %w", filepath.Base(keyPath), err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", filepath.Base(certPath), err)
+	}
+	return nil
+}
+
+func serial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return n
+}
@@ -0,0 +1,65 @@
+package tlscert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadIssuesAndRotates(t *testing.T) {
+	dir := t.TempDir()
+	m, err := Load(dir, []string{"192.168.1.20", "desk.lan"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	leaf := m.Leaf()
+	for _, h := range []string{"127.0.0.1", "::1", "localhost", "192.168.1.20", "desk.lan"} {
+		if err := leaf.VerifyHostname(h); err != nil {
+			t.Errorf("leaf does not cover %s: %v", h, err)
+		}
+	}
+
+	// A client trusting only ca.pem accepts the server.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Listener = tls.NewListener(srv.Listener, m.TLSConfig()) // StartTLS would install its own certificate
+	srv.Start()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(m.CAPEM())
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := client.Get("https://" + srv.Listener.Addr().String()); err != nil {
+		t.Fatalf("TLS request trusting the local CA: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// Reloading keeps the CA and the still-valid leaf.
+	again, err := Load(dir, []string{"desk.lan"})
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !bytes.Equal(again.CAPEM(), m.CAPEM()) || !again.Leaf().Equal(leaf) {
+		t.Error("reload replaced the CA or a valid leaf")
+	}
+
+	// A new LAN name re-issues the leaf under the same CA.
+	wider, _ := Load(dir, []string{"192.168.1.20", "desk.lan", "10.0.0.5"})
+	if wider.Leaf().Equal(leaf) || wider.Leaf().VerifyHostname("10.0.0.5") != nil {
+		t.Error("leaf not re-issued for a new host")
+	}
+	if err := wider.Leaf().CheckSignatureFrom(wider.ca); err != nil || !bytes.Equal(wider.CAPEM(), m.CAPEM()) {
+		t.Errorf("re-issued leaf not signed by the same CA: %v", err)
+	}
+
+	// Near expiry the leaf is rotated on the next handshake.
+	before := wider.Leaf()
+	wider.now = func() time.Time { return before.NotAfter.Add(-renewBefore + time.Hour) }
+	cert, err := wider.getCertificate(nil)
+	if err != nil || cert.Leaf.Equal(before) || !cert.Leaf.NotAfter.After(before.NotAfter) {
+		t.Errorf("leaf not rotated before expiry: %v", err)
+	}
+}
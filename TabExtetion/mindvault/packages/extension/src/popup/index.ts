@@ -11,10 +11,9 @@ import { getDefaultLibrary, getAllLibraries, getLibraryById } from '../db/reposi
 import { createSession } from '../db/repositories/sessions';
 import { saveTabWithDedup } from '../db/repositories/saved-tabs';
 import { MIGRATION_FLAG_KEY, type MigrationRecord } from '@mindvault/shared';
-import { pushSession, pushTabs } from '../services/companion-client';
+import { findCompanionPort, getPendingPairingCode, pushSession, pushTabs } from '../services/companion-client';
 
 const LAST_LIBRARY_KEY = 'mv_last_library_id';
-const COMPANION_URL   = 'http://127.0.0.1:47821';
 
 // ---- DOM refs ----------------------------------------------
 const tabListEl       = document.getElementById('tabList')        as HTMLUListElement;
@@ -264,13 +263,15 @@ function dismissMigrationBanner(): void {
 /** Ping companion /health endpoint; update status dot. Non-blocking, fire-and-forget. */
 async function checkCompanionStatus(): Promise<void> {
   try {
-    const ctrl = new AbortController();
-    setTimeout(() => ctrl.abort(), 2000); // 2s timeout — popup is short-lived
-    const res = await fetch(`${COMPANION_URL}/health`, { signal: ctrl.signal });
-    if (res.ok) {
+    // Probes the remembered port first, then 47821–47830 (1s each).
+    if ((await findCompanionPort()) !== null) {
       companionDot.classList.add('online');
       companionDot.classList.remove('offline');
       companionDot.title = 'Companion: online — tabs sync to local vault';
+      const code = await getPendingPairingCode();
+      if (code) {
+        companionDot.title = `Companion: waiting for pairing approval — approve code ${code} in the companion dashboard`;
+      }
     } else {
       setCompanionOffline();
     }
@@ -2,19 +2,25 @@
  * CompanionClient — fire-and-forget HTTP client for the local companion daemon.
  *
  * Responsibilities:
- *  - Bootstrap: fetch auth token from GET /token (no auth required, localhost only)
+ *  - Pairing: request a token with POST /pair, show the code, poll GET /pair/{id}
+ *    until the user approves it (companion dashboard or `mvaultd pair approve CODE`)
  *  - Cache token in chrome.storage.local as 'mv_companion_token'
  *  - Push library / session / tab records to companion after IDB writes
  *  - Silent on all errors — companion may not be running; extension works standalone
  *
  * Security note:
- *  GET /token is unauthenticated but companion binds only to 127.0.0.1.
- *  Only processes on the same machine can reach it.
+ *  The companion never hands out a token without the user approving the
+ *  pairing code, so other local processes or pages cannot obtain one.
  */
 
-const BASE = 'http://127.0.0.1:47821';
+// mvaultd listens on 127.0.0.1:47821, or on the next free port up to 47830 when
+// that one is taken; the port that answered last is remembered.
+const DEFAULT_PORT = 47821;
+const PORT_FALLBACKS = 9;
+const PORT_STORAGE_KEY = 'mv_companion_port';
 const TOKEN_STORAGE_KEY = 'mv_companion_token';
 const BOOTSTRAP_FLAG_KEY = 'mv_companion_bootstrapped';
+const PAIRING_STORAGE_KEY = 'mv_companion_pairing'; // pending PairingState
 
 // ── Repository imports (used by syncAllUnpushedSessions only) ─────────────────
 // Lazy imports at the bottom of the module to avoid circular-dep concerns.
@@ -105,14 +111,58 @@ function timedFetch(url: string, init?: RequestInit, timeoutMs = FETCH_TIMEOUT_M
   return fetch(url, { ...init, signal: ctrl.signal }).finally(() => clearTimeout(timer));
 }
 
-/** Retry a function up to `n` times with `delayMs` between attempts. */
-async function retry<T>(fn: () => Promise<T>, n: number, delayMs: number): Promise<T> {
-  let lastErr: unknown;
-  for (let i = 0; i < n; i++) {
-    try { return await fn(); } catch (e) { lastErr = e; }
-    if (i < n - 1) await new Promise(r => setTimeout(r, delayMs));
+let companionPort: number | null = null;
+
+/** Whether mvaultd (not some other local service) answers /health on port. */
+async function probePort(port: number): Promise<boolean> {
+  try {
+    const resp = await timedFetch(`http://127.0.0.1:${port}/health`, undefined, 1000);
+    if (!resp.ok) return false;
+    const health = (await resp.json()) as { service?: string };
+    return health.service === 'mvaultd';
+  } catch {
+    return false;
+  }
+}
+
+/**
+ * Find the companion's port: the one that answered last time, then the
+ * default port and its fallbacks in order. Returns null if none answers.
+ */
+export async function findCompanionPort(): Promise<number | null> {
+  if (companionPort !== null) return companionPort;
+  const candidates: number[] = [];
+  try {
+    const stored = await chrome.storage.local.get([PORT_STORAGE_KEY]);
+    const remembered = stored[PORT_STORAGE_KEY] as number | undefined;
+    if (remembered) candidates.push(remembered);
+  } catch { /* storage unavailable — probe the range */ }
+  for (let port = DEFAULT_PORT; port <= DEFAULT_PORT + PORT_FALLBACKS; port++) {
+    if (!candidates.includes(port)) candidates.push(port);
+  }
+  for (const port of candidates) {
+    if (await probePort(port)) {
+      companionPort = port;
+      void chrome.storage.local.set({ [PORT_STORAGE_KEY]: port }).catch(() => {});
+      return port;
+    }
+  }
+  return null;
+}
+
+/**
+ * timedFetch against the companion's path. Throws if no companion answers;
+ * a network error makes the next call look for the port again.
+ */
+async function companionFetch(path: string, init?: RequestInit): Promise<Response> {
+  const port = await findCompanionPort();
+  if (port === null) throw new Error('companion not running');
+  try {
+    return await timedFetch(`http://127.0.0.1:${port}${path}`, init);
+  } catch (e) {
+    companionPort = null; // restarted on another port, or stopped
+    throw e;
   }
-  throw lastErr;
 }
 
 /** Read token from chrome.storage.local — returns null if not set. */
@@ -125,33 +175,84 @@ async function loadCachedToken(): Promise<string | null> {
   }
 }
 
-/** Fetch token from companion /token endpoint and cache it. Retries twice on failure. */
-async function fetchAndCacheToken(): Promise<string | null> {
+/** A pairing request waiting for the user's approval. */
+interface PairingState {
+  id: string;
+  code: string;      // shown to the user, e.g. "482-913"
+  secret: string;    // proves to the companion that this client made the request
+  expiresAt: number; // Unix ms
+}
+
+/** Start a pairing request and remember it. Returns null if the companion is unreachable. */
+async function requestPairing(): Promise<PairingState | null> {
   try {
-    return await retry(async () => {
-      const resp = await timedFetch(`${BASE}/token`, { method: 'GET' });
-      if (!resp.ok) throw new Error(`token ${resp.status}`);
-      const data = (await resp.json()) as { token?: string };
-      if (!data.token) throw new Error('no token in response');
-      await chrome.storage.local.set({ [TOKEN_STORAGE_KEY]: data.token });
-      return data.token;
-    }, 2, 1000);
+    const resp = await companionFetch('/pair', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ client: `MindVault extension (${detectBrowser() || 'browser'})`, scope: 'write' }),
+    });
+    if (resp.status !== 202) return null; // offline, or rate limited — try again later
+    const p = (await resp.json()) as PairingState;
+    await chrome.storage.local.set({ [PAIRING_STORAGE_KEY]: p });
+    return p;
+  } catch {
+    return null;
+  }
+}
+
+/**
+ * Pair with the companion, or continue a pending pairing. Returns the token
+ * once the user has approved the code, null while still waiting (or offline).
+ * Denied / expired requests are dropped so the next call starts over.
+ */
+async function pairAndCacheToken(): Promise<string | null> {
+  try {
+    const stored = await chrome.storage.local.get([PAIRING_STORAGE_KEY]);
+    const pending = stored[PAIRING_STORAGE_KEY] as PairingState | undefined;
+    if (!pending || pending.expiresAt < Date.now()) {
+      await requestPairing();
+      return null;
+    }
+    const resp = await companionFetch(`/pair/${pending.id}`, {
+      headers: { 'X-MindVault-Pair-Secret': pending.secret },
+    });
+    const data = resp.ok ? ((await resp.json()) as { state?: string; token?: string }) : {};
+    if (data.state === 'pending') return null;
+    await chrome.storage.local.remove(PAIRING_STORAGE_KEY);
+    if (!data.token) return null; // denied, expired or unknown — pair again next time
+    await chrome.storage.local.set({ [TOKEN_STORAGE_KEY]: data.token });
+    return data.token;
   } catch {
-    return null; // companion not running — all retries exhausted
+    return null; // companion not running
   }
 }
 
-/** Get token — try cache first, fall back to fetching from companion. */
+/** Get token — try cache first, fall back to pairing with the companion. */
 async function getToken(): Promise<string | null> {
   const cached = await loadCachedToken();
   if (cached) return cached;
-  return fetchAndCacheToken();
+  return pairAndCacheToken();
+}
+
+/**
+ * The code of the pending pairing request, for the UI to show next to the
+ * companion status ("approve 482-913 in the companion"); null if none.
+ */
+export async function getPendingPairingCode(): Promise<string | null> {
+  try {
+    const stored = await chrome.storage.local.get([PAIRING_STORAGE_KEY, TOKEN_STORAGE_KEY]);
+    const pending = stored[PAIRING_STORAGE_KEY] as PairingState | undefined;
+    if (stored[TOKEN_STORAGE_KEY] || !pending || pending.expiresAt < Date.now()) return null;
+    return pending.code;
+  } catch {
+    return null;
+  }
 }
 
 /** Make an authenticated POST to the companion. Swallows all errors; uses 5s timeout. */
 async function post(path: string, token: string, body: unknown): Promise<boolean> {
   try {
-    const resp = await timedFetch(`${BASE}${path}`, {
+    const resp = await companionFetch(path, {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
@@ -159,6 +260,10 @@ async function post(path: string, token: string, body: unknown): Promise<boolean
       },
       body: JSON.stringify(body),
     });
+    if (resp.status === 401) {
+      // Token revoked on the companion — forget it and pair again.
+      await chrome.storage.local.remove(TOKEN_STORAGE_KEY);
+    }
     return resp.ok;
   } catch {
     return false; // companion offline or timeout
@@ -168,7 +273,7 @@ async function post(path: string, token: string, body: unknown): Promise<boolean
 /** Check if a library already exists in companion. Returns true if it does. Uses 5s timeout. */
 async function libraryExistsInCompanion(libraryId: string, token: string): Promise<boolean> {
   try {
-    const resp = await timedFetch(`${BASE}/libraries/${libraryId}`, {
+    const resp = await companionFetch(`/libraries/${libraryId}`, {
       headers: { 'X-MindVault-Token': token },
     });
     return resp.status === 200;
@@ -181,14 +286,14 @@ async function libraryExistsInCompanion(libraryId: string, token: string): Promi
 
 /**
  * Bootstrap the companion client.
- * - Fetches and caches the auth token
+ * - Pairs with the companion (or continues a pending pairing) if no token is cached
  * - Ensures the given library exists in companion SQLite (creates if missing)
  * Call once on extension startup from background service worker.
  */
 export async function bootstrapCompanion(library: PushLibraryPayload): Promise<void> {
   try {
-    const token = await fetchAndCacheToken(); // always re-fetch on startup
-    if (!token) return; // companion not running
+    const token = await getToken();
+    if (!token) return; // companion not running, or pairing not approved yet
 
     const exists = await libraryExistsInCompanion(library.id, token);
     if (!exists) {
@@ -435,7 +540,7 @@ export async function checkSyncPending(): Promise<boolean> {
   try {
     const token = await getToken();
     if (!token) return false;
-    const resp = await timedFetch(`${BASE}/sync/pending`, {
+    const resp = await companionFetch('/sync/pending', {
       headers: { 'X-MindVault-Token': token },
     });
     if (!resp.ok) return false;